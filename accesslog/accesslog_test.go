@@ -0,0 +1,219 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestAccessLog(t *testing.T) { TestingT(t) }
+
+type AccessLogSuite struct {
+}
+
+var _ = Suite(&AccessLogSuite{})
+
+func (s *AccessLogSuite) record() *Record {
+	return &Record{
+		Time:       time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Duration:   1500 * time.Microsecond,
+		RequestId:  "01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		ClientIp:   "127.0.0.1",
+		RemoteUser: "frank",
+		Method:     "GET",
+		RequestURI: "/apache_pb.gif",
+		Proto:      "HTTP/1.0",
+		Host:       "example.com",
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  `Mozilla/4.08 "quoted"`,
+		LocationId: "loc1",
+		StatusCode: 200,
+		BytesIn:    10,
+		BytesOut:   2326,
+		Attempts: []AttemptRecord{
+			{Endpoint: "http://localhost:5000", Error: "connection refused", Duration: time.Millisecond},
+			{Endpoint: "http://localhost:5001", StatusCode: 200, Duration: 500 * time.Microsecond},
+		},
+	}
+}
+
+func (s *AccessLogSuite) TestCommonFormat(c *C) {
+	out := (&CommonFormatter{}).Format(s.record())
+	c.Assert(string(out), Equals, `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`+"\n")
+
+	r := s.record()
+	r.RemoteUser, r.ClientIp, r.BytesOut = "", "", 0
+	out = (&CommonFormatter{}).Format(r)
+	c.Assert(string(out), Equals, `- - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 -`+"\n")
+}
+
+func (s *AccessLogSuite) TestCombinedFormat(c *C) {
+	out := (&CombinedFormatter{}).Format(s.record())
+	c.Assert(string(out), Equals,
+		`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""`+"\n")
+}
+
+func (s *AccessLogSuite) TestJsonFormat(c *C) {
+	out := (&JsonFormatter{}).Format(s.record())
+	c.Assert(out[len(out)-1], Equals, byte('\n'))
+
+	var decoded map[string]interface{}
+	c.Assert(json.Unmarshal(out, &decoded), IsNil)
+	c.Assert(decoded["time"], Equals, "2000-10-10T13:55:36-07:00")
+	c.Assert(decoded["duration_ms"], Equals, 1.5)
+	c.Assert(decoded["request_id"], Equals, "01ARZ3NDEKTSV4RRFFQ69G5FAV")
+	c.Assert(decoded["client_ip"], Equals, "127.0.0.1")
+	c.Assert(decoded["location"], Equals, "loc1")
+	c.Assert(decoded["status"], Equals, float64(200))
+	c.Assert(decoded["bytes_in"], Equals, float64(10))
+	c.Assert(decoded["bytes_out"], Equals, float64(2326))
+	c.Assert(decoded["attempts"], DeepEquals, []interface{}{
+		map[string]interface{}{"endpoint": "http://localhost:5000", "error": "connection refused", "duration_ms": float64(1)},
+		map[string]interface{}{"endpoint": "http://localhost:5001", "status": float64(200), "duration_ms": 0.5},
+	})
+}
+
+func (s *AccessLogSuite) TestNewRecord(c *C) {
+	httpReq, err := http.NewRequest("POST", "http://example.com/path?a=b", nil)
+	c.Assert(err, IsNil)
+	httpReq.RemoteAddr = "10.0.0.1:5000"
+	httpReq.RequestURI = "/path?a=b"
+	httpReq.SetBasicAuth("bob", "secret")
+	httpReq = netutils.SetClientIp(httpReq, net.ParseIP("1.2.3.4"))
+
+	req := request.NewBaseRequest(httpReq, 3, nil)
+	request.SetRequestId(req, "7c9e6679-7425-40de-944b-e07fc1f90ae7")
+	req.AddAttempt(&request.BaseAttempt{
+		Endpoint: endpoint.MustParseUrl("http://localhost:5000"),
+		Error:    fmt.Errorf("timeout"),
+		Duration: time.Second,
+	})
+	start := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	rec := NewRecord(req, middleware.Completion{
+		HttpRequest: httpReq,
+		Start:       start,
+		Duration:    2 * time.Second,
+		LocationId:  "loc1",
+		StatusCode:  502,
+		BytesIn:     5,
+		BytesOut:    6,
+	})
+	c.Assert(rec.Time, Equals, start)
+	c.Assert(rec.RequestId, Equals, "7c9e6679-7425-40de-944b-e07fc1f90ae7")
+	c.Assert(rec.ClientIp, Equals, "1.2.3.4")
+	c.Assert(rec.RemoteUser, Equals, "bob")
+	c.Assert(rec.Method, Equals, "POST")
+	c.Assert(rec.RequestURI, Equals, "/path?a=b")
+	c.Assert(rec.Host, Equals, "example.com")
+	c.Assert(rec.StatusCode, Equals, 502)
+	c.Assert(rec.Attempts, DeepEquals, []AttemptRecord{{Endpoint: "http://localhost:5000", Error: "timeout", Duration: time.Second}})
+}
+
+func (s *AccessLogSuite) TestLogger(c *C) {
+	_, err := NewLogger(nil, &CommonFormatter{})
+	c.Assert(err, NotNil)
+	_, err = NewLogger(&bytes.Buffer{}, nil)
+	c.Assert(err, NotNil)
+
+	buf := &bytes.Buffer{}
+	l, err := NewLogger(buf, &CommonFormatter{})
+	c.Assert(err, IsNil)
+
+	httpReq, err := http.NewRequest("GET", "http://example.com/", nil)
+	c.Assert(err, IsNil)
+	httpReq.RemoteAddr = "10.0.0.1:5000"
+	l.ObserveCompletion(nil, middleware.Completion{HttpRequest: httpReq, Start: time.Unix(0, 0).UTC(), StatusCode: 200})
+	c.Assert(buf.String(), Equals, `10.0.0.1 - - [01/Jan/1970:00:00:00 +0000] "GET / HTTP/1.1" 200 -`+"\n")
+}
+
+func (s *AccessLogSuite) TestAsyncWriter(c *C) {
+	buf := &bytes.Buffer{}
+	w := NewAsyncWriter(buf, 100)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	c.Assert(w.Close(), IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	expected := ""
+	for i := 0; i < 10; i++ {
+		expected += fmt.Sprintf("line %d\n", i)
+	}
+	c.Assert(buf.String(), Equals, expected)
+	c.Assert(w.GetDropped(), Equals, int64(0))
+
+	// Writes after close are dropped
+	w.Write([]byte("late\n"))
+	c.Assert(w.GetDropped(), Equals, int64(1))
+	c.Assert(buf.String(), Equals, expected)
+}
+
+func (s *AccessLogSuite) TestAsyncWriterDropsWhenFull(c *C) {
+	blocked := &blockingWriter{unblock: make(chan bool)}
+	w := NewAsyncWriter(blocked, 1)
+	for i := 0; i < 10; i++ {
+		w.Write([]byte("line\n"))
+	}
+	close(blocked.unblock)
+	c.Assert(w.Close(), IsNil)
+	// At most one record is being written and one is buffered
+	c.Assert(w.GetDropped() >= 8, Equals, true)
+}
+
+func (s *AccessLogSuite) TestFileRotation(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := NewFileWriter(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	stop := ReopenOnSigusr1(f)
+	defer stop()
+
+	f.Write([]byte("first\n"))
+	c.Assert(os.Rename(path, path+".1"), IsNil)
+	// Writes go to the moved file until it's reopened
+	f.Write([]byte("second\n"))
+
+	c.Assert(syscall.Kill(os.Getpid(), syscall.SIGUSR1), IsNil)
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.Write([]byte("third\n"))
+
+	rotated, err := ioutil.ReadFile(path + ".1")
+	c.Assert(err, IsNil)
+	c.Assert(string(rotated), Equals, "first\nsecond\n")
+	current, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(current), Equals, "third\n")
+
+	_, err = NewFileWriter(filepath.Join(dir, "missing", "access.log"))
+	c.Assert(err, NotNil)
+}
+
+type blockingWriter struct {
+	unblock chan bool
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
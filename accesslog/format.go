@@ -0,0 +1,126 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Formatter encodes the record as a single log line, including the trailing newline
+type Formatter interface {
+	Format(*Record) []byte
+}
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// CommonFormatter formats records in NCSA Common Log Format:
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326
+type CommonFormatter struct {
+}
+
+func (f *CommonFormatter) Format(r *Record) []byte {
+	return []byte(formatCommon(r) + "\n")
+}
+
+// CombinedFormatter formats records in Combined Log Format, that is Common Log Format with referer and user agent
+type CombinedFormatter struct {
+}
+
+func (f *CombinedFormatter) Format(r *Record) []byte {
+	return []byte(fmt.Sprintf("%s %s %s\n", formatCommon(r), quote(r.Referer), quote(r.UserAgent)))
+}
+
+// JsonFormatter formats records as JSON objects with all the record fields, one object per line
+type JsonFormatter struct {
+}
+
+type jsonRecord struct {
+	Time       string        `json:"time"`
+	DurationMs float64       `json:"duration_ms"`
+	RequestId  string        `json:"request_id,omitempty"`
+	ClientIp   string        `json:"client_ip,omitempty"`
+	RemoteUser string        `json:"remote_user,omitempty"`
+	Method     string        `json:"method"`
+	RequestURI string        `json:"uri"`
+	Proto      string        `json:"proto"`
+	Host       string        `json:"host,omitempty"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	LocationId string        `json:"location,omitempty"`
+	StatusCode int           `json:"status"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	Attempts   []jsonAttempt `json:"attempts"`
+}
+
+type jsonAttempt struct {
+	Endpoint   string  `json:"endpoint,omitempty"`
+	StatusCode int     `json:"status,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+func (f *JsonFormatter) Format(r *Record) []byte {
+	out := jsonRecord{
+		Time:       r.Time.Format(time.RFC3339Nano),
+		DurationMs: milliseconds(r.Duration),
+		RequestId:  r.RequestId,
+		ClientIp:   r.ClientIp,
+		RemoteUser: r.RemoteUser,
+		Method:     r.Method,
+		RequestURI: r.RequestURI,
+		Proto:      r.Proto,
+		Host:       r.Host,
+		Referer:    r.Referer,
+		UserAgent:  r.UserAgent,
+		LocationId: r.LocationId,
+		StatusCode: r.StatusCode,
+		BytesIn:    r.BytesIn,
+		BytesOut:   r.BytesOut,
+		Attempts:   make([]jsonAttempt, len(r.Attempts)),
+	}
+	for i, a := range r.Attempts {
+		out.Attempts[i] = jsonAttempt{
+			Endpoint:   a.Endpoint,
+			StatusCode: a.StatusCode,
+			Error:      a.Error,
+			DurationMs: milliseconds(a.Duration),
+		}
+	}
+	// Marshal can not fail for the record consisting of strings and numbers
+	data, _ := json.Marshal(out)
+	return append(data, '\n')
+}
+
+func formatCommon(r *Record) string {
+	bytesOut := "-"
+	if r.BytesOut != 0 {
+		bytesOut = strconv.FormatInt(r.BytesOut, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		dash(r.ClientIp), dash(escape(r.RemoteUser)), r.Time.Format(clfTimeFormat),
+		escape(r.Method), escape(r.RequestURI), escape(r.Proto), r.StatusCode, bytesOut)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func dash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+func quote(v string) string {
+	return `"` + dash(escape(v)) + `"`
+}
+
+// escape prevents the clients from forging log lines with quotes and control characters
+func escape(v string) string {
+	q := strconv.Quote(v)
+	return q[1 : len(q)-1]
+}
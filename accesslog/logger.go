@@ -0,0 +1,37 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Logger is a completion observer writing one record per request, add it to the proxy options:
+//
+//	w, _ := accesslog.NewFileWriter("/var/log/vulcan/access.log")
+//	defer accesslog.ReopenOnSigusr1(w)()
+//	logger, _ := accesslog.NewLogger(accesslog.NewAsyncWriter(w, 0), &accesslog.JsonFormatter{})
+//	proxy, _ := vulcan.NewProxyWithOptions(router, vulcan.Options{CompletionObservers: []middleware.CompletionObserver{logger}})
+type Logger struct {
+	w         io.Writer
+	formatter Formatter
+}
+
+func NewLogger(w io.Writer, formatter Formatter) (*Logger, error) {
+	if w == nil {
+		return nil, fmt.Errorf("Writer can not be nil")
+	}
+	if formatter == nil {
+		return nil, fmt.Errorf("Formatter can not be nil")
+	}
+	return &Logger{w: w, formatter: formatter}, nil
+}
+
+func (l *Logger) ObserveCompletion(r request.Request, c middleware.Completion) {
+	if _, err := l.w.Write(l.formatter.Format(NewRecord(r, c))); err != nil {
+		log.Errorf("Failed to write access log record: %s", err)
+	}
+}
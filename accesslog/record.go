@@ -0,0 +1,91 @@
+// Package accesslog writes one record per request handled by the proxy in Common, Combined or JSON format
+package accesslog
+
+import (
+	"net"
+	"time"
+
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Record describes the request handled by the proxy
+type Record struct {
+	Time       time.Time
+	Duration   time.Duration
+	RequestId  string
+	ClientIp   string
+	RemoteUser string
+	Method     string
+	RequestURI string
+	Proto      string
+	Host       string
+	Referer    string
+	UserAgent  string
+	LocationId string
+	StatusCode int
+	BytesIn    int64
+	BytesOut   int64
+	Attempts   []AttemptRecord
+}
+
+// AttemptRecord describes the attempt to proxy the request to the endpoint
+type AttemptRecord struct {
+	Endpoint   string
+	StatusCode int
+	Error      string
+	Duration   time.Duration
+}
+
+// NewRecord creates a record from the completed request
+func NewRecord(r request.Request, c middleware.Completion) *Record {
+	req := c.HttpRequest
+	rec := &Record{
+		Time:       c.Start,
+		Duration:   c.Duration,
+		Method:     req.Method,
+		RequestURI: req.RequestURI,
+		Proto:      req.Proto,
+		Host:       req.Host,
+		Referer:    req.Referer(),
+		UserAgent:  req.UserAgent(),
+		LocationId: c.LocationId,
+		StatusCode: c.StatusCode,
+		BytesIn:    c.BytesIn,
+		BytesOut:   c.BytesOut,
+	}
+	if rec.RequestURI == "" && req.URL != nil {
+		rec.RequestURI = req.URL.RequestURI()
+	}
+	if ip, ok := netutils.GetClientIp(req); ok {
+		rec.ClientIp = ip.String()
+	} else if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		rec.ClientIp = host
+	}
+	if auth, err := netutils.ParseAuthHeader(req.Header.Get("Authorization")); err == nil {
+		rec.RemoteUser = auth.Username
+	}
+	if r == nil {
+		return rec
+	}
+	rec.RequestId = request.GetRequestId(r)
+	for _, a := range r.GetAttempts() {
+		rec.Attempts = append(rec.Attempts, newAttemptRecord(a))
+	}
+	return rec
+}
+
+func newAttemptRecord(a request.Attempt) AttemptRecord {
+	out := AttemptRecord{Duration: a.GetDuration()}
+	if e := a.GetEndpoint(); e != nil {
+		out.Endpoint = e.GetId()
+	}
+	if re := a.GetResponse(); re != nil {
+		out.StatusCode = re.StatusCode
+	}
+	if err := a.GetError(); err != nil {
+		out.Error = err.Error()
+	}
+	return out
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package accesslog
+
+import (
+	"syscall"
+)
+
+// ReopenOnSigusr1 reopens the file on SIGUSR1, e.g. from logrotate's postrotate script
+func ReopenOnSigusr1(f *FileWriter) func() {
+	return ReopenOnSignal(f, syscall.SIGUSR1)
+}
@@ -0,0 +1,135 @@
+package accesslog
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/internal/queue"
+)
+
+const DefaultBufferSize = 1024
+
+// AsyncWriter writes to the underlying writer in the background goroutine, so slow disks
+// do not add latency to the requests. Records are dropped if the buffer is full.
+type AsyncWriter struct {
+	w       io.Writer
+	records *queue.Queue
+}
+
+// NewAsyncWriter creates a writer buffering up to bufferSize records, DefaultBufferSize is used if it's 0
+func NewAsyncWriter(w io.Writer, bufferSize int) *AsyncWriter {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	a := &AsyncWriter{w: w}
+	a.records = queue.New(bufferSize, a.loop)
+	return a
+}
+
+// Write queues the record, it never blocks and never fails, dropped records are counted instead
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	record := make([]byte, len(p))
+	copy(record, p)
+	a.records.Push(record)
+	return len(p), nil
+}
+
+// GetDropped returns the number of records dropped because the buffer was full
+func (a *AsyncWriter) GetDropped() int64 {
+	return a.records.GetDropped()
+}
+
+// Close writes the buffered records and stops the background goroutine, the underlying writer is not closed
+func (a *AsyncWriter) Close() error {
+	a.records.Close()
+	return nil
+}
+
+func (a *AsyncWriter) loop(records <-chan interface{}) {
+	w := bufio.NewWriter(a.w)
+	for record := range records {
+		w.Write(record.([]byte))
+		// Flush once the queue is drained, so the records are batched under load and written promptly otherwise
+		if len(records) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+}
+
+// FileWriter appends records to the file and supports reopening the file for the log rotation
+type FileWriter struct {
+	path  string
+	mutex *sync.Mutex
+	file  *os.File
+}
+
+func NewFileWriter(path string) (*FileWriter, error) {
+	f := &FileWriter{path: path, mutex: &sync.Mutex{}}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileWriter) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.file.Write(p)
+}
+
+// Reopen closes and opens the file again, so after logrotate has moved the file, records go to the new file
+func (f *FileWriter) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	return nil
+}
+
+func (f *FileWriter) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.file.Close()
+}
+
+// ReopenOnSignal reopens the file every time the process receives one of the signals,
+// see ReopenOnSigusr1 for the conventional rotation signal. Call the returned function to stop.
+func ReopenOnSignal(f *FileWriter, signals ...os.Signal) func() {
+	ch := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	signal.Notify(ch, signals...)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if err := f.Reopen(); err != nil {
+					log.Errorf("Failed to reopen access log '%s': %s", f.path, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(stop)
+		})
+	}
+}
@@ -23,12 +23,16 @@
 // * OnTripped action is called on transition (Standby -> Tripped)
 // * OnStandby action is called on transition (Recovering -> Standby)
 //
+// In the dry run mode circuit breaker goes through the same states, but lets all requests through and
+// only logs and counts the trips instead, so the conditions can be tuned on the real traffic.
+//
 package circuitbreaker
 
 import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mailgun/log"
@@ -89,10 +93,17 @@ type Options struct {
 
 	// OnTripped defines action activated during (Recovering->Standby) transition
 	OnStandby SideEffect
+
+	// DryRun lets all requests through instead of activating the fallback, the trips are logged and counted
+	// by GetDryRunTrips, side effects are not activated
+	DryRun bool
 }
 
 // CircuitBreaker is a middleware that implements circuit breaker pattern
 type CircuitBreaker struct {
+	// Number of trips in the dry run mode, goes first to be 64-bit aligned for atomic operations
+	dryRunTrips int64
+
 	o Options
 
 	m       *sync.RWMutex
@@ -171,7 +182,7 @@ func (c *CircuitBreaker) ProcessRequest(r request.Request) (*http.Response, erro
 		return nil, nil
 	case stateTripped:
 		if c.tm.UtcNow().Before(c.until) {
-			return c.fallback.ProcessRequest(r)
+			return c.activateFallback(r)
 		}
 		// We have been in active state enough, enter recovering state
 		c.setRecovering()
@@ -189,7 +200,7 @@ func (c *CircuitBreaker) ProcessRequest(r request.Request) (*http.Response, erro
 			c.markToRecordMetrics(r)
 			return nil, nil
 		}
-		return c.fallback.ProcessRequest(r)
+		return c.activateFallback(r)
 	}
 
 	return nil, nil
@@ -209,6 +220,26 @@ func (c *CircuitBreaker) ProcessResponse(r request.Request, a request.Attempt) {
 	}
 }
 
+// GetState returns the name of the current state: standby, tripped or recovering
+func (c *CircuitBreaker) GetState() string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.state.String()
+}
+
+// GetDryRunTrips returns the number of times the circuit breaker would have tripped in the dry run mode
+func (c *CircuitBreaker) GetDryRunTrips() int64 {
+	return atomic.LoadInt64(&c.dryRunTrips)
+}
+
+// activateFallback replies to the request with the fallback, or lets it through in the dry run mode
+func (c *CircuitBreaker) activateFallback(r request.Request) (*http.Response, error) {
+	if c.o.DryRun {
+		return nil, nil
+	}
+	return c.fallback.ProcessRequest(r)
+}
+
 func (c *CircuitBreaker) isStandby() bool {
 	c.m.RLock()
 	defer c.m.RUnlock()
@@ -231,6 +262,13 @@ func (c *CircuitBreaker) setState(new cbState, until time.Time) {
 	log.Infof("%v setting state to %v, until %v", c, new, until)
 	c.state = new
 	c.until = until
+	if c.o.DryRun {
+		if new == stateTripped {
+			atomic.AddInt64(&c.dryRunTrips, 1)
+			log.Infof("%v would have tripped, letting requests through in the dry run mode", c)
+		}
+		return
+	}
 	switch new {
 	case stateTripped:
 		c.exec(c.o.OnTripped)
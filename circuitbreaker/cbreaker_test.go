@@ -5,11 +5,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/mailgun/timetools"
 	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/grpc"
 	"github.com/mailgun/vulcan/metrics"
 	"github.com/mailgun/vulcan/middleware"
 	"github.com/mailgun/vulcan/netutils"
@@ -291,6 +293,43 @@ func (s *CBSuite) TestSideEffects(c *C) {
 	}
 }
 
+// Dry run goes through the states, but lets all requests through and activates no side effects
+func (s *CBSuite) TestDryRun(c *C) {
+	executed := make(chan bool, 1)
+	cb := s.new(c, triggerNetRatio, fallbackResponse,
+		Options{
+			FallbackDuration: 10 * time.Second,
+			RecoveryDuration: 10 * time.Second,
+			OnTripped:        &signalSideEffect{executed: executed},
+			DryRun:           true,
+		})
+
+	req := makeRequest(O{})
+	cb.metrics = statsNetErrors(0.6)
+	cb.ProcessResponse(req, req.Attempts[0])
+	c.Assert(cb.state, Equals, cbState(stateTripped))
+	c.Assert(cb.GetDryRunTrips(), Equals, int64(1))
+
+	re, err := cb.ProcessRequest(req)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	// Recovering state lets all requests through as well
+	s.advanceTime(10*time.Second + time.Millisecond)
+	for i := 0; i < 10; i++ {
+		re, err = cb.ProcessRequest(makeRequest(O{}))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(cb.state, Equals, cbState(stateRecovering))
+
+	select {
+	case <-executed:
+		c.Error("side effect was activated in the dry run mode")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
 func (s *CBSuite) TestInvalidParams(c *C) {
 	cond, err := ParseExpression("NetworkErrorRatio() < 0.5")
 	c.Assert(err, IsNil)
@@ -351,6 +390,21 @@ func statsNetErrors(threshold float64) *metrics.RoundTripMetrics {
 	return m
 }
 
+func statsGrpcErrors(threshold float64) *metrics.RoundTripMetrics {
+	m, err := metrics.NewRoundTripMetrics(metrics.RoundTripOptions{})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100; i++ {
+		if i < int(threshold*100) {
+			m.RecordMetrics(&request.BaseAttempt{Response: grpc.NewErrorResponse(nil, grpc.Unavailable, "")})
+		} else {
+			m.RecordMetrics(&request.BaseAttempt{Response: grpc.NewErrorResponse(nil, grpc.OK, "")})
+		}
+	}
+	return m
+}
+
 func statsLatencyAtQuantile(quantile float64, value time.Duration) *metrics.RoundTripMetrics {
 	m, err := metrics.NewRoundTripMetrics(metrics.RoundTripOptions{})
 	if err != nil {
@@ -378,6 +432,30 @@ type statusCode struct {
 	Code  int
 	Count int64
 }
+
+// Run with -race to check the metrics recorded by parallel requests
+func (s *CBSuite) TestConcurrentRequests(c *C) {
+	cb := s.new(c, triggerNetRatio, fallbackResponse, Options{})
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				req := makeRequest(O{})
+				cb.ProcessRequest(req)
+				cb.ProcessResponse(req, &request.BaseAttempt{Response: &http.Response{StatusCode: http.StatusOK}})
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(cb.GetState(), Equals, "standby")
+	c.Assert(cb.metrics.GetTotalCount(), Equals, int64(1000))
+	c.Assert(cb.metrics.GetStatusCodesCounts(), DeepEquals, map[int]int64{http.StatusOK: 1000})
+}
+
 type O struct {
 	stats      *metrics.RoundTripMetrics
 	id         int64
@@ -403,3 +481,12 @@ func expr(v string) threshold.Predicate {
 	}
 	return e
 }
+
+type signalSideEffect struct {
+	executed chan bool
+}
+
+func (e *signalSideEffect) Exec() error {
+	e.executed <- true
+	return nil
+}
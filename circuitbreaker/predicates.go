@@ -36,6 +36,7 @@ func ParseExpression(in string) (threshold.Predicate, error) {
 		Functions: map[string]interface{}{
 			"LatencyAtQuantileMS": latencyAtQuantile,
 			"NetworkErrorRatio":   networkErrorRatio,
+			"GrpcErrorRatio":      grpcErrorRatio,
 			"ResponseCodeRatio":   responseCodeRatio,
 		},
 	})
@@ -78,6 +79,16 @@ func networkErrorRatio() threshold.RequestToFloat64 {
 	}
 }
 
+func grpcErrorRatio() threshold.RequestToFloat64 {
+	return func(r request.Request) float64 {
+		m := getMetrics(r)
+		if m == nil {
+			return 0
+		}
+		return m.GetGrpcErrorRatio()
+	}
+}
+
 func responseCodeRatio(startA, endA, startB, endB int) threshold.RequestToFloat64 {
 	return func(r request.Request) float64 {
 		m := getMetrics(r)
@@ -28,6 +28,16 @@ func (s *PredicatesSuite) TestTriggered(c *C) {
 			Request:    makeRequest(O{stats: statsNetErrors(0.6)}),
 			V:          false,
 		},
+		{
+			Expression: "GrpcErrorRatio() > 0.5",
+			Request:    makeRequest(O{stats: statsGrpcErrors(0.6)}),
+			V:          true,
+		},
+		{
+			Expression: "GrpcErrorRatio() > 0.5",
+			Request:    makeRequest(O{stats: statsGrpcErrors(0.4)}),
+			V:          false,
+		},
 		{
 			Expression: "LatencyAtQuantileMS(50.0) > 50",
 			Request:    makeRequest(O{stats: statsLatencyAtQuantile(50, time.Millisecond*51)}),
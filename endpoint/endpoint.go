@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/mailgun/vulcan/netutils"
 	"net/url"
+	"strings"
 )
 
 type Endpoint interface {
@@ -17,9 +18,18 @@ type Endpoint interface {
 type HttpEndpoint struct {
 	url *url.URL
 	id  string
+	// Set for endpoints listening on unix sockets
+	socketPath string
 }
 
 func ParseUrl(in string) (*HttpEndpoint, error) {
+	if strings.HasPrefix(in, UnixScheme+"://") {
+		u, err := url.Parse(in)
+		if err != nil {
+			return nil, err
+		}
+		return parseUnixUrl(u)
+	}
 	url, err := netutils.ParseUrl(in)
 	if err != nil {
 		return nil, err
@@ -39,12 +49,21 @@ func NewHttpEndpoint(in *url.URL) (*HttpEndpoint, error) {
 	if in == nil {
 		return nil, fmt.Errorf("Provide url")
 	}
+	if in.Scheme == UnixScheme {
+		return parseUnixUrl(in)
+	}
 	return &HttpEndpoint{
 		url: netutils.CopyUrl(in),
 		id:  fmt.Sprintf("%s://%s", in.Scheme, in.Host)}, nil
 }
 
 func (e *HttpEndpoint) String() string {
+	if e.socketPath != "" {
+		if e.url.Path != "" {
+			return fmt.Sprintf("%s:%s", e.id, e.url.Path)
+		}
+		return e.id
+	}
 	return e.url.String()
 }
 
@@ -52,6 +71,13 @@ func (e *HttpEndpoint) GetId() string {
 	return e.id
 }
 
+// GetUrl returns the url of the endpoint, for unix socket endpoints it's an http url with
+// the host that encodes the socket path, see UnixSocketHost
 func (e *HttpEndpoint) GetUrl() *url.URL {
 	return e.url
 }
+
+// GetSocketPath returns the unix socket path or empty string for tcp endpoints
+func (e *HttpEndpoint) GetSocketPath() string {
+	return e.socketPath
+}
@@ -0,0 +1,92 @@
+package endpoint
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestEndpoint(t *testing.T) { TestingT(t) }
+
+type EndpointSuite struct {
+}
+
+var _ = Suite(&EndpointSuite{})
+
+func (s *EndpointSuite) TestParseHttp(c *C) {
+	e, err := ParseUrl("http://localhost:5000/path")
+	c.Assert(err, IsNil)
+	c.Assert(e.GetId(), Equals, "http://localhost:5000")
+	c.Assert(e.GetUrl().Host, Equals, "localhost:5000")
+	c.Assert(e.GetSocketPath(), Equals, "")
+	c.Assert(e.String(), Equals, "http://localhost:5000/path")
+
+	_, err = ParseUrl("localhost")
+	c.Assert(err, NotNil)
+}
+
+func (s *EndpointSuite) TestParseUnix(c *C) {
+	e, err := ParseUrl("unix:///var/run/app.sock")
+	c.Assert(err, IsNil)
+	c.Assert(e.GetId(), Equals, "unix:///var/run/app.sock")
+	c.Assert(e.GetSocketPath(), Equals, "/var/run/app.sock")
+	c.Assert(e.GetUrl().Scheme, Equals, "http")
+	c.Assert(e.GetUrl().Path, Equals, "")
+	c.Assert(e.String(), Equals, "unix:///var/run/app.sock")
+
+	path, ok := UnixSocketPath(e.GetUrl().Host + ":80")
+	c.Assert(ok, Equals, true)
+	c.Assert(path, Equals, "/var/run/app.sock")
+}
+
+func (s *EndpointSuite) TestParseUnixWithPrefix(c *C) {
+	e, err := ParseUrl("unix:///var/run/app.sock:/api/v1")
+	c.Assert(err, IsNil)
+	c.Assert(e.GetId(), Equals, "unix:///var/run/app.sock")
+	c.Assert(e.GetSocketPath(), Equals, "/var/run/app.sock")
+	c.Assert(e.GetUrl().Path, Equals, "/api/v1")
+	c.Assert(e.String(), Equals, "unix:///var/run/app.sock:/api/v1")
+
+	// Different sockets map to different hosts
+	e2 := MustParseUrl("unix:///var/run/app2.sock")
+	c.Assert(e.GetUrl().Host, Not(Equals), e2.GetUrl().Host)
+}
+
+func (s *EndpointSuite) TestParseUnixEscapedColon(c *C) {
+	e, err := ParseUrl("unix:///var/run/app%3A1.sock:/api")
+	c.Assert(err, IsNil)
+	c.Assert(e.GetSocketPath(), Equals, "/var/run/app:1.sock")
+	c.Assert(e.GetUrl().Path, Equals, "/api")
+	c.Assert(e.String(), Equals, "unix:///var/run/app%3A1.sock:/api")
+
+	path, ok := UnixSocketPath(e.GetUrl().Host + ":80")
+	c.Assert(ok, Equals, true)
+	c.Assert(path, Equals, "/var/run/app:1.sock")
+
+	// String representation parses back to the same endpoint
+	e2, err := ParseUrl(e.String())
+	c.Assert(err, IsNil)
+	c.Assert(e2.GetSocketPath(), Equals, e.GetSocketPath())
+}
+
+func (s *EndpointSuite) TestParseUnixErrors(c *C) {
+	urls := []string{
+		"unix://host/var/run/app.sock",
+		"unix://",
+		"unix:///var/run/app.sock:api",
+		// Unescaped colon in the socket path is taken for the prefix separator
+		"unix:///var/run/app:1.sock",
+	}
+	for _, u := range urls {
+		_, err := ParseUrl(u)
+		c.Assert(err, NotNil, Commentf("%s", u))
+	}
+}
+
+func (s *EndpointSuite) TestUnixSocketPath(c *C) {
+	_, ok := UnixSocketPath("localhost:80")
+	c.Assert(ok, Equals, false)
+
+	_, ok = UnixSocketPath("zz.unix:80")
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,77 @@
+package endpoint
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// UnixScheme is used for endpoints listening on unix sockets, e.g.
+// unix:///var/run/app.sock or unix:///var/run/app.sock:/prefix to prepend the path prefix to the requests.
+// The first colon separates the prefix, so colons in the socket path should be escaped as %3A.
+const UnixScheme = "unix"
+
+// Unix socket endpoints are represented by http urls with the host that encodes the socket path,
+// the transport dialer decodes the host back to the socket path. This way connections to different sockets
+// are pooled separately and the rest of the proxy works with the endpoint as with any http endpoint.
+const unixHostSuffix = ".unix"
+
+// UnixSocketHost encodes the socket path into the url host
+func UnixSocketHost(socketPath string) string {
+	return hex.EncodeToString([]byte(socketPath)) + unixHostSuffix
+}
+
+// UnixSocketPath decodes the socket path from the host or host:port created by UnixSocketHost,
+// returns false if the host does not represent unix socket
+func UnixSocketPath(hostPort string) (string, bool) {
+	host := hostPort
+	if h, _, err := net.SplitHostPort(hostPort); err == nil {
+		host = h
+	}
+	if !strings.HasSuffix(host, unixHostSuffix) {
+		return "", false
+	}
+	path, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+	if err != nil {
+		return "", false
+	}
+	return string(path), true
+}
+
+func parseUnixUrl(in *url.URL) (*HttpEndpoint, error) {
+	if in.Host != "" {
+		return nil, fmt.Errorf("Unix socket url should not have host, e.g. unix:///var/run/app.sock")
+	}
+	// Path prefix follows the socket path after the colon, e.g. unix:///var/run/app.sock:/prefix.
+	// The escaped path is split, so the escaped colons (%3A) stay in the socket path
+	socketPath, prefix := in.EscapedPath(), ""
+	if idx := strings.IndexRune(socketPath, ':'); idx != -1 {
+		socketPath, prefix = socketPath[:idx], socketPath[idx+1:]
+	}
+	socketPath, err := url.PathUnescape(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if prefix, err = url.PathUnescape(prefix); err != nil {
+		return nil, err
+	}
+	if socketPath == "" {
+		return nil, fmt.Errorf("Provide unix socket path")
+	}
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("Path prefix should start with /, got '%s'", prefix)
+	}
+	return &HttpEndpoint{
+		url:        &url.URL{Scheme: "http", Host: UnixSocketHost(socketPath), Path: prefix},
+		id:         fmt.Sprintf("%s://%s", UnixScheme, escapeSocketPath(socketPath)),
+		socketPath: socketPath,
+	}, nil
+}
+
+// escapeSocketPath escapes the characters that have special meaning in the unix urls,
+// so the id and the string representation of the endpoint can be parsed back
+func escapeSocketPath(socketPath string) string {
+	return strings.NewReplacer("%", "%25", ":", "%3A").Replace(socketPath)
+}
@@ -12,6 +12,8 @@ import (
 
 const (
 	StatusTooManyRequests = 429
+	// Non standard status used when the client closes the connection before the response is sent
+	StatusClientClosedRequest = 499
 )
 
 type ProxyError interface {
@@ -28,9 +30,13 @@ type JsonFormatter struct {
 }
 
 func (f *JsonFormatter) Format(err ProxyError) (int, []byte, string) {
-	encodedError, e := json.Marshal(map[string]interface{}{
+	body := map[string]interface{}{
 		"error": string(err.Error()),
-	})
+	}
+	if e, ok := err.(*RequestIdError); ok {
+		body["request_id"] = e.RequestId
+	}
+	encodedError, e := json.Marshal(body)
 	if e != nil {
 		log.Errorf("Failed to serialize: %s", e)
 		encodedError = []byte("{}")
@@ -59,6 +65,40 @@ func (r *HttpError) GetStatusCode() int {
 	return r.StatusCode
 }
 
+// LimitError is replied by the limiters when the client has exceeded the limit, e.g. the rate of the requests
+type LimitError struct {
+	Body string
+	// Headers sent to the client, e.g. Retry-After
+	Header http.Header
+}
+
+func (r *LimitError) Headers() http.Header {
+	return r.Header
+}
+
+func (r *LimitError) Error() string {
+	return r.Body
+}
+
+func (r *LimitError) GetStatusCode() int {
+	return StatusTooManyRequests
+}
+
+// RequestIdError annotates the error with the id of the request that has failed, so formatters
+// can include it in the response body
+type RequestIdError struct {
+	ProxyError
+	RequestId string
+}
+
+// WithRequestId annotates the error with the request id, returns the error as is if the id is empty
+func WithRequestId(err ProxyError, requestId string) ProxyError {
+	if requestId == "" {
+		return err
+	}
+	return &RequestIdError{ProxyError: err, RequestId: requestId}
+}
+
 type RedirectError struct {
 	URL *url.URL
 }
@@ -0,0 +1,150 @@
+// Helpers for proxying gRPC requests: status codes, mapping of HTTP failures to gRPC statuses
+// and error responses that gRPC clients understand.
+package grpc
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mailgun/vulcan/netutils"
+)
+
+const (
+	ContentType = "application/grpc"
+	// Status and message headers are sent in trailers, or in headers for trailers-only responses
+	StatusHeader  = "Grpc-Status"
+	MessageHeader = "Grpc-Message"
+)
+
+// Code is a gRPC status code, see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+type Code int
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	DataLoss           Code = 15
+	Unauthenticated    Code = 16
+)
+
+var codeNames = map[Code]string{
+	OK:                 "OK",
+	Canceled:           "CANCELED",
+	Unknown:            "UNKNOWN",
+	InvalidArgument:    "INVALID_ARGUMENT",
+	DeadlineExceeded:   "DEADLINE_EXCEEDED",
+	NotFound:           "NOT_FOUND",
+	AlreadyExists:      "ALREADY_EXISTS",
+	PermissionDenied:   "PERMISSION_DENIED",
+	ResourceExhausted:  "RESOURCE_EXHAUSTED",
+	FailedPrecondition: "FAILED_PRECONDITION",
+	Aborted:            "ABORTED",
+	OutOfRange:         "OUT_OF_RANGE",
+	Unimplemented:      "UNIMPLEMENTED",
+	Internal:           "INTERNAL",
+	Unavailable:        "UNAVAILABLE",
+	DataLoss:           "DATA_LOSS",
+	Unauthenticated:    "UNAUTHENTICATED",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CODE(%d)", int(c))
+}
+
+// IsFailure returns true for codes that indicate a server side failure rather than the client error,
+// these are treated as failures by metrics and circuit breakers
+func (c Code) IsFailure() bool {
+	switch c {
+	case Unknown, DeadlineExceeded, ResourceExhausted, Internal, Unavailable, DataLoss:
+		return true
+	}
+	return false
+}
+
+// IsGrpc returns true if the headers have gRPC content type
+func IsGrpc(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), ContentType)
+}
+
+// GetStatus returns the status of the gRPC response. Status is taken from the trailers, or from
+// the headers in case of trailers-only response. Returns false if the response is not a gRPC response
+// or has no status, e.g. the body has not been read yet.
+func GetStatus(re *http.Response) (Code, bool) {
+	if re == nil || !IsGrpc(re.Header) {
+		return 0, false
+	}
+	value := re.Trailer.Get(StatusHeader)
+	if value == "" {
+		value = re.Header.Get(StatusHeader)
+	}
+	if value == "" {
+		return 0, false
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return Unknown, true
+	}
+	return Code(code), true
+}
+
+// FromHttpStatus maps HTTP status code to gRPC status code. It follows
+// https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md with the exception
+// of the proxy specific codes: 429 is returned by rate limiters, so it's RESOURCE_EXHAUSTED and timeouts
+// are DEADLINE_EXCEEDED
+func FromHttpStatus(statusCode int) Code {
+	switch statusCode {
+	case http.StatusOK:
+		return OK
+	case http.StatusBadRequest:
+		return Internal
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return Unimplemented
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return DeadlineExceeded
+	case http.StatusRequestEntityTooLarge, 429:
+		return ResourceExhausted
+	case 499:
+		return Canceled
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return Unavailable
+	}
+	return Unknown
+}
+
+// NewErrorResponse returns trailers-only gRPC response with the given status and message
+func NewErrorResponse(request *http.Request, code Code, message string) *http.Response {
+	re := netutils.NewHttpResponse(request, http.StatusOK, nil, ContentType)
+	re.Header.Set(StatusHeader, strconv.Itoa(int(code)))
+	if message != "" {
+		re.Header.Set(MessageHeader, EncodeMessage(message))
+	}
+	return re
+}
+
+// EncodeMessage percent-encodes the status message as demanded by the gRPC over HTTP/2 spec
+func EncodeMessage(message string) string {
+	// PathEscape encodes a superset of what's required, and the result is still decoded correctly
+	return url.PathEscape(message)
+}
@@ -0,0 +1,71 @@
+package grpc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestGrpc(t *testing.T) { TestingT(t) }
+
+type GrpcSuite struct {
+}
+
+var _ = Suite(&GrpcSuite{})
+
+func (s *GrpcSuite) TestFromHttpStatus(c *C) {
+	tc := []struct {
+		Status int
+		Code   Code
+	}{
+		{http.StatusOK, OK},
+		{http.StatusBadRequest, Internal},
+		{http.StatusUnauthorized, Unauthenticated},
+		{http.StatusForbidden, PermissionDenied},
+		{http.StatusNotFound, Unimplemented},
+		{http.StatusRequestTimeout, DeadlineExceeded},
+		{429, ResourceExhausted},
+		{http.StatusBadGateway, Unavailable},
+		{http.StatusServiceUnavailable, Unavailable},
+		{http.StatusInternalServerError, Unknown},
+	}
+	for _, t := range tc {
+		c.Assert(FromHttpStatus(t.Status), Equals, t.Code, Commentf("%d", t.Status))
+	}
+}
+
+func (s *GrpcSuite) TestGetStatus(c *C) {
+	re := NewErrorResponse(nil, Unavailable, "no endpoints: 100%")
+	code, ok := GetStatus(re)
+	c.Assert(ok, Equals, true)
+	c.Assert(code, Equals, Unavailable)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.Header.Get(MessageHeader), Equals, "no%20endpoints:%20100%25")
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(len(body), Equals, 0)
+
+	// Trailers have priority
+	re.Trailer = http.Header{StatusHeader: []string{"0"}}
+	code, ok = GetStatus(re)
+	c.Assert(ok, Equals, true)
+	c.Assert(code, Equals, OK)
+
+	// Not a gRPC response
+	re.Header.Set("Content-Type", "text/plain")
+	_, ok = GetStatus(re)
+	c.Assert(ok, Equals, false)
+
+	_, ok = GetStatus(nil)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GrpcSuite) TestCode(c *C) {
+	c.Assert(Unavailable.String(), Equals, "UNAVAILABLE")
+	c.Assert(Code(42).String(), Equals, "CODE(42)")
+	c.Assert(Unavailable.IsFailure(), Equals, true)
+	c.Assert(NotFound.IsFailure(), Equals, false)
+	c.Assert(OK.IsFailure(), Equals, false)
+}
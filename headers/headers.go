@@ -6,12 +6,14 @@ const (
 	XForwardedFor      = "X-Forwarded-For"
 	XForwardedHost     = "X-Forwarded-Host"
 	XForwardedServer   = "X-Forwarded-Server"
+	Forwarded          = "Forwarded"
 	Connection         = "Connection"
 	KeepAlive          = "Keep-Alive"
 	ProxyAuthenticate  = "Proxy-Authenticate"
 	ProxyAuthorization = "Proxy-Authorization"
 	Te                 = "Te" // canonicalized version of "TE"
 	Trailers           = "Trailers"
+	Trailer            = "Trailer"
 	TransferEncoding   = "Transfer-Encoding"
 	Upgrade            = "Upgrade"
 	ContentLength      = "Content-Length"
@@ -27,6 +29,7 @@ var HopHeaders = []string{
 	ProxyAuthorization,
 	Te, // canonicalized version of "TE"
 	Trailers,
+	Trailer,
 	TransferEncoding,
 	Upgrade,
 }
@@ -0,0 +1,72 @@
+// Package queue hands the items over to the background goroutine without blocking the requests,
+// e.g. the metrics, the access log records and the spans. Items that do not fit in the queue are dropped.
+package queue
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ConsumerFn reads the items until the channel is closed
+type ConsumerFn func(items <-chan interface{})
+
+// Queue is the bounded queue read by the consumer in the background goroutine
+type Queue struct {
+	items   chan interface{}
+	done    chan struct{}
+	mutex   *sync.RWMutex
+	closed  bool
+	dropped int64
+}
+
+// New creates the queue holding up to size items and starts the consumer
+func New(size int, consume ConsumerFn) *Queue {
+	q := &Queue{
+		items: make(chan interface{}, size),
+		done:  make(chan struct{}),
+		mutex: &sync.RWMutex{},
+	}
+	go func() {
+		defer close(q.done)
+		consume(q.items)
+	}()
+	return q
+}
+
+// Push queues the item, it never blocks, the item is dropped if the queue is full or closed
+func (q *Queue) Push(item interface{}) bool {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	if q.closed {
+		atomic.AddInt64(&q.dropped, 1)
+		return false
+	}
+	select {
+	case q.items <- item:
+		return true
+	default:
+		atomic.AddInt64(&q.dropped, 1)
+		return false
+	}
+}
+
+// GetDropped returns the number of items dropped because the queue was full or closed
+func (q *Queue) GetDropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// Close closes the queue and waits until the consumer has read the queued items,
+// returns false if the queue was already closed
+func (q *Queue) Close() bool {
+	q.mutex.Lock()
+	closed := q.closed
+	if !closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.mutex.Unlock()
+
+	<-q.done
+	return !closed
+}
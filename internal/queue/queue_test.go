@@ -0,0 +1,52 @@
+package queue
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestQueue(t *testing.T) { TestingT(t) }
+
+type QueueSuite struct{}
+
+var _ = Suite(&QueueSuite{})
+
+func (s *QueueSuite) TestConsume(c *C) {
+	consumed := []interface{}{}
+	q := New(4, func(items <-chan interface{}) {
+		for item := range items {
+			consumed = append(consumed, item)
+		}
+	})
+	c.Assert(q.Push("a"), Equals, true)
+	c.Assert(q.Push("b"), Equals, true)
+	q.Close()
+
+	c.Assert(consumed, DeepEquals, []interface{}{"a", "b"})
+	c.Assert(q.GetDropped(), Equals, int64(0))
+}
+
+// Items are dropped instead of blocking if the consumer lags behind or the queue is closed
+func (s *QueueSuite) TestDrop(c *C) {
+	release := make(chan struct{})
+	consumed := 0
+	q := New(1, func(items <-chan interface{}) {
+		<-release
+		for range items {
+			consumed += 1
+		}
+	})
+	c.Assert(q.Push("a"), Equals, true)
+	c.Assert(q.Push("b"), Equals, false)
+	c.Assert(q.GetDropped(), Equals, int64(1))
+
+	close(release)
+	c.Assert(q.Close(), Equals, true)
+	c.Assert(q.Push("c"), Equals, false)
+	c.Assert(q.GetDropped(), Equals, int64(2))
+	c.Assert(consumed, Equals, 1)
+
+	// Closing twice is fine
+	c.Assert(q.Close(), Equals, false)
+}
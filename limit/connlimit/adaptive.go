@@ -0,0 +1,325 @@
+package connlimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/request"
+)
+
+const (
+	DefaultInitialLimit = 20
+	DefaultMinLimit     = 1
+	DefaultMaxLimit     = 1000
+	DefaultHistory      = 100
+)
+
+// Sample is the outcome of the request the algorithm adjusts the limit by
+type Sample struct {
+	// Round trip time of the request to the endpoint
+	Rtt time.Duration
+	// Number of requests in flight when the request was sent, including the request
+	InFlight int64
+	// Request failed without response, e.g. timed out
+	Dropped bool
+}
+
+// Algorithm adjusts the concurrency limit after every request. It's called by the limiter under lock,
+// so algorithms can keep state without synchronization.
+type Algorithm interface {
+	// Update returns the new limit, the limiter keeps it within the min and max limits
+	Update(limit float64, s Sample) float64
+}
+
+// AIMDOptions defines optional parameters of the AIMD algorithm
+type AIMDOptions struct {
+	// Requests slower than this are treated as dropped, only the dropped requests decrease the limit if it's 0
+	LatencyThreshold time.Duration
+	// Amount added to the limit after a successful request, 1 is used if it's 0
+	Increase float64
+	// Factor the limit is multiplied by after a dropped request, 0.9 is used if it's 0
+	Backoff float64
+}
+
+// AIMD increases the limit additively while the requests succeed and decreases it multiplicatively once they
+// are dropped or slow, similar to the TCP congestion control
+type AIMD struct {
+	o AIMDOptions
+}
+
+func NewAIMD(o AIMDOptions) (*AIMD, error) {
+	if o.LatencyThreshold < 0 {
+		return nil, fmt.Errorf("Invalid latency threshold: %v", o.LatencyThreshold)
+	}
+	if o.Increase < 0 {
+		return nil, fmt.Errorf("Invalid increase: %v", o.Increase)
+	}
+	if o.Backoff < 0 || o.Backoff >= 1 {
+		return nil, fmt.Errorf("Backoff should be within (0, 1), got %v", o.Backoff)
+	}
+	if o.Increase == 0 {
+		o.Increase = 1
+	}
+	if o.Backoff == 0 {
+		o.Backoff = 0.9
+	}
+	return &AIMD{o: o}, nil
+}
+
+func (a *AIMD) Update(limit float64, s Sample) float64 {
+	if s.Dropped || (a.o.LatencyThreshold > 0 && s.Rtt > a.o.LatencyThreshold) {
+		return limit * a.o.Backoff
+	}
+	// The limit is not tested unless the requests use at least a half of it
+	if float64(s.InFlight)*2 >= limit {
+		return limit + a.o.Increase
+	}
+	return limit
+}
+
+// GradientOptions defines optional parameters of the Gradient algorithm
+type GradientOptions struct {
+	// Ratio of the short term latency to the long term latency that is tolerated before the limit is decreased,
+	// 1.5 is used if it's 0
+	Tolerance float64
+	// Share of the new limit mixed into the current one, 0.2 is used if it's 0
+	Smoothing float64
+	// Number of samples the long term latency is averaged over, 600 is used if it's 0
+	LongWindow int
+	// Number of requests allowed to queue at the endpoint while the latency is fine, the square root
+	// of the limit is used if it's 0
+	QueueSize float64
+}
+
+// Gradient is the algorithm similar to the Netflix concurrency limits Gradient2: it compares the latency of the
+// requests to the long term average latency, and decreases the limit as the requests get queued at the endpoint,
+// or increases it by the queue size while the latency stays close to the average
+type Gradient struct {
+	o       GradientOptions
+	longRtt float64
+	samples int
+}
+
+func NewGradient(o GradientOptions) (*Gradient, error) {
+	if o.Tolerance != 0 && o.Tolerance < 1 {
+		return nil, fmt.Errorf("Tolerance should be >= 1, got %v", o.Tolerance)
+	}
+	if o.Smoothing < 0 || o.Smoothing > 1 {
+		return nil, fmt.Errorf("Smoothing should be within (0, 1], got %v", o.Smoothing)
+	}
+	if o.LongWindow < 0 || o.QueueSize < 0 {
+		return nil, fmt.Errorf("Long window and queue size can not be negative")
+	}
+	if o.Tolerance == 0 {
+		o.Tolerance = 1.5
+	}
+	if o.Smoothing == 0 {
+		o.Smoothing = 0.2
+	}
+	if o.LongWindow == 0 {
+		o.LongWindow = 600
+	}
+	return &Gradient{o: o}, nil
+}
+
+func (g *Gradient) Update(limit float64, s Sample) float64 {
+	rtt := float64(s.Rtt)
+	if rtt <= 0 {
+		return limit
+	}
+	// Long term average warms up as a plain average of the first samples
+	if g.samples < g.o.LongWindow {
+		g.samples++
+	}
+	g.longRtt += (rtt - g.longRtt) / float64(g.samples)
+	// Let the average recover faster after the latency has dropped, e.g. once the endpoint has recovered
+	if g.longRtt > rtt*2 {
+		g.longRtt *= 0.95
+	}
+
+	// Do not grow the limit the requests are not using
+	if float64(s.InFlight)*2 < limit {
+		return limit
+	}
+
+	gradient := math.Max(0.5, math.Min(1, g.o.Tolerance*g.longRtt/rtt))
+	queueSize := g.o.QueueSize
+	if queueSize == 0 {
+		queueSize = math.Sqrt(limit)
+	}
+	if s.Dropped {
+		gradient, queueSize = 0.5, 0
+	}
+	newLimit := limit*gradient + queueSize
+	return limit*(1-g.o.Smoothing) + newLimit*g.o.Smoothing
+}
+
+// AdaptiveOptions defines optional parameters of the AdaptiveLimiter
+type AdaptiveOptions struct {
+	// Algorithm adjusting the limit, Gradient with the default options is used if it's nil
+	Algorithm Algorithm
+	// Limit to start with, DefaultInitialLimit is used if it's 0
+	InitialLimit int64
+	// Limit never goes below this, DefaultMinLimit is used if it's 0
+	MinLimit int64
+	// Limit never goes above this, DefaultMaxLimit is used if it's 0
+	MaxLimit int64
+	// Number of the last limit changes kept, DefaultHistory is used if it's 0
+	History int
+	// Interface that gives current time (so tests can override)
+	Clock timetools.TimeProvider
+}
+
+// LimitChange is a change of the limit kept in the history
+type LimitChange struct {
+	Time  time.Time
+	Limit int64
+	// Round trip time of the request that has changed the limit
+	Rtt time.Duration
+}
+
+// AdaptiveLimiter limits the number of requests in flight to the location, like the ConnectionLimiter, but finds
+// the limit on its own: it measures the round trip time of every request and adjusts the limit by the algorithm,
+// so it grows while the endpoints keep up and sheds load once the latency grows. Requests over the limit are
+// rejected with errors.LimitError, like the ones over the limit of the ConnectionLimiter.
+type AdaptiveLimiter struct {
+	o        AdaptiveOptions
+	mutex    *sync.Mutex
+	limit    float64
+	inFlight int64
+	// Ring buffer of the last limit changes
+	history []LimitChange
+	next    int
+	// Key of the request user data marking the requests let through
+	requestKey string
+}
+
+func NewAdaptiveLimiter(o AdaptiveOptions) (*AdaptiveLimiter, error) {
+	o, err := setAdaptiveDefaults(o)
+	if err != nil {
+		return nil, err
+	}
+	l := &AdaptiveLimiter{
+		o:       o,
+		mutex:   &sync.Mutex{},
+		limit:   float64(o.InitialLimit),
+		history: make([]LimitChange, 0, o.History),
+	}
+	l.requestKey = fmt.Sprintf("connlimit.adaptive.%p", l)
+	l.record(o.Clock.UtcNow(), 0)
+	return l, nil
+}
+
+func (l *AdaptiveLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.inFlight >= int64(l.limit) {
+		return nil, &errors.LimitError{
+			Body: fmt.Sprintf("Concurrency limit reached: %d", int64(l.limit)),
+		}
+	}
+	l.inFlight += 1
+	r.SetUserData(l.requestKey, l.inFlight)
+	return nil, nil
+}
+
+func (l *AdaptiveLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	v, ok := r.GetUserData(l.requestKey)
+	if !ok {
+		return
+	}
+	r.DeleteUserData(l.requestKey)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.inFlight -= 1
+	// Requests rejected by the middlewares never got to the endpoint and say nothing about its capacity
+	if a == nil || request.IsIntercepted(a) || (a.GetResponse() == nil && a.GetError() == nil) {
+		return
+	}
+	s := Sample{
+		Rtt:      a.GetDuration(),
+		InFlight: v.(int64),
+		Dropped:  a.GetError() != nil,
+	}
+	previous := int64(l.limit)
+	l.limit = math.Max(float64(l.o.MinLimit), math.Min(float64(l.o.MaxLimit), l.o.Algorithm.Update(l.limit, s)))
+	if int64(l.limit) != previous {
+		l.record(l.o.Clock.UtcNow(), s.Rtt)
+	}
+}
+
+// GetLimit returns the current limit
+func (l *AdaptiveLimiter) GetLimit() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int64(l.limit)
+}
+
+// GetInFlight returns the number of requests in flight
+func (l *AdaptiveLimiter) GetInFlight() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.inFlight
+}
+
+// GetHistory returns the last changes of the limit, oldest first
+func (l *AdaptiveLimiter) GetHistory() []LimitChange {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	out := make([]LimitChange, 0, len(l.history))
+	if len(l.history) == cap(l.history) {
+		out = append(out, l.history[l.next:]...)
+	}
+	return append(out, l.history[:l.next]...)
+}
+
+func (l *AdaptiveLimiter) record(now time.Time, rtt time.Duration) {
+	c := LimitChange{Time: now, Limit: int64(l.limit), Rtt: rtt}
+	if len(l.history) < cap(l.history) {
+		l.history = append(l.history, c)
+	} else {
+		l.history[l.next] = c
+	}
+	l.next = (l.next + 1) % cap(l.history)
+}
+
+func setAdaptiveDefaults(o AdaptiveOptions) (AdaptiveOptions, error) {
+	if o.InitialLimit < 0 || o.MinLimit < 0 || o.MaxLimit < 0 || o.History < 0 {
+		return o, fmt.Errorf("Limits and history can not be negative")
+	}
+	if o.Algorithm == nil {
+		g, err := NewGradient(GradientOptions{})
+		if err != nil {
+			return o, err
+		}
+		o.Algorithm = g
+	}
+	if o.InitialLimit == 0 {
+		o.InitialLimit = DefaultInitialLimit
+	}
+	if o.MinLimit == 0 {
+		o.MinLimit = DefaultMinLimit
+	}
+	if o.MaxLimit == 0 {
+		o.MaxLimit = DefaultMaxLimit
+	}
+	if o.History == 0 {
+		o.History = DefaultHistory
+	}
+	if o.MinLimit > o.MaxLimit || o.InitialLimit < o.MinLimit || o.InitialLimit > o.MaxLimit {
+		return o, fmt.Errorf("Initial limit should be within [%d, %d], got %d", o.MinLimit, o.MaxLimit, o.InitialLimit)
+	}
+	if o.Clock == nil {
+		o.Clock = &timetools.RealTime{}
+	}
+	return o, nil
+}
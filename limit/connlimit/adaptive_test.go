@@ -0,0 +1,235 @@
+package connlimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+type AdaptiveSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&AdaptiveSuite{})
+
+func (s *AdaptiveSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *AdaptiveSuite) newLimiter(c *C, a Algorithm, o AdaptiveOptions) *AdaptiveLimiter {
+	o.Algorithm = a
+	o.Clock = s.clock
+	l, err := NewAdaptiveLimiter(o)
+	c.Assert(err, IsNil)
+	return l
+}
+
+func (s *AdaptiveSuite) TestInvalidParams(c *C) {
+	for _, o := range []AdaptiveOptions{
+		{InitialLimit: -1},
+		{History: -1},
+		{MinLimit: 10, MaxLimit: 5},
+		{InitialLimit: 2000},
+		{InitialLimit: 5, MinLimit: 10},
+	} {
+		_, err := NewAdaptiveLimiter(o)
+		c.Assert(err, NotNil)
+	}
+	_, err := NewAIMD(AIMDOptions{Backoff: 1})
+	c.Assert(err, NotNil)
+	_, err = NewAIMD(AIMDOptions{LatencyThreshold: -1})
+	c.Assert(err, NotNil)
+	_, err = NewGradient(GradientOptions{Tolerance: 0.5})
+	c.Assert(err, NotNil)
+	_, err = NewGradient(GradientOptions{Smoothing: 2})
+	c.Assert(err, NotNil)
+}
+
+// Requests over the limit are shed until the requests in flight complete
+func (s *AdaptiveSuite) TestShedLoad(c *C) {
+	aimd, err := NewAIMD(AIMDOptions{})
+	c.Assert(err, IsNil)
+	l := s.newLimiter(c, aimd, AdaptiveOptions{InitialLimit: 2})
+
+	r1, r2 := makeAdaptiveRequest("1.2.3.4"), makeAdaptiveRequest("1.2.3.5")
+	for _, r := range []request.Request{r1, r2} {
+		re, err := l.ProcessRequest(r)
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+	r3 := makeAdaptiveRequest("1.2.3.6")
+	re, err := l.ProcessRequest(r3)
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	c.Assert(err.(*errors.LimitError).GetStatusCode(), Equals, errors.StatusTooManyRequests)
+	c.Assert(l.GetInFlight(), Equals, int64(2))
+
+	// Rejected request does not count
+	l.ProcessResponse(r3, nil)
+	c.Assert(l.GetInFlight(), Equals, int64(2))
+
+	// Successful request at full utilization grows the limit
+	l.ProcessResponse(r1, makeAttempt(10*time.Millisecond, nil))
+	c.Assert(l.GetInFlight(), Equals, int64(1))
+	c.Assert(l.GetLimit(), Equals, int64(3))
+}
+
+func (s *AdaptiveSuite) TestAIMD(c *C) {
+	aimd, err := NewAIMD(AIMDOptions{LatencyThreshold: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	c.Assert(aimd.Update(10, Sample{Rtt: time.Millisecond, InFlight: 10}), Equals, 11.0)
+	// The limit is not grown while it's underused
+	c.Assert(aimd.Update(10, Sample{Rtt: time.Millisecond, InFlight: 2}), Equals, 10.0)
+	c.Assert(aimd.Update(10, Sample{Rtt: time.Second, InFlight: 10}), Equals, 9.0)
+	c.Assert(aimd.Update(10, Sample{Rtt: time.Millisecond, InFlight: 10, Dropped: true}), Equals, 9.0)
+}
+
+func (s *AdaptiveSuite) TestGradient(c *C) {
+	g, err := NewGradient(GradientOptions{})
+	c.Assert(err, IsNil)
+
+	limit := 16.0
+	for i := 0; i < 10; i++ {
+		limit = g.Update(limit, Sample{Rtt: 10 * time.Millisecond, InFlight: int64(limit)})
+	}
+	c.Assert(limit > 16, Equals, true, Commentf("%v", limit))
+
+	// Requests get queued at the endpoint
+	grown := limit
+	for i := 0; i < 10; i++ {
+		limit = g.Update(limit, Sample{Rtt: 100 * time.Millisecond, InFlight: int64(limit)})
+	}
+	c.Assert(limit < grown, Equals, true, Commentf("%v", limit))
+}
+
+// Limiter sheds load while the endpoint is slow and lets the traffic back once it recovers
+func (s *AdaptiveSuite) TestEndpointSlowdown(c *C) {
+	g, err := NewGradient(GradientOptions{})
+	c.Assert(err, IsNil)
+	l := s.newLimiter(c, g, AdaptiveOptions{InitialLimit: 20, MaxLimit: 100})
+
+	s.sendRounds(c, l, 5, 10*time.Millisecond)
+	grown := l.GetLimit()
+	c.Assert(grown > 20, Equals, true, Commentf("%d", grown))
+
+	s.sendRounds(c, l, 2, 100*time.Millisecond)
+	shed := l.GetLimit()
+	c.Assert(shed < grown/2, Equals, true, Commentf("%d", shed))
+
+	s.sendRounds(c, l, 5, 10*time.Millisecond)
+	c.Assert(l.GetLimit() > shed*2, Equals, true, Commentf("%d", l.GetLimit()))
+}
+
+func (s *AdaptiveSuite) TestHistory(c *C) {
+	aimd, err := NewAIMD(AIMDOptions{LatencyThreshold: 5 * time.Millisecond})
+	c.Assert(err, IsNil)
+	l := s.newLimiter(c, aimd, AdaptiveOptions{InitialLimit: 10, History: 3})
+	c.Assert(l.GetHistory(), DeepEquals, []LimitChange{{Time: s.clock.UtcNow(), Limit: 10}})
+
+	// Every slow request backs off the limit: 9, 8, 7, 6
+	for i := 1; i <= 4; i++ {
+		s.clock.Sleep(time.Second)
+		r := makeAdaptiveRequest("1.2.3.4")
+		_, err := l.ProcessRequest(r)
+		c.Assert(err, IsNil)
+		l.ProcessResponse(r, makeAttempt(time.Duration(i)*10*time.Millisecond, nil))
+	}
+	history := l.GetHistory()
+	c.Assert(len(history), Equals, 3)
+	for i, h := range history {
+		c.Assert(h.Limit, Equals, int64(8-i))
+		c.Assert(h.Rtt, Equals, time.Duration(i+2)*10*time.Millisecond)
+	}
+	c.Assert(history[2].Time, Equals, s.clock.UtcNow())
+
+	// Network errors decrease the limit as well
+	r := makeAdaptiveRequest("1.2.3.4")
+	_, err = l.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	l.ProcessResponse(r, makeAttempt(time.Millisecond, fmt.Errorf("connection refused")))
+	c.Assert(l.GetLimit(), Equals, int64(5))
+}
+
+// Requests rejected by the middlewares after the limiter never get to the endpoint and don't back off the limit
+func (s *AdaptiveSuite) TestRejectedByMiddleware(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	aimd, err := NewAIMD(AIMDOptions{})
+	c.Assert(err, IsNil)
+	l := s.newLimiter(c, aimd, AdaptiveOptions{InitialLimit: 10})
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	c.Assert(rr.AddEndpoint(endpoint.MustParseUrl(server.URL)), IsNil)
+	location, err := httploc.NewLocation("loc1", rr)
+	c.Assert(err, IsNil)
+	c.Assert(location.GetMiddlewareChain().Add("adaptive", 0, l), IsNil)
+	reject := &middleware.MiddlewareWrapper{
+		OnRequest: func(r request.Request) (*http.Response, error) {
+			return nil, &errors.LimitError{Body: "Too many requests"}
+		},
+	}
+	c.Assert(location.GetMiddlewareChain().Add("reject", 1, reject), IsNil)
+
+	proxy, err := vulcan.NewProxy(&route.ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	for i := 0; i < 3; i++ {
+		response, _, err := GET(proxyServer.URL, Opts{})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, 429)
+	}
+	c.Assert(l.GetLimit(), Equals, int64(10))
+	c.Assert(l.GetInFlight(), Equals, int64(0))
+}
+
+// sendRounds sends as many requests as the limiter lets through and completes them in rounds
+func (s *AdaptiveSuite) sendRounds(c *C, l *AdaptiveLimiter, rounds int, rtt time.Duration) {
+	for i := 0; i < rounds; i++ {
+		var admitted []request.Request
+		for {
+			r := makeAdaptiveRequest("1.2.3.4")
+			if _, err := l.ProcessRequest(r); err != nil {
+				break
+			}
+			admitted = append(admitted, r)
+		}
+		for _, r := range admitted {
+			l.ProcessResponse(r, makeAttempt(rtt, nil))
+		}
+		c.Assert(l.GetInFlight(), Equals, int64(0))
+	}
+}
+
+func makeAttempt(rtt time.Duration, err error) request.Attempt {
+	a := &request.BaseAttempt{Duration: rtt, Error: err}
+	if err == nil {
+		a.Response = &http.Response{StatusCode: http.StatusOK}
+	}
+	return a
+}
+
+func makeAdaptiveRequest(ip string) request.Request {
+	return request.NewBaseRequest(&http.Request{RemoteAddr: ip}, 1, nil)
+}
@@ -3,9 +3,9 @@ package connlimit
 
 import (
 	"fmt"
+	"github.com/mailgun/log"
 	"github.com/mailgun/vulcan/errors"
 	"github.com/mailgun/vulcan/limit"
-	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
 	"net/http"
 	"sync"
@@ -19,6 +19,17 @@ type ConnectionLimiter struct {
 	connections      map[string]int64
 	maxConnections   int64
 	totalConnections int64
+	// In the dry run mode all requests are let through, the requests that would have been rejected are counted
+	dryRun           bool
+	dryRunRejections int64
+	dryRunErrors     int64
+}
+
+// Options defines optional parameters of the ConnectionLimiter
+type Options struct {
+	// DryRun lets all requests through, the requests that would have been rejected are logged and counted
+	// by GetDryRunRejections, so the limit can be tuned on the real traffic
+	DryRun bool
 }
 
 func NewClientIpLimiter(maxConnections int64) (*ConnectionLimiter, error) {
@@ -26,6 +37,10 @@ func NewClientIpLimiter(maxConnections int64) (*ConnectionLimiter, error) {
 }
 
 func NewConnectionLimiter(mapper limit.MapperFn, maxConnections int64) (*ConnectionLimiter, error) {
+	return NewConnectionLimiterWithOptions(mapper, maxConnections, Options{})
+}
+
+func NewConnectionLimiterWithOptions(mapper limit.MapperFn, maxConnections int64, o Options) (*ConnectionLimiter, error) {
 	if mapper == nil {
 		return nil, fmt.Errorf("Mapper function can not be nil")
 	}
@@ -37,6 +52,7 @@ func NewConnectionLimiter(mapper limit.MapperFn, maxConnections int64) (*Connect
 		mapper:         mapper,
 		maxConnections: maxConnections,
 		connections:    make(map[string]int64),
+		dryRun:         o.DryRun,
 	}, nil
 }
 
@@ -45,16 +61,24 @@ func (cl *ConnectionLimiter) ProcessRequest(r request.Request) (*http.Response,
 	defer cl.mutex.Unlock()
 
 	token, amount, err := cl.mapper(r)
+	if err != nil && cl.dryRun {
+		// Failures to map the request are not the limit decisions, so they are counted apart
+		cl.dryRunErrors += 1
+		log.Errorf("Connection limiter has failed to map request %d: %s", r.GetId(), err)
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	connections := cl.connections[token]
-	if connections >= cl.maxConnections {
-		return netutils.NewTextResponse(
-			r.GetHttpRequest(),
-			errors.StatusTooManyRequests,
-			fmt.Sprintf("Connection limit reached. Max is: %d, yours: %d", cl.maxConnections, connections)), nil
+	if connections >= cl.maxConnections && cl.dryRun {
+		cl.dryRunRejections += 1
+		log.Infof("Request %d would have been rejected by the connection limiter, connections of '%s': %d", r.GetId(), token, connections)
+	} else if connections >= cl.maxConnections {
+		return nil, &errors.LimitError{
+			Body: fmt.Sprintf("Connection limit reached. Max is: %d, yours: %d", cl.maxConnections, connections),
+		}
 	}
 
 	cl.connections[token] += amount
@@ -92,3 +116,17 @@ func (cl *ConnectionLimiter) GetMaxConnections() int64 {
 func (cl *ConnectionLimiter) SetMaxConnections(max int64) {
 	cl.maxConnections = max
 }
+
+// GetDryRunRejections returns the number of requests that would have been rejected in the dry run mode
+func (cl *ConnectionLimiter) GetDryRunRejections() int64 {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.dryRunRejections
+}
+
+// GetDryRunErrors returns the number of requests the limiter has failed to map in the dry run mode
+func (cl *ConnectionLimiter) GetDryRunErrors() int64 {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.dryRunErrors
+}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
 	"github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
 )
@@ -31,8 +33,8 @@ func (s *ConnLimiterSuite) TestHitLimitAndRelease(c *C) {
 
 	// Next request from the same ip hits rate limit, because the active connections > 1
 	re, err = l.ProcessRequest(r)
-	c.Assert(re, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 
 	// Once the first request finished, next one succeeds
 	l.ProcessResponse(r, nil)
@@ -55,8 +57,8 @@ func (s *ConnLimiterSuite) TestDifferentIps(c *C) {
 	c.Assert(err, IsNil)
 
 	re, err = l.ProcessRequest(r)
-	c.Assert(re, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 
 	re, err = l.ProcessRequest(r2)
 	c.Assert(re, IsNil)
@@ -77,8 +79,8 @@ func (s *ConnLimiterSuite) TestConnectionCount(c *C) {
 	c.Assert(l.GetConnectionCount(), Equals, int64(1))
 
 	re, err = l.ProcessRequest(r)
-	c.Assert(re, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 	c.Assert(l.GetConnectionCount(), Equals, int64(1))
 
 	re, err = l.ProcessRequest(r2)
@@ -102,6 +104,33 @@ func (s *ConnLimiterSuite) TestFailure(c *C) {
 	c.Assert(re, IsNil)
 }
 
+// Dry run lets all requests through and counts the ones that would have been rejected
+func (s *ConnLimiterSuite) TestDryRun(c *C) {
+	l, err := NewConnectionLimiterWithOptions(limit.MapClientIp, 1, Options{DryRun: true})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4")
+	for i := 0; i < 3; i++ {
+		re, err := l.ProcessRequest(r)
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(l.GetConnectionCount(), Equals, int64(3))
+	c.Assert(l.GetDryRunRejections(), Equals, int64(2))
+
+	// Mapper failures are counted apart from the limit decisions
+	re, err := l.ProcessRequest(makeRequest(""))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+	c.Assert(l.GetDryRunRejections(), Equals, int64(2))
+	c.Assert(l.GetDryRunErrors(), Equals, int64(1))
+
+	for i := 0; i < 3; i++ {
+		l.ProcessResponse(r, nil)
+	}
+	c.Assert(l.GetConnectionCount(), Equals, int64(0))
+}
+
 func (s *ConnLimiterSuite) TestWrongParams(c *C) {
 	_, err := NewConnectionLimiter(nil, 1)
 	c.Assert(err, NotNil)
@@ -4,15 +4,18 @@ package limit
 import (
 	"fmt"
 	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
+	"net"
+	"strconv"
 	"strings"
 )
 
 // Limiter is an interface for request limiters (e.g. rate/connection) limiters
 type Limiter interface {
-	// In case if limiter wants to reject request, it should return http response
-	// will be proxied to the client.
-	// In case if limiter returns an error, it will be treated as a request error and will
+	// In case if limiter wants to reject request, it should return errors.ProxyError, e.g. errors.LimitError,
+	// that will be formatted by the proxy and replied to the client, or http response that will be proxied to the client.
+	// In case if limiter returns any other error, it will be treated as a request error and will
 	// potentially activate failure recovery and failover algorithms.
 	// In case if lmimiter wants to delay request, it should return duration > 0
 	// Otherwise limiter should return (0, nil) to allow request to proceed
@@ -37,6 +40,11 @@ func MapClientIp(req request.Request) (string, int64, error) {
 	return t, 1, err
 }
 
+// MapGlobal maps all requests to the same token, so the limit applies to all clients together
+func MapGlobal(req request.Request) (string, int64, error) {
+	return "global", 1, nil
+}
+
 func MapRequestHost(req request.Request) (string, int64, error) {
 	t, err := RequestToHost(req)
 	return t, 1, err
@@ -47,11 +55,21 @@ func MakeMapRequestHeader(header string) MapperFn {
 }
 
 func VariableToMapper(variable string) (MapperFn, error) {
-	tokenMapper, err := MakeTokenMapperFromVariable(variable)
+	return VariablesToMapper(variable, "request.count")
+}
+
+// VariablesToMapper constructs the mapper out of the token variable, e.g. "client.ip", and the amount variable,
+// e.g. "request.bytes"
+func VariablesToMapper(tokenVariable, amountVariable string) (MapperFn, error) {
+	tokenMapper, err := MakeTokenMapperFromVariable(tokenVariable)
+	if err != nil {
+		return nil, err
+	}
+	amountMapper, err := MakeAmountMapperFromVariable(amountVariable)
 	if err != nil {
 		return nil, err
 	}
-	return MakeMapper(tokenMapper, RequestToCount), nil
+	return MakeMapper(tokenMapper, amountMapper), nil
 }
 
 // Make mapper constructs the mapper function out of two functions - token mapper and amount mapper
@@ -71,6 +89,14 @@ func MakeMapper(t TokenMapperFn, a AmountMapperFn) MapperFn {
 
 // RequestToClientIp is a TokenMapper that maps the request to the client IP.
 func RequestToClientIp(req request.Request) (string, error) {
+	// Client IP resolved by the proxy from the forwarding headers sent by trusted proxies
+	if ip, ok := netutils.GetClientIp(req.GetHttpRequest()); ok {
+		return ip.String(), nil
+	}
+	// Remote address can be IPv6 address, e.g. [::1]:8080, when client address comes from PROXY protocol header
+	if host, _, err := net.SplitHostPort(req.GetHttpRequest().RemoteAddr); err == nil && host != "" {
+		return host, nil
+	}
 	vals := strings.SplitN(req.GetHttpRequest().RemoteAddr, ":", 2)
 	if len(vals[0]) == 0 {
 		return "", fmt.Errorf("Failed to parse client IP")
@@ -100,20 +126,153 @@ func MakeRequestToHeader(header string) TokenMapperFn {
 	}
 }
 
-// Converts varaiable string to a mapper function used in limiters
+// Converts varaiable string to a mapper function used in limiters. Supported variables are:
+//
+//	client.ip                   - client IP
+//	client.ip/24                - network of the client IP, so the clients of the network share the token.
+//	                              IPv6 networks are /64 unless the prefix is given too, e.g. client.ip/24/56
+//	request.host                - host of the request
+//	request.path                - path of the request
+//	request.header.<name>       - value of the header
+//	request.cookie.<name>       - value of the cookie
+//	request.query.<name>        - value of the query parameter
+//	request.basicauth.user      - user name of the basic auth
+//
+// Variables are combined with '+' into composite tokens, e.g. client.ip+request.header.X-Tenant. Every part of
+// the composite token is prefixed with its length, e.g. "8:10.1.2.3+2:t1", so values containing '+' never clash.
+//
+// Requests missing the header, the cookie, the query parameter or the basic auth map to the empty value,
+// so all of them share one token.
 func MakeTokenMapperFromVariable(variable string) (TokenMapperFn, error) {
-	if variable == "client.ip" {
-		return RequestToClientIp, nil
+	if !strings.Contains(variable, "+") {
+		return makeTokenMapper(variable)
+	}
+	var mappers []TokenMapperFn
+	for _, v := range strings.Split(variable, "+") {
+		m, err := makeTokenMapper(v)
+		if err != nil {
+			return nil, err
+		}
+		mappers = append(mappers, m)
 	}
-	if variable == "request.host" {
+	return func(req request.Request) (string, error) {
+		tokens := make([]string, len(mappers))
+		for i, m := range mappers {
+			t, err := m(req)
+			if err != nil {
+				return "", err
+			}
+			tokens[i] = fmt.Sprintf("%d:%s", len(t), t)
+		}
+		return strings.Join(tokens, "+"), nil
+	}, nil
+}
+
+// MakeAmountMapperFromVariable converts variable string to the amount mapper. Supported variables are:
+//
+//	request.count - every request is one token
+//	request.bytes - request body size in bytes
+func MakeAmountMapperFromVariable(variable string) (AmountMapperFn, error) {
+	switch variable {
+	case "request.count":
+		return RequestToCount, nil
+	case "request.bytes":
+		return RequestToBytes, nil
+	}
+	return nil, fmt.Errorf("Unsupported amount variable: '%s'", variable)
+}
+
+func makeTokenMapper(variable string) (TokenMapperFn, error) {
+	switch variable {
+	case "client.ip":
+		return RequestToClientIp, nil
+	case "request.host":
 		return RequestToHost, nil
+	case "request.path":
+		return RequestToPath, nil
+	case "request.basicauth.user":
+		return RequestToBasicAuthUser, nil
+	}
+	if strings.HasPrefix(variable, "client.ip/") {
+		return makeRequestToClientNetwork(strings.TrimPrefix(variable, "client.ip/"))
 	}
-	if strings.HasPrefix(variable, "request.header.") {
-		header := strings.TrimPrefix(variable, "request.header.")
-		if len(header) == 0 {
-			return nil, fmt.Errorf("Wrong header: %s", header)
+	prefixes := map[string]func(string) TokenMapperFn{
+		"request.header.": MakeRequestToHeader,
+		"request.cookie.": MakeRequestToCookie,
+		"request.query.":  MakeRequestToQuery,
+	}
+	for prefix, fn := range prefixes {
+		if strings.HasPrefix(variable, prefix) {
+			name := strings.TrimPrefix(variable, prefix)
+			if len(name) == 0 {
+				return nil, fmt.Errorf("Wrong variable: '%s'", variable)
+			}
+			return fn(name), nil
 		}
-		return MakeRequestToHeader(header), nil
 	}
 	return nil, fmt.Errorf("Unsupported limiting variable: '%s'", variable)
 }
+
+// RequestToPath maps request to its path
+func RequestToPath(req request.Request) (string, error) {
+	return req.GetHttpRequest().URL.Path, nil
+}
+
+// RequestToBasicAuthUser maps request to the user name of the basic auth, empty if the request has no valid basic auth
+func RequestToBasicAuthUser(req request.Request) (string, error) {
+	auth, err := netutils.ParseAuthHeader(req.GetHttpRequest().Header.Get("Authorization"))
+	if err != nil {
+		return "", nil
+	}
+	return auth.Username, nil
+}
+
+// MakeRequestToCookie creates a TokenMapper that maps the request to the cookie value, empty if there is no cookie.
+func MakeRequestToCookie(name string) TokenMapperFn {
+	return func(req request.Request) (string, error) {
+		cookie, err := req.GetHttpRequest().Cookie(name)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	}
+}
+
+// MakeRequestToQuery creates a TokenMapper that maps the request to the query parameter value, empty if there is no parameter.
+func MakeRequestToQuery(name string) TokenMapperFn {
+	return func(req request.Request) (string, error) {
+		return req.GetHttpRequest().URL.Query().Get(name), nil
+	}
+}
+
+// makeRequestToClientNetwork parses the prefix lengths, e.g. "24" or "24/56", and creates a TokenMapper that maps
+// the request to the network of the client IP
+func makeRequestToClientNetwork(prefix string) (TokenMapperFn, error) {
+	vals := strings.SplitN(prefix, "/", 2)
+	v4, err := strconv.Atoi(vals[0])
+	if err != nil || v4 < 0 || v4 > 32 {
+		return nil, fmt.Errorf("Wrong IPv4 prefix length: '%s'", vals[0])
+	}
+	v6 := 64
+	if len(vals) == 2 {
+		if v6, err = strconv.Atoi(vals[1]); err != nil || v6 < 0 || v6 > 128 {
+			return nil, fmt.Errorf("Wrong IPv6 prefix length: '%s'", vals[1])
+		}
+	}
+	return func(req request.Request) (string, error) {
+		token, err := RequestToClientIp(req)
+		if err != nil {
+			return "", err
+		}
+		ip := net.ParseIP(token)
+		if ip == nil {
+			return "", fmt.Errorf("Failed to parse client IP: '%s'", token)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			n := net.IPNet{IP: ip4.Mask(net.CIDRMask(v4, 32)), Mask: net.CIDRMask(v4, 32)}
+			return n.String(), nil
+		}
+		n := net.IPNet{IP: ip.Mask(net.CIDRMask(v6, 128)), Mask: net.CIDRMask(v6, 128)}
+		return n.String(), nil
+	}, nil
+}
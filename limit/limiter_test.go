@@ -1,7 +1,11 @@
 package limit
 
 import (
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
+	"net"
+	"net/http"
 	"testing"
 )
 
@@ -29,3 +33,104 @@ func (s *LimitSuite) TestVariableToMapper(c *C) {
 	c.Assert(err, NotNil)
 	c.Assert(m, IsNil)
 }
+
+func (s *LimitSuite) TestRequestToClientIp(c *C) {
+	cases := map[string]string{
+		"127.0.0.1:8080": "127.0.0.1",
+		"[::1]:8080":     "::1",
+		"10.0.0.1":       "10.0.0.1",
+	}
+	for remoteAddr, expected := range cases {
+		ip, err := RequestToClientIp(&request.BaseRequest{HttpRequest: &http.Request{RemoteAddr: remoteAddr}})
+		c.Assert(err, IsNil)
+		c.Assert(ip, Equals, expected)
+	}
+	_, err := RequestToClientIp(&request.BaseRequest{HttpRequest: &http.Request{}})
+	c.Assert(err, NotNil)
+
+	// Client IP resolved by the proxy takes precedence
+	r := netutils.SetClientIp(&http.Request{RemoteAddr: "10.0.0.1:8080"}, net.ParseIP("1.2.3.4"))
+	ip, err := RequestToClientIp(&request.BaseRequest{HttpRequest: r})
+	c.Assert(err, IsNil)
+	c.Assert(ip, Equals, "1.2.3.4")
+}
+
+func (s *LimitSuite) TestTokenVariables(c *C) {
+	r, _ := http.NewRequest("GET", "http://example.com/v1/messages?key=k1", nil)
+	r.RemoteAddr = "10.1.2.3:8080"
+	r.Header.Set("X-Tenant", "t1")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	r.Header.Set("Authorization", (&netutils.BasicAuth{Username: "alice", Password: "secret"}).String())
+	req := request.NewBaseRequest(r, 1, nil)
+
+	cases := map[string]string{
+		"client.ip":                                     "10.1.2.3",
+		"client.ip/24":                                  "10.1.2.0/24",
+		"client.ip/8/56":                                "10.0.0.0/8",
+		"request.host":                                  "example.com",
+		"request.path":                                  "/v1/messages",
+		"request.header.X-Tenant":                       "t1",
+		"request.cookie.session":                        "s1",
+		"request.cookie.missing":                        "",
+		"request.query.key":                             "k1",
+		"request.basicauth.user":                        "alice",
+		"client.ip+request.header.X-Tenant":             "8:10.1.2.3+2:t1",
+		"request.basicauth.user+client.ip/16":           "5:alice+11:10.1.0.0/16",
+		"request.header.X-Tenant+request.query.missing": "2:t1+0:",
+	}
+	for variable, expected := range cases {
+		m, err := MakeTokenMapperFromVariable(variable)
+		c.Assert(err, IsNil, Commentf("%s", variable))
+		token, err := m(req)
+		c.Assert(err, IsNil)
+		c.Assert(token, Equals, expected, Commentf("%s", variable))
+	}
+
+	// Parts are delimited by their lengths, so the values containing '+' do not clash
+	m, err := MakeTokenMapperFromVariable("request.header.X-A+request.header.X-B")
+	c.Assert(err, IsNil)
+	r.Header.Set("X-A", "a+b")
+	r.Header.Set("X-B", "c")
+	t1, err := m(req)
+	c.Assert(err, IsNil)
+	r.Header.Set("X-A", "a")
+	r.Header.Set("X-B", "b+c")
+	t2, err := m(req)
+	c.Assert(err, IsNil)
+	c.Assert(t1, Not(Equals), t2)
+
+	for _, variable := range []string{"client.ip/33", "client.ip/24/129", "client.ip/x", "request.cookie.", "request.query.", "client.ip+", "request.user"} {
+		_, err := MakeTokenMapperFromVariable(variable)
+		c.Assert(err, NotNil, Commentf("%s", variable))
+	}
+}
+
+func (s *LimitSuite) TestClientNetworkIpv6(c *C) {
+	req := request.NewBaseRequest(&http.Request{RemoteAddr: "[2001:db8:1:2:3::1]:8080"}, 1, nil)
+	m, err := MakeTokenMapperFromVariable("client.ip/24")
+	c.Assert(err, IsNil)
+	token, err := m(req)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "2001:db8:1:2::/64")
+
+	m, err = MakeTokenMapperFromVariable("client.ip/24/48")
+	c.Assert(err, IsNil)
+	token, err = m(req)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "2001:db8:1::/48")
+}
+
+func (s *LimitSuite) TestAmountVariables(c *C) {
+	m, err := VariablesToMapper("client.ip", "request.count")
+	c.Assert(err, IsNil)
+	token, amount, err := m(request.NewBaseRequest(&http.Request{RemoteAddr: "1.2.3.4:80"}, 1, nil))
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "1.2.3.4")
+	c.Assert(amount, Equals, int64(1))
+
+	_, err = MakeAmountMapperFromVariable("request.bytes")
+	c.Assert(err, IsNil)
+
+	_, err = VariablesToMapper("client.ip", "request.size")
+	c.Assert(err, NotNil)
+}
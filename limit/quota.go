@@ -0,0 +1,94 @@
+package limit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Rate limit headers, see https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+const (
+	RateLimitLimit     = "RateLimit-Limit"
+	RateLimitRemaining = "RateLimit-Remaining"
+	RateLimitReset     = "RateLimit-Reset"
+	// Legacy variants, X-RateLimit-Reset is the Unix time in seconds when the quota resets
+	XRateLimitLimit     = "X-RateLimit-Limit"
+	XRateLimitRemaining = "X-RateLimit-Remaining"
+	XRateLimitReset     = "X-RateLimit-Reset"
+	RetryAfter          = "Retry-After"
+)
+
+// Quota describes the limit of the client at the moment, it's sent to the client in the rate limit headers
+type Quota struct {
+	// Number of requests (or other tokens) the client is allowed to make in a burst
+	Limit int64
+	// Number of tokens left
+	Remaining int64
+	// Time until the quota is fully restored
+	Reset time.Duration
+}
+
+// SetHeaders sets both the standard and the legacy rate limit headers
+func (q Quota) SetHeaders(h http.Header, now time.Time) {
+	remaining := q.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	h.Set(RateLimitLimit, strconv.FormatInt(q.Limit, 10))
+	h.Set(RateLimitRemaining, strconv.FormatInt(remaining, 10))
+	h.Set(RateLimitReset, strconv.FormatInt(seconds(q.Reset), 10))
+	h.Set(XRateLimitLimit, strconv.FormatInt(q.Limit, 10))
+	h.Set(XRateLimitRemaining, strconv.FormatInt(remaining, 10))
+	h.Set(XRateLimitReset, strconv.FormatInt(now.Unix()+seconds(q.Reset), 10))
+}
+
+// QuotaHeaders is kept in the request until the response and sets the rate limit headers of the response, e.g. Quota
+type QuotaHeaders interface {
+	SetHeaders(h http.Header, now time.Time)
+}
+
+// QuotaKey returns the key of the request user data keeping the quota of the limiter until the response.
+// Several limiters can process the same request, so every limiter instance gets its own key.
+func QuotaKey(limiter interface{}) string {
+	return fmt.Sprintf("limit.quota.%p", limiter)
+}
+
+// StoreQuota keeps the quota in the request until the response
+func StoreQuota(r request.Request, key string, q QuotaHeaders) {
+	r.SetUserData(key, q)
+}
+
+// ApplyQuota sets the headers of the quota kept in the request on the response of the attempt and forgets the quota
+func ApplyQuota(r request.Request, a request.Attempt, key string, now time.Time) {
+	q, ok := r.GetUserData(key)
+	if !ok {
+		return
+	}
+	r.DeleteUserData(key)
+	if re := a.GetResponse(); re != nil {
+		q.(QuotaHeaders).SetHeaders(re.Header, now)
+	}
+}
+
+// NewLimitError creates the rejection carrying the quota headers and Retry-After header telling
+// the client when to retry the request. Retry-After is omitted if retryAfter is 0.
+func NewLimitError(body string, q Quota, retryAfter time.Duration, now time.Time) *errors.LimitError {
+	h := make(http.Header)
+	q.SetHeaders(h, now)
+	if retryAfter > 0 {
+		h.Set(RetryAfter, strconv.FormatInt(seconds(retryAfter), 10))
+	}
+	return &errors.LimitError{Body: body, Header: h}
+}
+
+// seconds rounds the duration up to whole seconds, so clients never retry too early
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,67 @@
+package quota
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+)
+
+// AdminHandler is an admin API inspecting and resetting the usage of the limiter:
+//
+//	GET    /quotas       - lists the keys that have used the quotas in the current windows
+//	GET    /quotas/<key> - returns the usage of the key in the current windows
+//	DELETE /quotas/<key> - resets the usage of the key
+type AdminHandler struct {
+	limiter *Limiter
+}
+
+type usageReply struct {
+	Period    Period    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+func NewAdminHandler(l *Limiter) *AdminHandler {
+	return &AdminHandler{
+		limiter: l,
+	}
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	key := strings.TrimPrefix(path, "/quotas/")
+	switch {
+	case path == "/quotas" && r.Method == "GET":
+		netutils.ReplyJson(w, map[string]interface{}{"keys": h.limiter.GetKeys()})
+	case strings.HasPrefix(path, "/quotas/") && r.Method == "GET":
+		netutils.ReplyJson(w, map[string]interface{}{"key": key, "usage": h.getUsage(key)})
+	case strings.HasPrefix(path, "/quotas/") && r.Method == "DELETE":
+		h.limiter.ResetUsage(key)
+		log.Infof("Reset quota usage of '%s'", key)
+		netutils.ReplyJson(w, map[string]interface{}{"key": key})
+	default:
+		netutils.ReplyError(w, errors.FromStatus(http.StatusNotFound))
+	}
+}
+
+func (h *AdminHandler) getUsage(key string) []usageReply {
+	usage := h.limiter.GetUsage(key)
+	out := make([]usageReply, len(usage))
+	for i, u := range usage {
+		limit := h.limiter.GetLimit(u.Period)
+		out[i] = usageReply{
+			Period:    u.Period,
+			Limit:     limit,
+			Used:      u.Used,
+			Remaining: limit - u.Used,
+			Reset:     u.Period.end(u.Start),
+		}
+	}
+	return out
+}
@@ -0,0 +1,353 @@
+package quota
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+)
+
+const (
+	DefaultSavePeriod    = 10 * time.Second
+	DefaultWarningHeader = "X-Quota-Warning"
+)
+
+type Options struct {
+	// Timezone of the calendar windows, UTC is used if it's nil
+	Location *time.Location
+	// Store persisting the usage, the usage is kept in memory only if it's nil
+	Store Store
+	// How often the usage is saved to the store, DefaultSavePeriod is used if it's 0
+	SavePeriod time.Duration
+	// Share of the limit, e.g. 0.8, after which the responses carry the warning header, no warnings are sent if it's 0
+	SoftLimit float64
+	// Header carrying the warning, DefaultWarningHeader is used if it's empty
+	WarningHeader string
+	// Interface that gives current time (so tests can override)
+	Clock timetools.TimeProvider
+}
+
+// Limiter rejects the requests of the keys that have used up any of their quotas in the current windows.
+// Usage is saved to the store periodically and when the limiter is closed, and is loaded back on start.
+type Limiter struct {
+	quotas  *QuotaSet
+	periods []Period
+	mapper  limit.MapperFn
+	options Options
+	mutex   *sync.Mutex
+	// Windows of the keys, one per period in the same order as periods
+	usage map[string][]window
+	// Usage has changed since the last save
+	dirty bool
+	// Keys without usage are forgotten once the shortest window ends
+	nextPrune time.Time
+	stop      chan struct{}
+	done      chan struct{}
+	once      *sync.Once
+	// Key of the request user data keeping the quota until the response
+	stateKey string
+}
+
+// window is the usage of the key within the calendar window
+type window struct {
+	start time.Time
+	used  int64
+}
+
+// state of the quotas passed from the request to the response
+type state struct {
+	quota    limit.Quota
+	warnings []string
+	header   string
+}
+
+// SetHeaders sets the rate limit headers and the warnings
+func (s *state) SetHeaders(h http.Header, now time.Time) {
+	s.quota.SetHeaders(h, now)
+	for _, w := range s.warnings {
+		h.Add(s.header, w)
+	}
+}
+
+// NewLimiter constructs a `Limiter` middleware instance keeping the usage in memory.
+func NewLimiter(quotas *QuotaSet, mapper limit.MapperFn) (*Limiter, error) {
+	return NewLimiterWithOptions(quotas, mapper, Options{})
+}
+
+// NewLimiterWithOptions constructs a `Limiter` middleware instance and loads the usage saved in the store.
+func NewLimiterWithOptions(quotas *QuotaSet, mapper limit.MapperFn, o Options) (*Limiter, error) {
+	if quotas == nil || len(quotas.m) == 0 {
+		return nil, fmt.Errorf("Provide quotas")
+	}
+	if mapper == nil {
+		return nil, fmt.Errorf("Provide mapper function")
+	}
+	o, err := setDefaults(o)
+	if err != nil {
+		return nil, err
+	}
+	l := &Limiter{
+		quotas:  quotas,
+		periods: quotas.periods(),
+		mapper:  mapper,
+		options: o,
+		mutex:   &sync.Mutex{},
+		usage:   make(map[string][]window),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		once:    &sync.Once{},
+	}
+	l.stateKey = limit.QuotaKey(l)
+
+	if o.Store != nil {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+		go l.loop()
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+func (l *Limiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	token, amount, err := l.mapper(r)
+	if err != nil {
+		return nil, err
+	}
+	s, err := l.consume(token, amount)
+	if err != nil {
+		return nil, err
+	}
+	limit.StoreQuota(r, l.stateKey, s)
+	return nil, nil
+}
+
+// ProcessResponse lets the client know its quota in the rate limit headers and warns it once the soft limit is exceeded
+func (l *Limiter) ProcessResponse(r request.Request, a request.Attempt) {
+	limit.ApplyQuota(r, a, l.stateKey, l.options.Clock.UtcNow())
+}
+
+// GetUsage returns the usage of the key in the current windows
+func (l *Limiter) GetUsage(key string) []Usage {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	windows := l.usage[key]
+	usage := make([]Usage, len(l.periods))
+	for i, p := range l.periods {
+		usage[i] = Usage{Key: key, Period: p, Start: p.start(now)}
+		if windows != nil && windows[i].start.Equal(usage[i].Start) {
+			usage[i].Used = windows[i].used
+		}
+	}
+	return usage
+}
+
+// GetKeys returns the keys that have used the quotas in the current windows
+func (l *Limiter) GetKeys() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	keys := []string{}
+	for _, u := range l.collect(l.now()) {
+		if len(keys) == 0 || keys[len(keys)-1] != u.Key {
+			keys = append(keys, u.Key)
+		}
+	}
+	return keys
+}
+
+// ResetUsage forgets the usage of the key in the current windows
+func (l *Limiter) ResetUsage(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.usage, key)
+	l.dirty = true
+}
+
+// GetLimit returns the limit of the quota of the period, 0 if there is no such quota
+func (l *Limiter) GetLimit(period Period) int64 {
+	return l.quotas.m[period]
+}
+
+// Close stops the background saving and saves the usage
+func (l *Limiter) Close() error {
+	l.once.Do(func() {
+		close(l.stop)
+	})
+	<-l.done
+	return nil
+}
+
+func (l *Limiter) consume(token string, amount int64) (*state, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if !now.Before(l.nextPrune) {
+		l.prune(now)
+	}
+	windows := l.windows(token, now)
+	for i, p := range l.periods {
+		max := l.quotas.m[p]
+		if amount > max {
+			return nil, fmt.Errorf("Requested tokens larger than the %s quota", p)
+		}
+		if windows[i].used+amount > max {
+			reset := p.end(windows[i].start).Sub(now)
+			q := limit.Quota{Limit: max, Remaining: max - windows[i].used, Reset: reset}
+			return nil, limit.NewLimitError(fmt.Sprintf("The %s quota is exceeded", p), q, reset, now)
+		}
+	}
+
+	s := &state{header: l.options.WarningHeader}
+	for i, p := range l.periods {
+		max := l.quotas.m[p]
+		windows[i].used += amount
+		q := limit.Quota{Limit: max, Remaining: max - windows[i].used, Reset: p.end(windows[i].start).Sub(now)}
+		if i == 0 || q.Remaining < s.quota.Remaining {
+			s.quota = q
+		}
+		if l.options.SoftLimit > 0 && float64(windows[i].used) >= l.options.SoftLimit*float64(max) {
+			s.warnings = append(s.warnings, fmt.Sprintf("%s; used=%d; limit=%d", p, windows[i].used, max))
+		}
+	}
+	l.dirty = true
+	return s, nil
+}
+
+// windows returns the windows of the key, the usage of the windows that have ended is dropped
+func (l *Limiter) windows(key string, now time.Time) []window {
+	windows, ok := l.usage[key]
+	if !ok {
+		windows = make([]window, len(l.periods))
+		l.usage[key] = windows
+	}
+	for i, p := range l.periods {
+		if start := p.start(now); !windows[i].start.Equal(start) {
+			windows[i] = window{start: start}
+		}
+	}
+	return windows
+}
+
+// collect returns the usage in the current windows sorted by key and forgets the keys that have no usage
+func (l *Limiter) collect(now time.Time) []Usage {
+	l.prune(now)
+	usage := []Usage{}
+	for key, windows := range l.usage {
+		for i, p := range l.periods {
+			if windows[i].used != 0 && windows[i].start.Equal(p.start(now)) {
+				usage = append(usage, Usage{Key: key, Period: p, Start: windows[i].start, Used: windows[i].used})
+			}
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Key < usage[j].Key })
+	return usage
+}
+
+// prune forgets the keys that have no usage in the current windows, so the keys seen once do not pile up
+func (l *Limiter) prune(now time.Time) {
+	for key, windows := range l.usage {
+		active := false
+		for i, p := range l.periods {
+			if windows[i].used != 0 && windows[i].start.Equal(p.start(now)) {
+				active = true
+				break
+			}
+		}
+		if !active {
+			delete(l.usage, key)
+		}
+	}
+	l.nextPrune = time.Time{}
+	for _, p := range l.periods {
+		if end := p.end(p.start(now)); l.nextPrune.IsZero() || end.Before(l.nextPrune) {
+			l.nextPrune = end
+		}
+	}
+}
+
+func (l *Limiter) load() error {
+	saved, err := l.options.Store.Load()
+	if err != nil {
+		return err
+	}
+	now := l.now()
+	for _, u := range saved {
+		for i, p := range l.periods {
+			start := p.start(now)
+			// Usage of the windows that have ended while the limiter was down is dropped
+			if u.Period == p && u.Start.Equal(start) {
+				l.windows(u.Key, now)[i].used = u.Used
+			}
+		}
+	}
+	return nil
+}
+
+// save saves the usage to the store if it has changed
+func (l *Limiter) save() {
+	l.mutex.Lock()
+	if !l.dirty {
+		l.mutex.Unlock()
+		return
+	}
+	usage := l.collect(l.now())
+	l.dirty = false
+	l.mutex.Unlock()
+
+	if err := l.options.Store.Save(usage); err != nil {
+		log.Errorf("Failed to save quota usage: %s", err)
+		l.mutex.Lock()
+		l.dirty = true
+		l.mutex.Unlock()
+	}
+}
+
+func (l *Limiter) loop() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.options.SavePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.save()
+		case <-l.stop:
+			l.save()
+			return
+		}
+	}
+}
+
+func (l *Limiter) now() time.Time {
+	return l.options.Clock.UtcNow().In(l.options.Location)
+}
+
+func setDefaults(o Options) (Options, error) {
+	if o.SoftLimit < 0 || o.SoftLimit > 1 {
+		return o, fmt.Errorf("Soft limit should be within [0, 1], got %v", o.SoftLimit)
+	}
+	if o.Location == nil {
+		o.Location = time.UTC
+	}
+	if o.SavePeriod <= 0 {
+		o.SavePeriod = DefaultSavePeriod
+	}
+	if o.WarningHeader == "" {
+		o.WarningHeader = DefaultWarningHeader
+	}
+	if o.Clock == nil {
+		o.Clock = &timetools.RealTime{}
+	}
+	return o, nil
+}
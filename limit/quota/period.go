@@ -0,0 +1,87 @@
+// Long period request quotas, e.g. 10000 requests per day per API key, counted within calendar windows
+// and persisted, so they survive restarts
+package quota
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Period of the calendar window, windows start at the beginning of the hour, day or month in the limiter's timezone
+type Period string
+
+const (
+	Hour  Period = "hour"
+	Day   Period = "day"
+	Month Period = "month"
+)
+
+// ParsePeriod parses the period name, e.g. "day"
+func ParsePeriod(s string) (Period, error) {
+	switch p := Period(s); p {
+	case Hour, Day, Month:
+		return p, nil
+	}
+	return "", fmt.Errorf("Unsupported quota period: '%s'", s)
+}
+
+// start returns the beginning of the window containing the moment
+func (p Period) start(t time.Time) time.Time {
+	switch p {
+	case Hour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case Day:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// end returns the beginning of the window following the one that starts at the moment
+func (p Period) end(start time.Time) time.Time {
+	switch p {
+	case Hour:
+		return start.Add(time.Hour)
+	case Day:
+		return start.AddDate(0, 0, 1)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// QuotaSet maintains a set of quotas. It can contain only one quota per period at a time.
+type QuotaSet struct {
+	m map[Period]int64
+}
+
+// NewQuotaSet creates an empty `QuotaSet` instance.
+func NewQuotaSet() *QuotaSet {
+	return &QuotaSet{m: make(map[Period]int64)}
+}
+
+// Add adds a quota to the set. If there is a quota with the same period in the
+// set then the new quota overrides the old one.
+func (qs *QuotaSet) Add(period Period, limit int64) error {
+	if _, err := ParsePeriod(string(period)); err != nil {
+		return err
+	}
+	if limit <= 0 {
+		return fmt.Errorf("Invalid limit: %v", limit)
+	}
+	qs.m[period] = limit
+	return nil
+}
+
+func (qs *QuotaSet) String() string {
+	return fmt.Sprint(qs.m)
+}
+
+// periods returns the periods of the quotas, shortest first
+func (qs *QuotaSet) periods() []Period {
+	order := map[Period]int{Hour: 0, Day: 1, Month: 2}
+	out := make([]Period, 0, len(qs.m))
+	for p := range qs.m {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return order[out[i]] < order[out[j]] })
+	return out
+}
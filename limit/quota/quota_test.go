@@ -0,0 +1,282 @@
+package quota
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestQuota(t *testing.T) { TestingT(t) }
+
+type QuotaSuite struct {
+	clock *timetools.FreezedTime
+	est   *time.Location
+}
+
+var _ = Suite(&QuotaSuite{})
+
+func (s *QuotaSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	s.est = time.FixedZone("EST", -5*3600)
+}
+
+func (s *QuotaSuite) newLimiter(c *C, quotas *QuotaSet, o Options) *Limiter {
+	o.Clock = s.clock
+	if o.Location == nil {
+		o.Location = s.est
+	}
+	l, err := NewLimiterWithOptions(quotas, limit.MapClientIp, o)
+	c.Assert(err, IsNil)
+	return l
+}
+
+func (s *QuotaSuite) TestQuotaSet(c *C) {
+	qs := NewQuotaSet()
+	c.Assert(qs.Add("week", 1), NotNil)
+	c.Assert(qs.Add(Day, 0), NotNil)
+	c.Assert(qs.Add(Month, 10), IsNil)
+	c.Assert(qs.Add(Hour, 1), IsNil)
+	c.Assert(qs.periods(), DeepEquals, []Period{Hour, Month})
+
+	p, err := ParsePeriod("day")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, Day)
+	_, err = ParsePeriod("days")
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiter(NewQuotaSet(), limit.MapClientIp)
+	c.Assert(err, NotNil)
+	_, err = NewLimiter(qs, nil)
+	c.Assert(err, NotNil)
+	_, err = NewLimiterWithOptions(qs, limit.MapClientIp, Options{SoftLimit: 2})
+	c.Assert(err, NotNil)
+}
+
+func (s *QuotaSuite) TestPeriods(c *C) {
+	t := time.Date(2012, 2, 29, 13, 45, 0, 0, s.est)
+	c.Assert(Hour.start(t), Equals, time.Date(2012, 2, 29, 13, 0, 0, 0, s.est))
+	c.Assert(Hour.end(Hour.start(t)), Equals, time.Date(2012, 2, 29, 14, 0, 0, 0, s.est))
+	c.Assert(Day.start(t), Equals, time.Date(2012, 2, 29, 0, 0, 0, 0, s.est))
+	c.Assert(Day.end(Day.start(t)), Equals, time.Date(2012, 3, 1, 0, 0, 0, 0, s.est))
+	c.Assert(Month.start(t), Equals, time.Date(2012, 2, 1, 0, 0, 0, 0, s.est))
+	c.Assert(Month.end(Month.start(t)), Equals, time.Date(2012, 3, 1, 0, 0, 0, 0, s.est))
+}
+
+// Windows follow the calendar of the timezone
+func (s *QuotaSuite) TestDayWindow(c *C) {
+	quotas := NewQuotaSet()
+	quotas.Add(Day, 2)
+	l := s.newLimiter(c, quotas, Options{})
+
+	for i := 0; i < 2; i++ {
+		re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+
+	// It's 00:06:07 in New York, so the window resets in 23:53:53
+	_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	h := err.(*errors.LimitError).Headers()
+	c.Assert(h.Get("Retry-After"), Equals, "86033")
+	c.Assert(h.Get("RateLimit-Limit"), Equals, "2")
+	c.Assert(h.Get("RateLimit-Remaining"), Equals, "0")
+
+	// Other keys have their own quotas
+	_, err = l.ProcessRequest(makeRequest("1.2.3.5"))
+	c.Assert(err, IsNil)
+
+	s.clock.Sleep(86033 * time.Second)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+}
+
+// Keys are forgotten once their windows end, even if the usage is not saved
+func (s *QuotaSuite) TestPruneKeys(c *C) {
+	quotas := NewQuotaSet()
+	quotas.Add(Hour, 2)
+	l := s.newLimiter(c, quotas, Options{})
+
+	_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(len(l.usage), Equals, 1)
+
+	s.clock.Sleep(time.Hour)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.5"))
+	c.Assert(err, IsNil)
+	c.Assert(len(l.usage), Equals, 1)
+	c.Assert(l.GetUsage("1.2.3.5")[0].Used, Equals, int64(1))
+}
+
+func (s *QuotaSuite) TestMultipleQuotas(c *C) {
+	quotas := NewQuotaSet()
+	quotas.Add(Hour, 2)
+	quotas.Add(Month, 3)
+	l := s.newLimiter(c, quotas, Options{})
+
+	for i := 0; i < 2; i++ {
+		_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(err, IsNil)
+	}
+	_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	c.Assert(err.(*errors.LimitError).Headers().Get("Retry-After"), Equals, "3233")
+
+	s.clock.Sleep(time.Hour)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+
+	// Month quota is used up now
+	s.clock.Sleep(time.Hour)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	c.Assert(err.Error(), Equals, "The month quota is exceeded")
+
+	c.Assert(l.GetUsage("1.2.3.4"), DeepEquals, []Usage{
+		{Key: "1.2.3.4", Period: Hour, Start: time.Date(2012, 3, 4, 2, 0, 0, 0, s.est), Used: 0},
+		{Key: "1.2.3.4", Period: Month, Start: time.Date(2012, 3, 1, 0, 0, 0, 0, s.est), Used: 3},
+	})
+}
+
+// Allowed responses carry the quota and the warning once the soft limit is exceeded
+func (s *QuotaSuite) TestSoftLimit(c *C) {
+	quotas := NewQuotaSet()
+	quotas.Add(Day, 4)
+	l := s.newLimiter(c, quotas, Options{SoftLimit: 0.5})
+
+	for i, warning := range []string{"", "day; used=2; limit=4", "day; used=3; limit=4"} {
+		req := makeRequest("1.2.3.4")
+		_, err := l.ProcessRequest(req)
+		c.Assert(err, IsNil)
+
+		a := &request.BaseAttempt{Response: &http.Response{Header: make(http.Header)}}
+		l.ProcessResponse(req, a)
+		c.Assert(a.Response.Header.Get("X-Quota-Warning"), Equals, warning)
+		c.Assert(a.Response.Header.Get("RateLimit-Remaining"), Equals, []string{"3", "2", "1"}[i])
+		c.Assert(a.Response.Header.Get("RateLimit-Reset"), Equals, "86033")
+	}
+}
+
+// Usage survives restarts
+func (s *QuotaSuite) TestPersistence(c *C) {
+	store, err := NewFileStore(filepath.Join(c.MkDir(), "quotas.json"))
+	c.Assert(err, IsNil)
+	quotas := NewQuotaSet()
+	quotas.Add(Day, 3)
+
+	l := s.newLimiter(c, quotas, Options{Store: store})
+	for i := 0; i < 2; i++ {
+		_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(l.Close(), IsNil)
+	c.Assert(l.Close(), IsNil)
+
+	saved, err := store.Load()
+	c.Assert(err, IsNil)
+	c.Assert(len(saved), Equals, 1)
+	c.Assert(saved[0].Used, Equals, int64(2))
+
+	l = s.newLimiter(c, quotas, Options{Store: store})
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	c.Assert(l.Close(), IsNil)
+
+	// Windows that have ended while the limiter was down are dropped
+	s.clock.Sleep(24 * time.Hour)
+	l = s.newLimiter(c, quotas, Options{Store: store})
+	c.Assert(l.GetKeys(), DeepEquals, []string{})
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(l.Close(), IsNil)
+}
+
+func (s *QuotaSuite) TestFileStore(c *C) {
+	_, err := NewFileStore("")
+	c.Assert(err, NotNil)
+
+	path := filepath.Join(c.MkDir(), "quotas.json")
+	store, err := NewFileStore(path)
+	c.Assert(err, IsNil)
+
+	saved, err := store.Load()
+	c.Assert(err, IsNil)
+	c.Assert(saved, IsNil)
+
+	c.Assert(ioutil.WriteFile(path, []byte("{"), 0600), IsNil)
+	_, err = store.Load()
+	c.Assert(err, NotNil)
+
+	quotas := NewQuotaSet()
+	quotas.Add(Day, 3)
+	_, err = NewLimiterWithOptions(quotas, limit.MapClientIp, Options{Store: store})
+	c.Assert(err, NotNil)
+}
+
+func (s *QuotaSuite) TestAdmin(c *C) {
+	quotas := NewQuotaSet()
+	quotas.Add(Day, 3)
+	l := s.newLimiter(c, quotas, Options{})
+	_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+
+	admin := httptest.NewServer(NewAdminHandler(l))
+	defer admin.Close()
+
+	var keys struct {
+		Keys []string
+	}
+	c.Assert(getJson(admin.URL+"/quotas", &keys), Equals, http.StatusOK)
+	c.Assert(keys.Keys, DeepEquals, []string{"1.2.3.4"})
+
+	var usage struct {
+		Key   string
+		Usage []usageReply
+	}
+	c.Assert(getJson(admin.URL+"/quotas/1.2.3.4", &usage), Equals, http.StatusOK)
+	c.Assert(usage.Key, Equals, "1.2.3.4")
+	c.Assert(len(usage.Usage), Equals, 1)
+	c.Assert(usage.Usage[0].Period, Equals, Day)
+	c.Assert(usage.Usage[0].Used, Equals, int64(1))
+	c.Assert(usage.Usage[0].Remaining, Equals, int64(2))
+	c.Assert(usage.Usage[0].Reset.Equal(time.Date(2012, 3, 5, 0, 0, 0, 0, s.est)), Equals, true)
+
+	req, _ := http.NewRequest("DELETE", admin.URL+"/quotas/1.2.3.4", nil)
+	re, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(l.GetUsage("1.2.3.4")[0].Used, Equals, int64(0))
+	c.Assert(l.GetKeys(), DeepEquals, []string{})
+
+	c.Assert(getJson(admin.URL+"/other", &usage), Equals, http.StatusNotFound)
+}
+
+func getJson(url string, value interface{}) int {
+	re, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	defer re.Body.Close()
+	body, _ := ioutil.ReadAll(re.Body)
+	json.Unmarshal(body, value)
+	return re.StatusCode
+}
+
+func makeRequest(ip string) request.Request {
+	return request.NewBaseRequest(&http.Request{RemoteAddr: ip}, 1, nil)
+}
@@ -0,0 +1,79 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Usage is the number of tokens consumed by the key within the window of the period
+type Usage struct {
+	Key    string    `json:"key"`
+	Period Period    `json:"period"`
+	Start  time.Time `json:"start"`
+	Used   int64     `json:"used"`
+}
+
+// Store persists the usage, so the quotas survive restarts
+type Store interface {
+	// Load returns the usage saved the last time, nothing if it was never saved
+	Load() ([]Usage, error)
+	// Save replaces the saved usage
+	Save([]Usage) error
+}
+
+// FileStore keeps the usage in the local JSON file
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Provide file path")
+	}
+	return &FileStore{path: path}, nil
+}
+
+type fileContents struct {
+	Usage []Usage `json:"usage"`
+}
+
+func (s *FileStore) Load() ([]Usage, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var contents fileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("Bad quota file '%s': %s", s.path, err)
+	}
+	return contents.Usage, nil
+}
+
+// Save writes the usage to the temporary file and renames it, so the file is never left half written
+func (s *FileStore) Save(usage []Usage) error {
+	data, err := json.Marshal(fileContents{Usage: usage})
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
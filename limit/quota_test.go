@@ -0,0 +1,34 @@
+package limit
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func (s *LimitSuite) TestApplyQuota(c *C) {
+	now := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	r := request.NewBaseRequest(&http.Request{}, 1, nil)
+	a, b := new(int), new(int)
+	c.Assert(QuotaKey(a), Not(Equals), QuotaKey(b))
+
+	StoreQuota(r, QuotaKey(a), Quota{Limit: 10, Remaining: 3, Reset: 1500 * time.Millisecond})
+	attempt := &request.BaseAttempt{Response: &http.Response{Header: http.Header{}}}
+	ApplyQuota(r, attempt, QuotaKey(a), now)
+	h := attempt.Response.Header
+	c.Assert(h.Get(RateLimitLimit), Equals, "10")
+	c.Assert(h.Get(RateLimitRemaining), Equals, "3")
+	c.Assert(h.Get(RateLimitReset), Equals, "2")
+
+	// Quota is applied once
+	_, ok := r.GetUserData(QuotaKey(a))
+	c.Assert(ok, Equals, false)
+
+	// Attempts without response are skipped
+	StoreQuota(r, QuotaKey(b), Quota{Limit: 10})
+	ApplyQuota(r, &request.BaseAttempt{}, QuotaKey(b), now)
+	_, ok = r.GetUserData(QuotaKey(b))
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,107 @@
+package slidingwindow
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/request"
+)
+
+const (
+	benchTokens = 1024
+	benchLimit  = 100
+)
+
+// Every limiter allows 100 requests per minute
+var benchLimiters = map[string]func(clock timetools.TimeProvider) (limit.Limiter, error){
+	"TokenBucket": func(clock timetools.TimeProvider) (limit.Limiter, error) {
+		rates := tokenbucket.NewRateSet()
+		rates.Add(time.Minute, benchLimit, benchLimit)
+		return tokenbucket.NewLimiter(rates, benchTokens, limit.MapClientIp, nil, clock)
+	},
+	"Log": func(clock timetools.TimeProvider) (limit.Limiter, error) {
+		windows := NewWindowSet()
+		windows.Add(time.Minute, benchLimit)
+		return NewLogLimiterWithOptions(windows, limit.MapClientIp, Options{Capacity: benchTokens, Clock: clock})
+	},
+	"Counter": func(clock timetools.TimeProvider) (limit.Limiter, error) {
+		windows := NewWindowSet()
+		windows.Add(time.Minute, benchLimit)
+		return NewCounterLimiterWithOptions(windows, limit.MapClientIp, Options{Capacity: benchTokens, Clock: clock})
+	},
+}
+
+func BenchmarkTokenBucket(b *testing.B) { benchmarkLimiter(b, "TokenBucket") }
+
+func BenchmarkLog(b *testing.B) { benchmarkLimiter(b, "Log") }
+
+func BenchmarkCounter(b *testing.B) { benchmarkLimiter(b, "Counter") }
+
+func BenchmarkTokenBucketMemory(b *testing.B) { benchmarkMemory(b, "TokenBucket") }
+
+func BenchmarkLogMemory(b *testing.B) { benchmarkMemory(b, "Log") }
+
+func BenchmarkCounterMemory(b *testing.B) { benchmarkMemory(b, "Counter") }
+
+// benchmarkLimiter measures CPU cost of a request of one of the clients sending requests at the limit
+func benchmarkLimiter(b *testing.B, name string) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	l, err := benchLimiters[name](clock)
+	if err != nil {
+		b.Fatal(err)
+	}
+	requests := makeBenchRequests()
+	// Every client sends a request every 600ms on average
+	step := time.Minute / benchLimit / benchTokens
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clock.Sleep(step)
+		l.ProcessRequest(requests[i%len(requests)])
+	}
+}
+
+// benchmarkMemory measures memory held per client that has consumed the whole limit
+func benchmarkMemory(b *testing.B, name string) {
+	requests := makeBenchRequests()
+	var perToken float64
+	for i := 0; i < b.N; i++ {
+		clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+		before := heapAlloc()
+		l, err := benchLimiters[name](clock)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < benchLimit; j++ {
+			for _, r := range requests {
+				l.ProcessRequest(r)
+			}
+			clock.Sleep(time.Millisecond)
+		}
+		perToken = float64(heapAlloc()-before) / benchTokens
+		runtime.KeepAlive(l)
+	}
+	b.ReportMetric(perToken, "B/token")
+}
+
+func makeBenchRequests() []request.Request {
+	requests := make([]request.Request, benchTokens)
+	for i := range requests {
+		requests[i] = request.NewBaseRequest(&http.Request{RemoteAddr: fmt.Sprintf("10.0.%d.%d", i/256, i%256)}, int64(i), nil)
+	}
+	return requests
+}
+
+func heapAlloc() int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapAlloc)
+}
@@ -0,0 +1,134 @@
+package slidingwindow
+
+import (
+	"math"
+	"time"
+
+	"github.com/mailgun/vulcan/limit"
+)
+
+// CounterLimiter is the approximate sliding window limiter. It keeps the counts of the current and the previous
+// fixed windows and weights the previous count by the share of the sliding window it still covers, assuming
+// the tokens were consumed evenly. Its memory cost does not depend on the limit.
+type CounterLimiter struct {
+	*limiter
+}
+
+// NewCounterLimiter constructs a `CounterLimiter` middleware instance.
+func NewCounterLimiter(windows *WindowSet, mapper limit.MapperFn) (*CounterLimiter, error) {
+	return NewCounterLimiterWithOptions(windows, mapper, Options{})
+}
+
+func NewCounterLimiterWithOptions(windows *WindowSet, mapper limit.MapperFn, o Options) (*CounterLimiter, error) {
+	l, err := newLimiter(windows, mapper, o, newWindowCounters)
+	if err != nil {
+		return nil, err
+	}
+	return &CounterLimiter{l}, nil
+}
+
+// windowCounter counts the tokens of the current and the previous fixed windows of the period
+type windowCounter struct {
+	// Number of the current fixed window since the Unix epoch
+	index    int64
+	current  int64
+	previous int64
+}
+
+type windowCounters struct {
+	windows  []window
+	counters []windowCounter
+}
+
+func newWindowCounters(windows []window, now time.Time) tracker {
+	return &windowCounters{windows: windows, counters: make([]windowCounter, len(windows))}
+}
+
+func (c *windowCounters) consume(amount int64, now time.Time) (time.Duration, limit.Quota) {
+	at := now.UnixNano()
+	var delay time.Duration
+	estimates := make([]float64, len(c.windows))
+	for i, w := range c.windows {
+		c.counters[i].advance(at, w.period)
+		estimates[i] = c.counters[i].estimate(at, w.period)
+		if d := c.counters[i].timeTillFits(at, w, amount); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		for i := range c.counters {
+			c.counters[i].current += amount
+			estimates[i] += float64(amount)
+		}
+	}
+	var quota limit.Quota
+	for i, w := range c.windows {
+		remaining := w.limit - int64(math.Ceil(estimates[i]-1e-9))
+		if i == 0 || remaining < quota.Remaining {
+			quota = limit.Quota{Limit: w.limit, Remaining: remaining, Reset: c.counters[i].timeTillReset(at, w.period)}
+		}
+	}
+	return delay, quota
+}
+
+// advance moves the counter to the fixed window of the moment
+func (c *windowCounter) advance(at int64, period time.Duration) {
+	index := at / int64(period)
+	switch index - c.index {
+	case 0:
+		return
+	case 1:
+		c.previous = c.current
+	default:
+		c.previous = 0
+	}
+	c.index, c.current = index, 0
+}
+
+// estimate returns the approximate number of tokens consumed within the sliding window ending at the moment
+func (c *windowCounter) estimate(at int64, period time.Duration) float64 {
+	return float64(c.previous)*(1-c.elapsed(at, period)) + float64(c.current)
+}
+
+// elapsed returns the share of the current fixed window that has passed
+func (c *windowCounter) elapsed(at int64, period time.Duration) float64 {
+	return float64(at-c.index*int64(period)) / float64(period)
+}
+
+// timeTillFits returns the time until the estimate drops enough for the amount to fit the window
+func (c *windowCounter) timeTillFits(at int64, w window, amount int64) time.Duration {
+	excess := c.estimate(at, w.period) + float64(amount) - float64(w.limit)
+	// Tolerate the rounding errors of the estimate
+	if excess <= 1e-9 {
+		return 0
+	}
+	period := float64(w.period)
+	elapsed := c.elapsed(at, w.period)
+	// The previous window leaves the sliding window by the end of the current one
+	if c.previous != 0 && float64(c.previous)*(1-elapsed) >= excess {
+		return ceilDuration(excess / float64(c.previous) * period)
+	}
+	// Then the current window leaves it during the next one
+	left := (1 - elapsed) * period
+	need := c.current + amount - w.limit
+	if need <= 0 {
+		return ceilDuration(left)
+	}
+	return ceilDuration(left + float64(need)/float64(c.current)*period)
+}
+
+// timeTillReset returns the time until no tokens are left within the sliding window
+func (c *windowCounter) timeTillReset(at int64, period time.Duration) time.Duration {
+	left := (1 - c.elapsed(at, period)) * float64(period)
+	switch {
+	case c.current != 0:
+		return ceilDuration(left + float64(period))
+	case c.previous != 0:
+		return ceilDuration(left)
+	}
+	return 0
+}
+
+func ceilDuration(d float64) time.Duration {
+	return time.Duration(math.Ceil(d))
+}
@@ -0,0 +1,117 @@
+package slidingwindow
+
+import (
+	"time"
+
+	"github.com/mailgun/vulcan/limit"
+)
+
+// LogLimiter is the exact sliding window limiter. It keeps the log of the tokens consumed within the longest window,
+// so its memory cost grows with the limit.
+type LogLimiter struct {
+	*limiter
+}
+
+// NewLogLimiter constructs a `LogLimiter` middleware instance.
+func NewLogLimiter(windows *WindowSet, mapper limit.MapperFn) (*LogLimiter, error) {
+	return NewLogLimiterWithOptions(windows, mapper, Options{})
+}
+
+func NewLogLimiterWithOptions(windows *WindowSet, mapper limit.MapperFn, o Options) (*LogLimiter, error) {
+	l, err := newLimiter(windows, mapper, o, newWindowLog)
+	if err != nil {
+		return nil, err
+	}
+	return &LogLimiter{l}, nil
+}
+
+// logEntry is the amount of tokens consumed at the moment, Unix time in nanoseconds
+type logEntry struct {
+	at     int64
+	amount int64
+}
+
+// windowLog keeps the entries consumed within the longest window, oldest first
+type windowLog struct {
+	windows []window
+	entries []logEntry
+}
+
+func newWindowLog(windows []window, now time.Time) tracker {
+	return &windowLog{windows: windows}
+}
+
+func (l *windowLog) consume(amount int64, now time.Time) (time.Duration, limit.Quota) {
+	at := now.UnixNano()
+	l.expire(at)
+
+	var delay time.Duration
+	var quota limit.Quota
+	counts := make([]int64, len(l.windows))
+	for i, w := range l.windows {
+		counts[i] = l.count(at, w.period)
+		if excess := counts[i] + amount - w.limit; excess > 0 {
+			if d := l.timeTillFreed(at, w.period, excess); d > delay {
+				delay = d
+			}
+		}
+	}
+	if delay == 0 {
+		if n := len(l.entries); n != 0 && l.entries[n-1].at == at {
+			l.entries[n-1].amount += amount
+		} else {
+			l.entries = append(l.entries, logEntry{at: at, amount: amount})
+		}
+	}
+	for i, w := range l.windows {
+		remaining := w.limit - counts[i]
+		if delay == 0 {
+			remaining -= amount
+		}
+		if i == 0 || remaining < quota.Remaining {
+			quota = limit.Quota{Limit: w.limit, Remaining: remaining, Reset: l.timeTillFreed(at, w.period, w.limit)}
+		}
+	}
+	return delay, quota
+}
+
+// expire drops the entries that have left the longest window
+func (l *windowLog) expire(at int64) {
+	start := at - int64(l.windows[len(l.windows)-1].period)
+	i := 0
+	for i < len(l.entries) && l.entries[i].at <= start {
+		i++
+	}
+	// Dropped entries are released once append reallocates the slice
+	l.entries = l.entries[i:]
+}
+
+// count returns the amount of tokens consumed within the period
+func (l *windowLog) count(at int64, period time.Duration) int64 {
+	start := at - int64(period)
+	count := int64(0)
+	for i := len(l.entries) - 1; i >= 0 && l.entries[i].at > start; i-- {
+		count += l.entries[i].amount
+	}
+	return count
+}
+
+// timeTillFreed returns the time until the amount of tokens consumed within the period leave it,
+// or until all of them leave it if there are fewer
+func (l *windowLog) timeTillFreed(at int64, period time.Duration, amount int64) time.Duration {
+	start := at - int64(period)
+	freed, last := int64(0), int64(0)
+	for _, e := range l.entries {
+		if e.at <= start {
+			continue
+		}
+		freed, last = freed+e.amount, e.at
+		if freed >= amount {
+			break
+		}
+	}
+	if last == 0 {
+		return 0
+	}
+	return time.Duration(last + int64(period) - at)
+}
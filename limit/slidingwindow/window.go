@@ -0,0 +1,166 @@
+// Sliding window request rate limiters. Unlike token buckets they never let the clients
+// exceed the limit in any window, including the edges of the fixed windows.
+package slidingwindow
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+)
+
+const DefaultCapacity = 65536
+
+// window limits the number of tokens consumed within any period of the given length
+type window struct {
+	period time.Duration
+	limit  int64
+}
+
+func (w *window) String() string {
+	return fmt.Sprintf("window(%v/%v)", w.limit, w.period)
+}
+
+// WindowSet maintains a set of windows. It can contain only one window per period at a time.
+type WindowSet struct {
+	m map[time.Duration]*window
+}
+
+// NewWindowSet creates an empty `WindowSet` instance.
+func NewWindowSet() *WindowSet {
+	return &WindowSet{m: make(map[time.Duration]*window)}
+}
+
+// Add adds a window to the set. If there is a window with the same period in the
+// set then the new window overrides the old one.
+func (ws *WindowSet) Add(period time.Duration, limit int64) error {
+	if period < time.Millisecond {
+		return fmt.Errorf("Invalid period: %v", period)
+	}
+	if limit <= 0 {
+		return fmt.Errorf("Invalid limit: %v", limit)
+	}
+	ws.m[period] = &window{period, limit}
+	return nil
+}
+
+func (ws *WindowSet) String() string {
+	return fmt.Sprint(ws.m)
+}
+
+// sorted returns the windows sorted by period
+func (ws *WindowSet) sorted() []window {
+	out := make([]window, 0, len(ws.m))
+	for _, w := range ws.m {
+		out = append(out, *w)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].period < out[j].period })
+	return out
+}
+
+type Options struct {
+	// Maximum number of tokens tracked at a time, DefaultCapacity is used if it's 0
+	Capacity int
+	// Interface that gives current time (so tests can override)
+	Clock timetools.TimeProvider
+}
+
+// tracker keeps the tokens consumed by a single client in all windows
+type tracker interface {
+	// consume takes the amount if it fits all windows. Returns 0 if it was taken, otherwise the time
+	// until it fits, along with the quota of the window with the fewest tokens left
+	consume(amount int64, now time.Time) (time.Duration, limit.Quota)
+}
+
+// limiter holds the logic shared by the limiters, the trackers implement the algorithms
+type limiter struct {
+	windows    []window
+	maxPeriod  time.Duration
+	mapper     limit.MapperFn
+	clock      timetools.TimeProvider
+	mutex      *sync.Mutex
+	trackers   *ttlmap.TtlMap
+	newTracker func(windows []window, now time.Time) tracker
+	// Key of the request user data keeping the quota until the response
+	quotaKey string
+}
+
+func newLimiter(windows *WindowSet, mapper limit.MapperFn, o Options, newTracker func([]window, time.Time) tracker) (*limiter, error) {
+	if windows == nil || len(windows.m) == 0 {
+		return nil, fmt.Errorf("Provide windows")
+	}
+	if mapper == nil {
+		return nil, fmt.Errorf("Provide mapper function")
+	}
+	if o.Capacity <= 0 {
+		o.Capacity = DefaultCapacity
+	}
+	if o.Clock == nil {
+		o.Clock = &timetools.RealTime{}
+	}
+	trackers, err := ttlmap.NewMapWithProvider(o.Capacity, o.Clock)
+	if err != nil {
+		return nil, err
+	}
+	sorted := windows.sorted()
+	l := &limiter{
+		windows:    sorted,
+		maxPeriod:  sorted[len(sorted)-1].period,
+		mapper:     mapper,
+		clock:      o.Clock,
+		mutex:      &sync.Mutex{},
+		trackers:   trackers,
+		newTracker: newTracker,
+	}
+	// Several limiters can process the same request
+	l.quotaKey = limit.QuotaKey(l)
+	return l, nil
+}
+
+func (l *limiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	token, amount, err := l.mapper(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range l.windows {
+		if amount > w.limit {
+			return nil, fmt.Errorf("Requested tokens larger than the limit of %v", &w)
+		}
+	}
+
+	now := l.clock.UtcNow()
+	delay, quota := l.consume(token, amount, now)
+	if delay > 0 {
+		return nil, limit.NewLimitError("Too many requests", quota, delay, now)
+	}
+	limit.StoreQuota(r, l.quotaKey, quota)
+	return nil, nil
+}
+
+// ProcessResponse lets the client know its quota in the rate limit headers of the response
+func (l *limiter) ProcessResponse(r request.Request, a request.Attempt) {
+	limit.ApplyQuota(r, a, l.quotaKey, l.clock.UtcNow())
+}
+
+func (l *limiter) consume(token string, amount int64, now time.Time) (time.Duration, limit.Quota) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var t tracker
+	if v, ok := l.trackers.Get(token); ok {
+		t = v.(tracker)
+	} else {
+		t = l.newTracker(l.windows, now)
+	}
+	delay, quota := t.consume(amount, now)
+	// Tokens consumed more than two longest periods ago do not affect the client anymore,
+	// so the tracker expires after that much time of inactivity
+	l.trackers.Set(token, t, int(l.maxPeriod/time.Second)*2+1)
+	return delay, quota
+}
@@ -0,0 +1,230 @@
+package slidingwindow
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestSlidingWindow(t *testing.T) { TestingT(t) }
+
+type WindowSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&WindowSuite{})
+
+func (s *WindowSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *WindowSuite) TestWindowSetAdd(c *C) {
+	ws := NewWindowSet()
+	c.Assert(ws.Add(0, 1), NotNil)
+	c.Assert(ws.Add(time.Microsecond, 1), NotNil)
+	c.Assert(ws.Add(time.Second, 0), NotNil)
+	c.Assert(ws.Add(time.Second, 1), IsNil)
+	c.Assert(ws.Add(time.Second, 2), IsNil)
+	c.Assert(fmt.Sprint(ws), Equals, "map[1s:window(2/1s)]")
+}
+
+func (s *WindowSuite) TestInvalidParams(c *C) {
+	_, err := NewLogLimiter(nil, limit.MapClientIp)
+	c.Assert(err, NotNil)
+
+	_, err = NewCounterLimiter(NewWindowSet(), limit.MapClientIp)
+	c.Assert(err, NotNil)
+
+	windows := NewWindowSet()
+	windows.Add(time.Second, 1)
+	_, err = NewLogLimiter(windows, nil)
+	c.Assert(err, NotNil)
+
+	l, err := NewCounterLimiter(windows, limit.MapClientIp)
+	c.Assert(err, IsNil)
+	_, err = l.ProcessRequest(makeRequest(""))
+	c.Assert(err, NotNil)
+}
+
+// Token bucket would let the client consume the burst twice around the edge of the fixed window
+func (s *WindowSuite) TestLogWindowEdge(c *C) {
+	windows := NewWindowSet()
+	windows.Add(time.Second, 2)
+	l, err := NewLogLimiterWithOptions(windows, limit.MapClientIp, Options{Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	s.clock.Sleep(900 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+
+	s.clock.Sleep(200 * time.Millisecond)
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	c.Assert(err.(*errors.LimitError).Headers().Get("Retry-After"), Equals, "1")
+
+	// Other clients are not affected
+	re, err = l.ProcessRequest(makeRequest("1.2.3.5"))
+	c.Assert(err, IsNil)
+
+	s.clock.Sleep(800 * time.Millisecond)
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+}
+
+func (s *WindowSuite) TestLogMultipleWindows(c *C) {
+	windows := NewWindowSet()
+	windows.Add(time.Second, 2)
+	windows.Add(time.Minute, 3)
+	l, err := NewLogLimiterWithOptions(windows, limit.MapClientIp, Options{Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(err, IsNil)
+		s.clock.Sleep(time.Second)
+	}
+	// Minute window is exhausted, the first request leaves it in 57 seconds
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	h := err.(*errors.LimitError).Headers()
+	c.Assert(h.Get("Retry-After"), Equals, "57")
+	c.Assert(h.Get("RateLimit-Limit"), Equals, "3")
+	c.Assert(h.Get("RateLimit-Remaining"), Equals, "0")
+	c.Assert(h.Get("RateLimit-Reset"), Equals, "59")
+
+	s.clock.Sleep(57 * time.Second)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+
+	// Amount can never exceed the smallest limit
+	l, err = NewLogLimiterWithOptions(windows, limit.MakeMapper(limit.RequestToClientIp, func(request.Request) (int64, error) {
+		return 3, nil
+	}), Options{Clock: s.clock})
+	c.Assert(err, IsNil)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, NotNil)
+	c.Assert(err, Not(FitsTypeOf), &errors.LimitError{})
+}
+
+func (s *WindowSuite) TestCounterEstimate(c *C) {
+	windows := NewWindowSet()
+	windows.Add(time.Second, 10)
+	l, err := NewCounterLimiterWithOptions(windows, limit.MapClientIp, Options{Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 10; i++ {
+		_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(err, IsNil)
+	}
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+
+	// Half of the previous window is still within the sliding window
+	s.clock.Sleep(1500 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(err, IsNil)
+	}
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+
+	// Every 100ms another token of the previous window leaves the sliding window
+	s.clock.Sleep(100 * time.Millisecond)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+
+	// Nothing is left of the windows after two periods
+	s.clock.Sleep(2 * time.Second)
+	for i := 0; i < 10; i++ {
+		_, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *WindowSuite) TestCounterDelay(c *C) {
+	windows := NewWindowSet()
+	windows.Add(time.Second, 10)
+	l, err := NewCounterLimiterWithOptions(windows, limit.MapClientIp, Options{Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 10; i++ {
+		l.ProcessRequest(makeRequest("1.2.3.4"))
+	}
+	tracker, _ := l.trackers.Get("1.2.3.4")
+	counters := tracker.(*windowCounters)
+	at := s.clock.UtcNow().UnixNano()
+
+	// Current window leaves the sliding window during the next one
+	c.Assert(counters.counters[0].timeTillFits(at, counters.windows[0], 1), Equals, 1100*time.Millisecond)
+	c.Assert(counters.counters[0].timeTillReset(at, time.Second), Equals, 2*time.Second)
+
+	s.clock.Sleep(1500 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		l.ProcessRequest(makeRequest("1.2.3.4"))
+	}
+	at = s.clock.UtcNow().UnixNano()
+	// Previous window leaves the sliding window by the end of the current one
+	c.Assert(counters.counters[0].timeTillFits(at, counters.windows[0], 2), Equals, 200*time.Millisecond)
+}
+
+// Allowed responses carry the quota of the client
+func (s *WindowSuite) TestQuotaHeaders(c *C) {
+	windows := NewWindowSet()
+	windows.Add(time.Second, 2)
+	for _, newLimiter := range []func() (limit.Limiter, error){
+		func() (limit.Limiter, error) {
+			return NewLogLimiterWithOptions(windows, limit.MapClientIp, Options{Clock: s.clock})
+		},
+		func() (limit.Limiter, error) {
+			return NewCounterLimiterWithOptions(windows, limit.MapClientIp, Options{Clock: s.clock})
+		},
+	} {
+		l, err := newLimiter()
+		c.Assert(err, IsNil)
+
+		req := makeRequest("1.2.3.4")
+		_, err = l.ProcessRequest(req)
+		c.Assert(err, IsNil)
+
+		a := &request.BaseAttempt{Response: &http.Response{Header: make(http.Header)}}
+		l.ProcessResponse(req, a)
+		c.Assert(a.Response.Header.Get("RateLimit-Limit"), Equals, "2")
+		c.Assert(a.Response.Header.Get("RateLimit-Remaining"), Equals, "1")
+	}
+}
+
+// Clients are forgotten after two longest periods of inactivity
+func (s *WindowSuite) TestExpiration(c *C) {
+	windows := NewWindowSet()
+	windows.Add(time.Second, 1)
+	l, err := NewLogLimiterWithOptions(windows, limit.MapClientIp, Options{Clock: s.clock, Capacity: 10})
+	c.Assert(err, IsNil)
+
+	_, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(l.trackers.Len(), Equals, 1)
+
+	s.clock.Sleep(time.Hour)
+	_, ok := l.trackers.Get("1.2.3.4")
+	c.Assert(ok, Equals, false)
+}
+
+func makeRequest(ip string) request.Request {
+	return request.NewBaseRequest(&http.Request{RemoteAddr: ip}, 1, nil)
+}
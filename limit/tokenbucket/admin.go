@@ -0,0 +1,77 @@
+package tokenbucket
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+)
+
+// RateTableHandler is an admin API pushing the rate table config:
+//
+//	GET /rates         - returns the current config
+//	PUT /rates         - replaces the config with the JSON config of the request body
+//	GET /rates/<token> - returns the rates applied to the token
+type RateTableHandler struct {
+	table *RateTable
+}
+
+func NewRateTableHandler(t *RateTable) *RateTableHandler {
+	return &RateTableHandler{
+		table: t,
+	}
+}
+
+func (h *RateTableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/rates" && r.Method == "GET":
+		netutils.ReplyJson(w, h.table.GetConfig())
+	case path == "/rates" && (r.Method == "PUT" || r.Method == "POST"):
+		h.updateRates(w, r)
+	case strings.HasPrefix(path, "/rates/") && r.Method == "GET":
+		token := strings.TrimPrefix(path, "/rates/")
+		netutils.ReplyJson(w, map[string]interface{}{"token": token, "rates": specsOf(h.table.GetRates(token))})
+	default:
+		netutils.ReplyError(w, errors.FromStatus(http.StatusNotFound))
+	}
+}
+
+func (h *RateTableHandler) updateRates(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		netutils.ReplyError(w, &errors.HttpError{StatusCode: http.StatusBadRequest, Body: err.Error()})
+		return
+	}
+	cfg, err := ParseJsonRateConfig(body)
+	if err != nil {
+		netutils.ReplyError(w, &errors.HttpError{StatusCode: http.StatusBadRequest, Body: err.Error()})
+		return
+	}
+	if err := h.table.Update(cfg); err != nil {
+		netutils.ReplyError(w, &errors.HttpError{StatusCode: http.StatusBadRequest, Body: err.Error()})
+		return
+	}
+	log.Infof("Updated rate table: %d tiers, %d tokens", len(cfg.Tiers), len(cfg.Tokens))
+	netutils.ReplyJson(w, cfg)
+}
+
+// specsOf returns the rates sorted by period, empty if the limiter's default rates apply
+func specsOf(rates *RateSet) []RateSpec {
+	periods := make([]time.Duration, 0, len(rates.m))
+	for p := range rates.m {
+		periods = append(periods, p)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i] < periods[j] })
+	specs := make([]RateSpec, len(periods))
+	for i, p := range periods {
+		r := rates.m[p]
+		specs[i] = RateSpec{Period: r.period.String(), Average: r.average, Burst: r.burst}
+	}
+	return specs
+}
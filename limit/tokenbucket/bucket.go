@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
 )
 
 const UndefinedDelay = -1
@@ -83,6 +84,27 @@ func (tb *tokenBucket) rollback() {
 	tb.lastConsumed = 0
 }
 
+// refund returns the specified number of tokens to the bucket, e.g. when the
+// request that has consumed them was rejected by the other limiter. The bucket
+// never holds more tokens than its burst size.
+func (tb *tokenBucket) refund(tokens int64) {
+	tb.updateAvailableTokens()
+	tb.availableTokens += tokens
+	if tb.availableTokens > tb.burst {
+		tb.availableTokens = tb.burst
+	}
+	tb.lastConsumed = 0
+}
+
+// quota returns the number of tokens left and the time until the bucket is full
+func (tb *tokenBucket) quota() limit.Quota {
+	reset := time.Duration(tb.burst-tb.availableTokens)*tb.timePerToken - tb.clock.UtcNow().Sub(tb.lastRefresh)
+	if reset < 0 {
+		reset = 0
+	}
+	return limit.Quota{Limit: tb.burst, Remaining: tb.availableTokens, Reset: reset}
+}
+
 // Update modifies `average` and `burst` fields of the token bucket according
 // to the provided `Rate`
 func (tb *tokenBucket) update(rate *rate) error {
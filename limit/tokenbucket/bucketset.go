@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
 	"sort")
 
 // TokenBucketSet represents a set of TokenBucket covering different time periods.
@@ -72,13 +73,39 @@ func (tbs *tokenBucketSet) consume(tokens int64) (time.Duration, error) {
 	// If we could not make ALL buckets consume tokens for whatever reason,
 	// then rollback consumption for all of them.
 	if firstErr != nil || maxDelay > 0 {
-		for _, tokenBucket := range tbs.buckets {
-			tokenBucket.rollback()
-		}
+		tbs.rollback()
 	}
 	return maxDelay, firstErr
 }
 
+// rollback reverts the most recent consumption of all buckets in the set.
+func (tbs *tokenBucketSet) rollback() {
+	for _, tokenBucket := range tbs.buckets {
+		tokenBucket.rollback()
+	}
+}
+
+// refund returns the specified number of tokens to all buckets in the set.
+func (tbs *tokenBucketSet) refund(tokens int64) {
+	for _, tokenBucket := range tbs.buckets {
+		tokenBucket.refund(tokens)
+	}
+}
+
+// quota returns the quota of the bucket with the fewest tokens left, the one
+// that takes longer to refill if there are several of them.
+func (tbs *tokenBucketSet) quota() limit.Quota {
+	var q limit.Quota
+	first := true
+	for _, tokenBucket := range tbs.buckets {
+		bq := tokenBucket.quota()
+		if first || bq.Remaining < q.Remaining || (bq.Remaining == q.Remaining && bq.Reset > q.Reset) {
+			q, first = bq, false
+		}
+	}
+	return q
+}
+
 // debugState returns string that reflects the current state of all buckets in
 // this set. It is intended to be used for debugging and testing only.
 func (tbs *tokenBucketSet) debugState() string {
@@ -0,0 +1,211 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
+)
+
+const DefaultSyncPeriod = 100 * time.Millisecond
+
+type CachedOptions struct {
+	// How often the tokens consumed locally are consumed from the shared store, DefaultSyncPeriod is used if it's 0
+	SyncPeriod time.Duration
+	// Maximum number of tokens kept by the local store, DefaultCapacity is used if it's 0
+	Capacity int
+	// Interface that gives current time (so tests can override)
+	Clock timetools.TimeProvider
+}
+
+// CachedStore trades precision for latency: requests are admitted by the local in-memory buckets without
+// a round trip to the shared store, and the tokens consumed locally are consumed from the shared store
+// every sync period. If the shared store rejects them, because the proxies together have exceeded the rate,
+// the token is rejected locally until the shared buckets refill. So the proxies may exceed the rate by up to
+// one sync period worth of requests each.
+type CachedStore struct {
+	shared  Store
+	local   *MemoryStore
+	options CachedOptions
+	mutex   *sync.Mutex
+	entries map[string]*cachedEntry
+	stop    chan struct{}
+	done    chan struct{}
+	once    *sync.Once
+}
+
+// cachedEntry holds the state of the token between the syncs
+type cachedEntry struct {
+	rates *RateSet
+	// Tokens consumed locally since the last sync
+	pending int64
+	// Token is rejected until this time after the shared store has rejected the pending tokens
+	blockedUntil time.Time
+}
+
+// NewCachedStore creates the store syncing with the shared store in the background until it's closed
+func NewCachedStore(shared Store, o CachedOptions) (*CachedStore, error) {
+	if shared == nil {
+		return nil, fmt.Errorf("Provide shared store")
+	}
+	if o.SyncPeriod <= 0 {
+		o.SyncPeriod = DefaultSyncPeriod
+	}
+	if o.Clock == nil {
+		o.Clock = &timetools.RealTime{}
+	}
+	local, err := NewMemoryStore(o.Capacity, o.Clock)
+	if err != nil {
+		return nil, err
+	}
+	s := &CachedStore{
+		shared:  shared,
+		local:   local,
+		options: o,
+		mutex:   &sync.Mutex{},
+		entries: make(map[string]*cachedEntry),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		once:    &sync.Once{},
+	}
+	go s.loop()
+	return s, nil
+}
+
+func (s *CachedStore) Consume(token string, rates *RateSet, amount int64) (Status, error) {
+	statuses, err := s.ConsumeAll([]Consumption{{Token: token, Rates: rates, Amount: amount}})
+	if err != nil {
+		return Status{Delay: UndefinedDelay}, err
+	}
+	return statuses[0], nil
+}
+
+func (s *CachedStore) ConsumeAll(cs []Consumption) ([]Status, error) {
+	if err := checkConsumptions(cs); err != nil {
+		return nil, err
+	}
+	now := s.options.Clock.UtcNow()
+	statuses := make([]Status, len(cs))
+	blocked := false
+	s.mutex.Lock()
+	for i, c := range cs {
+		if e, ok := s.entries[c.Token]; ok && now.Before(e.blockedUntil) {
+			delay := e.blockedUntil.Sub(now)
+			statuses[i] = Status{Delay: delay, Quota: limit.Quota{Limit: minBurst(c.Rates), Reset: delay}}
+			blocked = true
+		}
+	}
+	s.mutex.Unlock()
+	if blocked {
+		return statuses, nil
+	}
+
+	statuses, err := s.local.ConsumeAll(cs)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range statuses {
+		if st.Delay > 0 {
+			return statuses, nil
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range cs {
+		e, ok := s.entries[c.Token]
+		if !ok {
+			e = &cachedEntry{}
+			s.entries[c.Token] = e
+		}
+		e.rates = c.Rates
+		e.pending += c.Amount
+	}
+	return statuses, nil
+}
+
+func (s *CachedStore) Rollback(token string, rates *RateSet, amount int64) error {
+	if err := s.local.Rollback(token, rates, amount); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e, ok := s.entries[token]; ok {
+		if amount > e.pending {
+			amount = e.pending
+		}
+		e.pending -= amount
+	}
+	return nil
+}
+
+// Sync consumes the tokens consumed locally since the last sync from the shared store
+func (s *CachedStore) Sync() {
+	type pending struct {
+		token  string
+		rates  *RateSet
+		amount int64
+	}
+	now := s.options.Clock.UtcNow()
+	batch := []pending{}
+	s.mutex.Lock()
+	for token, e := range s.entries {
+		if e.pending != 0 {
+			batch = append(batch, pending{token: token, rates: e.rates, amount: e.pending})
+			e.pending = 0
+		} else if !now.Before(e.blockedUntil) {
+			delete(s.entries, token)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, p := range batch {
+		// The pending amount could have exceeded the burst if the proxy has granted more than the shared rate
+		amount := p.amount
+		for _, r := range p.rates.m {
+			if amount > r.burst {
+				amount = r.burst
+			}
+		}
+		res, err := s.shared.Consume(p.token, p.rates, amount)
+		if err != nil {
+			log.Errorf("Failed to sync rate limit of '%s': %s", p.token, err)
+			continue
+		}
+		if res.Delay > 0 {
+			s.mutex.Lock()
+			if e, ok := s.entries[p.token]; ok {
+				e.blockedUntil = now.Add(res.Delay)
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// Close stops the background sync after syncing the pending tokens
+func (s *CachedStore) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+	return nil
+}
+
+func (s *CachedStore) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.options.SyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Sync()
+		case <-s.stop:
+			s.Sync()
+			return
+		}
+	}
+}
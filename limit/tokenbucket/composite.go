@@ -0,0 +1,131 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+)
+
+// RateLimitLevel is the header telling the client which level of the CompositeLimiter rejected the request
+const RateLimitLevel = "X-RateLimit-Level"
+
+// Level is one of the limits enforced by the CompositeLimiter, e.g. the rates per API key or per tenant
+type Level struct {
+	// Name of the level reported when it rejects the request, e.g. "tenant"
+	Name string
+	// Rates of the level
+	Rates *RateSet
+	// Maps the request to the token of the level, e.g. limit.MapGlobal for the global rates
+	Mapper limit.MapperFn
+}
+
+// CompositeOptions defines optional parameters of the CompositeLimiter
+type CompositeOptions struct {
+	// Maximum number of tokens kept by the default in-memory store, DefaultCapacity is used if it's 0
+	Capacity int
+	// Interface that gives current time (so tests can override)
+	Clock timetools.TimeProvider
+	// Store keeps the state of the buckets of all levels, MemoryStore is used if it's nil
+	Store Store
+}
+
+// CompositeLimiter enforces several levels of rates on the same requests, e.g. "100 rps per API key AND
+// 5000 rps per tenant AND 20000 rps global". Tokens are consumed from all levels or from none of them
+// in one call of the store, so the tokens taken for a rejected request are never seen by the concurrent requests.
+type CompositeLimiter struct {
+	levels []Level
+	clock  timetools.TimeProvider
+	store  Store
+	// Key of the request user data keeping the quota until the response
+	quotaKey string
+}
+
+// NewCompositeLimiter constructs a `CompositeLimiter` middleware instance keeping the buckets in memory.
+func NewCompositeLimiter(levels []Level) (*CompositeLimiter, error) {
+	return NewCompositeLimiterWithOptions(levels, CompositeOptions{})
+}
+
+// NewCompositeLimiterWithOptions constructs a `CompositeLimiter` middleware instance keeping the buckets in the store.
+func NewCompositeLimiterWithOptions(levels []Level, o CompositeOptions) (*CompositeLimiter, error) {
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("Provide levels")
+	}
+	names := make(map[string]bool, len(levels))
+	for _, l := range levels {
+		if l.Name == "" {
+			return nil, fmt.Errorf("Provide level name")
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("Duplicate level: '%s'", l.Name)
+		}
+		names[l.Name] = true
+		if l.Rates == nil || len(l.Rates.m) == 0 {
+			return nil, fmt.Errorf("Provide rates of level '%s'", l.Name)
+		}
+		if l.Mapper == nil {
+			return nil, fmt.Errorf("Provide mapper function of level '%s'", l.Name)
+		}
+	}
+
+	if o.Clock == nil {
+		o.Clock = &timetools.RealTime{}
+	}
+	if o.Store == nil {
+		store, err := NewMemoryStore(o.Capacity, o.Clock)
+		if err != nil {
+			return nil, err
+		}
+		o.Store = store
+	}
+
+	cl := &CompositeLimiter{
+		levels: append([]Level(nil), levels...),
+		clock:  o.Clock,
+		store:  o.Store,
+	}
+	cl.quotaKey = limit.QuotaKey(cl)
+	return cl, nil
+}
+
+func (cl *CompositeLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	cs := make([]Consumption, len(cl.levels))
+	for i, l := range cl.levels {
+		token, amount, err := l.Mapper(r)
+		if err != nil {
+			return nil, err
+		}
+		cs[i] = Consumption{Token: levelToken(l.Name, token), Rates: l.Rates, Amount: amount}
+	}
+	statuses, err := cl.store.ConsumeAll(cs)
+	if err != nil {
+		return nil, err
+	}
+	var quota limit.Quota
+	for i, res := range statuses {
+		if res.Delay > 0 {
+			name := cl.levels[i].Name
+			e := limit.NewLimitError(fmt.Sprintf("Too many requests, the %s limit is exceeded", name), res.Quota, res.Delay, cl.clock.UtcNow())
+			e.Header.Set(RateLimitLevel, name)
+			return nil, e
+		}
+		if i == 0 || res.Quota.Remaining < quota.Remaining {
+			quota = res.Quota
+		}
+	}
+	limit.StoreQuota(r, cl.quotaKey, quota)
+	return nil, nil
+}
+
+// levelToken keys the bucket of the level in the shared store, the name is length-prefixed
+// so the tokens of different levels never clash, e.g. "a" with "b.c" and "a.b" with "c"
+func levelToken(name, token string) string {
+	return fmt.Sprintf("%d:%s|%s", len(name), name, token)
+}
+
+// ProcessResponse lets the client know the quota of the tightest level in the rate limit headers of the response
+func (cl *CompositeLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	limit.ApplyQuota(r, a, cl.quotaKey, cl.clock.UtcNow())
+}
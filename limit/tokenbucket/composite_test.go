@@ -0,0 +1,173 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type CompositeSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&CompositeSuite{})
+
+func (s *CompositeSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func makeRates(average, burst int64) *RateSet {
+	rs := NewRateSet()
+	rs.Add(time.Second, average, burst)
+	return rs
+}
+
+// Clients of the tenant with 2 tokens, one token per client, 3 tokens globally
+func (s *CompositeSuite) newLimiter(c *C) *CompositeLimiter {
+	cl, err := NewCompositeLimiterWithOptions([]Level{
+		{Name: "client", Rates: makeRates(1, 1), Mapper: limit.MapClientIp},
+		{Name: "tenant", Rates: makeRates(2, 2), Mapper: limit.MakeMapRequestHeader("X-Tenant")},
+		{Name: "global", Rates: makeRates(3, 3), Mapper: limit.MapGlobal},
+	}, CompositeOptions{Clock: s.clock})
+	c.Assert(err, IsNil)
+	return cl
+}
+
+func (s *CompositeSuite) TestInvalidParams(c *C) {
+	_, err := NewCompositeLimiter(nil)
+	c.Assert(err, NotNil)
+
+	for _, levels := range [][]Level{
+		{{Rates: makeRates(1, 1), Mapper: limit.MapGlobal}},
+		{{Name: "global", Mapper: limit.MapGlobal}},
+		{{Name: "global", Rates: NewRateSet(), Mapper: limit.MapGlobal}},
+		{{Name: "global", Rates: makeRates(1, 1)}},
+		{{Name: "global", Rates: makeRates(1, 1), Mapper: limit.MapGlobal}, {Name: "global", Rates: makeRates(1, 1), Mapper: limit.MapGlobal}},
+	} {
+		_, err := NewCompositeLimiter(levels)
+		c.Assert(err, NotNil)
+	}
+}
+
+// Every level rejects requests on its own and reports itself
+func (s *CompositeSuite) TestLevels(c *C) {
+	cl := s.newLimiter(c)
+
+	_, err := cl.ProcessRequest(makeTenantRequest("1.2.3.4", "a"))
+	c.Assert(err, IsNil)
+
+	err = s.expectRejected(c, cl, makeTenantRequest("1.2.3.4", "a"), "client")
+	c.Assert(err.Error(), Equals, "Too many requests, the client limit is exceeded")
+
+	_, err = cl.ProcessRequest(makeTenantRequest("1.2.3.5", "a"))
+	c.Assert(err, IsNil)
+	s.expectRejected(c, cl, makeTenantRequest("1.2.3.6", "a"), "tenant")
+
+	_, err = cl.ProcessRequest(makeTenantRequest("1.2.3.6", "b"))
+	c.Assert(err, IsNil)
+	s.expectRejected(c, cl, makeTenantRequest("1.2.3.7", "b"), "global")
+
+	s.clock.Sleep(time.Second)
+	_, err = cl.ProcessRequest(makeTenantRequest("1.2.3.4", "a"))
+	c.Assert(err, IsNil)
+}
+
+// Rejected requests take no tokens from the levels that have let them through
+func (s *CompositeSuite) TestAllOrNone(c *C) {
+	cl := s.newLimiter(c)
+
+	_, err := cl.ProcessRequest(makeTenantRequest("1.2.3.4", "a"))
+	c.Assert(err, IsNil)
+	_, err = cl.ProcessRequest(makeTenantRequest("1.2.3.5", "a"))
+	c.Assert(err, IsNil)
+
+	// Tenant rejects the requests, so the clients and the global level keep their tokens
+	for i := 0; i < 5; i++ {
+		s.expectRejected(c, cl, makeTenantRequest("1.2.3.6", "a"), "tenant")
+	}
+	_, err = cl.ProcessRequest(makeTenantRequest("1.2.3.6", "b"))
+	c.Assert(err, IsNil)
+}
+
+// Allowed responses carry the quota of the tightest level
+func (s *CompositeSuite) TestQuotaHeaders(c *C) {
+	cl, err := NewCompositeLimiterWithOptions([]Level{
+		{Name: "client", Rates: makeRates(5, 5), Mapper: limit.MapClientIp},
+		{Name: "global", Rates: makeRates(3, 3), Mapper: limit.MapGlobal},
+	}, CompositeOptions{Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	req := makeTenantRequest("1.2.3.4", "a")
+	_, err = cl.ProcessRequest(req)
+	c.Assert(err, IsNil)
+
+	a := &request.BaseAttempt{Response: &http.Response{Header: make(http.Header)}}
+	cl.ProcessResponse(req, a)
+	c.Assert(a.Response.Header.Get("RateLimit-Limit"), Equals, "3")
+	c.Assert(a.Response.Header.Get("RateLimit-Remaining"), Equals, "2")
+}
+
+func (s *CompositeSuite) TestMapperFailure(c *C) {
+	failing := func(r request.Request) (string, int64, error) {
+		return "", -1, fmt.Errorf("Failed")
+	}
+	cl, err := NewCompositeLimiterWithOptions([]Level{
+		{Name: "global", Rates: makeRates(1, 1), Mapper: limit.MapGlobal},
+		{Name: "client", Rates: makeRates(1, 1), Mapper: failing},
+	}, CompositeOptions{Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	_, err = cl.ProcessRequest(makeTenantRequest("1.2.3.4", "a"))
+	c.Assert(err, NotNil)
+	c.Assert(err, Not(FitsTypeOf), &errors.LimitError{})
+
+	// Global token has been returned
+	res, err := cl.store.Consume("6:global|global", makeRates(1, 1), 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+}
+
+// Levels keep separate buckets even if the names and the tokens join to the same string
+func (s *CompositeSuite) TestLevelTokensDoNotClash(c *C) {
+	mapToken := func(token string) limit.MapperFn {
+		return func(r request.Request) (string, int64, error) {
+			return token, 1, nil
+		}
+	}
+	cl, err := NewCompositeLimiterWithOptions([]Level{
+		{Name: "a", Rates: makeRates(1, 1), Mapper: mapToken("b.c")},
+		{Name: "a.b", Rates: makeRates(1, 1), Mapper: mapToken("c")},
+	}, CompositeOptions{Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	r := makeTenantRequest("1.2.3.4", "a")
+	re, err := cl.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	s.expectRejected(c, cl, r, "a")
+}
+
+func (s *CompositeSuite) expectRejected(c *C, cl *CompositeLimiter, r request.Request, level string) error {
+	re, err := cl.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	h := err.(*errors.LimitError).Headers()
+	c.Assert(h.Get(RateLimitLevel), Equals, level)
+	c.Assert(h.Get("Retry-After"), Equals, "1")
+	return err
+}
+
+func makeTenantRequest(ip, tenant string) request.Request {
+	req := &http.Request{RemoteAddr: ip, Header: make(http.Header)}
+	req.Header.Set("X-Tenant", tenant)
+	return request.NewBaseRequest(req, 1, nil)
+}
@@ -0,0 +1,415 @@
+package tokenbucket
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+)
+
+// RateSpec is a rate of the rate table config, period is a duration string, e.g. "1s" or "1m"
+type RateSpec struct {
+	Period  string `json:"period"`
+	Average int64  `json:"average"`
+	Burst   int64  `json:"burst"`
+}
+
+// TokenRates assigns the tier or the rates to the token. Token can contain '*' wildcards matching any
+// characters, e.g. "acme-*"
+type TokenRates struct {
+	Token string     `json:"token"`
+	Tier  string     `json:"tier,omitempty"`
+	Rates []RateSpec `json:"rates,omitempty"`
+}
+
+// RateConfig is the contents of the rate table. JSON config looks like:
+//
+//	{
+//	  "default": "free",
+//	  "tiers": {
+//	    "free": [{"period": "1s", "average": 10, "burst": 20}],
+//	    "pro": [{"period": "1s", "average": 100, "burst": 200}]
+//	  },
+//	  "tokens": [
+//	    {"token": "key-1", "tier": "pro"},
+//	    {"token": "acme-*", "rates": [{"period": "1m", "average": 6000, "burst": 1000}]}
+//	  ]
+//	}
+//
+// CSV config has the same contents, one rate or token per line:
+//
+//	default,free
+//	tier,free,1s,10,20
+//	tier,pro,1s,100,200
+//	token,key-1,pro
+//	token,acme-*,1m,6000,1000
+type RateConfig struct {
+	// Tier of the tokens that are not in the table, the limiter's default rates are used if it's empty
+	Default string                `json:"default,omitempty"`
+	Tiers   map[string][]RateSpec `json:"tiers,omitempty"`
+	Tokens  []TokenRates          `json:"tokens,omitempty"`
+}
+
+// ParseJsonRateConfig parses the JSON rate table config
+func ParseJsonRateConfig(data []byte) (*RateConfig, error) {
+	var cfg RateConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Bad JSON: %s", err)
+	}
+	return &cfg, nil
+}
+
+// ParseCsvRateConfig parses the CSV rate table config, lines starting with '#' are ignored
+func ParseCsvRateConfig(data []byte) (*RateConfig, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Bad CSV: %s", err)
+	}
+
+	cfg := &RateConfig{Tiers: make(map[string][]RateSpec)}
+	tokens := make(map[string]int)
+	for _, rec := range records {
+		switch {
+		case rec[0] == "default" && len(rec) == 2:
+			cfg.Default = rec[1]
+		case rec[0] == "tier" && len(rec) == 5:
+			spec, err := parseCsvRate(rec[2:])
+			if err != nil {
+				return nil, err
+			}
+			cfg.Tiers[rec[1]] = append(cfg.Tiers[rec[1]], spec)
+		case rec[0] == "token" && len(rec) == 3:
+			cfg.Tokens = append(cfg.Tokens, TokenRates{Token: rec[1], Tier: rec[2]})
+		case rec[0] == "token" && len(rec) == 5:
+			spec, err := parseCsvRate(rec[2:])
+			if err != nil {
+				return nil, err
+			}
+			// Several rates of the same token go to the same entry
+			i, ok := tokens[rec[1]]
+			if !ok {
+				i = len(cfg.Tokens)
+				tokens[rec[1]] = i
+				cfg.Tokens = append(cfg.Tokens, TokenRates{Token: rec[1]})
+			}
+			cfg.Tokens[i].Rates = append(cfg.Tokens[i].Rates, spec)
+		default:
+			return nil, fmt.Errorf("Bad CSV line: '%s'", strings.Join(rec, ","))
+		}
+	}
+	return cfg, nil
+}
+
+// LoadRateConfig reads the rate table config from the file, the format is defined by the extension: .json or .csv
+func LoadRateConfig(path string) (*RateConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ParseJsonRateConfig(data)
+	case ".csv":
+		return ParseCsvRateConfig(data)
+	}
+	return nil, fmt.Errorf("Unsupported rate config format: '%s'", path)
+}
+
+func parseCsvRate(fields []string) (RateSpec, error) {
+	average, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return RateSpec{}, fmt.Errorf("Bad average: '%s'", fields[1])
+	}
+	burst, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return RateSpec{}, fmt.Errorf("Bad burst: '%s'", fields[2])
+	}
+	return RateSpec{Period: fields[0], Average: average, Burst: burst}, nil
+}
+
+// RateTable is a ready-made ConfigMapperFn of the TokenLimiter looking up the rates of the request token in the table,
+// e.g. the rates of the plans of the API keys. Table can be updated on the fly, e.g. by reloading the config file,
+// changed rates apply to the existing buckets of the tokens.
+//
+//	table, _ := NewRateTable(limit.MakeRequestToHeader("X-Api-Key"))
+//	table.WatchFile("/etc/vulcan/rates.json", 10*time.Second)
+//	limiter, _ := NewLimiterWithOptions(defaultRates, limit.MakeMapRequestHeader("X-Api-Key"), Options{ConfigMapper: table.ConfigMapper})
+type RateTable struct {
+	mapper limit.TokenMapperFn
+	mutex  *sync.RWMutex
+	config *RateConfig
+	rates  *rateLookup
+	stop   chan struct{}
+	done   chan struct{}
+	once   *sync.Once
+}
+
+// rateLookup is the immutable index of the config, it's replaced as a whole on update
+type rateLookup struct {
+	exact map[string]*RateSet
+	// Wildcard tokens, the most specific first
+	wildcards []wildcardRates
+	def       *RateSet
+}
+
+type wildcardRates struct {
+	pattern string
+	rates   *RateSet
+}
+
+// noRates makes the limiter use its default rates
+var noRates = NewRateSet()
+
+// NewRateTable creates an empty table looking up the tokens returned by the mapper
+func NewRateTable(mapper limit.TokenMapperFn) (*RateTable, error) {
+	if mapper == nil {
+		return nil, fmt.Errorf("Provide mapper function")
+	}
+	return &RateTable{
+		mapper: mapper,
+		mutex:  &sync.RWMutex{},
+		config: &RateConfig{},
+		rates:  &rateLookup{exact: make(map[string]*RateSet)},
+		once:   &sync.Once{},
+	}, nil
+}
+
+// ConfigMapper is the ConfigMapperFn returning the rates of the request token
+func (t *RateTable) ConfigMapper(r request.Request) (*RateSet, error) {
+	token, err := t.mapper(r)
+	if err != nil {
+		return nil, err
+	}
+	return t.GetRates(token), nil
+}
+
+// GetRates returns the rates of the token: exact match goes first, then the most specific wildcard,
+// then the default tier. Returns empty set if there is no match, so the limiter uses its default rates
+func (t *RateTable) GetRates(token string) *RateSet {
+	t.mutex.RLock()
+	lookup := t.rates
+	t.mutex.RUnlock()
+
+	if rates, ok := lookup.exact[token]; ok {
+		return rates
+	}
+	for _, w := range lookup.wildcards {
+		if matchWildcard(w.pattern, token) {
+			return w.rates
+		}
+	}
+	if lookup.def != nil {
+		return lookup.def
+	}
+	return noRates
+}
+
+// GetConfig returns the current config of the table
+func (t *RateTable) GetConfig() *RateConfig {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.config
+}
+
+// Update replaces the contents of the table, the table is left intact if the config is invalid
+func (t *RateTable) Update(cfg *RateConfig) error {
+	lookup, err := newRateLookup(cfg)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.config = cfg
+	t.rates = lookup
+	return nil
+}
+
+// LoadFile updates the table from the config file
+func (t *RateTable) LoadFile(path string) error {
+	cfg, err := LoadRateConfig(path)
+	if err != nil {
+		return err
+	}
+	return t.Update(cfg)
+}
+
+// WatchFile loads the config file and reloads it every period when it changes, until the table is closed.
+// Table keeps the previous config if the changed file is invalid.
+func (t *RateTable) WatchFile(path string, period time.Duration) error {
+	if period <= 0 {
+		return fmt.Errorf("Invalid period: %v", period)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := t.LoadFile(path); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stop != nil {
+		return fmt.Errorf("Already watching the file")
+	}
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.watch(path, period, fi, t.stop, t.done)
+	return nil
+}
+
+// Close stops watching the file
+func (t *RateTable) Close() error {
+	t.mutex.RLock()
+	stop, done := t.stop, t.done
+	t.mutex.RUnlock()
+	if stop == nil {
+		return nil
+	}
+	t.once.Do(func() {
+		close(stop)
+	})
+	<-done
+	return nil
+}
+
+func (t *RateTable) watch(path string, period time.Duration, last os.FileInfo, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Errorf("Failed to check rate config '%s': %s", path, err)
+			continue
+		}
+		if fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		if err := t.LoadFile(path); err != nil {
+			log.Errorf("Failed to reload rate config '%s', keeping the previous one: %s", path, err)
+			continue
+		}
+		log.Infof("Reloaded rate config '%s'", path)
+	}
+}
+
+func newRateLookup(cfg *RateConfig) (*rateLookup, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("Provide rate config")
+	}
+	tiers := make(map[string]*RateSet, len(cfg.Tiers))
+	for name, specs := range cfg.Tiers {
+		rates, err := newRateSetFromSpecs(specs)
+		if err != nil {
+			return nil, fmt.Errorf("Bad rates of tier '%s': %s", name, err)
+		}
+		tiers[name] = rates
+	}
+
+	lookup := &rateLookup{exact: make(map[string]*RateSet)}
+	if cfg.Default != "" {
+		def, ok := tiers[cfg.Default]
+		if !ok {
+			return nil, fmt.Errorf("Unknown default tier: '%s'", cfg.Default)
+		}
+		lookup.def = def
+	}
+	seen := make(map[string]bool, len(cfg.Tokens))
+	for _, tr := range cfg.Tokens {
+		if tr.Token == "" {
+			return nil, fmt.Errorf("Provide token")
+		}
+		if seen[tr.Token] {
+			return nil, fmt.Errorf("Duplicate token: '%s'", tr.Token)
+		}
+		seen[tr.Token] = true
+
+		var rates *RateSet
+		switch {
+		case tr.Tier != "" && len(tr.Rates) != 0:
+			return nil, fmt.Errorf("Provide either tier or rates of token '%s'", tr.Token)
+		case tr.Tier != "":
+			var ok bool
+			if rates, ok = tiers[tr.Tier]; !ok {
+				return nil, fmt.Errorf("Unknown tier of token '%s': '%s'", tr.Token, tr.Tier)
+			}
+		default:
+			var err error
+			if rates, err = newRateSetFromSpecs(tr.Rates); err != nil {
+				return nil, fmt.Errorf("Bad rates of token '%s': %s", tr.Token, err)
+			}
+		}
+		if strings.Contains(tr.Token, "*") {
+			lookup.wildcards = append(lookup.wildcards, wildcardRates{pattern: tr.Token, rates: rates})
+		} else {
+			lookup.exact[tr.Token] = rates
+		}
+	}
+	// Patterns with more literal characters are more specific, the order of the config breaks the ties
+	sort.SliceStable(lookup.wildcards, func(i, j int) bool {
+		return literals(lookup.wildcards[i].pattern) > literals(lookup.wildcards[j].pattern)
+	})
+	return lookup, nil
+}
+
+func newRateSetFromSpecs(specs []RateSpec) (*RateSet, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("Provide rates")
+	}
+	rates := NewRateSet()
+	for _, s := range specs {
+		period, err := time.ParseDuration(s.Period)
+		if err != nil {
+			return nil, fmt.Errorf("Bad period: '%s'", s.Period)
+		}
+		if err := rates.Add(period, s.Average, s.Burst); err != nil {
+			return nil, err
+		}
+	}
+	return rates, nil
+}
+
+func literals(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*")
+}
+
+// matchWildcard reports whether the token matches the pattern, '*' matches any sequence of characters
+func matchWildcard(pattern, token string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(token, parts[0]) {
+		return false
+	}
+	token = token[len(parts[0]):]
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		i := strings.Index(token, part)
+		if i < 0 {
+			return false
+		}
+		token = token[i+len(part):]
+	}
+	return len(token) >= len(parts[last]) && strings.HasSuffix(token, parts[last])
+}
@@ -0,0 +1,279 @@
+package tokenbucket
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type RateTableSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&RateTableSuite{})
+
+func (s *RateTableSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+const jsonRates = `{
+  "default": "free",
+  "tiers": {
+    "free": [{"period": "1s", "average": 1, "burst": 1}],
+    "pro": [{"period": "1s", "average": 10, "burst": 20}]
+  },
+  "tokens": [
+    {"token": "key-1", "tier": "pro"},
+    {"token": "acme-*", "tier": "pro"},
+    {"token": "acme-*-test", "rates": [{"period": "1s", "average": 2, "burst": 2}, {"period": "1m", "average": 60, "burst": 10}]}
+  ]
+}`
+
+const csvRates = `# kind,name,...
+default,free
+tier,free,1s,1,1
+tier,pro,1s,10,20
+token,key-1,pro
+token,acme-*,pro
+token,acme-*-test,1s,2,2
+token,acme-*-test,1m,60,10
+`
+
+func (s *RateTableSuite) TestParse(c *C) {
+	fromJson, err := ParseJsonRateConfig([]byte(jsonRates))
+	c.Assert(err, IsNil)
+	fromCsv, err := ParseCsvRateConfig([]byte(csvRates))
+	c.Assert(err, IsNil)
+	c.Assert(fromCsv, DeepEquals, fromJson)
+
+	for _, data := range []string{"token,key-1", "tier,free,1s,x,1", "tier,free,1s,1,x", "rate,1s,1,1", `"a`} {
+		_, err := ParseCsvRateConfig([]byte(data))
+		c.Assert(err, NotNil, Commentf("%s", data))
+	}
+	_, err = ParseJsonRateConfig([]byte("{"))
+	c.Assert(err, NotNil)
+}
+
+func (s *RateTableSuite) TestLookup(c *C) {
+	t := s.newTable(c, jsonRates)
+
+	c.Assert(specsOf(t.GetRates("key-1")), DeepEquals, []RateSpec{{"1s", 10, 20}})
+	c.Assert(specsOf(t.GetRates("acme-prod")), DeepEquals, []RateSpec{{"1s", 10, 20}})
+	// The most specific wildcard wins
+	c.Assert(specsOf(t.GetRates("acme-1-test")), DeepEquals, []RateSpec{{"1s", 2, 2}, {"1m0s", 60, 10}})
+	c.Assert(specsOf(t.GetRates("key-2")), DeepEquals, []RateSpec{{"1s", 1, 1}})
+
+	// Without the default tier the limiter uses its default rates
+	c.Assert(t.Update(&RateConfig{}), IsNil)
+	c.Assert(len(t.GetRates("key-1").m), Equals, 0)
+}
+
+func (s *RateTableSuite) TestInvalidConfig(c *C) {
+	_, err := NewRateTable(nil)
+	c.Assert(err, NotNil)
+
+	t := s.newTable(c, jsonRates)
+	free := []RateSpec{{"1s", 1, 1}}
+	for _, cfg := range []*RateConfig{
+		nil,
+		{Default: "gold", Tiers: map[string][]RateSpec{"free": free}},
+		{Tiers: map[string][]RateSpec{"free": {{"1 sec", 1, 1}}}},
+		{Tiers: map[string][]RateSpec{"free": {{"1s", 0, 1}}}},
+		{Tiers: map[string][]RateSpec{"free": {}}},
+		{Tokens: []TokenRates{{Token: "key-1", Tier: "gold"}}},
+		{Tokens: []TokenRates{{Tier: "free"}}},
+		{Tiers: map[string][]RateSpec{"free": free}, Tokens: []TokenRates{{Token: "key-1", Tier: "free", Rates: free}}},
+		{Tiers: map[string][]RateSpec{"free": free}, Tokens: []TokenRates{{Token: "key-1", Tier: "free"}, {Token: "key-1", Tier: "free"}}},
+	} {
+		c.Assert(t.Update(cfg), NotNil)
+	}
+	// Table is left intact
+	c.Assert(specsOf(t.GetRates("key-1")), DeepEquals, []RateSpec{{"1s", 10, 20}})
+}
+
+func (s *RateTableSuite) TestMatchWildcard(c *C) {
+	cases := []struct {
+		pattern string
+		token   string
+		match   bool
+	}{
+		{"acme-*", "acme-1", true},
+		{"acme-*", "acme-", true},
+		{"acme-*", "other", false},
+		{"*-test", "acme-test", true},
+		{"*-test", "acme-prod", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+		{"a*a", "a", false},
+		{"*", "", true},
+	}
+	for _, tc := range cases {
+		c.Assert(matchWildcard(tc.pattern, tc.token), Equals, tc.match, Commentf("%s %s", tc.pattern, tc.token))
+	}
+}
+
+// Changed rates apply to the existing buckets of the tokens
+func (s *RateTableSuite) TestLimiterUpdate(c *C) {
+	t := s.newTable(c, jsonRates)
+	tl, err := NewLimiterWithOptions(s.defaultRates(), limit.MakeMapRequestHeader("X-Api-Key"), Options{ConfigMapper: t.ConfigMapper, Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	_, err = tl.ProcessRequest(makeKeyRequest("key-2"))
+	c.Assert(err, IsNil)
+	_, err = tl.ProcessRequest(makeKeyRequest("key-2"))
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+
+	// Upgrade the token to pro
+	cfg, err := ParseJsonRateConfig([]byte(jsonRates))
+	c.Assert(err, IsNil)
+	cfg.Tokens = append(cfg.Tokens, TokenRates{Token: "key-2", Tier: "pro"})
+	c.Assert(t.Update(cfg), IsNil)
+
+	s.clock.Sleep(time.Second)
+	for i := 0; i < 10; i++ {
+		_, err = tl.ProcessRequest(makeKeyRequest("key-2"))
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *RateTableSuite) TestWatchFile(c *C) {
+	path := filepath.Join(c.MkDir(), "rates.json")
+	c.Assert(ioutil.WriteFile(path, []byte(jsonRates), 0600), IsNil)
+
+	t := s.newTable(c, "{}")
+	c.Assert(t.WatchFile(path, 0), NotNil)
+	c.Assert(t.WatchFile(filepath.Join(c.MkDir(), "missing.json"), 10*time.Millisecond), NotNil)
+	c.Assert(t.WatchFile(path, 10*time.Millisecond), IsNil)
+	defer t.Close()
+	c.Assert(t.WatchFile(path, 10*time.Millisecond), NotNil)
+	c.Assert(specsOf(t.GetRates("key-2")), DeepEquals, []RateSpec{{"1s", 1, 1}})
+
+	cfg := &RateConfig{Default: "pro", Tiers: map[string][]RateSpec{"pro": {{"1s", 10, 20}}}}
+	s.writeFile(c, path, cfg, time.Now().Add(time.Minute))
+	s.waitRates(c, t, "key-2", []RateSpec{{"1s", 10, 20}})
+
+	// Invalid config is ignored
+	s.writeFile(c, path, &RateConfig{Default: "gold"}, time.Now().Add(2*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(specsOf(t.GetRates("key-2")), DeepEquals, []RateSpec{{"1s", 10, 20}})
+
+	c.Assert(t.Close(), IsNil)
+	c.Assert(t.Close(), IsNil)
+}
+
+func (s *RateTableSuite) TestCsvFile(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "rates.csv")
+	c.Assert(ioutil.WriteFile(path, []byte(csvRates), 0600), IsNil)
+	t := s.newTable(c, "{}")
+	c.Assert(t.LoadFile(path), IsNil)
+	c.Assert(specsOf(t.GetRates("key-1")), DeepEquals, []RateSpec{{"1s", 10, 20}})
+
+	path = filepath.Join(dir, "rates.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(csvRates), 0600), IsNil)
+	c.Assert(t.LoadFile(path), NotNil)
+}
+
+func (s *RateTableSuite) TestAdmin(c *C) {
+	t := s.newTable(c, "{}")
+	admin := httptest.NewServer(NewRateTableHandler(t))
+	defer admin.Close()
+
+	re, err := http.DefaultClient.Do(newAdminRequest(c, "PUT", admin.URL+"/rates", jsonRates))
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(specsOf(t.GetRates("key-1")), DeepEquals, []RateSpec{{"1s", 10, 20}})
+
+	var cfg RateConfig
+	c.Assert(getJson(c, admin.URL+"/rates", &cfg), Equals, http.StatusOK)
+	c.Assert(cfg.Default, Equals, "free")
+	c.Assert(len(cfg.Tokens), Equals, 3)
+
+	var token struct {
+		Token string
+		Rates []RateSpec
+	}
+	c.Assert(getJson(c, admin.URL+"/rates/acme-1-test", &token), Equals, http.StatusOK)
+	c.Assert(token.Token, Equals, "acme-1-test")
+	c.Assert(token.Rates, DeepEquals, []RateSpec{{"1s", 2, 2}, {"1m0s", 60, 10}})
+
+	for _, body := range []string{"{", `{"default": "gold"}`} {
+		re, err := http.DefaultClient.Do(newAdminRequest(c, "PUT", admin.URL+"/rates", body))
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	}
+
+	c.Assert(getJson(c, admin.URL+"/other", &cfg), Equals, http.StatusNotFound)
+}
+
+func (s *RateTableSuite) newTable(c *C, config string) *RateTable {
+	t, err := NewRateTable(limit.MakeRequestToHeader("X-Api-Key"))
+	c.Assert(err, IsNil)
+	cfg, err := ParseJsonRateConfig([]byte(config))
+	c.Assert(err, IsNil)
+	c.Assert(t.Update(cfg), IsNil)
+	return t
+}
+
+func (s *RateTableSuite) defaultRates() *RateSet {
+	rates := NewRateSet()
+	rates.Add(time.Second, 100, 100)
+	return rates
+}
+
+func (s *RateTableSuite) writeFile(c *C, path string, cfg *RateConfig, mtime time.Time) {
+	data, err := json.Marshal(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(path, data, 0600), IsNil)
+	// Make sure the change is noticed even if the file system has coarse timestamps
+	c.Assert(os.Chtimes(path, mtime, mtime), IsNil)
+}
+
+func (s *RateTableSuite) waitRates(c *C, t *RateTable, token string, expected []RateSpec) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if reflect.DeepEqual(specsOf(t.GetRates(token)), expected) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("Rates of %s were not reloaded: %v", token, specsOf(t.GetRates(token)))
+}
+
+func newAdminRequest(c *C, method, url, body string) *http.Request {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	return req
+}
+
+func getJson(c *C, url string, value interface{}) int {
+	re, err := http.Get(url)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	json.Unmarshal(body, value)
+	return re.StatusCode
+}
+
+func makeKeyRequest(key string) request.Request {
+	req := &http.Request{RemoteAddr: "1.2.3.4", Header: make(http.Header)}
+	req.Header.Set("X-Api-Key", key)
+	return request.NewBaseRequest(req, 1, nil)
+}
@@ -0,0 +1,361 @@
+package tokenbucket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
+)
+
+const (
+	DefaultKeyPrefix = "vulcan:tb:"
+	DefaultPoolSize  = 16
+	DefaultTimeout   = time.Second
+)
+
+// gcraScript consumes or returns the tokens of all buckets of the tokens atomically. Buckets are stored
+// as the theoretical arrival time (https://en.wikipedia.org/wiki/Generic_cell_rate_algorithm) in microseconds,
+// that is equivalent to the token bucket with the refill interval and the burst tolerance.
+//
+// KEYS: one key per rate of every token
+// ARGV: now, rollback flag, then the token number (starting from 1), the amount, the interval and the tolerance
+// of every key, keys of the same token go one after another
+// Returns four numbers per token: the delay in microseconds (0 if the tokens were consumed), then the burst,
+// the number of tokens left and the time in microseconds until the bucket is full of the bucket with the fewest
+// tokens left. Tokens are not consumed if any token has the delay.
+const gcraScript = `
+local now = tonumber(ARGV[1])
+local rollback = ARGV[2] == "1"
+local tats = {}
+local news = {}
+local delays = {}
+local blocked = false
+for i, key in ipairs(KEYS) do
+	local token = tonumber(ARGV[i * 4 - 1])
+	local amount = tonumber(ARGV[i * 4])
+	local interval = tonumber(ARGV[i * 4 + 1])
+	local tolerance = tonumber(ARGV[i * 4 + 2])
+	tats[i] = math.max(tonumber(redis.call("GET", key) or now), now)
+	delays[token] = delays[token] or 0
+	if rollback then
+		news[i] = math.max(tats[i] - amount * interval, now)
+	else
+		news[i] = tats[i] + amount * interval
+		delays[token] = math.max(delays[token], news[i] - now - tolerance)
+		blocked = blocked or delays[token] > 0
+	end
+end
+if not blocked then
+	for i, key in ipairs(KEYS) do
+		redis.call("SET", key, string.format("%d", news[i]), "PX", math.floor((news[i] - now) / 1000) + 1)
+		tats[i] = news[i]
+	end
+end
+local reply = {}
+for i = 1, #KEYS do
+	local token = tonumber(ARGV[i * 4 - 1])
+	local interval = tonumber(ARGV[i * 4 + 1])
+	local tolerance = tonumber(ARGV[i * 4 + 2])
+	local left = math.floor((now + tolerance - tats[i]) / interval)
+	local j = token * 4 - 3
+	if reply[j] == nil or left < reply[j + 2] or (left == reply[j + 2] and tats[i] - now > reply[j + 3]) then
+		reply[j], reply[j + 1], reply[j + 2], reply[j + 3] = delays[token], math.floor(tolerance / interval), left, tats[i] - now
+	end
+end
+return reply
+`
+
+var gcraScriptSha = func() string {
+	sum := sha1.Sum([]byte(gcraScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+type RedisOptions struct {
+	// Password sent with AUTH command, AUTH is not sent if it's empty
+	Password string
+	// Database selected with SELECT command
+	Database int
+	// Prefix of the bucket keys, DefaultKeyPrefix is used if it's empty
+	KeyPrefix string
+	// Maximum number of idle connections kept open, DefaultPoolSize is used if it's 0
+	PoolSize int
+	// Timeout of connecting to the server and of every command, DefaultTimeout is used if it's 0
+	Timeout time.Duration
+	// Interface that gives current time (so tests can override)
+	Clock timetools.TimeProvider
+}
+
+// RedisStore keeps the buckets in Redis, so all proxies using the same server share the rates.
+// Buckets are updated atomically by the Lua script, every request takes one round trip to the server.
+// Buckets are refilled with the microsecond precision, so the rates of more than one token per microsecond are rejected.
+type RedisStore struct {
+	addr    string
+	options RedisOptions
+	pool    chan *redisConn
+}
+
+// NewRedisStore creates a store using Redis server at the address, e.g. localhost:6379
+func NewRedisStore(addr string) (*RedisStore, error) {
+	return NewRedisStoreWithOptions(addr, RedisOptions{})
+}
+
+func NewRedisStoreWithOptions(addr string, o RedisOptions) (*RedisStore, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("Provide Redis address")
+	}
+	if o.KeyPrefix == "" {
+		o.KeyPrefix = DefaultKeyPrefix
+	}
+	if o.PoolSize <= 0 {
+		o.PoolSize = DefaultPoolSize
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Clock == nil {
+		o.Clock = &timetools.RealTime{}
+	}
+	return &RedisStore{
+		addr:    addr,
+		options: o,
+		pool:    make(chan *redisConn, o.PoolSize),
+	}, nil
+}
+
+func (s *RedisStore) Consume(token string, rates *RateSet, amount int64) (Status, error) {
+	statuses, err := s.ConsumeAll([]Consumption{{Token: token, Rates: rates, Amount: amount}})
+	if err != nil {
+		return Status{Delay: UndefinedDelay}, err
+	}
+	return statuses[0], nil
+}
+
+func (s *RedisStore) ConsumeAll(cs []Consumption) ([]Status, error) {
+	if err := checkConsumptions(cs); err != nil {
+		return nil, err
+	}
+	reply, err := s.eval(cs, false)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, len(cs))
+	for i := range statuses {
+		statuses[i] = Status{
+			Delay: time.Duration(reply[i*4]) * time.Microsecond,
+			Quota: limit.Quota{
+				Limit:     reply[i*4+1],
+				Remaining: reply[i*4+2],
+				Reset:     time.Duration(reply[i*4+3]) * time.Microsecond,
+			},
+		}
+	}
+	return statuses, nil
+}
+
+func (s *RedisStore) Rollback(token string, rates *RateSet, amount int64) error {
+	_, err := s.eval([]Consumption{{Token: token, Rates: rates, Amount: amount}}, true)
+	return err
+}
+
+// Close closes the idle connections
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.pool:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// eval runs the script and returns its reply
+func (s *RedisStore) eval(cs []Consumption, rollback bool) ([]int64, error) {
+	keys := []string{}
+	args := []string{
+		strconv.FormatInt(s.options.Clock.UtcNow().UnixNano()/int64(time.Microsecond), 10),
+		"0",
+	}
+	if rollback {
+		args[1] = "1"
+	}
+	for i, c := range cs {
+		// Sort rates by period, so keys and arguments are always in the same order
+		periods := make([]int, 0, len(c.Rates.m))
+		for period := range c.Rates.m {
+			periods = append(periods, int(period))
+		}
+		sort.Ints(periods)
+
+		for _, period := range periods {
+			r := c.Rates.m[time.Duration(period)]
+			interval := int64(r.period/time.Microsecond) / r.average
+			if interval == 0 {
+				return nil, fmt.Errorf("Rate %v is too high, Redis store supports up to one token per microsecond", r)
+			}
+			keys = append(keys, fmt.Sprintf("%s%s:%d", s.options.KeyPrefix, c.Token, period))
+			args = append(args,
+				strconv.Itoa(i+1), strconv.FormatInt(c.Amount, 10),
+				strconv.FormatInt(interval, 10), strconv.FormatInt(interval*r.burst, 10))
+		}
+	}
+
+	c, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.evalScript(keys, args)
+	if err != nil {
+		// Server replies with errors, e.g. NOSCRIPT, are not connection failures
+		if _, ok := err.(redisError); !ok {
+			c.Close()
+			return nil, err
+		}
+	}
+	s.putConn(c)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != len(cs)*4 {
+		return nil, fmt.Errorf("Unexpected reply from Redis: %v", reply)
+	}
+	values := make([]int64, len(items))
+	for i, item := range items {
+		if values[i], ok = item.(int64); !ok {
+			return nil, fmt.Errorf("Unexpected reply from Redis: %v", reply)
+		}
+	}
+	return values, nil
+}
+
+func (s *RedisStore) getConn() (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, s.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), timeout: s.options.Timeout}
+	if s.options.Password != "" {
+		if _, err := c.do("AUTH", s.options.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if s.options.Database != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.options.Database)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *RedisStore) putConn(c *redisConn) {
+	select {
+	case s.pool <- c:
+	default:
+		c.Close()
+	}
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisConn speaks Redis serialization protocol, see https://redis.io/docs/reference/protocol-spec/
+type redisConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// evalScript runs the script by the hash, loading it with EVAL if the server does not have it cached
+func (c *redisConn) evalScript(keys, args []string) (interface{}, error) {
+	cmd := append([]string{"EVALSHA", gcraScriptSha, strconv.Itoa(len(keys))}, keys...)
+	reply, err := c.do(append(cmd, args...)...)
+	if e, ok := err.(redisError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", gcraScript
+		return c.do(append(cmd, args...)...)
+	}
+	return reply, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	w := bufio.NewWriter(c.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// readReply reads the reply: strings are returned as strings, integers as int64, nil bulk strings
+// and arrays as nil, arrays as []interface{} and errors as redisError
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("Bad Redis reply: %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		out := make([]interface{}, count)
+		for i := range out {
+			if out[i], err = readReply(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("Bad Redis reply: %q", line)
+}
@@ -0,0 +1,420 @@
+package tokenbucket
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/limit"
+	. "gopkg.in/check.v1"
+)
+
+type RedisSuite struct {
+	clock  *timetools.FreezedTime
+	server *testRedis
+}
+
+var _ = Suite(&RedisSuite{})
+
+func (s *RedisSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	server, err := newTestRedis("secret")
+	c.Assert(err, IsNil)
+	s.server = server
+}
+
+func (s *RedisSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *RedisSuite) newStore(c *C) *RedisStore {
+	store, err := NewRedisStoreWithOptions(s.server.Addr(), RedisOptions{Password: "secret", Database: 2, Clock: s.clock})
+	c.Assert(err, IsNil)
+	return store
+}
+
+func (s *RedisSuite) TestBadParams(c *C) {
+	_, err := NewRedisStore("")
+	c.Assert(err, NotNil)
+}
+
+func (s *RedisSuite) TestConsume(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+	rates := NewRateSet()
+	rates.Add(time.Second, 2, 2)
+	rates.Add(time.Minute, 10, 10)
+
+	for i := 0; i < 2; i++ {
+		res, err := store.Consume("a", rates, 1)
+		c.Assert(err, IsNil)
+		c.Assert(res.Delay, Equals, time.Duration(0))
+	}
+	res, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, 500*time.Millisecond)
+	c.Assert(res.Quota, Equals, limit.Quota{Limit: 2, Remaining: 0, Reset: time.Second})
+
+	s.clock.Sleep(500 * time.Millisecond)
+	res, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+
+	// Second bucket is further from being exhausted
+	s.clock.Sleep(time.Second)
+	res, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Quota, Equals, limit.Quota{Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond})
+
+	_, err = store.Consume("a", rates, 3)
+	c.Assert(err, NotNil)
+
+	// Every rate is kept under its own key in the selected database
+	c.Assert(s.server.Keys(2), DeepEquals, []string{"vulcan:tb:a:1000000000", "vulcan:tb:a:60000000000"})
+}
+
+// Stores connected to the same server share the buckets
+func (s *RedisSuite) TestSharedBuckets(c *C) {
+	a, b := s.newStore(c), s.newStore(c)
+	defer a.Close()
+	defer b.Close()
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+
+	res, err := a.Consume("token", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+
+	res, err = b.Consume("token", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Second)
+
+	c.Assert(a.Rollback("token", rates, 1), IsNil)
+	res, err = b.Consume("token", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+}
+
+// Script is loaded once and is then called by the hash on the pooled connection
+func (s *RedisSuite) TestScriptCaching(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+	rates := NewRateSet()
+	rates.Add(time.Second, 10, 10)
+
+	for i := 0; i < 3; i++ {
+		_, err := store.Consume("a", rates, 1)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.server.Count("EVAL"), Equals, 1)
+	c.Assert(s.server.Count("EVALSHA"), Equals, 3)
+	c.Assert(s.server.Count("AUTH"), Equals, 1)
+}
+
+func (s *RedisSuite) TestBadPassword(c *C) {
+	store, err := NewRedisStoreWithOptions(s.server.Addr(), RedisOptions{Password: "wrong", Clock: s.clock})
+	c.Assert(err, IsNil)
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+
+	_, err = store.Consume("a", rates, 1)
+	c.Assert(err, NotNil)
+}
+
+func (s *RedisSuite) TestServerDown(c *C) {
+	store := s.newStore(c)
+	s.server.Close()
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+
+	_, err := store.Consume("a", rates, 1)
+	c.Assert(err, NotNil)
+}
+
+func (s *RedisSuite) TestConsumeAll(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+	checkConsumeAll(c, store)
+	// Tokens are consumed in one round trip
+	c.Assert(s.server.Count("EVAL")+s.server.Count("EVALSHA"), Equals, 4)
+}
+
+// Rates refilled faster than the microsecond precision of the buckets are rejected
+func (s *RedisSuite) TestRateTooHigh(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+	rates := NewRateSet()
+	rates.Add(time.Millisecond, 2000, 2000)
+
+	_, err := store.Consume("a", rates, 1)
+	c.Assert(err, NotNil)
+	c.Assert(s.server.Count("EVALSHA"), Equals, 0)
+}
+
+// RealRedisSuite runs the script on the Redis server at REDIS_ADDR, it's skipped if the variable is not set
+type RealRedisSuite struct {
+	clock *timetools.FreezedTime
+	store *RedisStore
+}
+
+var _ = Suite(&RealRedisSuite{})
+
+func (s *RealRedisSuite) SetUpSuite(c *C) {
+	if os.Getenv("REDIS_ADDR") == "" {
+		c.Skip("REDIS_ADDR is not set")
+	}
+}
+
+func (s *RealRedisSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	store, err := NewRedisStoreWithOptions(os.Getenv("REDIS_ADDR"), RedisOptions{
+		Password: os.Getenv("REDIS_PASSWORD"),
+		// Every test gets its own buckets
+		KeyPrefix: fmt.Sprintf("vulcan:test:%d:", time.Now().UnixNano()),
+		Clock:     s.clock,
+	})
+	c.Assert(err, IsNil)
+	s.store = store
+}
+
+func (s *RealRedisSuite) TearDownTest(c *C) {
+	s.store.Close()
+}
+
+func (s *RealRedisSuite) TestConsume(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 2, 2)
+	rates.Add(time.Minute, 10, 10)
+
+	for i := 0; i < 2; i++ {
+		res, err := s.store.Consume("a", rates, 1)
+		c.Assert(err, IsNil)
+		c.Assert(res.Delay, Equals, time.Duration(0))
+	}
+	res, err := s.store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, 500*time.Millisecond)
+	c.Assert(res.Quota, Equals, limit.Quota{Limit: 2, Remaining: 0, Reset: time.Second})
+
+	s.clock.Sleep(500 * time.Millisecond)
+	res, err = s.store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+
+	s.clock.Sleep(time.Second)
+	res, err = s.store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Quota, Equals, limit.Quota{Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond})
+}
+
+func (s *RealRedisSuite) TestConsumeAll(c *C) {
+	checkConsumeAll(c, s.store)
+}
+
+func (s *RealRedisSuite) TestRollback(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+
+	res, err := s.store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+	res, err = s.store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Second)
+
+	c.Assert(s.store.Rollback("a", rates, 1), IsNil)
+	res, err = s.store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+}
+
+// testRedis is a local stand-in for Redis server that supports the commands used by the store
+// and runs the Go version of the script
+type testRedis struct {
+	listener net.Listener
+	password string
+	mutex    *sync.Mutex
+	data     map[int]map[string]string
+	scripts  map[string]bool
+	counts   map[string]int
+}
+
+func newTestRedis(password string) (*testRedis, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r := &testRedis{
+		listener: l,
+		password: password,
+		mutex:    &sync.Mutex{},
+		data:     make(map[int]map[string]string),
+		scripts:  make(map[string]bool),
+		counts:   make(map[string]int),
+	}
+	go r.serve()
+	return r, nil
+}
+
+func (r *testRedis) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *testRedis) Close() {
+	r.listener.Close()
+}
+
+func (r *testRedis) Count(cmd string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.counts[cmd]
+}
+
+func (r *testRedis) Keys(db int) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	keys := []string{}
+	for k := range r.data[db] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *testRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *testRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authorized, db := r.password == "", 0
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) == 0 {
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = item.(string)
+		}
+		cmd := strings.ToUpper(args[0])
+
+		r.mutex.Lock()
+		r.counts[cmd]++
+		var out string
+		switch {
+		case cmd == "AUTH":
+			if args[1] == r.password {
+				authorized = true
+				out = "+OK\r\n"
+			} else {
+				out = "-WRONGPASS invalid password\r\n"
+			}
+		case !authorized:
+			out = "-NOAUTH Authentication required\r\n"
+		case cmd == "SELECT":
+			db, _ = strconv.Atoi(args[1])
+			out = "+OK\r\n"
+		case cmd == "EVALSHA" && !r.scripts[args[1]]:
+			out = "-NOSCRIPT No matching script\r\n"
+		case cmd == "EVAL" && args[1] != gcraScript:
+			out = "-ERR unknown script\r\n"
+		case cmd == "EVAL" || cmd == "EVALSHA":
+			r.scripts[gcraScriptSha] = true
+			numKeys, _ := strconv.Atoi(args[2])
+			reply := r.gcra(db, args[3:3+numKeys], args[3+numKeys:])
+			out = fmt.Sprintf("*%d\r\n", len(reply))
+			for _, v := range reply {
+				out += fmt.Sprintf(":%d\r\n", v)
+			}
+		default:
+			out = "-ERR unknown command\r\n"
+		}
+		r.mutex.Unlock()
+
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+// gcra mirrors gcraScript
+func (r *testRedis) gcra(db int, keys, argv []string) []int64 {
+	if r.data[db] == nil {
+		r.data[db] = make(map[string]string)
+	}
+	arg := func(i int) int64 {
+		v, _ := strconv.ParseInt(argv[i], 10, 64)
+		return v
+	}
+	now, rollback := arg(0), argv[1] == "1"
+	tats := make([]int64, len(keys))
+	news := make([]int64, len(keys))
+	delays := []int64{}
+	blocked := false
+	for i, key := range keys {
+		token, amount, interval, tolerance := int(arg(2+i*4)), arg(3+i*4), arg(4+i*4), arg(5+i*4)
+		tats[i] = now
+		if v, ok := r.data[db][key]; ok {
+			tats[i], _ = strconv.ParseInt(v, 10, 64)
+		}
+		tats[i] = maxInt64(tats[i], now)
+		if len(delays) < token {
+			delays = append(delays, 0)
+		}
+		if rollback {
+			news[i] = maxInt64(tats[i]-amount*interval, now)
+		} else {
+			news[i] = tats[i] + amount*interval
+			delays[token-1] = maxInt64(delays[token-1], news[i]-now-tolerance)
+			blocked = blocked || delays[token-1] > 0
+		}
+	}
+	if !blocked {
+		for i, key := range keys {
+			r.data[db][key] = strconv.FormatInt(news[i], 10)
+			tats[i] = news[i]
+		}
+	}
+	reply := make([]int64, 0, len(delays)*4)
+	for i := range keys {
+		token, interval, tolerance := int(arg(2+i*4)), arg(4+i*4), arg(5+i*4)
+		left := (now + tolerance - tats[i]) / interval
+		j := (token - 1) * 4
+		if len(reply) == j {
+			reply = append(reply, delays[token-1], tolerance/interval, left, tats[i]-now)
+		} else if left < reply[j+2] || (left == reply[j+2] && tats[i]-now > reply[j+3]) {
+			reply[j+1], reply[j+2], reply[j+3] = tolerance/interval, left, tats[i]-now
+		}
+	}
+	return reply
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,185 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/mailgun/vulcan/limit"
+)
+
+// Store keeps the state of the token buckets. Stores shared by several proxies, e.g. RedisStore,
+// make the proxies enforce the rates together, instead of every proxy granting the full rate.
+type Store interface {
+	// Consume atomically takes the amount of tokens from the buckets of the token, one bucket per rate.
+	// Tokens are taken from all buckets or from none of them. Returns error if the amount exceeds the burst.
+	Consume(token string, rates *RateSet, amount int64) (Status, error)
+	// ConsumeAll atomically takes the tokens of all consumptions: tokens are taken from the buckets of every
+	// token or from none of them. Returns the status of every consumption, no tokens were taken if any of them
+	// has the delay. Returns error if the tokens repeat or any amount exceeds the burst.
+	ConsumeAll(cs []Consumption) ([]Status, error)
+	// Rollback atomically returns the amount of tokens consumed earlier to the buckets of the token
+	Rollback(token string, rates *RateSet, amount int64) error
+}
+
+// Consumption is the amount of tokens to take from the buckets of the token
+type Consumption struct {
+	Token  string
+	Rates  *RateSet
+	Amount int64
+}
+
+// Status of the buckets after consuming the tokens
+type Status struct {
+	// Time to wait until the tokens become available, 0 if they were consumed
+	Delay time.Duration
+	// Quota of the bucket with the fewest tokens left
+	Quota limit.Quota
+}
+
+// MemoryStore keeps the buckets in the process memory, every proxy enforces the rates on its own
+type MemoryStore struct {
+	mutex      *sync.Mutex
+	clock      timetools.TimeProvider
+	bucketSets *ttlmap.TtlMap
+}
+
+// NewMemoryStore creates a store holding the buckets for up to capacity tokens, DefaultCapacity is used if it's 0
+func NewMemoryStore(capacity int, clock timetools.TimeProvider) (*MemoryStore, error) {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	if clock == nil {
+		clock = &timetools.RealTime{}
+	}
+	bucketSets, err := ttlmap.NewMapWithProvider(capacity, clock)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryStore{
+		mutex:      &sync.Mutex{},
+		clock:      clock,
+		bucketSets: bucketSets,
+	}, nil
+}
+
+func (s *MemoryStore) Consume(token string, rates *RateSet, amount int64) (Status, error) {
+	statuses, err := s.ConsumeAll([]Consumption{{Token: token, Rates: rates, Amount: amount}})
+	if err != nil {
+		return Status{Delay: UndefinedDelay}, err
+	}
+	return statuses[0], nil
+}
+
+func (s *MemoryStore) ConsumeAll(cs []Consumption) ([]Status, error) {
+	if err := checkConsumptions(cs); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucketSets := make([]*tokenBucketSet, len(cs))
+	statuses := make([]Status, len(cs))
+	rejected := false
+	for i, c := range cs {
+		bucketSets[i] = s.getBucketSet(c.Token, c.Rates)
+		delay, err := bucketSets[i].consume(c.Amount)
+		if err != nil {
+			for _, bucketSet := range bucketSets[:i] {
+				bucketSet.rollback()
+			}
+			return nil, err
+		}
+		statuses[i] = Status{Delay: delay, Quota: bucketSets[i].quota()}
+		rejected = rejected || delay > 0
+	}
+	if rejected {
+		// Buckets are still locked, so rolling back the consumptions returns them to the state before the call
+		for i, bucketSet := range bucketSets {
+			bucketSet.rollback()
+			statuses[i].Quota = bucketSet.quota()
+		}
+	}
+	return statuses, nil
+}
+
+func (s *MemoryStore) Rollback(token string, rates *RateSet, amount int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucketSetI, exists := s.bucketSets.Get(token)
+	if !exists {
+		// Buckets have expired, so they are full anyway
+		return nil
+	}
+	bucketSet := bucketSetI.(*tokenBucketSet)
+	bucketSet.update(rates)
+	bucketSet.refund(amount)
+	return nil
+}
+
+// getBucketSet returns the buckets of the token updated to the rates, creating them if the token has none
+func (s *MemoryStore) getBucketSet(token string, rates *RateSet) *tokenBucketSet {
+	bucketSetI, exists := s.bucketSets.Get(token)
+	if !exists {
+		bucketSet := newTokenBucketSet(rates, s.clock)
+		s.bucketSets.Set(token, bucketSet, bucketSetTtl(bucketSet))
+		return bucketSet
+	}
+	bucketSet := bucketSetI.(*tokenBucketSet)
+	maxPeriod := bucketSet.maxPeriod
+	// Rates of the token could have changed, e.g. the rate table was reloaded, the buckets keep their tokens
+	bucketSet.update(rates)
+	if bucketSet.maxPeriod != maxPeriod {
+		s.bucketSets.Set(token, bucketSet, bucketSetTtl(bucketSet))
+	}
+	return bucketSet
+}
+
+// bucketSetTtl returns the ttl of the buckets in seconds. We set ttl as 10 times rate period. E.g. if rate is
+// 100 requests/second per client ip the counters for this ip will expire after 10 seconds of inactivity
+func bucketSetTtl(bucketSet *tokenBucketSet) int {
+	return int(bucketSet.maxPeriod/time.Second)*10 + 1
+}
+
+// checkBurst returns error if the amount can never be consumed from the buckets of the rates
+func checkBurst(rates *RateSet, amount int64) error {
+	for _, r := range rates.m {
+		if amount > r.burst {
+			return fmt.Errorf("Requested tokens larger than max tokens")
+		}
+	}
+	return nil
+}
+
+// checkConsumptions returns error if the tokens repeat, have no rates or any of the amounts can never be consumed
+func checkConsumptions(cs []Consumption) error {
+	tokens := make(map[string]bool, len(cs))
+	for _, c := range cs {
+		if c.Rates == nil || len(c.Rates.m) == 0 {
+			return fmt.Errorf("Provide rates of token: '%s'", c.Token)
+		}
+		if tokens[c.Token] {
+			return fmt.Errorf("Duplicate token: '%s'", c.Token)
+		}
+		tokens[c.Token] = true
+		if err := checkBurst(c.Rates, c.Amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// minBurst returns the burst of the smallest bucket
+func minBurst(rates *RateSet) int64 {
+	burst := int64(0)
+	for _, r := range rates.m {
+		if burst == 0 || r.burst < burst {
+			burst = r.burst
+		}
+	}
+	return burst
+}
@@ -0,0 +1,205 @@
+package tokenbucket
+
+import (
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
+	. "gopkg.in/check.v1"
+)
+
+type StoreSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&StoreSuite{})
+
+func (s *StoreSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *StoreSuite) TestMemoryStore(c *C) {
+	store, err := NewMemoryStore(0, s.clock)
+	c.Assert(err, IsNil)
+	rates := NewRateSet()
+	rates.Add(time.Second, 2, 2)
+
+	for i := 0; i < 2; i++ {
+		res, err := store.Consume("a", rates, 1)
+		c.Assert(err, IsNil)
+		c.Assert(res.Delay, Equals, time.Duration(0))
+	}
+	res, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, 500*time.Millisecond)
+	c.Assert(res.Quota, Equals, limit.Quota{Limit: 2, Remaining: 0, Reset: time.Second})
+
+	// Other tokens have their own buckets
+	res, err = store.Consume("b", rates, 2)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+
+	c.Assert(store.Rollback("a", rates, 1), IsNil)
+	res, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+
+	// Buckets never hold more than the burst
+	c.Assert(store.Rollback("b", rates, 10), IsNil)
+	res, err = store.Consume("b", rates, 3)
+	c.Assert(err, NotNil)
+	c.Assert(store.Rollback("missing", rates, 1), IsNil)
+}
+
+func (s *StoreSuite) TestMemoryStoreConsumeAll(c *C) {
+	store, err := NewMemoryStore(0, s.clock)
+	c.Assert(err, IsNil)
+	checkConsumeAll(c, store)
+}
+
+func (s *StoreSuite) TestCachedStoreConsumeAll(c *C) {
+	shared, err := NewMemoryStore(0, s.clock)
+	c.Assert(err, IsNil)
+	cached, err := NewCachedStore(shared, CachedOptions{SyncPeriod: time.Hour, Clock: s.clock})
+	c.Assert(err, IsNil)
+	defer cached.Close()
+	checkConsumeAll(c, cached)
+}
+
+// checkConsumeAll checks that the store takes the tokens from the buckets of all tokens or from none of them
+func checkConsumeAll(c *C, store Store) {
+	small, large := NewRateSet(), NewRateSet()
+	small.Add(time.Second, 1, 1)
+	large.Add(time.Second, 2, 2)
+	cs := []Consumption{{Token: "a", Rates: large, Amount: 1}, {Token: "b", Rates: small, Amount: 1}}
+
+	statuses, err := store.ConsumeAll(cs)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, DeepEquals, []Status{
+		{Quota: limit.Quota{Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond}},
+		{Quota: limit.Quota{Limit: 1, Remaining: 0, Reset: time.Second}},
+	})
+
+	// Second token is exhausted, so the first one keeps its tokens
+	statuses, err = store.ConsumeAll(cs)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, DeepEquals, []Status{
+		{Quota: limit.Quota{Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond}},
+		{Delay: time.Second, Quota: limit.Quota{Limit: 1, Remaining: 0, Reset: time.Second}},
+	})
+	res, err := store.Consume("a", large, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+
+	_, err = store.ConsumeAll([]Consumption{{Token: "c", Rates: large, Amount: 1}, {Token: "c", Rates: small, Amount: 1}})
+	c.Assert(err, NotNil)
+	_, err = store.ConsumeAll([]Consumption{{Token: "c", Rates: large, Amount: 1}, {Token: "d", Rates: small, Amount: 2}})
+	c.Assert(err, NotNil)
+
+	// Tokens without rates are rejected rather than let through
+	for _, rates := range []*RateSet{nil, NewRateSet()} {
+		_, err = store.ConsumeAll([]Consumption{{Token: "c", Rates: large, Amount: 1}, {Token: "d", Rates: rates, Amount: 1}})
+		c.Assert(err, ErrorMatches, "Provide rates of token: 'd'")
+		_, err = store.Consume("d", rates, 1)
+		c.Assert(err, ErrorMatches, "Provide rates of token: 'd'")
+	}
+}
+
+// Limiters of the proxies sharing the store enforce the rate together
+func (s *StoreSuite) TestSharedStore(c *C) {
+	store, err := NewMemoryStore(0, s.clock)
+	c.Assert(err, IsNil)
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+
+	limiters := make([]*TokenLimiter, 2)
+	for i := range limiters {
+		limiters[i], err = NewLimiterWithOptions(rates, limit.MapClientIp, Options{Clock: s.clock, Store: store})
+		c.Assert(err, IsNil)
+	}
+
+	re, err := limiters[0].ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	re, err = limiters[1].ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+
+	s.clock.Sleep(time.Second)
+	re, err = limiters[1].ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+}
+
+func (s *StoreSuite) TestCachedStore(c *C) {
+	shared, err := NewMemoryStore(0, s.clock)
+	c.Assert(err, IsNil)
+	rates := NewRateSet()
+	rates.Add(time.Second, 2, 2)
+
+	_, err = NewCachedStore(nil, CachedOptions{})
+	c.Assert(err, NotNil)
+
+	proxies := make([]*CachedStore, 2)
+	for i := range proxies {
+		proxies[i], err = NewCachedStore(shared, CachedOptions{SyncPeriod: time.Hour, Clock: s.clock})
+		c.Assert(err, IsNil)
+		defer proxies[i].Close()
+	}
+
+	// Every proxy admits the full rate locally until the sync
+	for _, p := range proxies {
+		for i := 0; i < 2; i++ {
+			res, err := p.Consume("a", rates, 1)
+			c.Assert(err, IsNil)
+			c.Assert(res.Delay, Equals, time.Duration(0))
+		}
+		res, err := p.Consume("a", rates, 1)
+		c.Assert(err, IsNil)
+		c.Assert(res.Delay > 0, Equals, true)
+	}
+
+	// Once synced, the second proxy finds out the shared rate has been exceeded
+	proxies[0].Sync()
+	proxies[1].Sync()
+
+	s.clock.Sleep(500 * time.Millisecond)
+	res, err := proxies[0].Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+	res, err = proxies[1].Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, 500*time.Millisecond)
+
+	// Shared bucket has refilled
+	s.clock.Sleep(time.Second)
+	res, err = proxies[1].Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+}
+
+func (s *StoreSuite) TestCachedStoreRollback(c *C) {
+	shared, err := NewMemoryStore(0, s.clock)
+	c.Assert(err, IsNil)
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+
+	cached, err := NewCachedStore(shared, CachedOptions{SyncPeriod: time.Hour, Clock: s.clock})
+	c.Assert(err, IsNil)
+
+	res, err := cached.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+	c.Assert(cached.Rollback("a", rates, 1), IsNil)
+
+	// Nothing is pending, so the shared bucket is intact
+	c.Assert(cached.Close(), IsNil)
+	c.Assert(cached.Close(), IsNil)
+	res, err = shared.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.Delay, Equals, time.Duration(0))
+}
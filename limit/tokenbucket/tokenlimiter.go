@@ -4,19 +4,20 @@ package tokenbucket
 import (
 	"fmt"
 	"net/http"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mailgun/log"
 	"github.com/mailgun/timetools"
-	"github.com/mailgun/ttlmap"
 	"github.com/mailgun/vulcan/errors"
 	"github.com/mailgun/vulcan/limit"
-	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
 )
 
-const DefaultCapacity = 65536
+const (
+	DefaultCapacity   = 65536
+	DefaultMaxDelayed = 1024
+)
 
 // RateSet maintains a set of rates. It can contain only one rate per period at a time.
 type RateSet struct {
@@ -46,7 +47,7 @@ func (rs *RateSet) Add(period time.Duration, average int64, burst int64) error {
 	return nil
 }
 
-func (rs* RateSet) String() string {
+func (rs *RateSet) String() string {
 	return fmt.Sprint(rs.m)
 }
 
@@ -56,16 +57,53 @@ type ConfigMapperFn func(r request.Request) (*RateSet, error)
 
 // TokenLimiter implements rate limiting middleware.
 type TokenLimiter struct {
+	// Number of requests held at the moment, goes first to be 64-bit aligned for atomic operations
+	delayed int64
+	// Number of requests that would have been rejected in the dry run mode
+	dryRunRejections int64
+	// Number of requests the limiter has failed to process in the dry run mode, e.g. to map
+	dryRunErrors int64
 	defaultRates *RateSet
 	mapper       limit.MapperFn
 	configMapper ConfigMapperFn
 	clock        timetools.TimeProvider
-	mutex        sync.Mutex
-	bucketSets   *ttlmap.TtlMap
+	store        Store
+	maxDelay     time.Duration
+	maxDelayed   int64
+	dryRun       bool
+	// Key of the request user data keeping the quota until the response
+	quotaKey string
+}
+
+// Options defines optional parameters of the TokenLimiter
+type Options struct {
+	// Maximum number of tokens kept by the default in-memory store, DefaultCapacity is used if it's 0
+	Capacity int
+	// Retrieves the rates from the requests, the default rates are used if it's nil
+	ConfigMapper ConfigMapperFn
+	// Interface that gives current time (so tests can override)
+	Clock timetools.TimeProvider
+	// Store keeps the state of the buckets, e.g. RedisStore shared by the proxies.
+	// MemoryStore is used if it's nil
+	Store Store
+	// Maximum time the request is held until the tokens become available, instead of being rejected.
+	// This smooths the bursts of the clients. Requests are rejected right away if it's 0
+	MaxDelay time.Duration
+	// Maximum number of requests held at a time, requests are rejected when the queue is full.
+	// DefaultMaxDelayed is used if it's 0
+	MaxDelayed int
+	// DryRun lets all requests through, the requests that would have been rejected are logged and counted
+	// by GetDryRunRejections, so the rates can be tuned on the real traffic
+	DryRun bool
 }
 
 // NewLimiter constructs a `TokenLimiter` middleware instance.
 func NewLimiter(defaultRates *RateSet, capacity int, mapper limit.MapperFn, configMapper ConfigMapperFn, clock timetools.TimeProvider) (*TokenLimiter, error) {
+	return NewLimiterWithOptions(defaultRates, mapper, Options{Capacity: capacity, ConfigMapper: configMapper, Clock: clock})
+}
+
+// NewLimiterWithOptions constructs a `TokenLimiter` middleware instance keeping the buckets in the store.
+func NewLimiterWithOptions(defaultRates *RateSet, mapper limit.MapperFn, o Options) (*TokenLimiter, error) {
 	if defaultRates == nil || len(defaultRates.m) == 0 {
 		return nil, fmt.Errorf("Provide default rates")
 	}
@@ -74,25 +112,36 @@ func NewLimiter(defaultRates *RateSet, capacity int, mapper limit.MapperFn, conf
 	}
 
 	// Set default values for optional fields.
-	if capacity <= 0 {
-		capacity = DefaultCapacity
+	if o.Clock == nil {
+		o.Clock = &timetools.RealTime{}
 	}
-	if clock == nil {
-		clock = &timetools.RealTime{}
+	if o.Store == nil {
+		store, err := NewMemoryStore(o.Capacity, o.Clock)
+		if err != nil {
+			return nil, err
+		}
+		o.Store = store
 	}
-
-	bucketSets, err := ttlmap.NewMapWithProvider(DefaultCapacity, clock)
-	if err != nil {
-		return nil, err
+	if o.MaxDelay < 0 {
+		return nil, fmt.Errorf("Invalid max delay: %v", o.MaxDelay)
+	}
+	if o.MaxDelayed <= 0 {
+		o.MaxDelayed = DefaultMaxDelayed
 	}
 
-	return &TokenLimiter{
+	tl := &TokenLimiter{
 		defaultRates: defaultRates,
 		mapper:       mapper,
-		configMapper: configMapper,
-		clock:        clock,
-		bucketSets:   bucketSets,
-	}, nil
+		configMapper: o.ConfigMapper,
+		clock:        o.Clock,
+		store:        o.Store,
+		maxDelay:     o.MaxDelay,
+		maxDelayed:   int64(o.MaxDelayed),
+		dryRun:       o.DryRun,
+	}
+	// Several limiters can process the same request
+	tl.quotaKey = limit.QuotaKey(tl)
+	return tl, nil
 }
 
 // DefaultRates returns the default rate set of the limiter. The only reason to
@@ -106,39 +155,96 @@ func (tl *TokenLimiter) DefaultRates() *RateSet {
 }
 
 func (tl *TokenLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
+	if !tl.dryRun {
+		return tl.processRequest(r)
+	}
+	_, err := tl.processRequest(r)
+	if _, ok := err.(*errors.LimitError); ok {
+		atomic.AddInt64(&tl.dryRunRejections, 1)
+		log.Infof("Request %d would have been rejected by the rate limiter: %s", r.GetId(), err)
+	} else if err != nil {
+		// Failures to map the request or to reach the store are not the limit decisions, so they are counted apart
+		atomic.AddInt64(&tl.dryRunErrors, 1)
+		log.Errorf("Rate limiter has failed to process request %d: %s", r.GetId(), err)
+	}
+	return nil, nil
+}
 
+// GetDryRunRejections returns the number of requests that would have been rejected in the dry run mode
+func (tl *TokenLimiter) GetDryRunRejections() int64 {
+	return atomic.LoadInt64(&tl.dryRunRejections)
+}
+
+// GetDryRunErrors returns the number of requests the limiter has failed to process in the dry run mode
+func (tl *TokenLimiter) GetDryRunErrors() int64 {
+	return atomic.LoadInt64(&tl.dryRunErrors)
+}
+
+func (tl *TokenLimiter) processRequest(r request.Request) (*http.Response, error) {
 	token, amount, err := tl.mapper(r)
 	if err != nil {
 		return nil, err
 	}
 
-	effectiveRates := tl.effectiveRates(r)
-	bucketSetI, exists := tl.bucketSets.Get(token)
-	var bucketSet *tokenBucketSet
-
-	if exists {
-		bucketSet = bucketSetI.(*tokenBucketSet)
-		bucketSet.update(effectiveRates)
-	} else {
-		bucketSet = newTokenBucketSet(effectiveRates, tl.clock)
-		// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
-		// the counters for this ip will expire after 10 seconds of inactivity
-		tl.bucketSets.Set(token, bucketSet, int(bucketSet.maxPeriod/time.Second)*10+1)
-	}
-
-	delay, err := bucketSet.consume(amount)
+	rates := tl.effectiveRates(r)
+	res, err := tl.store.Consume(token, rates, amount)
 	if err != nil {
 		return nil, err
 	}
-	if delay > 0 {
-		return netutils.NewTextResponse(r.GetHttpRequest(), errors.StatusTooManyRequests, "Too many requests"), nil
+	if tl.dryRun {
+		// Requests are never held in the dry run mode, they would have been rejected if the delay is too long
+		if res.Delay > tl.maxDelay {
+			return nil, limit.NewLimitError("Too many requests", res.Quota, res.Delay, tl.clock.UtcNow())
+		}
+		return nil, nil
+	}
+	if res.Delay > 0 {
+		if res, err = tl.wait(r, token, rates, amount, res); err != nil {
+			return nil, err
+		}
 	}
+	if res.Delay > 0 {
+		return nil, limit.NewLimitError("Too many requests", res.Quota, res.Delay, tl.clock.UtcNow())
+	}
+	limit.StoreQuota(r, tl.quotaKey, res.Quota)
 	return nil, nil
 }
 
+// ProcessResponse lets the client know its quota in the rate limit headers of the response
 func (tl *TokenLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	limit.ApplyQuota(r, a, tl.quotaKey, tl.clock.UtcNow())
+}
+
+// wait holds the request until the tokens are consumed. Gives up and returns the last result if the tokens can't be
+// consumed within the max delay, the queue is full or the client has gone away.
+func (tl *TokenLimiter) wait(r request.Request, token string, rates *RateSet, amount int64, res Status) (Status, error) {
+	if res.Delay > tl.maxDelay {
+		return res, nil
+	}
+	if atomic.AddInt64(&tl.delayed, 1) > tl.maxDelayed {
+		atomic.AddInt64(&tl.delayed, -1)
+		return res, nil
+	}
+	defer atomic.AddInt64(&tl.delayed, -1)
+
+	deadline := tl.clock.UtcNow().Add(tl.maxDelay)
+	done := r.GetHttpRequest().Context().Done()
+	for res.Delay > 0 {
+		// Other requests could have taken the tokens while we were waiting
+		if tl.clock.UtcNow().Add(res.Delay).After(deadline) {
+			return res, nil
+		}
+		select {
+		case <-tl.clock.After(res.Delay):
+		case <-done:
+			return res, nil
+		}
+		var err error
+		if res, err = tl.store.Consume(token, rates, amount); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
 }
 
 // effectiveRates retrieves rates to be applied to the request.
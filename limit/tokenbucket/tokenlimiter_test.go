@@ -1,12 +1,15 @@
 package tokenbucket
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/mailgun/timetools"
 	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/errors"
 	"github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
 )
@@ -56,8 +59,8 @@ func (s *LimiterSuite) TestHitLimit(c *C) {
 
 	// Next request from the same ip hits rate limit
 	re, err = tl.ProcessRequest(makeRequest("1.2.3.4"))
-	c.Assert(re, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 
 	// Second later, the request from this ip will succeed
 	s.clock.Sleep(time.Second)
@@ -110,8 +113,8 @@ func (s *LimiterSuite) TestIsolation(c *C) {
 
 	// Next request from the same ip hits rate limit
 	re, err = tl.ProcessRequest(makeRequest("1.2.3.4"))
-	c.Assert(re, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 
 	// The request from other ip can proceed
 	re, err = tl.ProcessRequest(makeRequest("1.2.3.5"))
@@ -131,8 +134,8 @@ func (s *LimiterSuite) TestExpiration(c *C) {
 
 	// Next request from the same ip hits rate limit
 	re, err = tl.ProcessRequest(makeRequest("1.2.3.4"))
-	c.Assert(re, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 
 	// 24 hours later, the request from this ip will succeed
 	s.clock.Sleep(24 * time.Hour)
@@ -156,8 +159,8 @@ func (s *LimiterSuite) TestBadConfigMapper(c *C) {
 	c.Assert(response, IsNil)
 	c.Assert(err, IsNil)
 	response, err = tl.ProcessRequest(req) // Rejected
-	c.Assert(response, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(response, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 
 	s.clock.Sleep(time.Second)
 	response, err = tl.ProcessRequest(req) // Processed
@@ -180,8 +183,8 @@ func (s *LimiterSuite) TestEmptyConfig(c *C) {
 	c.Assert(response, IsNil)
 	c.Assert(err, IsNil)
 	response, err = tl.ProcessRequest(req) // Rejected
-	c.Assert(response, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(response, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 
 	s.clock.Sleep(time.Second)
 	response, err = tl.ProcessRequest(req) // Processed
@@ -210,8 +213,8 @@ func (s *LimiterSuite) TestConfigApplied(c *C) {
 	c.Assert(response, IsNil)
 	c.Assert(err, IsNil)
 	response, err = tl.ProcessRequest(req) // Rejected
-	c.Assert(response, NotNil)
-	c.Assert(err, IsNil)
+	c.Assert(response, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
 
 	s.clock.Sleep(time.Second)
 	response, err = tl.ProcessRequest(req) // Processed
@@ -219,10 +222,159 @@ func (s *LimiterSuite) TestConfigApplied(c *C) {
 	c.Assert(err, IsNil)
 }
 
-func makeRequest(ip string) request.Request {
-	return &request.BaseRequest{
-		HttpRequest: &http.Request{
-			RemoteAddr: ip,
-		},
+// Requests are held until the tokens become available instead of being rejected
+func (s *LimiterSuite) TestDelay(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+	tl, err := NewLimiterWithOptions(rates, limit.MapClientIp, Options{Clock: s.clock, MaxDelay: 2 * time.Second})
+	c.Assert(err, IsNil)
+
+	start := s.clock.UtcNow()
+	for i := 0; i < 3; i++ {
+		re, err := tl.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.clock.UtcNow().Sub(start), Equals, 2*time.Second)
+	c.Assert(atomic.LoadInt64(&tl.delayed), Equals, int64(0))
+}
+
+// Requests that would wait longer than the max delay are rejected right away
+func (s *LimiterSuite) TestDelayExceeded(c *C) {
+	rates := NewRateSet()
+	rates.Add(10*time.Second, 1, 1)
+	tl, err := NewLimiterWithOptions(rates, limit.MapClientIp, Options{Clock: s.clock, MaxDelay: time.Second})
+	c.Assert(err, IsNil)
+
+	re, err := tl.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	start := s.clock.UtcNow()
+	re, err = tl.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	c.Assert(s.clock.UtcNow(), Equals, start)
+
+	// Client is told when to retry
+	h := err.(*errors.LimitError).Headers()
+	c.Assert(h.Get("Retry-After"), Equals, "10")
+	c.Assert(h.Get("RateLimit-Limit"), Equals, "1")
+	c.Assert(h.Get("RateLimit-Remaining"), Equals, "0")
+	c.Assert(h.Get("RateLimit-Reset"), Equals, "10")
+	c.Assert(h.Get("X-RateLimit-Reset"), Equals, fmt.Sprint(start.Unix()+10))
+
+	_, err = NewLimiterWithOptions(rates, limit.MapClientIp, Options{Clock: s.clock, MaxDelay: -1})
+	c.Assert(err, NotNil)
+}
+
+// Requests are rejected when the queue is full, held requests are released when the clients go away
+func (s *LimiterSuite) TestQueueFull(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Minute, 1, 1)
+	tl, err := NewLimiterWithOptions(rates, limit.MapClientIp, Options{MaxDelay: time.Hour, MaxDelayed: 1})
+	c.Assert(err, IsNil)
+
+	re, err := tl.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	held := request.NewBaseRequest(makeRequest("1.2.3.4").GetHttpRequest().WithContext(ctx), 2, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := tl.ProcessRequest(held)
+		done <- err
+	}()
+	for atomic.LoadInt64(&tl.delayed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	re, err = tl.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, FitsTypeOf, &errors.LimitError{})
+
+	cancel()
+	select {
+	case err := <-done:
+		c.Assert(err, FitsTypeOf, &errors.LimitError{})
+	case <-time.After(time.Second):
+		c.Fatalf("Held request was not released")
 	}
+	c.Assert(atomic.LoadInt64(&tl.delayed), Equals, int64(0))
+}
+
+// Allowed responses carry the quota of the client
+func (s *LimiterSuite) TestQuotaHeaders(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 2, 2)
+	tl, err := NewLimiter(rates, 0, limit.MapClientIp, nil, s.clock)
+	c.Assert(err, IsNil)
+
+	req := makeRequest("1.2.3.4")
+	re, err := tl.ProcessRequest(req)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	a := &request.BaseAttempt{Response: &http.Response{Header: make(http.Header)}}
+	tl.ProcessResponse(req, a)
+	h := a.Response.Header
+	c.Assert(h.Get("RateLimit-Limit"), Equals, "2")
+	c.Assert(h.Get("RateLimit-Remaining"), Equals, "1")
+	c.Assert(h.Get("RateLimit-Reset"), Equals, "1")
+	c.Assert(h.Get("X-RateLimit-Limit"), Equals, "2")
+	c.Assert(h.Get("X-RateLimit-Remaining"), Equals, "1")
+	c.Assert(h.Get("X-RateLimit-Reset"), Equals, fmt.Sprint(s.clock.UtcNow().Unix()+1))
+
+	// Quota is set once per request
+	a = &request.BaseAttempt{Response: &http.Response{Header: make(http.Header)}}
+	tl.ProcessResponse(req, a)
+	c.Assert(a.Response.Header.Get("RateLimit-Limit"), Equals, "")
+}
+
+// Dry run lets all requests through and counts the ones that would have been rejected
+func (s *LimiterSuite) TestDryRun(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+	tl, err := NewLimiterWithOptions(rates, limit.MapClientIp, Options{Clock: s.clock, DryRun: true})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		req := makeRequest("1.2.3.4")
+		re, err := tl.ProcessRequest(req)
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+
+		// Clients get no quota headers
+		a := &request.BaseAttempt{Response: &http.Response{Header: make(http.Header)}}
+		tl.ProcessResponse(req, a)
+		c.Assert(a.Response.Header.Get("RateLimit-Limit"), Equals, "")
+	}
+	c.Assert(tl.GetDryRunRejections(), Equals, int64(2))
+
+	// Mapper failures are counted apart from the limit decisions
+	re, err := tl.ProcessRequest(makeRequest(""))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+	c.Assert(tl.GetDryRunRejections(), Equals, int64(2))
+	c.Assert(tl.GetDryRunErrors(), Equals, int64(1))
+}
+
+// Requests that would have been delayed are not held and not counted in the dry run mode
+func (s *LimiterSuite) TestDryRunDelay(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+	tl, err := NewLimiterWithOptions(rates, limit.MapClientIp, Options{Clock: s.clock, DryRun: true, MaxDelay: time.Second})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		_, err := tl.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(atomic.LoadInt64(&tl.delayed), Equals, int64(0))
+	c.Assert(tl.GetDryRunRejections(), Equals, int64(0))
+}
+
+func makeRequest(ip string) request.Request {
+	return request.NewBaseRequest(&http.Request{RemoteAddr: ip}, 1, nil)
 }
@@ -7,7 +7,6 @@ import (
 	"github.com/mailgun/timetools"
 	"github.com/mailgun/vulcan/endpoint"
 	"github.com/mailgun/vulcan/metrics"
-	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
 	"net/http"
 	"net/url"
@@ -151,6 +150,18 @@ func (r *RoundRobin) GetEndpoints() []*WeightedEndpoint {
 	return r.endpoints
 }
 
+// GetEffectiveWeights returns the current effective weights of the endpoints by the endpoint id
+func (r *RoundRobin) GetEffectiveWeights() map[string]int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	weights := make(map[string]int, len(r.endpoints))
+	for _, e := range r.endpoints {
+		weights[e.GetId()] = e.GetEffectiveWeight()
+	}
+	return weights
+}
+
 func (rr *RoundRobin) AddEndpoint(endpoint endpoint.Endpoint) error {
 	return rr.AddEndpointWithOptions(endpoint, EndpointOptions{})
 }
@@ -204,11 +215,12 @@ func (r *RoundRobin) findEndpointByUrl(iu *url.URL) (*WeightedEndpoint, int) {
 }
 
 func (r *RoundRobin) FindEndpointByUrl(url string) *WeightedEndpoint {
-	out, err := netutils.ParseUrl(url)
+	// Endpoint parser understands both http and unix socket urls
+	out, err := endpoint.ParseUrl(url)
 	if err != nil {
 		return nil
 	}
-	found, _ := r.findEndpointByUrl(out)
+	found, _ := r.findEndpointByUrl(out.GetUrl())
 	return found
 }
 
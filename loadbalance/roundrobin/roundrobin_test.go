@@ -176,6 +176,28 @@ func (s *RoundRobinSuite) TestFindEndpoint(c *C) {
 	c.Assert(r.FindEndpointByUrl("http://localhost wrong url 5000"), IsNil)
 }
 
+func (s *RoundRobinSuite) TestFindUnixEndpoint(c *C) {
+	r := s.newRR()
+
+	uA := MustParseUrl("unix:///var/run/a.sock")
+	uB := MustParseUrl("unix:///var/run/b.sock")
+	c.Assert(r.AddEndpoint(uA), IsNil)
+	c.Assert(r.AddEndpoint(uB), IsNil)
+	c.Assert(r.AddEndpoint(MustParseUrl("unix:///var/run/a.sock")), NotNil)
+
+	c.Assert(r.FindEndpointById("unix:///var/run/b.sock").GetId(), Equals, uB.GetId())
+	c.Assert(r.FindEndpointByUrl("unix:///var/run/a.sock").GetId(), Equals, uA.GetId())
+	c.Assert(r.FindEndpointByUrl("unix:///var/run/c.sock"), IsNil)
+
+	u, err := r.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, uA)
+
+	u, err = r.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, uB)
+}
+
 func (s *RoundRobinSuite) advanceTime(d time.Duration) {
 	s.tm.CurrentTime = s.tm.CurrentTime.Add(d)
 }
@@ -0,0 +1,63 @@
+package httploc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/grpc"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Maximum amount of the non gRPC response body used as the status message
+const maxGrpcMessageBytes = 1024
+
+// grpcResponse converts the proxy errors and non gRPC responses, e.g. generated by
+// rate limiters or circuit breaker fallbacks, to gRPC responses clients can understand
+func grpcResponse(req request.Request, response *http.Response, err error) (*http.Response, error) {
+	if response != nil {
+		if grpc.IsGrpc(response.Header) {
+			return response, nil
+		}
+		defer response.Body.Close()
+		message := http.StatusText(response.StatusCode)
+		body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxGrpcMessageBytes))
+		if err == nil && len(strings.TrimSpace(string(body))) != 0 {
+			message = strings.TrimSpace(string(body))
+		}
+		return grpc.NewErrorResponse(req.GetHttpRequest(), grpc.FromHttpStatus(response.StatusCode), message), nil
+	}
+	if err == nil {
+		return nil, nil
+	}
+	// Redirects are handled by the proxy, there's nothing to convert
+	if _, ok := err.(*errors.RedirectError); ok {
+		return nil, err
+	}
+	return grpc.NewErrorResponse(req.GetHttpRequest(), errorToGrpcCode(err), err.Error()), nil
+}
+
+func errorToGrpcCode(err error) grpc.Code {
+	switch err {
+	case context.Canceled:
+		return grpc.Canceled
+	case context.DeadlineExceeded:
+		return grpc.DeadlineExceeded
+	}
+	switch e := err.(type) {
+	case errors.ProxyError:
+		return grpc.FromHttpStatus(e.GetStatusCode())
+	case *netutils.MaxSizeReachedError:
+		return grpc.ResourceExhausted
+	case net.Error:
+		if e.Timeout() {
+			return grpc.DeadlineExceeded
+		}
+	}
+	return grpc.Unavailable
+}
@@ -0,0 +1,86 @@
+package httploc
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/metrics"
+	. "github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+var grpcHeaders = http.Header{"Content-Type": []string{"application/grpc"}}
+
+func (s *LocSuite) newGrpcProxy(c *C, endpoints ...string) (*HttpLocation, *httptest.Server) {
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(endpoints...), Options{Grpc: true})
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	return location, httptest.NewServer(proxy)
+}
+
+func (s *LocSuite) TestGrpcNoEndpoints(c *C) {
+	_, proxy := s.newGrpcProxy(c)
+	defer proxy.Close()
+
+	response, _, err := MakeRequest(proxy.URL, Opts{Method: "POST", Headers: grpcHeaders})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(response.Header.Get("Content-Type"), Equals, "application/grpc")
+	c.Assert(response.Header.Get("Grpc-Status"), Equals, "14")
+	c.Assert(response.Header.Get("Grpc-Message"), Equals, "No%20endpoints")
+}
+
+func (s *LocSuite) TestGrpcRateLimited(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+	})
+	defer server.Close()
+
+	location, proxy := s.newGrpcProxy(c, server.URL)
+	defer proxy.Close()
+
+	location.GetMiddlewareChain().Add("limiter", 0, &MiddlewareWrapper{
+		OnRequest: func(r Request) (*http.Response, error) {
+			return netutils.NewTextResponse(r.GetHttpRequest(), errors.StatusTooManyRequests, "Too many requests"), nil
+		},
+	})
+
+	response, _, err := MakeRequest(proxy.URL, Opts{Method: "POST", Headers: grpcHeaders})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(response.Header.Get("Grpc-Status"), Equals, "8")
+	c.Assert(response.Header.Get("Grpc-Message"), Equals, "Too%20many%20requests")
+}
+
+func (s *LocSuite) TestGrpcResponsePassedThrough(c *C) {
+	var metricsStatus bool
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "14")
+	})
+	defer server.Close()
+
+	location, proxy := s.newGrpcProxy(c, server.URL)
+	defer proxy.Close()
+
+	location.GetMiddlewareChain().Add("observer", 0, &MiddlewareWrapper{
+		OnResponse: func(r Request, a Attempt) {
+			metricsStatus = metrics.IsGrpcError(a)
+		},
+	})
+
+	response, bodyBytes, err := MakeRequest(proxy.URL, Opts{Method: "POST", Headers: grpcHeaders})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "message")
+	c.Assert(response.Trailer.Get("Grpc-Status"), Equals, "14")
+	c.Assert(metricsStatus, Equals, true)
+}
@@ -0,0 +1,188 @@
+package httploc
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/vulcan"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func (s *LocSuite) newProtocolProxy(c *C, o Options, endpoints ...string) *httptest.Server {
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(endpoints...), o)
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	return httptest.NewServer(proxy)
+}
+
+func (s *LocSuite) TestH2cEndpoint(c *C) {
+	var protoMajor int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoMajor = r.ProtoMajor
+		w.Write([]byte("Hi, I'm h2c endpoint"))
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	proxy := s.newProtocolProxy(c, Options{}, server.URL)
+	defer proxy.Close()
+
+	// HTTP/1.1 is the default
+	response, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(protoMajor, Equals, 1)
+
+	h2cProxy := s.newProtocolProxy(c, Options{Protocol: H2c}, server.URL)
+	defer h2cProxy.Close()
+
+	response, bodyBytes, err := MakeRequest(h2cProxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm h2c endpoint")
+	c.Assert(protoMajor, Equals, 2)
+}
+
+func (s *LocSuite) TestH2Endpoint(c *C) {
+	var protoMajor int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoMajor = r.ProtoMajor
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	proxy := s.newProtocolProxy(c, Options{Protocol: Http2, Tls: TlsOptions{InsecureSkipVerify: true}}, server.URL)
+	defer proxy.Close()
+
+	response, _, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(protoMajor, Equals, 2)
+}
+
+func (s *LocSuite) TestUnsupportedProtocol(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{Protocol: Protocol(42)})
+	c.Assert(err, NotNil)
+
+	_, err = NewTransportWithTls(TransportOptions{Protocol: Protocol(42)})
+	c.Assert(err, NotNil)
+
+	// NewTransport can't fail, so it falls back to HTTP/1.1
+	t := NewTransport(TransportOptions{Protocol: Protocol(42)})
+	c.Assert(t.Protocols.HTTP1(), Equals, true)
+	c.Assert(t.Protocols.HTTP2(), Equals, false)
+}
+
+// Incoming HTTP/2 request is proxied to the h2c endpoint, trailers are passed both ways
+// and hop-by-hop headers are removed
+func (s *LocSuite) TestHttp2Trailers(c *C) {
+	var te, requestTrailer string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		te = r.Header.Get("Te")
+		requestTrailer = r.Trailer.Get("X-Request-Trailer")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Write([]byte("Hi, I'm endpoint"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{Protocol: H2c})
+	c.Assert(err, IsNil)
+	p, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewUnstartedServer(p)
+	proxy.EnableHTTP2 = true
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	request, err := http.NewRequest("POST", proxy.URL, &trailerReader{data: []byte("hello")})
+	c.Assert(err, IsNil)
+	request.Header.Set("Te", "trailers")
+	request.Trailer = http.Header{"X-Request-Trailer": nil}
+	request.Body.(*trailerReader).trailer = request.Trailer
+
+	response, err := client.Do(request)
+	c.Assert(err, IsNil)
+	c.Assert(response.ProtoMajor, Equals, 2)
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
+	c.Assert(response.Header.Get("Keep-Alive"), Equals, "")
+	c.Assert(response.Trailer.Get("Grpc-Status"), Equals, "0")
+	c.Assert(te, Equals, "trailers")
+	c.Assert(requestTrailer, Equals, "value")
+}
+
+// Request to the endpoint is canceled once the client goes away
+func (s *LocSuite) TestClientCancel(c *C) {
+	canceled := make(chan bool, 1)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+		}
+	})
+	defer server.Close()
+
+	_, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", proxy.URL, nil)
+	c.Assert(err, IsNil)
+	_, err = http.DefaultClient.Do(request)
+	c.Assert(err, NotNil)
+
+	select {
+	case v := <-canceled:
+		c.Assert(v, Equals, true)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("endpoint request was not canceled")
+	}
+}
+
+// trailerReader sets the request trailer once the body has been read
+type trailerReader struct {
+	data    []byte
+	trailer http.Header
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	if len(t.data) == 0 {
+		t.trailer.Set("X-Request-Trailer", "value")
+		return 0, io.EOF
+	}
+	n := copy(p, t.data)
+	t.data = t.data[n:]
+	return n, nil
+}
+
+func (t *trailerReader) Close() error {
+	return nil
+}
@@ -2,10 +2,12 @@
 package httploc
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,6 +19,7 @@ import (
 	"github.com/mailgun/vulcan/loadbalance"
 	"github.com/mailgun/vulcan/middleware"
 	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/proxyproto"
 	"github.com/mailgun/vulcan/request"
 	"github.com/mailgun/vulcan/threshold"
 )
@@ -72,17 +75,72 @@ type Options struct {
 	FailoverPredicate threshold.Predicate
 	// Used in forwarding headers
 	Hostname string
-	// In this case appends new forward info to the existing header
+	// Deprecated: appends new forward info to the existing headers sent by any peer. Forwarding headers
+	// (X-Forwarded-*, Forwarded) sent by the proxy's TrustedProxies are preserved and appended to without it.
 	TrustForwardHeader bool
 	// Time provider (useful for testing purposes)
 	TimeProvider timetools.TimeProvider
 	// Transport gives a way to provide external transport that can be shared between multiple locations
 	Transport *http.Transport
+	// Rewrite rules for the request path and query, by default the request uri is forwarded as is
+	Rewrite UrlRewrite
+	// Controls the Host header sent to the endpoints, by default the client's Host is preserved
+	UpstreamHost UpstreamHost
+	// TLS settings for https endpoints, ignored if external Transport is supplied
+	Tls TlsOptions
+	// HTTP protocol used to talk to the endpoints, ignored if external Transport is supplied
+	Protocol Protocol
+	// In gRPC mode proxy failures and non gRPC responses (e.g. from rate limiters)
+	// are converted to gRPC responses with the status and message in headers
+	Grpc bool
+	// Sends PROXY protocol header with the client address to the endpoints, ignored if external Transport is supplied.
+	// Header describes a single client connection, so keep-alive connections to the endpoints are disabled in this mode.
+	ProxyProtocol proxyproto.Version
+}
+
+// Protocol selects HTTP protocol version used to talk to the endpoints
+type Protocol int
+
+const (
+	// HTTP/1.1 for all endpoints
+	Http1 Protocol = iota
+	// HTTP/2 negotiated with ALPN for https endpoints with fallback to HTTP/1.1, HTTP/1.1 for http endpoints
+	Http2
+	// HTTP/2 for all endpoints: h2 for https and h2c with prior knowledge for http endpoints, e.g. gRPC services
+	H2c
+)
+
+// HostPolicy defines what Host header is sent to the endpoint
+type HostPolicy int
+
+const (
+	// Preserve the Host header sent by the client. TLS server name (SNI) of https endpoints does not follow
+	// the client's Host and stays the endpoint host, as the connections to the endpoint are pooled and shared
+	// by the requests for all hosts. Set Tls.ServerName or use FixedHost if the endpoint expects a different name.
+	PreserveHost HostPolicy = iota
+	// Use the host of the endpoint url, it's also the TLS server name
+	EndpointHost
+	// Use the fixed host value, it's also the TLS server name unless Tls.ServerName is set
+	FixedHost
+)
+
+// UpstreamHost controls the Host header sent to the endpoints and the TLS server name used for https endpoints,
+// see HostPolicy for the details
+type UpstreamHost struct {
+	Policy HostPolicy
+	// Host to use with FixedHost policy
+	Host string
 }
 
 type TransportOptions struct {
 	Timeouts  Timeouts
 	KeepAlive KeepAlive
+	// TLS settings for https endpoints
+	Tls TlsOptions
+	// HTTP protocol used to talk to the endpoints
+	Protocol Protocol
+	// PROXY protocol version sent to the endpoints, 0 disables it
+	ProxyProtocol proxyproto.Version
 }
 
 func NewLocation(id string, loadBalancer loadbalance.LoadBalancer) (*HttpLocation, error) {
@@ -102,12 +160,14 @@ func NewLocationWithOptions(id string, loadBalancer loadbalance.LoadBalancer, o
 	observerChain.Add(BalancerId, loadBalancer)
 
 	middlewareChain := middleware.NewMiddlewareChain()
-	middlewareChain.Add(RewriterId, -2, &Rewriter{TrustForwardHeader: o.TrustForwardHeader, Hostname: o.Hostname})
+	middlewareChain.Add(RewriterId, -2, newRewriter(o))
 	middlewareChain.Add(BalancerId, -1, loadBalancer)
 
 	t := o.Transport
 	if t == nil {
-		t = NewTransport(TransportOptions{KeepAlive: o.KeepAlive, Timeouts: o.Timeouts})
+		if t, err = newTransport(o); err != nil {
+			return nil, err
+		}
 	}
 
 	return &HttpLocation{
@@ -126,18 +186,39 @@ func (l *HttpLocation) SetOptions(o Options) error {
 	if err != nil {
 		return err
 	}
+	t := options.Transport
+	if t == nil {
+		if t, err = newTransport(options); err != nil {
+			return err
+		}
+	}
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	if err := l.middlewareChain.Update(RewriterId, -2, &Rewriter{TrustForwardHeader: o.TrustForwardHeader, Hostname: o.Hostname}); err != nil {
+	if err := l.middlewareChain.Update(RewriterId, -2, newRewriter(options)); err != nil {
 		return err
 	}
 	l.options = options
+	l.setTransport(t)
+	return nil
+}
+
+// ReloadTls re-reads certificates and keys set in TLS options from disk and replaces the transport,
+// so the new connections to the endpoints will use the updated certificates.
+func (l *HttpLocation) ReloadTls() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	if l.options.Transport != nil {
-		l.setTransport(l.options.Transport)
-	} else {
-		l.setTransport(NewTransport(TransportOptions{KeepAlive: o.KeepAlive, Timeouts: o.Timeouts}))
+		return fmt.Errorf("Location uses external transport")
 	}
+	t, err := newTransport(l.options)
+	if err != nil {
+		return err
+	}
+	old := l.transport
+	l.setTransport(t)
+	old.CloseIdleConnections()
 	return nil
 }
 
@@ -180,6 +261,14 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 	// Get options and transport as one single read transaction.
 	// Options and transport may change if someone calls SetOptions
 	o, tr := l.GetOptionsAndTransport()
+	response, err := l.roundTrip(o, tr, req)
+	if o.Grpc {
+		return grpcResponse(req, response, err)
+	}
+	return response, err
+}
+
+func (l *HttpLocation) roundTrip(o Options, tr *http.Transport, req request.Request) (*http.Response, error) {
 	originalRequest := req.GetHttpRequest()
 
 	//  Check request size first, if that exceeds the limit, we don't bother reading the request.
@@ -209,6 +298,11 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 	defer body.Close()
 
 	for {
+		// Client has gone away (e.g. HTTP/2 stream was reset), no need to try other endpoints
+		if err := originalRequest.Context().Err(); err != nil {
+			return nil, err
+		}
+
 		_, err := req.GetBody().Seek(0, 0)
 		if err != nil {
 			return nil, err
@@ -222,7 +316,7 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 
 		// Adds headers, changes urls. Note that we rewrite request each time we proxy it to the
 		// endpoint, so that each try gets a fresh start
-		req.SetHttpRequest(l.copyRequest(originalRequest, req.GetBody(), endpoint))
+		req.SetHttpRequest(l.copyRequest(&o, originalRequest, req.GetBody(), endpoint))
 		// In case if error is not nil, we allow load balancer to choose the next endpoint
 		// e.g. to do request failover. Nil error means that we got proxied the request successfully.
 		response, err := l.proxyToEndpoint(tr, &o, endpoint, req)
@@ -271,12 +365,19 @@ func (l *HttpLocation) proxyToEndpoint(tr *http.Transport, o *Options, endpoint
 	defer l.unwindIter(it, req, a)
 
 	for v := it.Next(); v != nil; v = it.Next() {
-		a.Response, a.Error = v.ProcessRequest(req)
-		if a.Response != nil || a.Error != nil {
+		re, err := v.ProcessRequest(req)
+		if re != nil || err != nil {
 			// Move the iterator forward to count it again once we unwind the chain
 			it.Next()
-			log.Errorf("Midleware intercepted request with response=%v, error=%v", a.Response, a.Error)
-			return a.Response, a.Error
+			log.Errorf("Midleware intercepted request with response=%v, error=%v", re, err)
+			// Errors replied by the middlewares, e.g. rejections of the limiters, are not failures of the endpoint,
+			// so they are not recorded by the attempt to keep them from triggering failover. The attempt is marked
+			// as intercepted, so the observers can tell it apart from the requests to the endpoint
+			a.Response, a.Intercepted = re, true
+			if _, ok := err.(errors.ProxyError); !ok {
+				a.Error = err
+			}
+			return re, err
 		}
 	}
 	// Forward the request and mirror the response
@@ -290,7 +391,11 @@ func (l *HttpLocation) proxyToEndpoint(tr *http.Transport, o *Options, endpoint
 	return a.Response, a.Error
 }
 
-func (l *HttpLocation) copyRequest(req *http.Request, body netutils.MultiReader, endpoint endpoint.Endpoint) *http.Request {
+type socketEndpoint interface {
+	GetSocketPath() string
+}
+
+func (l *HttpLocation) copyRequest(o *Options, req *http.Request, body netutils.MultiReader, endpoint endpoint.Endpoint) *http.Request {
 	outReq := new(http.Request)
 	*outReq = *req // includes shallow copies of maps, but we handle this below
 
@@ -298,12 +403,27 @@ func (l *HttpLocation) copyRequest(req *http.Request, body netutils.MultiReader,
 	outReq.Body = body
 
 	endpointURL := endpoint.GetUrl()
+	outReq.URL = netutils.CopyUrl(req.URL)
 	outReq.URL.Scheme = endpointURL.Scheme
 	outReq.URL.Host = endpointURL.Host
-	outReq.URL.Opaque = req.RequestURI
-	// raw query is already included in RequestURI, so ignore it to avoid dupes
-	outReq.URL.RawQuery = ""
+	prefix := ""
+	// Only the unix socket endpoints have path prefix, the path of the http endpoints is ignored
+	if e, ok := endpoint.(socketEndpoint); ok && e.GetSocketPath() != "" {
+		prefix = strings.TrimSuffix(endpointURL.EscapedPath(), "/")
+	}
+	if o.Rewrite.isEmpty() && prefix == "" {
+		outReq.URL.Opaque = req.RequestURI
+		// raw query is already included in RequestURI, so ignore it to avoid dupes
+		outReq.URL.RawQuery = ""
+	} else {
+		// Opaque keeps the escaped path intact, so encoded characters are passed to the endpoint as is
+		path, query := o.Rewrite.rewrite(req.RequestURI)
+		// Endpoint url path, e.g. unix:///var/run/app.sock:/prefix, is prepended to the request path
+		outReq.URL.Opaque, outReq.URL.RawQuery = prefix+path, query
+	}
 
+	// Transport ignores the request protocol version and uses the one it's configured with,
+	// so this is what endpoints will see in case of HTTP/1.1
 	outReq.Proto = "HTTP/1.1"
 	outReq.ProtoMajor = 1
 	outReq.ProtoMinor = 1
@@ -313,6 +433,10 @@ func (l *HttpLocation) copyRequest(req *http.Request, body netutils.MultiReader,
 
 	outReq.Header = make(http.Header)
 	netutils.CopyHeaders(outReq.Header, req.Header)
+
+	if o.ProxyProtocol != 0 {
+		outReq = outReq.WithContext(proxyproto.NewContext(req.Context(), newProxyHeader(req)))
+	}
 	return outReq
 }
 
@@ -374,6 +498,15 @@ func setDefaults(o Options) (Options, error) {
 	if o.TimeProvider == nil {
 		o.TimeProvider = &timetools.RealTime{}
 	}
+	if o.UpstreamHost.Policy == FixedHost && o.UpstreamHost.Host == "" {
+		return o, fmt.Errorf("Provide host for the fixed host policy")
+	}
+	if err := o.Rewrite.validate(); err != nil {
+		return o, err
+	}
+	if err := validateProtocols(o.Protocol, o.ProxyProtocol); err != nil {
+		return o, err
+	}
 	if o.FailoverPredicate == nil {
 		// Failover on network errors for 2 times maximum on GET requests only.
 		p, err := threshold.ParseExpression(`Attempts() < 2 && IsNetworkError() && RequestMethod() == "GET"`)
@@ -385,16 +518,109 @@ func setDefaults(o Options) (Options, error) {
 	return o, nil
 }
 
+func newRewriter(o Options) *Rewriter {
+	return &Rewriter{
+		TrustForwardHeader: o.TrustForwardHeader,
+		Hostname:           o.Hostname,
+		UpstreamHost:       o.UpstreamHost,
+	}
+}
+
+func newTransport(o Options) (*http.Transport, error) {
+	tlsOptions := o.Tls
+	// TLS server name follows the Host header for the fixed host policy, for endpoint host policy it's
+	// the endpoint host set by default. With PreserveHost it's the endpoint host as well, see HostPolicy.
+	if tlsOptions.ServerName == "" && o.UpstreamHost.Policy == FixedHost {
+		tlsOptions.ServerName = hostWithoutPort(o.UpstreamHost.Host)
+	}
+	return NewTransportWithTls(TransportOptions{
+		KeepAlive:     o.KeepAlive,
+		Timeouts:      o.Timeouts,
+		Tls:           tlsOptions,
+		Protocol:      o.Protocol,
+		ProxyProtocol: o.ProxyProtocol,
+	})
+}
+
+func hostWithoutPort(hostPort string) string {
+	if host, _, err := net.SplitHostPort(hostPort); err == nil {
+		return host
+	}
+	return hostPort
+}
+
+// NewTransport creates transport with the given timeouts and keepalive settings. TLS options are not applied,
+// use NewTransportWithTls for them. Unsupported Protocol or ProxyProtocol are logged and replaced with HTTP/1.1
+// without PROXY protocol, use NewTransportWithTls to get the error instead.
 func NewTransport(o TransportOptions) *http.Transport {
-	return &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout:   o.Timeouts.Dial,
-			KeepAlive: o.KeepAlive.Period,
-		}).Dial,
+	o.Tls = TlsOptions{}
+	if err := validateProtocols(o.Protocol, o.ProxyProtocol); err != nil {
+		log.Errorf("%s, falling back to HTTP/1.1 without PROXY protocol", err)
+		o.Protocol, o.ProxyProtocol = Http1, 0
+	}
+	t, _ := NewTransportWithTls(o)
+	return t
+}
+
+// NewTransportWithTls creates transport with the given timeouts, keepalive and TLS settings,
+// it returns error in case if it failed to load certificates provided in TLS options
+func NewTransportWithTls(o TransportOptions) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   o.Timeouts.Dial,
+		KeepAlive: o.KeepAlive.Period,
+	}
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// Unix socket endpoints encode the socket path in the url host
+			if socketPath, ok := endpoint.UnixSocketPath(addr); ok {
+				network, addr = "unix", socketPath
+			}
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || o.ProxyProtocol == 0 {
+				return conn, err
+			}
+			return writeProxyHeader(ctx, o.ProxyProtocol, conn)
+		},
 		ResponseHeaderTimeout: o.Timeouts.Read,
 		TLSHandshakeTimeout:   o.Timeouts.TlsHandshake,
 		MaxIdleConnsPerHost:   o.KeepAlive.MaxIdleConnsPerHost,
 	}
+	if err := validateProtocols(o.Protocol, o.ProxyProtocol); err != nil {
+		return nil, err
+	}
+	if o.ProxyProtocol != 0 {
+		t.DisableKeepAlives = true
+	}
+	if !o.Tls.isEmpty() {
+		config, err := NewTlsConfig(o.Tls)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = config
+	}
+	t.Protocols = new(http.Protocols)
+	switch o.Protocol {
+	case Http1:
+		t.Protocols.SetHTTP1(true)
+	case Http2:
+		t.Protocols.SetHTTP1(true)
+		t.Protocols.SetHTTP2(true)
+	case H2c:
+		// Transport uses h2c for http endpoints only if HTTP/1 is disabled
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return t, nil
+}
+
+func validateProtocols(p Protocol, v proxyproto.Version) error {
+	if p != Http1 && p != Http2 && p != H2c {
+		return fmt.Errorf("Unsupported protocol: %d", p)
+	}
+	if v != 0 && v != proxyproto.V1 && v != proxyproto.V2 {
+		return fmt.Errorf("Unsupported PROXY protocol version: %d", v)
+	}
+	return nil
 }
 
 const (
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -256,6 +257,68 @@ func (s *LocSuite) TestFailover(c *C) {
 	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
 }
 
+// Forwarding headers from untrusted peers are replaced, from trusted ones are appended to
+func (s *LocSuite) TestTrustedProxies(c *C) {
+	var forwardedFor, forwardedProto, forwarded string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get(headers.XForwardedFor)
+		forwardedProto = r.Header.Get(headers.XForwardedProto)
+		forwarded = r.Header.Get(headers.Forwarded)
+	})
+	defer server.Close()
+
+	location, err := NewLocation("dummy", s.newRoundRobin(server.URL))
+	c.Assert(err, IsNil)
+
+	hdr := make(http.Header)
+	hdr.Set(headers.XForwardedProto, "https")
+	hdr.Set(headers.XForwardedFor, "192.168.1.1")
+	hdr.Set(headers.Forwarded, "for=192.168.1.1")
+
+	// Locations trust the peers the proxy trusts
+	for _, tc := range []struct {
+		trusted        string
+		forwardedFor   string
+		forwardedProto string
+		forwarded      string
+	}{
+		{"10.0.0.0/8", "127.0.0.1", "http", `for=127.0.0.1;host="client.com";proto=http`},
+		{"127.0.0.1", "192.168.1.1, 127.0.0.1", "https", `for=192.168.1.1, for=127.0.0.1;host="client.com";proto=http`},
+	} {
+		trusted, err := netutils.ParseTrustedProxies(tc.trusted)
+		c.Assert(err, IsNil)
+		proxy, err := vulcan.NewProxyWithOptions(&ConstRouter{Location: location}, vulcan.Options{TrustedProxies: trusted})
+		c.Assert(err, IsNil)
+		srv := httptest.NewServer(proxy)
+
+		_, _, err = MakeRequest(srv.URL, Opts{Headers: hdr, Host: "client.com"})
+		srv.Close()
+		c.Assert(err, IsNil)
+		c.Assert(forwardedFor, Equals, tc.forwardedFor)
+		c.Assert(forwardedProto, Equals, tc.forwardedProto)
+		c.Assert(forwarded, Equals, tc.forwarded)
+	}
+}
+
+// Forwarded header quotes the host as RFC 7239 quoted-string and leaves out the host that can't be quoted
+func (s *LocSuite) TestForwardedElement(c *C) {
+	rw := &Rewriter{}
+	for _, tc := range []struct {
+		remoteAddr string
+		host       string
+		expected   string
+	}{
+		{"1.2.3.4:5000", "client.com", `for=1.2.3.4;host="client.com";proto=http`},
+		{"[2001:db8::1]:5000", `a"b\c`, `for="[2001:db8::1]";host="a\"b\\c";proto=http`},
+		{"1.2.3.4:5000", "cli\x01ent.com", `for=1.2.3.4;proto=http`},
+		{"1.2.3.4:5000", "cliënt.com", `for=1.2.3.4;proto=http`},
+		{"", "", `proto=http`},
+	} {
+		req := &http.Request{RemoteAddr: tc.remoteAddr, Host: tc.host}
+		c.Assert(rw.forwardedElement(req, "http"), Equals, tc.expected)
+	}
+}
+
 // Test scenario when middleware intercepts the request
 func (s *LocSuite) TestMiddlewareInterceptsRequest(c *C) {
 	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
@@ -293,6 +356,47 @@ func (s *LocSuite) TestMiddlewareInterceptsRequest(c *C) {
 	c.Assert(calls["authRe"], Equals, 1)
 }
 
+// Errors replied by middlewares are formatted by the proxy and do not trigger failover
+func (s *LocSuite) TestMiddlewareRepliesError(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newProxy(s.newRoundRobin(server.URL, server.URL))
+	defer proxy.Close()
+
+	calls := 0
+	limiter := &MiddlewareWrapper{
+		OnRequest: func(r Request) (*http.Response, error) {
+			calls += 1
+			return nil, &errors.LimitError{Body: "Too many requests", Header: http.Header{"Retry-After": []string{"1"}}}
+		},
+		OnResponse: func(r Request, a Attempt) {
+			c.Assert(a.GetError(), IsNil)
+			c.Assert(IsIntercepted(a), Equals, true)
+		},
+	}
+	location.GetMiddlewareChain().Add("limiter", 0, limiter)
+	observed := 0
+	location.GetObserverChain().Add("observer", &ObserverWrapper{
+		OnResponse: func(r Request, a Attempt) {
+			observed += 1
+			c.Assert(IsIntercepted(a), Equals, true)
+			c.Assert(a.GetDuration(), Equals, time.Duration(0))
+		},
+	})
+
+	response, bodyBytes, err := MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, 429)
+	c.Assert(response.Header.Get("Retry-After"), Equals, "1")
+	c.Assert(response.Header.Get("Content-Type"), Equals, "application/json")
+	c.Assert(string(bodyBytes), Matches, `\{"error":"Too many requests".*`)
+	c.Assert(calls, Equals, 1)
+	c.Assert(observed, Equals, 1)
+}
+
 // Test scenario when middleware intercepts the request
 func (s *LocSuite) TestMultipleMiddlewaresRequestIntercepted(c *C) {
 	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
@@ -524,6 +628,132 @@ func (s *LocSuite) TestRewritesURLsWithEncodedPath(c *C) {
 	c.Assert(actualURL, Equals, path)
 }
 
+func (s *LocSuite) TestRewritesPathAndQuery(c *C) {
+	var actualURL string
+
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		actualURL = r.RequestURI
+	})
+	defer server.Close()
+
+	location, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	o := location.GetOptions()
+	o.Rewrite = UrlRewrite{StripPrefix: "/api/v1", RemoveQuery: []string{"token"}}
+	c.Assert(location.SetOptions(o), IsNil)
+
+	url := netutils.MustParseUrl(proxy.URL)
+	url.Opaque = "/api/v1/log/http%3A%2F%2Fwww.site.com?token=secret&a=b"
+
+	request, err := http.NewRequest("GET", url.String(), nil)
+	c.Assert(err, IsNil)
+	request.URL = url
+
+	_, err = http.DefaultClient.Do(request)
+	c.Assert(err, IsNil)
+	c.Assert(actualURL, Equals, "/log/http%3A%2F%2Fwww.site.com?a=b")
+}
+
+func (s *LocSuite) TestRewriteBadReplaceRule(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{
+		Rewrite: UrlRewrite{Replace: []UrlReplace{{Replacement: "/"}}},
+	})
+	c.Assert(err, NotNil)
+}
+
+func (s *LocSuite) TestUpstreamHost(c *C) {
+	var actualHost string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		actualHost = r.Host
+		c.Assert(r.Header.Get(headers.XForwardedHost), Equals, "client.com")
+	})
+	defer server.Close()
+
+	location, proxy := s.newProxy(s.newRoundRobin(server.URL))
+	defer proxy.Close()
+
+	_, _, err := MakeRequest(proxy.URL, Opts{Host: "client.com"})
+	c.Assert(err, IsNil)
+	c.Assert(actualHost, Equals, "client.com")
+
+	o := location.GetOptions()
+	o.UpstreamHost = UpstreamHost{Policy: EndpointHost}
+	c.Assert(location.SetOptions(o), IsNil)
+
+	_, _, err = MakeRequest(proxy.URL, Opts{Host: "client.com"})
+	c.Assert(err, IsNil)
+	c.Assert(actualHost, Equals, netutils.MustParseUrl(server.URL).Host)
+
+	o.UpstreamHost = UpstreamHost{Policy: FixedHost, Host: "backend.com:8443"}
+	c.Assert(location.SetOptions(o), IsNil)
+
+	_, _, err = MakeRequest(proxy.URL, Opts{Host: "client.com"})
+	c.Assert(err, IsNil)
+	c.Assert(actualHost, Equals, "backend.com:8443")
+
+	_, tr := location.GetOptionsAndTransport()
+	c.Assert(tr.TLSClientConfig.ServerName, Equals, "backend.com")
+}
+
+func (s *LocSuite) TestUpstreamHostFixedRequiresHost(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{
+		UpstreamHost: UpstreamHost{Policy: FixedHost},
+	})
+	c.Assert(err, NotNil)
+}
+
+func (s *LocSuite) TestUnixSocketEndpoint(c *C) {
+	var actualURL, actualHost string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actualURL = r.RequestURI
+		actualHost = r.Host
+		w.Write([]byte("Hi, I'm unix endpoint"))
+	}))
+
+	socketPath := filepath.Join(c.MkDir(), "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	c.Assert(err, IsNil)
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	location, proxy := s.newProxy(s.newRoundRobin("unix://" + socketPath + ":/prefix"))
+	defer proxy.Close()
+
+	response, bodyBytes, err := MakeRequest(proxy.URL+"/path?a=b", Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm unix endpoint")
+	c.Assert(actualURL, Equals, "/prefix/path?a=b")
+
+	o := location.GetOptions()
+	o.UpstreamHost = UpstreamHost{Policy: EndpointHost}
+	c.Assert(location.SetOptions(o), IsNil)
+
+	_, _, err = MakeRequest(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(actualHost, Equals, "localhost")
+}
+
+// Path of the http endpoint url is ignored, the request path is forwarded as is
+func (s *LocSuite) TestHttpEndpointPathIgnored(c *C) {
+	var actualURL string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		actualURL = r.RequestURI
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+
+	_, proxy := s.newProxy(s.newRoundRobin(server.URL + "/health"))
+	defer proxy.Close()
+
+	response, _, err := MakeRequest(proxy.URL+"/users?a=b", Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(actualURL, Equals, "/users?a=b")
+}
+
 // Test scenario when middleware redirects the request
 func (s *LocSuite) TestMiddlewareRedirectsRequest(c *C) {
 	server1 := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,48 @@
+package httploc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/mailgun/vulcan/proxyproto"
+)
+
+// newProxyHeader returns the header describing the client connection of the request,
+// the source or destination is nil if the address is unknown, e.g. the client is connected over unix socket
+func newProxyHeader(req *http.Request) *proxyproto.Header {
+	h := &proxyproto.Header{Source: parseTcpAddr(req.RemoteAddr)}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		h.Destination = parseTcpAddr(addr.String())
+	}
+	return h
+}
+
+// writeProxyHeader sends the header from the request context to the endpoint right after the connection is established.
+// If the header is missing, e.g. the connection is dialed for the health check, LOCAL or UNKNOWN header is sent.
+func writeProxyHeader(ctx context.Context, version proxyproto.Version, conn net.Conn) (net.Conn, error) {
+	h := &proxyproto.Header{}
+	if stored, ok := proxyproto.FromContext(ctx); ok {
+		*h = *stored
+	}
+	h.Version = version
+	if _, err := h.WriteTo(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func parseTcpAddr(hostPort string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
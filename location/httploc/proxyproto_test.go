@@ -0,0 +1,54 @@
+package httploc
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/proxyproto"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func (s *LocSuite) TestSendsProxyHeader(c *C) {
+	var remoteAddr, localAddr, forwardedFor string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+		localAddr = r.Context().Value(http.LocalAddrContextKey).(net.Addr).String()
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+		w.Write([]byte("Hi, I'm endpoint"))
+	}))
+	server.Listener = proxyproto.NewListener(server.Listener, proxyproto.Options{TrustAll: true, Required: true})
+	server.Start()
+	defer server.Close()
+
+	for _, version := range []proxyproto.Version{proxyproto.V1, proxyproto.V2} {
+		proxy := s.newProtocolProxy(c, Options{ProxyProtocol: version}, server.URL)
+
+		response, bodyBytes, err := MakeRequest(proxy.URL, Opts{})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
+
+		// Endpoint sees the proxy's client and the address the client has connected to
+		host, _, err := net.SplitHostPort(remoteAddr)
+		c.Assert(err, IsNil)
+		c.Assert(host, Equals, forwardedFor)
+		c.Assert(localAddr, Equals, netutils.MustParseUrl(proxy.URL).Host)
+		proxy.Close()
+	}
+}
+
+func (s *LocSuite) TestUnsupportedProxyProtocol(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{ProxyProtocol: 3})
+	c.Assert(err, NotNil)
+
+	// PROXY header is set by the location for the external transport too
+	_, err = NewLocationWithOptions("dummy", s.newRoundRobin(), Options{ProxyProtocol: 3, Transport: &http.Transport{}})
+	c.Assert(err, NotNil)
+
+	// NewTransport can't fail, so it falls back to the connections without PROXY protocol
+	t := NewTransport(TransportOptions{ProxyProtocol: 3})
+	c.Assert(t.DisableKeepAlives, Equals, false)
+}
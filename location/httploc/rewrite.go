@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/mailgun/vulcan/endpoint"
 	"github.com/mailgun/vulcan/headers"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
@@ -12,15 +13,22 @@ import (
 
 // Rewriter is responsible for removing hop-by-hop headers, fixing encodings and content-length
 type Rewriter struct {
+	// Deprecated: trusts forwarding headers from any peer. Forwarding headers sent by the proxy's
+	// TrustedProxies are preserved and appended to without it, see netutils.IsTrustedPeer
 	TrustForwardHeader bool
 	Hostname           string
+	// Controls the Host header sent to the endpoint
+	UpstreamHost UpstreamHost
 }
 
 func (rw *Rewriter) ProcessRequest(r request.Request) (*http.Response, error) {
 	req := r.GetHttpRequest()
 
+	// Headers sent by untrusted peers can be spoofed, so they are replaced
+	trusted := rw.isTrusted(req)
+
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if rw.TrustForwardHeader {
+		if trusted {
 			if prior, ok := req.Header[headers.XForwardedFor]; ok {
 				clientIP = strings.Join(prior, ", ") + ", " + clientIP
 			}
@@ -28,23 +36,51 @@ func (rw *Rewriter) ProcessRequest(r request.Request) (*http.Response, error) {
 		req.Header.Set(headers.XForwardedFor, clientIP)
 	}
 
-	if xfp := req.Header.Get(headers.XForwardedProto); xfp != "" && rw.TrustForwardHeader {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if xfp := req.Header.Get(headers.XForwardedProto); xfp != "" && trusted {
 		req.Header.Set(headers.XForwardedProto, xfp)
-	} else if req.TLS != nil {
-		req.Header.Set(headers.XForwardedProto, "https")
 	} else {
-		req.Header.Set(headers.XForwardedProto, "http")
+		req.Header.Set(headers.XForwardedProto, proto)
 	}
 
+	forwarded := rw.forwardedElement(req, proto)
+	if prior, ok := req.Header[headers.Forwarded]; ok && trusted {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	req.Header.Set(headers.Forwarded, forwarded)
+
 	if req.Host != "" {
 		req.Header.Set(headers.XForwardedHost, req.Host)
 	}
 	req.Header.Set(headers.XForwardedServer, rw.Hostname)
 
+	// Note that the URL host is set to the endpoint host at this point
+	switch rw.UpstreamHost.Policy {
+	case EndpointHost:
+		if _, ok := endpoint.UnixSocketPath(req.URL.Host); ok {
+			req.Host = "localhost"
+		} else {
+			req.Host = req.URL.Host
+		}
+	case FixedHost:
+		req.Host = rw.UpstreamHost.Host
+	}
+
+	// TE: trailers is the only TE value allowed in HTTP/2, and e.g. gRPC endpoints demand it
+	teTrailers := netutils.HasHeaderValue(req.Header, headers.Te, "trailers")
+
 	// Remove hop-by-hop headers to the backend.  Especially important is "Connection" because we want a persistent
 	// connection, regardless of what the client sent to us.
+	netutils.RemoveConnectionHeaders(req.Header)
 	netutils.RemoveHeaders(headers.HopHeaders, req.Header)
 
+	if teTrailers {
+		req.Header.Set(headers.Te, "trailers")
+	}
+
 	// We need to set ContentLength based on known request size. The incoming request may have been
 	// set without content length or using chunked TransferEncoding
 	totalSize, err := r.GetBody().TotalSize()
@@ -54,9 +90,33 @@ func (rw *Rewriter) ProcessRequest(r request.Request) (*http.Response, error) {
 	req.ContentLength = totalSize
 	// Remove TransferEncoding that could have been previously set
 	req.TransferEncoding = []string{}
+	// Trailers can be sent over HTTP/1.1 with chunked encoding only, so the content length should be unknown
+	if len(req.Trailer) != 0 {
+		req.ContentLength = -1
+	}
 
 	return nil, nil
 }
 
+func (rw *Rewriter) isTrusted(req *http.Request) bool {
+	return rw.TrustForwardHeader || netutils.IsTrustedPeer(req)
+}
+
+// forwardedElement returns RFC 7239 Forwarded header element describing this hop
+func (rw *Rewriter) forwardedElement(req *http.Request, proto string) string {
+	parts := []string{}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			parts = append(parts, "for="+netutils.FormatForwardedFor(ip))
+		}
+	}
+	// Host that can't be quoted is left out rather than passed to the endpoints mangled
+	if host, ok := netutils.QuoteForwardedValue(req.Host); req.Host != "" && ok {
+		parts = append(parts, "host="+host)
+	}
+	parts = append(parts, "proto="+proto)
+	return strings.Join(parts, ";")
+}
+
 func (tl *Rewriter) ProcessResponse(r request.Request, a request.Attempt) {
 }
@@ -0,0 +1,64 @@
+package httploc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TlsOptions control TLS connections to the https endpoints
+type TlsOptions struct {
+	// PEM encoded CA bundle used to verify endpoint certificates, system roots are used if empty
+	CaFile string
+	// PEM encoded client certificate and key presented to the endpoints
+	CertFile string
+	KeyFile  string
+	// Overrides the server name used for SNI and certificate verification
+	ServerName string
+	// Disables endpoint certificate verification, e.g. for staging pools with self signed certificates
+	InsecureSkipVerify bool
+	// Minimum TLS version, e.g. tls.VersionTLS12, Go's default is used if 0
+	MinVersion uint16
+	// Allowed cipher suites, Go's defaults are used if empty
+	CipherSuites []uint16
+}
+
+func (o *TlsOptions) isEmpty() bool {
+	return o.CaFile == "" && o.CertFile == "" && o.KeyFile == "" && o.ServerName == "" &&
+		!o.InsecureSkipVerify && o.MinVersion == 0 && len(o.CipherSuites) == 0
+}
+
+// NewTlsConfig reads the certificates and keys from disk and returns TLS client config.
+// Certificates are read every time the config is created, so to pick the updated files from disk
+// create a new config or call HttpLocation.ReloadTls
+func NewTlsConfig(o TlsOptions) (*tls.Config, error) {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, fmt.Errorf("Provide both certificate and key files")
+	}
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		MinVersion:         o.MinVersion,
+		CipherSuites:       o.CipherSuites,
+	}
+	if o.CaFile != "" {
+		bundle, err := ioutil.ReadFile(o.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No certificates found in CA bundle '%s'", o.CaFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
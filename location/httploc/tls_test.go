@@ -0,0 +1,201 @@
+package httploc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/mailgun/vulcan"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+// newTlsServer starts https server with certificate for 127.0.0.1 that requires client certificate
+// signed by the clientCert, returns the server and the path to its certificate
+func (s *LocSuite) newTlsServer(c *C, dir string, clientCert []byte) (*httptest.Server, string) {
+	certPEM, keyPEM := MakeCert("server", "127.0.0.1")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	c.Assert(err, IsNil)
+
+	clientCAs := x509.NewCertPool()
+	c.Assert(clientCAs.AppendCertsFromPEM(clientCert), Equals, true)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm tls endpoint"))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	return server, writeFile(c, dir, "server.pem", certPEM)
+}
+
+func writeFile(c *C, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	c.Assert(ioutil.WriteFile(path, data, 0600), IsNil)
+	return path
+}
+
+func (s *LocSuite) TestNewTlsConfig(c *C) {
+	dir := c.MkDir()
+	certPEM, keyPEM := MakeCert("client")
+
+	config, err := NewTlsConfig(TlsOptions{
+		CaFile:     writeFile(c, dir, "ca.pem", certPEM),
+		CertFile:   writeFile(c, dir, "cert.pem", certPEM),
+		KeyFile:    writeFile(c, dir, "key.pem", keyPEM),
+		ServerName: "example.com",
+		MinVersion: tls.VersionTLS12,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(config.RootCAs, NotNil)
+	c.Assert(len(config.Certificates), Equals, 1)
+	c.Assert(config.ServerName, Equals, "example.com")
+	c.Assert(config.MinVersion, Equals, uint16(tls.VersionTLS12))
+
+	// Key is missing
+	_, err = NewTlsConfig(TlsOptions{CertFile: filepath.Join(dir, "cert.pem")})
+	c.Assert(err, NotNil)
+
+	// Bundle has no certificates
+	_, err = NewTlsConfig(TlsOptions{CaFile: filepath.Join(dir, "key.pem")})
+	c.Assert(err, NotNil)
+
+	// File does not exist
+	_, err = NewTlsConfig(TlsOptions{CaFile: filepath.Join(dir, "missing.pem")})
+	c.Assert(err, NotNil)
+}
+
+func (s *LocSuite) TestNewTransportWithTls(c *C) {
+	dir := c.MkDir()
+	certPEM, _ := MakeCert("ca")
+
+	t, err := NewTransportWithTls(TransportOptions{Tls: TlsOptions{CaFile: writeFile(c, dir, "ca.pem", certPEM)}})
+	c.Assert(err, IsNil)
+	c.Assert(t.TLSClientConfig.RootCAs, NotNil)
+
+	_, err = NewTransportWithTls(TransportOptions{Tls: TlsOptions{CaFile: filepath.Join(dir, "missing.pem")}})
+	c.Assert(err, NotNil)
+
+	// TLS options are not applied by NewTransport
+	t = NewTransport(TransportOptions{Tls: TlsOptions{CaFile: filepath.Join(dir, "missing.pem")}})
+	c.Assert(t.TLSClientConfig, IsNil)
+}
+
+func (s *LocSuite) TestMutualTls(c *C) {
+	dir := c.MkDir()
+	clientCert, clientKey := MakeCert("client")
+
+	server, serverCA := s.newTlsServer(c, dir, clientCert)
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		Tls: TlsOptions{
+			CaFile:   serverCA,
+			CertFile: writeFile(c, dir, "client.pem", clientCert),
+			KeyFile:  writeFile(c, dir, "client.key", clientKey),
+		},
+	})
+	c.Assert(err, IsNil)
+
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	response, bodyBytes, err := MakeRequest(srv.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm tls endpoint")
+
+	// Without client certificate endpoint rejects the connection
+	o := location.GetOptions()
+	o.Tls = TlsOptions{CaFile: serverCA}
+	c.Assert(location.SetOptions(o), IsNil)
+
+	response, _, err = MakeRequest(srv.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+}
+
+func (s *LocSuite) TestInsecureSkipVerify(c *C) {
+	dir := c.MkDir()
+	clientCert, clientKey := MakeCert("client")
+
+	server, _ := s.newTlsServer(c, dir, clientCert)
+	defer server.Close()
+
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		Tls: TlsOptions{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "missing.key")},
+	})
+	c.Assert(err, NotNil)
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		Tls: TlsOptions{
+			InsecureSkipVerify: true,
+			CertFile:           writeFile(c, dir, "client.pem", clientCert),
+			KeyFile:            writeFile(c, dir, "client.key", clientKey),
+		},
+	})
+	c.Assert(err, IsNil)
+
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	response, _, err := MakeRequest(srv.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *LocSuite) TestReloadTls(c *C) {
+	dir := c.MkDir()
+	clientCert, clientKey := MakeCert("client")
+	otherCert, otherKey := MakeCert("other")
+
+	server, serverCA := s.newTlsServer(c, dir, clientCert)
+	defer server.Close()
+
+	certFile := writeFile(c, dir, "client.pem", otherCert)
+	keyFile := writeFile(c, dir, "client.key", otherKey)
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{
+		Tls: TlsOptions{CaFile: serverCA, CertFile: certFile, KeyFile: keyFile},
+	})
+	c.Assert(err, IsNil)
+
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	// Endpoint does not trust this certificate
+	response, _, err := MakeRequest(srv.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+
+	// Rotate the certificate on disk and reload
+	writeFile(c, dir, "client.pem", clientCert)
+	writeFile(c, dir, "client.key", clientKey)
+	c.Assert(location.ReloadTls(), IsNil)
+
+	response, _, err = MakeRequest(srv.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+	// Failed reload keeps the current transport
+	c.Assert(os.Remove(keyFile), IsNil)
+	c.Assert(location.ReloadTls(), NotNil)
+
+	response, _, err = MakeRequest(srv.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+}
@@ -0,0 +1,134 @@
+package httploc
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// UrlRewrite controls how the request path and query are changed before the request is forwarded to the endpoint.
+// Path rules are applied to the escaped path in the following order: StripPrefix, Replace, AddPrefix.
+type UrlRewrite struct {
+	// Prefix to remove from the path, e.g. location mounted at /api/v1 forwarding to the backend expecting /
+	StripPrefix string
+	// Prefix to add to the path
+	AddPrefix string
+	// Regular expression replacements, applied in order
+	Replace []UrlReplace
+	// Query parameters to remove
+	RemoveQuery []string
+	// Query parameters to append after the removal
+	AddQuery url.Values
+}
+
+// UrlReplace replaces the matches of the Pattern with the Replacement, that can refer to the capture groups, e.g. $1
+type UrlReplace struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// NewUrlReplace compiles the pattern and returns the replace rule
+func NewUrlReplace(pattern, replacement string) (*UrlReplace, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &UrlReplace{Pattern: re, Replacement: replacement}, nil
+}
+
+func (u *UrlRewrite) validate() error {
+	for _, r := range u.Replace {
+		if r.Pattern == nil {
+			return fmt.Errorf("Replace rule is missing pattern")
+		}
+	}
+	return nil
+}
+
+func (u *UrlRewrite) isEmpty() bool {
+	return u.StripPrefix == "" && u.AddPrefix == "" && len(u.Replace) == 0 && len(u.RemoveQuery) == 0 && len(u.AddQuery) == 0
+}
+
+// rewrite takes the raw request uri and returns the rewritten escaped path and query.
+// Note that we never unescape the path, so the encoded characters like %2F are passed to the endpoint as is.
+func (u *UrlRewrite) rewrite(requestURI string) (string, string) {
+	path, query := splitRequestURI(requestURI)
+
+	if hasPathPrefix(path, u.StripPrefix) {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(u.StripPrefix, "/"))
+	}
+	for _, r := range u.Replace {
+		path = r.Pattern.ReplaceAllString(path, r.Replacement)
+	}
+	if u.AddPrefix != "" {
+		path = strings.TrimSuffix(u.AddPrefix, "/") + ensureSlash(path)
+	}
+	return ensureSlash(path), u.rewriteQuery(query)
+}
+
+// hasPathPrefix matches the prefix at the path segment boundary only, so /api/v1 matches /api/v1 and /api/v1/users,
+// but not /api/v1users
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+func (u *UrlRewrite) rewriteQuery(query string) string {
+	if len(u.RemoveQuery) == 0 && len(u.AddQuery) == 0 {
+		return query
+	}
+	// Filter the raw query parts instead of parsing and encoding them back to preserve the original escaping
+	parts := []string{}
+	for _, part := range strings.Split(query, "&") {
+		if part == "" || u.isRemoved(part) {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(u.AddQuery) != 0 {
+		parts = append(parts, u.AddQuery.Encode())
+	}
+	return strings.Join(parts, "&")
+}
+
+func (u *UrlRewrite) isRemoved(part string) bool {
+	key := strings.SplitN(part, "=", 2)[0]
+	if k, err := url.QueryUnescape(key); err == nil {
+		key = k
+	}
+	for _, r := range u.RemoveQuery {
+		if r == key {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRequestURI splits the raw request uri into escaped path and query, request uri can be
+// in the absolute form, e.g. http://localhost/path?a=b, in this case scheme and host are dropped
+func splitRequestURI(requestURI string) (string, string) {
+	path, query := requestURI, ""
+	if idx := strings.IndexRune(requestURI, '?'); idx != -1 {
+		path, query = requestURI[:idx], requestURI[idx+1:]
+	}
+	if idx := strings.Index(path, "://"); idx != -1 && !strings.HasPrefix(path, "/") {
+		path = path[idx+3:]
+		if idx := strings.IndexRune(path, '/'); idx != -1 {
+			path = path[idx:]
+		} else {
+			path = "/"
+		}
+	}
+	return path, query
+}
+
+func ensureSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
@@ -0,0 +1,105 @@
+package httploc
+
+import (
+	"net/url"
+	"regexp"
+
+	. "gopkg.in/check.v1"
+)
+
+type RewriteSuite struct {
+}
+
+var _ = Suite(&RewriteSuite{})
+
+func (s *RewriteSuite) TestRewrite(c *C) {
+	tc := []struct {
+		Rewrite UrlRewrite
+		In      string
+		Path    string
+		Query   string
+	}{
+		{
+			Rewrite: UrlRewrite{StripPrefix: "/api/v1"},
+			In:      "/api/v1/users?a=b",
+			Path:    "/users",
+			Query:   "a=b",
+		},
+		{
+			Rewrite: UrlRewrite{StripPrefix: "/api/v1"},
+			In:      "/api/v1",
+			Path:    "/",
+		},
+		{
+			Rewrite: UrlRewrite{StripPrefix: "/api/v1"},
+			In:      "/other",
+			Path:    "/other",
+		},
+		// Prefix matches at the segment boundary only
+		{
+			Rewrite: UrlRewrite{StripPrefix: "/api/v1"},
+			In:      "/api/v1users",
+			Path:    "/api/v1users",
+		},
+		{
+			Rewrite: UrlRewrite{StripPrefix: "/api/v1/"},
+			In:      "/api/v1/users",
+			Path:    "/users",
+		},
+		{
+			Rewrite: UrlRewrite{AddPrefix: "/backend/"},
+			In:      "/users",
+			Path:    "/backend/users",
+		},
+		{
+			Rewrite: UrlRewrite{StripPrefix: "/api", AddPrefix: "/v2"},
+			In:      "http://localhost/api/users?a=b",
+			Path:    "/v2/users",
+			Query:   "a=b",
+		},
+		{
+			Rewrite: UrlRewrite{Replace: []UrlReplace{{Pattern: regexp.MustCompile(`^/users/([^/]+)/posts`), Replacement: "/posts/$1"}}},
+			In:      "/users/bob/posts/1",
+			Path:    "/posts/bob/1",
+		},
+		// Escaped characters are preserved
+		{
+			Rewrite: UrlRewrite{StripPrefix: "/log"},
+			In:      "/log/http%3A%2F%2Fwww.site.com%2Fsomething?a=%20b",
+			Path:    "/http%3A%2F%2Fwww.site.com%2Fsomething",
+			Query:   "a=%20b",
+		},
+		{
+			Rewrite: UrlRewrite{RemoveQuery: []string{"token", "a b"}, AddQuery: url.Values{"x": []string{"1 2"}}},
+			In:      "/path?token=secret&a=b&a%20b=c&c=%2F",
+			Path:    "/path",
+			Query:   "a=b&c=%2F&x=1+2",
+		},
+		{
+			Rewrite: UrlRewrite{AddQuery: url.Values{"x": []string{"y"}}},
+			In:      "/path",
+			Path:    "/path",
+			Query:   "x=y",
+		},
+	}
+	for i, t := range tc {
+		comment := Commentf("%d: %s", i, t.In)
+		path, query := t.Rewrite.rewrite(t.In)
+		c.Assert(path, Equals, t.Path, comment)
+		c.Assert(query, Equals, t.Query, comment)
+	}
+}
+
+func (s *RewriteSuite) TestNewUrlReplace(c *C) {
+	r, err := NewUrlReplace(`^/a/(.*)`, "/b/$1")
+	c.Assert(err, IsNil)
+	c.Assert(r.Pattern.ReplaceAllString("/a/c", r.Replacement), Equals, "/b/c")
+
+	_, err = NewUrlReplace(`(`, "")
+	c.Assert(err, NotNil)
+}
+
+func (s *RewriteSuite) TestValidate(c *C) {
+	c.Assert((&UrlRewrite{}).isEmpty(), Equals, true)
+	c.Assert((&UrlRewrite{Replace: []UrlReplace{{}}}).validate(), NotNil)
+}
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/mailgun/timetools"
@@ -10,50 +11,67 @@ import (
 // NewRollingCounterFn is a constructor of rolling counters.
 type NewRollingCounterFn func() (*RollingCounter, error)
 
-// Calculates in memory failure rate of an endpoint using rolling window of a predefined size
+// MinResolution is the smallest resolution of the rolling counter bucket
+const MinResolution = 10 * time.Millisecond
+
+// Calculates in memory failure rate of an endpoint using rolling window of a predefined size.
+// Counter is safe for concurrent use: every bucket is a single atomic word holding the count and the
+// number of the period it was counted in, so buckets left from the previous windows are recognized and
+// reset without locking.
 type RollingCounter struct {
 	timeProvider   timetools.TimeProvider
 	resolution     time.Duration
-	values         []int
-	countedBuckets int // how many samples in different buckets have we collected so far
-	lastBucket     int // last recorded bucket
-	lastUpdated    time.Time
+	values         []uint64
+	countedBuckets int64 // how many samples in different buckets have we collected so far
 }
 
+// Bucket word layout: the higher 32 bits hold the period number and the lower 32 bits hold the count
+const (
+	periodShift = 32
+	countMask   = 1<<periodShift - 1
+)
+
 // NewRollingCounter creates a counter with fixed amount of buckets that are rotated every resolition period.
-// E.g. 10 buckets with 1 second means that every new second the bucket is refreshed, so it maintains 10 second rolling window.
+// E.g. 10 buckets with 1 second means that every new second the bucket is refreshed, so it maintains 10 second rolling window,
+// and 10 buckets with 100 milliseconds maintain a second rolling window for the fast reacting circuit breakers.
 func NewRollingCounter(buckets int, resolution time.Duration, timeProvider timetools.TimeProvider) (*RollingCounter, error) {
 	if buckets <= 0 {
 		return nil, fmt.Errorf("Buckets should be >= 0")
 	}
-	if resolution < time.Second {
-		return nil, fmt.Errorf("Resolution should be larger than a second")
+	if resolution < MinResolution {
+		return nil, fmt.Errorf("Resolution should be at least %v", MinResolution)
 	}
 
 	return &RollingCounter{
 		resolution:   resolution,
 		timeProvider: timeProvider,
-		values:       make([]int, buckets),
-		lastBucket:   -1,
+		values:       make([]uint64, buckets),
 	}, nil
 }
 
 func (c *RollingCounter) Reset() {
-	c.lastBucket = -1
-	c.countedBuckets = 0
-	c.lastUpdated = time.Time{}
 	for i := range c.values {
-		c.values[i] = 0
+		atomic.StoreUint64(&c.values[i], 0)
 	}
+	atomic.StoreInt64(&c.countedBuckets, 0)
 }
 
 func (c *RollingCounter) CountedBuckets() int {
-	return c.countedBuckets
+	return int(atomic.LoadInt64(&c.countedBuckets))
 }
 
+// Count returns the sum of the buckets that belong to the current window
 func (c *RollingCounter) Count() int64 {
-	c.cleanup()
-	return c.sum()
+	current := c.getPeriod(c.timeProvider.UtcNow())
+	out := int64(0)
+	for i := range c.values {
+		v := atomic.LoadUint64(&c.values[i])
+		// Period numbers wrap around, the difference is still correct in the unsigned arithmetic
+		if current-uint32(v>>periodShift) < uint32(len(c.values)) {
+			out += int64(v & countMask)
+		}
+	}
+	return out
 }
 
 func (c *RollingCounter) Resolution() time.Duration {
@@ -69,48 +87,35 @@ func (c *RollingCounter) GetWindowSize() time.Duration {
 }
 
 func (c *RollingCounter) Inc() {
-	c.cleanup()
-	c.incBucketValue()
-}
-
-func (c *RollingCounter) incBucketValue() {
-	now := c.timeProvider.UtcNow()
-	bucket := c.getBucket(now)
-	c.values[bucket]++
-	c.lastUpdated = now
-	// Update usage stats if we haven't collected enough data
-	if c.countedBuckets < len(c.values) {
-		// Only update if we have advanced to the next bucket and not incremented the value
-		// in the current bucket.
-		if c.lastBucket != bucket {
-			c.lastBucket = bucket
-			c.countedBuckets++
+	period := c.getPeriod(c.timeProvider.UtcNow())
+	bucket := &c.values[int(period%uint32(len(c.values)))]
+	for {
+		old := atomic.LoadUint64(bucket)
+		fresh := uint32(old>>periodShift) != period || old&countMask == 0
+		updated := old + 1
+		if fresh {
+			updated = uint64(period)<<periodShift | 1
+		}
+		if atomic.CompareAndSwapUint64(bucket, old, updated) {
+			if fresh {
+				c.incCountedBuckets()
+			}
+			return
 		}
 	}
 }
 
-// Returns the number in the moving window bucket that this slot occupies
-func (c *RollingCounter) getBucket(t time.Time) int {
-	return int(t.Truncate(c.resolution).Unix() % int64(len(c.values)))
-}
-
-// Reset buckets that were not updated
-func (c *RollingCounter) cleanup() {
-	now := c.timeProvider.UtcNow()
-	for i := 0; i < len(c.values); i++ {
-		now = now.Add(time.Duration(-1*i) * c.resolution)
-		if now.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
-			c.values[c.getBucket(now)] = 0
-		} else {
-			break
+// Update usage stats if we haven't collected enough data
+func (c *RollingCounter) incCountedBuckets() {
+	for {
+		counted := atomic.LoadInt64(&c.countedBuckets)
+		if counted >= int64(len(c.values)) || atomic.CompareAndSwapInt64(&c.countedBuckets, counted, counted+1) {
+			return
 		}
 	}
 }
 
-func (c *RollingCounter) sum() int64 {
-	out := int64(0)
-	for _, v := range c.values {
-		out += int64(v)
-	}
-	return out
+// Returns the number of the resolution period since the epoch, the bucket is the period modulo the number of buckets
+func (c *RollingCounter) getPeriod(t time.Time) uint32 {
+	return uint32(t.UnixNano() / int64(c.resolution))
 }
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "gopkg.in/check.v1"
+)
+
+type CounterSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&CounterSuite{})
+
+func (s *CounterSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *CounterSuite) TestInvalidParams(c *C) {
+	_, err := NewRollingCounter(0, time.Second, s.tm)
+	c.Assert(err, NotNil)
+
+	_, err = NewRollingCounter(10, time.Millisecond, s.tm)
+	c.Assert(err, NotNil)
+}
+
+func (s *CounterSuite) TestSubSecondResolution(c *C) {
+	counter, err := NewRollingCounter(10, 100*time.Millisecond, s.tm)
+	c.Assert(err, IsNil)
+	c.Assert(counter.GetWindowSize(), Equals, time.Second)
+
+	counter.Inc()
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(100 * time.Millisecond)
+	counter.Inc()
+	counter.Inc()
+	c.Assert(counter.Count(), Equals, int64(3))
+	c.Assert(counter.CountedBuckets(), Equals, 2)
+
+	// The first bucket leaves the window
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(900 * time.Millisecond)
+	c.Assert(counter.Count(), Equals, int64(2))
+
+	// The bucket is reused by the new period
+	counter.Inc()
+	c.Assert(counter.Count(), Equals, int64(3))
+	c.Assert(counter.CountedBuckets(), Equals, 3)
+
+	// Whole window has passed
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	c.Assert(counter.Count(), Equals, int64(0))
+
+	counter.Inc()
+	counter.Reset()
+	c.Assert(counter.Count(), Equals, int64(0))
+	c.Assert(counter.CountedBuckets(), Equals, 0)
+}
+
+func (s *CounterSuite) TestCountedBucketsAreCapped(c *C) {
+	counter, err := NewRollingCounter(3, time.Second, s.tm)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 10; i++ {
+		counter.Inc()
+		s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	}
+	c.Assert(counter.CountedBuckets(), Equals, 3)
+	c.Assert(counter.Count(), Equals, int64(2))
+}
+
+func (s *CounterSuite) TestConcurrentInc(c *C) {
+	counter, err := NewRollingCounter(10, 100*time.Millisecond, s.tm)
+	c.Assert(err, IsNil)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counter.Inc()
+				counter.Count()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(counter.Count(), Equals, int64(10000))
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/mailgun/timetools"
 	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/grpc"
 	"github.com/mailgun/vulcan/middleware"
 	"github.com/mailgun/vulcan/request"
 )
@@ -25,6 +26,16 @@ func IsNetworkError(attempt request.Attempt) bool {
 	return attempt != nil && attempt.GetError() != nil
 }
 
+// IsGrpcError returns true if the attempt resulted in gRPC response with a failure status code,
+// e.g. UNAVAILABLE. Note that gRPC responses have HTTP 200 status code, the status is sent in trailers.
+func IsGrpcError(attempt request.Attempt) bool {
+	if attempt == nil {
+		return false
+	}
+	code, ok := grpc.GetStatus(attempt.GetResponse())
+	return ok && code.IsFailure()
+}
+
 // Calculates various performance metrics about the endpoint using counters of the predefined size
 type RollingMeter struct {
 	endpoint endpoint.Endpoint
@@ -66,7 +77,7 @@ func (r *RollingMeter) Reset() {
 }
 
 func (r *RollingMeter) IsReady() bool {
-	return r.errors.countedBuckets+r.successes.countedBuckets >= len(r.errors.values)
+	return r.errors.CountedBuckets()+r.successes.CountedBuckets() >= r.errors.Buckets()
 }
 
 func (r *RollingMeter) SuccessCount() int64 {
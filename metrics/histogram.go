@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/codahale/hdrhistogram"
@@ -24,6 +25,7 @@ type Histogram interface {
 
 // RollingHistogram holds multiple histograms and rotates every period.
 // It provides resulting histogram as a result of a call of 'Merged' function.
+// Rolling histograms created by NewRollingHistogram are safe for concurrent use.
 type RollingHistogram interface {
 	RecordValues(v, n int64) error
 	RecordLatencies(d time.Duration, n int64) error
@@ -42,6 +44,7 @@ func NewHDRHistogramFn(low, high int64, sigfigs int) NewHistogramFn {
 }
 
 type rollingHistogram struct {
+	mutex        *sync.Mutex
 	maker        NewHistogramFn
 	idx          int
 	lastRoll     time.Time
@@ -61,6 +64,7 @@ func NewRollingHistogram(maker NewHistogramFn, bucketCount int, period time.Dura
 	}
 
 	return &rollingHistogram{
+		mutex:        &sync.Mutex{},
 		maker:        maker,
 		buckets:      buckets,
 		period:       period,
@@ -69,6 +73,9 @@ func NewRollingHistogram(maker NewHistogramFn, bucketCount int, period time.Dura
 }
 
 func (r *rollingHistogram) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	r.idx = 0
 	r.lastRoll = r.timeProvider.UtcNow()
 	for _, b := range r.buckets {
@@ -82,12 +89,15 @@ func (r *rollingHistogram) rotate() {
 }
 
 func (r *rollingHistogram) Merged() (Histogram, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	m, err := r.maker()
 	if err != nil {
 		return m, err
 	}
 	for _, h := range r.buckets {
-		if m.Merge(h); err != nil {
+		if err := m.Merge(h); err != nil {
 			return nil, err
 		}
 	}
@@ -103,10 +113,16 @@ func (r *rollingHistogram) getHist() Histogram {
 }
 
 func (r *rollingHistogram) RecordLatencies(v time.Duration, n int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	return r.getHist().RecordLatencies(v, n)
 }
 
 func (r *rollingHistogram) RecordValues(v, n int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	return r.getHist().RecordValues(v, n)
 }
 
@@ -0,0 +1,161 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// breakerStates are exported as a series per state, with the value 1 for the current state
+var breakerStates = []string{"standby", "tripped", "recovering"}
+
+// Format returns the metrics in Prometheus text exposition format, series are sorted by labels
+func (r *Registry) Format() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b := &bytes.Buffer{}
+
+	lines := []string{}
+	for k, v := range r.requests {
+		lines = append(lines, series("vulcan_requests_total", v, "location", k.location, "endpoint", k.endpoint, "code", k.code))
+	}
+	writeFamily(b, "vulcan_requests_total", "counter", "Requests proxied to the endpoints by the response code, error for network errors and intercepted for requests rejected by the middlewares.", lines)
+
+	lines = []string{}
+	for k, v := range r.netErrors {
+		lines = append(lines, series("vulcan_network_errors_total", v, "location", k.location, "endpoint", k.endpoint))
+	}
+	writeFamily(b, "vulcan_network_errors_total", "counter", "Requests to the endpoints that have failed without response.", lines)
+
+	lines = []string{}
+	for k, h := range r.latencies {
+		lines = append(lines, r.formatHistogram("vulcan_request_duration_seconds", k, h))
+	}
+	writeFamily(b, "vulcan_request_duration_seconds", "histogram", "Round trip latency of the requests to the endpoints.", lines)
+
+	lines = []string{}
+	for locationId, rr := range r.balancers {
+		for endpointId, w := range rr.GetEffectiveWeights() {
+			lines = append(lines, series("vulcan_endpoint_effective_weight", w, "location", locationId, "endpoint", endpointId))
+		}
+	}
+	writeFamily(b, "vulcan_endpoint_effective_weight", "gauge", "Weight of the endpoint adjusted by the load balancer.", lines)
+
+	lines = []string{}
+	for locationId, cb := range r.breakers {
+		current := cb.GetState()
+		for _, state := range breakerStates {
+			v := 0
+			if state == current {
+				v = 1
+			}
+			lines = append(lines, series("vulcan_circuit_breaker_state", v, "location", locationId, "state", state))
+		}
+	}
+	writeFamily(b, "vulcan_circuit_breaker_state", "gauge", "Circuit breaker state, 1 for the current state.", lines)
+
+	lines = []string{}
+	for locationId, cb := range r.breakers {
+		lines = append(lines, series("vulcan_circuit_breaker_dry_run_trips_total", cb.GetDryRunTrips(), "location", locationId))
+	}
+	writeFamily(b, "vulcan_circuit_breaker_dry_run_trips_total", "counter", "Circuit breaker trips in the dry run mode.", lines)
+
+	lines = []string{}
+	for k, v := range r.limiters {
+		lines = append(lines, series("vulcan_limiter_rejections_total", atomic.LoadInt64(&v.rejections), "location", k.location, "limiter", k.limiter))
+	}
+	writeFamily(b, "vulcan_limiter_rejections_total", "counter", "Requests rejected by the limiters.", lines)
+
+	lines = []string{}
+	for k, v := range r.limiters {
+		lines = append(lines, series("vulcan_limiter_errors_total", atomic.LoadInt64(&v.errors), "location", k.location, "limiter", k.limiter))
+	}
+	writeFamily(b, "vulcan_limiter_errors_total", "counter", "Requests the limiters have failed to process, e.g. because of the mapper or the store errors.", lines)
+
+	lines = []string{}
+	for k, d := range r.dryRuns {
+		lines = append(lines, series("vulcan_limiter_dry_run_rejections_total", d.GetDryRunRejections(), "location", k.location, "limiter", k.limiter))
+	}
+	writeFamily(b, "vulcan_limiter_dry_run_rejections_total", "counter", "Requests the limiters in the dry run mode would have rejected.", lines)
+
+	lines = []string{}
+	for k, d := range r.dryRuns {
+		lines = append(lines, series("vulcan_limiter_dry_run_errors_total", d.GetDryRunErrors(), "location", k.location, "limiter", k.limiter))
+	}
+	writeFamily(b, "vulcan_limiter_dry_run_errors_total", "counter", "Requests the limiters in the dry run mode have failed to process.", lines)
+
+	lines = []string{}
+	for k, l := range r.adaptive {
+		lines = append(lines, series("vulcan_concurrency_limit", l.GetLimit(), "location", k.location, "limiter", k.limiter))
+	}
+	writeFamily(b, "vulcan_concurrency_limit", "gauge", "Current limit of the adaptive concurrency limiters.", lines)
+
+	lines = []string{}
+	for k, l := range r.adaptive {
+		lines = append(lines, series("vulcan_concurrency_in_flight", l.GetInFlight(), "location", k.location, "limiter", k.limiter))
+	}
+	writeFamily(b, "vulcan_concurrency_in_flight", "gauge", "Requests in flight of the adaptive concurrency limiters.", lines)
+
+	return b.Bytes()
+}
+
+func (r *Registry) formatHistogram(name string, k endpointKey, h *histogram) string {
+	lines := make([]string, 0, len(h.counts)+3)
+	cumulative := int64(0)
+	for i, bound := range r.options.Buckets {
+		cumulative += h.counts[i]
+		lines = append(lines, series(name+"_bucket", cumulative, "location", k.location, "endpoint", k.endpoint, "le", formatFloat(bound)))
+	}
+	lines = append(lines,
+		series(name+"_bucket", h.count, "location", k.location, "endpoint", k.endpoint, "le", "+Inf"),
+		series(name+"_sum", h.sum, "location", k.location, "endpoint", k.endpoint),
+		series(name+"_count", h.count, "location", k.location, "endpoint", k.endpoint))
+	// Keep the lines of one histogram together when the families are sorted
+	return strings.Join(lines, "\n")
+}
+
+func writeFamily(b *bytes.Buffer, name, kind, help string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	sort.Strings(lines)
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+}
+
+// series formats a sample line, labels are passed as name, value pairs
+func series(name string, value interface{}, labels ...string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+	}
+	var v string
+	switch val := value.(type) {
+	case float64:
+		v = formatFloat(val)
+	default:
+		v = fmt.Sprintf("%d", val)
+	}
+	return fmt.Sprintf("%s{%s} %s", name, strings.Join(pairs, ","), v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
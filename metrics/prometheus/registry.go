@@ -0,0 +1,243 @@
+// Package prometheus exposes the proxy metrics in Prometheus text format.
+//
+// Unlike the rolling windows in the metrics package, that are used for load balancing and circuit breaker
+// decisions, the registry keeps cumulative counters, so Prometheus can compute rates over any period:
+//
+//	registry := prometheus.NewRegistry()
+//	registry.RegisterLocation(location)
+//	registry.RegisterBalancer(location.GetId(), rr)
+//	http.Handle("/metrics", registry)
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailgun/vulcan/circuitbreaker"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/connlimit"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/request"
+)
+
+// ObserverId is the id of the registry observer in the location observer chain
+const ObserverId = "prometheus"
+
+// DefaultBuckets are the upper bounds of the latency histogram buckets in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Options struct {
+	// Upper bounds of the latency histogram buckets in seconds, DefaultBuckets are used if empty
+	Buckets []float64
+}
+
+// Registry collects the metrics of the registered locations, balancers, circuit breakers and limiters
+// and serves them in Prometheus text format
+type Registry struct {
+	options Options
+	mutex   *sync.Mutex
+
+	requests  map[requestKey]int64
+	netErrors map[endpointKey]int64
+	latencies map[endpointKey]*histogram
+	limiters  map[limiterKey]*limiterCounters
+	dryRuns   map[limiterKey]dryRunLimiter
+	balancers map[string]*roundrobin.RoundRobin
+	breakers  map[string]*circuitbreaker.CircuitBreaker
+	adaptive  map[limiterKey]*connlimit.AdaptiveLimiter
+}
+
+type endpointKey struct {
+	location string
+	endpoint string
+}
+
+type requestKey struct {
+	endpointKey
+	code string
+}
+
+type limiterKey struct {
+	location string
+	limiter  string
+}
+
+// limiterCounters are updated atomically by the instrumented limiters
+type limiterCounters struct {
+	rejections int64
+	errors     int64
+}
+
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func NewRegistry() *Registry {
+	r, _ := NewRegistryWithOptions(Options{})
+	return r
+}
+
+func NewRegistryWithOptions(o Options) (*Registry, error) {
+	o, err := validateOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{
+		options:   o,
+		mutex:     &sync.Mutex{},
+		requests:  make(map[requestKey]int64),
+		netErrors: make(map[endpointKey]int64),
+		latencies: make(map[endpointKey]*histogram),
+		limiters:  make(map[limiterKey]*limiterCounters),
+		dryRuns:   make(map[limiterKey]dryRunLimiter),
+		balancers: make(map[string]*roundrobin.RoundRobin),
+		breakers:  make(map[string]*circuitbreaker.CircuitBreaker),
+		adaptive:  make(map[limiterKey]*connlimit.AdaptiveLimiter),
+	}, nil
+}
+
+// RegisterLocation adds the observer recording every attempt to proxy the request to the location endpoints
+func (r *Registry) RegisterLocation(l *httploc.HttpLocation) error {
+	return l.GetObserverChain().Add(ObserverId, &locationObserver{registry: r, location: l.GetId()})
+}
+
+// RegisterBalancer exports the effective weights of the balancer endpoints
+func (r *Registry) RegisterBalancer(locationId string, rr *roundrobin.RoundRobin) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.balancers[locationId] = rr
+}
+
+// RegisterCircuitBreaker exports the state of the location circuit breaker
+func (r *Registry) RegisterCircuitBreaker(locationId string, cb *circuitbreaker.CircuitBreaker) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.breakers[locationId] = cb
+}
+
+// RegisterAdaptiveLimiter exports the current limit and the requests in flight of the adaptive limiter
+func (r *Registry) RegisterAdaptiveLimiter(locationId, limiterId string, l *connlimit.AdaptiveLimiter) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.adaptive[limiterKey{location: locationId, limiter: limiterId}] = l
+}
+
+// InstrumentLimiter wraps the limiter to count the rejected requests and the requests it has failed to process,
+// e.g. because of the mapper or the store errors, add the returned limiter to the location middleware chain
+// instead of the original one. Limiters in the dry run mode, e.g. tokenbucket.TokenLimiter, export the requests
+// they would have rejected too
+func (r *Registry) InstrumentLimiter(locationId, limiterId string, l limit.Limiter) limit.Limiter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := limiterKey{location: locationId, limiter: limiterId}
+	counters, ok := r.limiters[key]
+	if !ok {
+		counters = &limiterCounters{}
+		r.limiters[key] = counters
+	}
+	if d, ok := l.(dryRunLimiter); ok {
+		r.dryRuns[key] = d
+	}
+	return &countingLimiter{Limiter: l, counters: counters}
+}
+
+// ServeHTTP writes the metrics in Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(r.Format())
+}
+
+func (r *Registry) recordAttempt(locationId string, a request.Attempt) {
+	key := endpointKey{location: locationId}
+	if a.GetEndpoint() != nil {
+		key.endpoint = a.GetEndpoint().GetId()
+	}
+	code := "error"
+	if a.GetResponse() != nil {
+		code = strconv.Itoa(a.GetResponse().StatusCode)
+	}
+	intercepted := request.IsIntercepted(a)
+	if intercepted && a.GetResponse() == nil {
+		code = "intercepted"
+	}
+	seconds := a.GetDuration().Seconds()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.requests[requestKey{endpointKey: key, code: code}] += 1
+	// Requests replied by the middlewares have never reached the endpoint, so they don't tell its latency
+	if intercepted {
+		return
+	}
+	if metrics.IsNetworkError(a) {
+		r.netErrors[key] += 1
+	}
+	h, ok := r.latencies[key]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(r.options.Buckets))}
+		r.latencies[key] = h
+	}
+	// Buckets are counted cumulatively when formatted
+	if i := sort.SearchFloat64s(r.options.Buckets, seconds); i < len(h.counts) {
+		h.counts[i] += 1
+	}
+	h.sum += seconds
+	h.count += 1
+}
+
+type locationObserver struct {
+	registry *Registry
+	location string
+}
+
+func (o *locationObserver) ObserveRequest(r request.Request) {
+}
+
+func (o *locationObserver) ObserveResponse(r request.Request, a request.Attempt) {
+	o.registry.recordAttempt(o.location, a)
+}
+
+// dryRunLimiter is implemented by the limiters supporting the dry run mode
+type dryRunLimiter interface {
+	GetDryRunRejections() int64
+	GetDryRunErrors() int64
+}
+
+type countingLimiter struct {
+	limit.Limiter
+	counters *limiterCounters
+}
+
+func (l *countingLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	re, err := l.Limiter.ProcessRequest(r)
+	if _, ok := err.(*errors.LimitError); ok || (re != nil && err == nil) {
+		atomic.AddInt64(&l.counters.rejections, 1)
+	} else if err != nil {
+		atomic.AddInt64(&l.counters.errors, 1)
+	}
+	return re, err
+}
+
+func validateOptions(o Options) (Options, error) {
+	if len(o.Buckets) == 0 {
+		o.Buckets = DefaultBuckets
+		return o, nil
+	}
+	for i := 1; i < len(o.Buckets); i++ {
+		if o.Buckets[i] <= o.Buckets[i-1] {
+			return o, fmt.Errorf("Buckets should be sorted in increasing order: %v", o.Buckets)
+		}
+	}
+	return o, nil
+}
@@ -0,0 +1,224 @@
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/circuitbreaker"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/connlimit"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func TestPrometheus(t *testing.T) { TestingT(t) }
+
+type RegistrySuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&RegistrySuite{
+	tm: &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	},
+})
+
+func (s *RegistrySuite) TestLocationMetrics(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	registry := NewRegistry()
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	c.Assert(rr.AddEndpointWithOptions(endpoint.MustParseUrl(server.URL), roundrobin.EndpointOptions{Weight: 3}), IsNil)
+	location, err := httploc.NewLocationWithOptions("loc1", rr, httploc.Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	c.Assert(registry.RegisterLocation(location), IsNil)
+	registry.RegisterBalancer("loc1", rr)
+
+	reject := &middleware.MiddlewareWrapper{
+		OnRequest: func(r request.Request) (*http.Response, error) {
+			if r.GetHttpRequest().Header.Get("X-Reject") != "" {
+				return netutils.NewTextResponse(r.GetHttpRequest(), 429, "Too many requests"), nil
+			}
+			return nil, nil
+		},
+	}
+	c.Assert(location.GetMiddlewareChain().Add("limiter", 0, registry.InstrumentLimiter("loc1", "rate", reject)), IsNil)
+
+	cb, err := circuitbreaker.New(
+		circuitbreaker.MustParseExpression(`NetworkErrorRatio() > 0.5`),
+		&middleware.MiddlewareWrapper{},
+		circuitbreaker.Options{})
+	c.Assert(err, IsNil)
+	registry.RegisterCircuitBreaker("loc1", cb)
+
+	proxy, err := vulcan.NewProxy(&route.ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	for _, path := range []string{"/", "/", "/fail"} {
+		_, _, err := GET(proxyServer.URL+path, Opts{})
+		c.Assert(err, IsNil)
+	}
+	rejected := http.Header{}
+	rejected.Set("X-Reject", "yes")
+	response, _, err := GET(proxyServer.URL, Opts{Headers: rejected})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, 429)
+
+	metricsServer := httptest.NewServer(registry)
+	defer metricsServer.Close()
+	response, body, err := GET(metricsServer.URL+"/metrics", Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.Header.Get("Content-Type"), Equals, "text/plain; version=0.0.4; charset=utf-8")
+
+	out := string(body)
+	labels := fmt.Sprintf(`location="loc1",endpoint="%s"`, server.URL)
+	expected := []string{
+		"# TYPE vulcan_requests_total counter",
+		`vulcan_requests_total{` + labels + `,code="200"} 2`,
+		`vulcan_requests_total{` + labels + `,code="429"} 1`,
+		`vulcan_requests_total{` + labels + `,code="500"} 1`,
+		// Request rejected by the limiter never got to the endpoint
+		"# TYPE vulcan_request_duration_seconds histogram",
+		`vulcan_request_duration_seconds_bucket{` + labels + `,le="0.005"} 3`,
+		`vulcan_request_duration_seconds_bucket{` + labels + `,le="+Inf"} 3`,
+		`vulcan_request_duration_seconds_sum{` + labels + `} 0`,
+		`vulcan_request_duration_seconds_count{` + labels + `} 3`,
+		`vulcan_endpoint_effective_weight{` + labels + `} 3`,
+		`vulcan_circuit_breaker_state{location="loc1",state="recovering"} 0`,
+		`vulcan_circuit_breaker_state{location="loc1",state="standby"} 1`,
+		`vulcan_circuit_breaker_state{location="loc1",state="tripped"} 0`,
+		`vulcan_circuit_breaker_dry_run_trips_total{location="loc1"} 0`,
+		`vulcan_limiter_rejections_total{location="loc1",limiter="rate"} 1`,
+	}
+	for _, line := range expected {
+		c.Assert(strings.Contains(out, line+"\n"), Equals, true, Commentf("missing %s in\n%s", line, out))
+	}
+	// No network errors were observed
+	c.Assert(strings.Contains(out, "vulcan_network_errors_total"), Equals, false)
+
+	// Registering the location twice is an error
+	c.Assert(registry.RegisterLocation(location), NotNil)
+}
+
+func (s *RegistrySuite) TestHistogram(c *C) {
+	registry, err := NewRegistryWithOptions(Options{Buckets: []float64{0.1, 1}})
+	c.Assert(err, IsNil)
+
+	e := endpoint.MustParseUrl("http://localhost:5000")
+	for _, d := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second} {
+		registry.recordAttempt("loc1", &request.BaseAttempt{Endpoint: e, Duration: d})
+	}
+	registry.recordAttempt("loc1", &request.BaseAttempt{Endpoint: e, Error: fmt.Errorf("connection refused")})
+	// Requests rejected by the middlewares are counted apart and don't get to the histogram
+	registry.recordAttempt("loc1", &request.BaseAttempt{Endpoint: e, Intercepted: true})
+
+	c.Assert(string(registry.Format()), Equals, `# HELP vulcan_requests_total Requests proxied to the endpoints by the response code, error for network errors and intercepted for requests rejected by the middlewares.
+# TYPE vulcan_requests_total counter
+vulcan_requests_total{location="loc1",endpoint="http://localhost:5000",code="error"} 5
+vulcan_requests_total{location="loc1",endpoint="http://localhost:5000",code="intercepted"} 1
+# HELP vulcan_network_errors_total Requests to the endpoints that have failed without response.
+# TYPE vulcan_network_errors_total counter
+vulcan_network_errors_total{location="loc1",endpoint="http://localhost:5000"} 1
+# HELP vulcan_request_duration_seconds Round trip latency of the requests to the endpoints.
+# TYPE vulcan_request_duration_seconds histogram
+vulcan_request_duration_seconds_bucket{location="loc1",endpoint="http://localhost:5000",le="0.1"} 3
+vulcan_request_duration_seconds_bucket{location="loc1",endpoint="http://localhost:5000",le="1"} 4
+vulcan_request_duration_seconds_bucket{location="loc1",endpoint="http://localhost:5000",le="+Inf"} 5
+vulcan_request_duration_seconds_sum{location="loc1",endpoint="http://localhost:5000"} 2.65
+vulcan_request_duration_seconds_count{location="loc1",endpoint="http://localhost:5000"} 5
+`)
+
+	_, err = NewRegistryWithOptions(Options{Buckets: []float64{1, 0.1}})
+	c.Assert(err, NotNil)
+}
+
+// Only the limit errors and the responses are counted as rejections, other errors are counted apart
+func (s *RegistrySuite) TestLimiterErrors(c *C) {
+	registry := NewRegistry()
+	limiter := registry.InstrumentLimiter("loc1", "rate", &middleware.MiddlewareWrapper{
+		OnRequest: func(r request.Request) (*http.Response, error) {
+			switch r.GetHttpRequest().Header.Get("X-Outcome") {
+			case "limit":
+				return nil, limit.NewLimitError("Too many requests", limit.Quota{Limit: 1}, time.Second, s.tm.UtcNow())
+			case "response":
+				return netutils.NewTextResponse(r.GetHttpRequest(), 429, "Too many requests"), nil
+			case "error":
+				return nil, fmt.Errorf("Store is down")
+			}
+			return nil, nil
+		},
+	})
+
+	for _, outcome := range []string{"", "limit", "response", "error", "error", "error"} {
+		req := &http.Request{Header: http.Header{}}
+		req.Header.Set("X-Outcome", outcome)
+		limiter.ProcessRequest(request.NewBaseRequest(req, 1, nil))
+	}
+
+	out := string(registry.Format())
+	c.Assert(strings.Contains(out, `vulcan_limiter_rejections_total{location="loc1",limiter="rate"} 2`+"\n"), Equals, true, Commentf(out))
+	c.Assert(strings.Contains(out, `vulcan_limiter_errors_total{location="loc1",limiter="rate"} 3`+"\n"), Equals, true, Commentf(out))
+}
+
+// Requests the limiters in the dry run mode let through are exported apart from the rejections
+func (s *RegistrySuite) TestDryRunLimiter(c *C) {
+	registry := NewRegistry()
+	l, err := connlimit.NewConnectionLimiterWithOptions(limit.MapClientIp, 1, connlimit.Options{DryRun: true})
+	c.Assert(err, IsNil)
+	limiter := registry.InstrumentLimiter("loc1", "conn", l)
+
+	for i := 0; i < 2; i++ {
+		re, err := limiter.ProcessRequest(request.NewBaseRequest(&http.Request{RemoteAddr: "1.2.3.4:5000"}, 1, nil))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+	// Request the limiter can not map
+	_, err = limiter.ProcessRequest(request.NewBaseRequest(&http.Request{}, 1, nil))
+	c.Assert(err, IsNil)
+
+	out := string(registry.Format())
+	c.Assert(strings.Contains(out, `vulcan_limiter_rejections_total{location="loc1",limiter="conn"} 0`+"\n"), Equals, true, Commentf(out))
+	c.Assert(strings.Contains(out, `vulcan_limiter_dry_run_rejections_total{location="loc1",limiter="conn"} 1`+"\n"), Equals, true, Commentf(out))
+	c.Assert(strings.Contains(out, `vulcan_limiter_dry_run_errors_total{location="loc1",limiter="conn"} 1`+"\n"), Equals, true, Commentf(out))
+}
+
+func (s *RegistrySuite) TestAdaptiveLimiter(c *C) {
+	registry := NewRegistry()
+	l, err := connlimit.NewAdaptiveLimiter(connlimit.AdaptiveOptions{InitialLimit: 5})
+	c.Assert(err, IsNil)
+	registry.RegisterAdaptiveLimiter("loc1", "adaptive", l)
+
+	_, err = l.ProcessRequest(request.NewBaseRequest(&http.Request{RemoteAddr: "1.2.3.4:5000"}, 1, nil))
+	c.Assert(err, IsNil)
+
+	out := string(registry.Format())
+	c.Assert(strings.Contains(out, `vulcan_concurrency_limit{location="loc1",limiter="adaptive"} 5`+"\n"), Equals, true, Commentf(out))
+	c.Assert(strings.Contains(out, `vulcan_concurrency_in_flight{location="loc1",limiter="adaptive"} 1`+"\n"), Equals, true, Commentf(out))
+}
+
+func (s *RegistrySuite) TestEscapeLabels(c *C) {
+	c.Assert(series("m", 1, "a", "x\"y\\z\nw"), Equals, `m{a="x\"y\\z\nw"} 1`)
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"sync"
 	"time"
 
 	"github.com/mailgun/log"
@@ -13,10 +14,13 @@ import (
 // all counters are collected as rolling window counters with defined precision, histograms
 // are a rolling window histograms with defined precision as well.
 // See RoundTripOptions for more detail on parameters.
+// Metrics are safe for concurrent use, e.g. by the circuit breaker recording the responses of parallel requests.
 type RoundTripMetrics struct {
 	o           *RoundTripOptions
 	total       *RollingCounter
 	netErrors   *RollingCounter
+	grpcErrors  *RollingCounter
+	mutex       *sync.RWMutex
 	statusCodes map[int]*RollingCounter
 	histogram   RollingHistogram
 }
@@ -25,7 +29,8 @@ type RoundTripOptions struct {
 	// CounterBuckets - how many buckets to allocate for rolling counter. Defaults to 10 buckets.
 	CounterBuckets int
 	// CounterResolution specifies the resolution for a single bucket
-	// (e.g. time.Second means that bucket will be counted for a second).
+	// (e.g. time.Second means that bucket will be counted for a second, 100 * time.Millisecond
+	// with 10 buckets keeps a second window for the fast reacting circuit breakers).
 	// defaults to time.Second
 	CounterResolution time.Duration
 	// HistMin - minimum non 0 value for a histogram (default 1)
@@ -59,6 +64,7 @@ func NewRoundTripMetrics(o RoundTripOptions) (*RoundTripMetrics, error) {
 	}
 
 	m := &RoundTripMetrics{
+		mutex:       &sync.RWMutex{},
 		statusCodes: make(map[int]*RollingCounter),
 		histogram:   h,
 		o:           &o,
@@ -74,8 +80,14 @@ func NewRoundTripMetrics(o RoundTripOptions) (*RoundTripMetrics, error) {
 		return nil, err
 	}
 
+	grpcErrors, err := m.newCounter()
+	if err != nil {
+		return nil, err
+	}
+
 	m.netErrors = netErrors
 	m.total = total
+	m.grpcErrors = grpcErrors
 	return m, nil
 }
 
@@ -93,8 +105,20 @@ func (m *RoundTripMetrics) GetNetworkErrorRatio() float64 {
 	return float64(m.netErrors.Count()) / float64(m.total.Count())
 }
 
+// GetGrpcErrorRatio calculates the amount of gRPC responses with failure status codes (e.g. UNAVAILABLE)
+// that occured in the given time window compared to the total requests count.
+func (m *RoundTripMetrics) GetGrpcErrorRatio() float64 {
+	if m.total.Count() == 0 {
+		return 0
+	}
+	return float64(m.grpcErrors.Count()) / float64(m.total.Count())
+}
+
 // GetResponseCodeRatio calculates ratio of count(startA to endA) / count(startB to endB)
 func (m *RoundTripMetrics) GetResponseCodeRatio(startA, endA, startB, endB int) float64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	a := int64(0)
 	b := int64(0)
 	for code, v := range m.statusCodes {
@@ -115,6 +139,7 @@ func (m *RoundTripMetrics) GetResponseCodeRatio(startA, endA, startB, endB int)
 func (m *RoundTripMetrics) RecordMetrics(a request.Attempt) {
 	m.total.Inc()
 	m.recordNetError(a)
+	m.recordGrpcError(a)
 	m.recordLatency(a)
 	m.recordStatusCode(a)
 }
@@ -129,8 +154,16 @@ func (m *RoundTripMetrics) GetNetworkErrorCount() int64 {
 	return m.netErrors.Count()
 }
 
+// GetGrpcErrorCount returns total count of gRPC responses with failure status codes
+func (m *RoundTripMetrics) GetGrpcErrorCount() int64 {
+	return m.grpcErrors.Count()
+}
+
 // GetStatusCodesCounts returns map with counts of the response codes
 func (m *RoundTripMetrics) GetStatusCodesCounts() map[int]int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	sc := make(map[int]int64)
 	for k, v := range m.statusCodes {
 		if v.Count() != 0 {
@@ -149,6 +182,10 @@ func (m *RoundTripMetrics) Reset() {
 	m.histogram.Reset()
 	m.total.Reset()
 	m.netErrors.Reset()
+	m.grpcErrors.Reset()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.statusCodes = make(map[int]*RollingCounter)
 }
 
@@ -162,6 +199,12 @@ func (m *RoundTripMetrics) recordNetError(a request.Attempt) {
 	}
 }
 
+func (m *RoundTripMetrics) recordGrpcError(a request.Attempt) {
+	if IsGrpcError(a) {
+		m.grpcErrors.Inc()
+	}
+}
+
 func (m *RoundTripMetrics) recordLatency(a request.Attempt) {
 	if err := m.histogram.RecordLatencies(a.GetDuration(), 1); err != nil {
 		log.Errorf("Failed to record latency: %v", err)
@@ -173,6 +216,18 @@ func (m *RoundTripMetrics) recordStatusCode(a request.Attempt) {
 		return
 	}
 	statusCode := a.GetResponse().StatusCode
+
+	m.mutex.RLock()
+	c, ok := m.statusCodes[statusCode]
+	m.mutex.RUnlock()
+	if ok {
+		c.Inc()
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Other goroutine could have created the counter before we grabbed the mutex
 	if c, ok := m.statusCodes[statusCode]; ok {
 		c.Inc()
 		return
@@ -3,9 +3,11 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/grpc"
 	"github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
 )
@@ -54,6 +56,71 @@ func (s *RRSuite) TestDefaults(c *C) {
 	c.Assert(h.LatencyAtQuantile(100), Equals, time.Duration(0))
 }
 
+func (s *RRSuite) TestGrpcErrors(c *C) {
+	rr, err := NewRoundTripMetrics(RoundTripOptions{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	rr.RecordMetrics(&request.BaseAttempt{Response: grpc.NewErrorResponse(nil, grpc.Unavailable, "")})
+	rr.RecordMetrics(&request.BaseAttempt{Response: grpc.NewErrorResponse(nil, grpc.NotFound, "")})
+	rr.RecordMetrics(&request.BaseAttempt{Response: grpc.NewErrorResponse(nil, grpc.OK, "")})
+	rr.RecordMetrics(makeAttempt(O{statusCode: 500}))
+
+	c.Assert(rr.GetGrpcErrorCount(), Equals, int64(1))
+	c.Assert(rr.GetGrpcErrorRatio(), Equals, float64(1)/float64(4))
+	c.Assert(rr.GetStatusCodesCounts(), DeepEquals, map[int]int64{500: 1, 200: 3})
+
+	rr.Reset()
+	c.Assert(rr.GetGrpcErrorCount(), Equals, int64(0))
+	c.Assert(rr.GetGrpcErrorRatio(), Equals, float64(0))
+}
+
+func (s *RRSuite) TestSubSecondResolution(c *C) {
+	tm := &timetools.FreezedTime{CurrentTime: s.tm.CurrentTime}
+	rr, err := NewRoundTripMetrics(RoundTripOptions{TimeProvider: tm, CounterResolution: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	rr.RecordMetrics(makeAttempt(O{err: fmt.Errorf("o")}))
+	tm.CurrentTime = tm.CurrentTime.Add(500 * time.Millisecond)
+	rr.RecordMetrics(makeAttempt(O{statusCode: 200}))
+	c.Assert(rr.GetNetworkErrorRatio(), Equals, 0.5)
+
+	// The error has left the second long window
+	tm.CurrentTime = tm.CurrentTime.Add(500 * time.Millisecond)
+	c.Assert(rr.GetNetworkErrorRatio(), Equals, float64(0))
+	c.Assert(rr.GetTotalCount(), Equals, int64(1))
+}
+
+// Run with -race to check the metrics recorded by parallel requests
+func (s *RRSuite) TestConcurrentRecording(c *C) {
+	rr, err := NewRoundTripMetrics(RoundTripOptions{TimeProvider: s.tm, CounterResolution: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				rr.RecordMetrics(makeAttempt(O{statusCode: 200 + i, duration: time.Millisecond}))
+				rr.GetStatusCodesCounts()
+				rr.GetResponseCodeRatio(500, 600, 200, 300)
+				rr.GetNetworkErrorRatio()
+				if _, err := rr.GetLatencyHistogram(); err != nil {
+					c.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.Assert(rr.GetTotalCount(), Equals, int64(1000))
+	counts := rr.GetStatusCodesCounts()
+	c.Assert(len(counts), Equals, 10)
+	for code, count := range counts {
+		c.Assert(count, Equals, int64(100), Commentf("code %d", code))
+	}
+}
+
 func makeAttempt(o O) *request.BaseAttempt {
 	a := &request.BaseAttempt{
 		Error:    o.err,
@@ -0,0 +1,251 @@
+// Package statsd sends request counters and timers to StatsD or DogStatsD over UDP.
+//
+// Emitter is a location observer, every attempt to proxy the request to the endpoint is counted
+// and timed, e.g. with the default options:
+//
+//	vulcan.loc1.http___localhost_5000.GET.2xx.requests:1|c
+//	vulcan.loc1.http___localhost_5000.GET.2xx.latency:12.5|ms
+//
+// or, in DogStatsD format:
+//
+//	vulcan.requests:1|c|#location:loc1,endpoint:http://localhost:5000,method:GET,status_class:2xx
+//	vulcan.latency:12.5|ms|#location:loc1,endpoint:http://localhost:5000,method:GET,status_class:2xx
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/internal/queue"
+	"github.com/mailgun/vulcan/request"
+)
+
+type Format int
+
+const (
+	// Plain StatsD, dimensions are the part of the metric name
+	FormatStatsd Format = iota
+	// DogStatsD, dimensions are sent as tags
+	FormatDogStatsd
+)
+
+const (
+	DefaultPrefix = "vulcan"
+	// Default name template for FormatStatsd, names are empty by default for FormatDogStatsd
+	DefaultNameTemplate = "{{.Location}}.{{.Endpoint}}.{{.Method}}.{{.StatusClass}}"
+	// Fits in a single Ethernet frame with IP and UDP headers
+	DefaultMaxPacketSize = 1432
+	DefaultFlushPeriod   = time.Second
+	DefaultQueueSize     = 4096
+)
+
+type Options struct {
+	// Prefix of all metric names
+	Prefix string
+	// Template of the metric name between the prefix and the metric suffix, executed with Name fields
+	NameTemplate string
+	Format       Format
+	// Maximum size of the UDP packet, metrics are batched up to this size
+	MaxPacketSize int
+	// Metrics are sent at least this often if the packet is not full
+	FlushPeriod time.Duration
+	// Maximum number of metrics waiting to be sent, metrics are dropped if the queue is full
+	QueueSize int
+}
+
+// Name holds the dimensions of the attempt available to the name template
+type Name struct {
+	Location string
+	Endpoint string
+	Method   string
+	// 2xx, 3xx, 4xx, 5xx, "error" if the endpoint has not responded or "intercepted" if a middleware,
+	// e.g. a rate limiter, has rejected the request before it reached the endpoint
+	StatusClass string
+}
+
+// Emitter is an observer sending the metrics of every attempt, it never blocks the request
+type Emitter struct {
+	location string
+	options  Options
+	name     *template.Template
+	conn     net.Conn
+	lines    *queue.Queue
+}
+
+// NewEmitter creates an emitter for the location sending metrics to the StatsD address, e.g. localhost:8125
+func NewEmitter(locationId, addr string) (*Emitter, error) {
+	return NewEmitterWithOptions(locationId, addr, Options{})
+}
+
+func NewEmitterWithOptions(locationId, addr string, o Options) (*Emitter, error) {
+	o = setDefaults(o)
+	name, err := template.New("name").Parse(o.NameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e := &Emitter{
+		location: locationId,
+		options:  o,
+		name:     name,
+		conn:     conn,
+	}
+	e.lines = queue.New(o.QueueSize, e.loop)
+	return e, nil
+}
+
+func (e *Emitter) ObserveRequest(r request.Request) {
+}
+
+// ObserveResponse queues the request counter and the latency timer of the attempt
+func (e *Emitter) ObserveResponse(r request.Request, a request.Attempt) {
+	n := Name{
+		Location:    e.location,
+		Method:      r.GetHttpRequest().Method,
+		StatusClass: "error",
+	}
+	if a.GetEndpoint() != nil {
+		n.Endpoint = a.GetEndpoint().GetId()
+	}
+	if a.GetResponse() != nil {
+		n.StatusClass = fmt.Sprintf("%dxx", a.GetResponse().StatusCode/100)
+	}
+	intercepted := request.IsIntercepted(a)
+	if intercepted && a.GetResponse() == nil {
+		n.StatusClass = "intercepted"
+	}
+	e.emit(e.formatLine(n, "requests", "1", "c"))
+	// Requests replied by the middlewares have never reached the endpoint, so they don't tell its latency
+	if intercepted {
+		return
+	}
+	ms := strconv.FormatFloat(float64(a.GetDuration())/float64(time.Millisecond), 'f', -1, 64)
+	e.emit(e.formatLine(n, "latency", ms, "ms"))
+}
+
+// GetDropped returns the number of metrics dropped because the queue was full or the emitter was closed
+func (e *Emitter) GetDropped() int64 {
+	return e.lines.GetDropped()
+}
+
+// Close sends the queued metrics and closes the connection
+func (e *Emitter) Close() error {
+	if !e.lines.Close() {
+		return nil
+	}
+	return e.conn.Close()
+}
+
+func (e *Emitter) formatLine(n Name, metric, value, kind string) string {
+	b := &bytes.Buffer{}
+	b.WriteString(e.options.Prefix)
+	e.writeName(b, Name{
+		Location:    sanitizeName(n.Location),
+		Endpoint:    sanitizeName(n.Endpoint),
+		Method:      sanitizeName(n.Method),
+		StatusClass: n.StatusClass,
+	})
+	fmt.Fprintf(b, ".%s:%s|%s", metric, value, kind)
+	if e.options.Format == FormatDogStatsd {
+		fmt.Fprintf(b, "|#location:%s,endpoint:%s,method:%s,status_class:%s",
+			sanitizeTag(n.Location), sanitizeTag(n.Endpoint), sanitizeTag(n.Method), n.StatusClass)
+	}
+	return b.String()
+}
+
+func (e *Emitter) writeName(b *bytes.Buffer, n Name) {
+	out := &bytes.Buffer{}
+	if err := e.name.Execute(out, n); err != nil {
+		log.Errorf("Failed to execute metric name template: %s", err)
+		return
+	}
+	if out.Len() != 0 {
+		b.WriteByte('.')
+		b.Write(out.Bytes())
+	}
+}
+
+func (e *Emitter) emit(line string) {
+	e.lines.Push(line)
+}
+
+func (e *Emitter) loop(lines <-chan interface{}) {
+	ticker := time.NewTicker(e.options.FlushPeriod)
+	defer ticker.Stop()
+
+	packet := &bytes.Buffer{}
+	for {
+		select {
+		case item, ok := <-lines:
+			if !ok {
+				e.flush(packet)
+				return
+			}
+			line := item.(string)
+			// Lines are separated by newlines, start a new packet if the line does not fit
+			if packet.Len() != 0 && packet.Len()+1+len(line) > e.options.MaxPacketSize {
+				e.flush(packet)
+			}
+			if packet.Len() != 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		case <-ticker.C:
+			e.flush(packet)
+		}
+	}
+}
+
+func (e *Emitter) flush(packet *bytes.Buffer) {
+	if packet.Len() == 0 {
+		return
+	}
+	if _, err := e.conn.Write(packet.Bytes()); err != nil {
+		log.Errorf("Failed to send metrics to %s: %s", e.conn.RemoteAddr(), err)
+	}
+	packet.Reset()
+}
+
+// sanitizeName replaces the characters that have special meaning in the metric names, e.g. dots and colons
+func sanitizeName(v string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, v)
+}
+
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+func sanitizeTag(v string) string {
+	return tagReplacer.Replace(v)
+}
+
+func setDefaults(o Options) Options {
+	if o.Prefix == "" {
+		o.Prefix = DefaultPrefix
+	}
+	if o.NameTemplate == "" && o.Format == FormatStatsd {
+		o.NameTemplate = DefaultNameTemplate
+	}
+	if o.MaxPacketSize <= 0 {
+		o.MaxPacketSize = DefaultMaxPacketSize
+	}
+	if o.FlushPeriod <= 0 {
+		o.FlushPeriod = DefaultFlushPeriod
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = DefaultQueueSize
+	}
+	return o
+}
@@ -0,0 +1,165 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func TestStatsd(t *testing.T) { TestingT(t) }
+
+type EmitterSuite struct {
+	listener net.PacketConn
+}
+
+var _ = Suite(&EmitterSuite{})
+
+func (s *EmitterSuite) SetUpTest(c *C) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.listener = l
+}
+
+func (s *EmitterSuite) TearDownTest(c *C) {
+	s.listener.Close()
+}
+
+func (s *EmitterSuite) TestStatsdFormat(c *C) {
+	e, err := NewEmitter("loc1", s.listener.LocalAddr().String())
+	c.Assert(err, IsNil)
+
+	s.observe(c, e, "GET", 200, 12500*time.Microsecond)
+	s.observe(c, e, "POST", 0, time.Second)
+	// Requests rejected by the middlewares don't report the latency
+	s.observeAttempt(c, e, "GET", &request.BaseAttempt{Endpoint: endpoint.MustParseUrl("http://localhost:5000"), Intercepted: true})
+	c.Assert(e.Close(), IsNil)
+
+	c.Assert(s.readLines(c, 5), DeepEquals, []string{
+		"vulcan.loc1.http___localhost_5000.GET.2xx.requests:1|c",
+		"vulcan.loc1.http___localhost_5000.GET.2xx.latency:12.5|ms",
+		"vulcan.loc1.http___localhost_5000.POST.error.requests:1|c",
+		"vulcan.loc1.http___localhost_5000.POST.error.latency:1000|ms",
+		"vulcan.loc1.http___localhost_5000.GET.intercepted.requests:1|c",
+	})
+}
+
+func (s *EmitterSuite) TestDogStatsdFormat(c *C) {
+	e, err := NewEmitterWithOptions("loc1", s.listener.LocalAddr().String(), Options{
+		Prefix: "edge",
+		Format: FormatDogStatsd,
+	})
+	c.Assert(err, IsNil)
+
+	s.observe(c, e, "GET", 503, time.Millisecond)
+	c.Assert(e.Close(), IsNil)
+
+	tags := "|#location:loc1,endpoint:http://localhost:5000,method:GET,status_class:5xx"
+	c.Assert(s.readLines(c, 2), DeepEquals, []string{
+		"edge.requests:1|c" + tags,
+		"edge.latency:1|ms" + tags,
+	})
+}
+
+func (s *EmitterSuite) TestNameTemplate(c *C) {
+	e, err := NewEmitterWithOptions("loc1", s.listener.LocalAddr().String(), Options{
+		NameTemplate: "{{.Location}}.{{.StatusClass}}",
+	})
+	c.Assert(err, IsNil)
+
+	s.observe(c, e, "GET", 404, time.Millisecond)
+	c.Assert(e.Close(), IsNil)
+
+	c.Assert(s.readLines(c, 2), DeepEquals, []string{"vulcan.loc1.4xx.requests:1|c", "vulcan.loc1.4xx.latency:1|ms"})
+
+	_, err = NewEmitterWithOptions("loc1", s.listener.LocalAddr().String(), Options{NameTemplate: "{{.Location"})
+	c.Assert(err, NotNil)
+}
+
+func (s *EmitterSuite) TestBatching(c *C) {
+	e, err := NewEmitterWithOptions("loc1", s.listener.LocalAddr().String(), Options{
+		MaxPacketSize: 200,
+		FlushPeriod:   time.Hour,
+	})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 10; i++ {
+		s.observe(c, e, "GET", 200, time.Millisecond)
+	}
+	c.Assert(e.Close(), IsNil)
+
+	lines := []string{}
+	for len(lines) < 20 {
+		packet := s.readPacket(c)
+		c.Assert(len(packet) <= 200, Equals, true)
+		// Packets are filled up, so no packet holds a single line of ~55 bytes
+		c.Assert(strings.Count(packet, "\n") >= 1, Equals, true, Commentf("%s", packet))
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	c.Assert(len(lines), Equals, 20)
+}
+
+func (s *EmitterSuite) TestFlushPeriod(c *C) {
+	e, err := NewEmitterWithOptions("loc1", s.listener.LocalAddr().String(), Options{FlushPeriod: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+	defer e.Close()
+
+	s.observe(c, e, "GET", 200, time.Millisecond)
+	c.Assert(len(s.readLines(c, 2)), Equals, 2)
+}
+
+func (s *EmitterSuite) TestNeverBlocks(c *C) {
+	e, err := NewEmitterWithOptions("loc1", s.listener.LocalAddr().String(), Options{QueueSize: 1, FlushPeriod: time.Hour})
+	c.Assert(err, IsNil)
+
+	// The queue holds a single metric, the rest is dropped if the background goroutine falls behind
+	for i := 0; i < 1000; i++ {
+		s.observe(c, e, "GET", 200, time.Millisecond)
+	}
+	c.Assert(e.Close(), IsNil)
+	c.Assert(e.Close(), IsNil)
+
+	dropped := e.GetDropped()
+	s.observe(c, e, "GET", 200, time.Millisecond)
+	c.Assert(e.GetDropped(), Equals, dropped+2)
+}
+
+func (s *EmitterSuite) observe(c *C, e *Emitter, method string, statusCode int, duration time.Duration) {
+	a := &request.BaseAttempt{Endpoint: endpoint.MustParseUrl("http://localhost:5000"), Duration: duration}
+	if statusCode != 0 {
+		a.Response = &http.Response{StatusCode: statusCode}
+	} else {
+		a.Error = fmt.Errorf("connection refused")
+	}
+	s.observeAttempt(c, e, method, a)
+}
+
+func (s *EmitterSuite) observeAttempt(c *C, e *Emitter, method string, a request.Attempt) {
+	httpReq, err := http.NewRequest(method, "http://localhost:5000", nil)
+	c.Assert(err, IsNil)
+	req := request.NewBaseRequest(httpReq, 1, nil)
+	e.ObserveRequest(req)
+	e.ObserveResponse(req, a)
+}
+
+func (s *EmitterSuite) readPacket(c *C) string {
+	buf := make([]byte, 65536)
+	s.listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := s.listener.ReadFrom(buf)
+	c.Assert(err, IsNil)
+	return string(buf[:n])
+}
+
+func (s *EmitterSuite) readLines(c *C, count int) []string {
+	lines := []string{}
+	for len(lines) < count {
+		lines = append(lines, strings.Split(s.readPacket(c), "\n")...)
+	}
+	return lines
+}
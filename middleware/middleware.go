@@ -4,6 +4,7 @@ package middleware
 import (
 	. "github.com/mailgun/vulcan/request"
 	"net/http"
+	"time"
 )
 
 // Middlewares are allowed to observe, modify and intercept http requests and responses
@@ -30,6 +31,29 @@ type Observer interface {
 	ObserveResponse(r Request, a Attempt)
 }
 
+// Completion describes the request handled by the proxy, after all attempts to the endpoints
+type Completion struct {
+	// Original request received from the client
+	HttpRequest *http.Request
+	// Time when the proxy has received the request
+	Start time.Time
+	// Time spent on the request, including writing the response to the client
+	Duration time.Duration
+	// Id of the location that has served the request, empty if the request was not routed
+	LocationId string
+	// Status code sent to the client
+	StatusCode int
+	// Bytes of the request body read from the client and bytes of the response body written to the client
+	BytesIn  int64
+	BytesOut int64
+}
+
+// CompletionObservers are notified once per request after the response has been written to the client,
+// e.g. to write access logs. Attempts made by the location are available in the request.
+type CompletionObserver interface {
+	ObserveCompletion(r Request, c Completion)
+}
+
 type ProcessRequestFn func(r Request) (*http.Response, error)
 type ProcessResponseFn func(r Request, a Attempt)
 
@@ -0,0 +1,191 @@
+package netutils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/vulcan/headers"
+)
+
+// TrustedProxies is a list of networks of the proxies and load balancers in front of vulcan,
+// forwarding headers are accepted only from the peers in these networks
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses CIDRs, e.g. 10.0.0.0/8, single IP addresses are accepted as well
+func ParseTrustedProxies(cidrs ...string) (TrustedProxies, error) {
+	out := make(TrustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Bad trusted proxy address: '%s'", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (t TrustedProxies) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIp returns the IP of the client that sent the request. If the peer is a trusted proxy,
+// the forwarded chain is walked right to left skipping trusted hops, and the first untrusted hop is the client.
+// The chain is taken from the RFC 7239 Forwarded header if it is present and from X-Forwarded-For otherwise.
+// If all hops are trusted, the leftmost one is returned.
+func ClientIp(req *http.Request, trusted TrustedProxies) net.IP {
+	ip := parseIp(req.RemoteAddr)
+	if ip == nil || !trusted.Contains(ip) {
+		return ip
+	}
+	hops := forwardedFor(req.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIp(hops[i])
+		if hop == nil {
+			// Unknown or obfuscated identifier, the nearest known hop is the best we can do
+			return ip
+		}
+		ip = hop
+		if !trusted.Contains(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+type clientKey struct{}
+
+// client is resolved by the proxy once per request
+type client struct {
+	ip net.IP
+	// Peer is one of the trusted proxies, so its forwarding headers can be trusted
+	trustedPeer bool
+}
+
+// ResolveClient resolves the client IP and checks if the peer is a trusted proxy, it returns the shallow copy
+// of the request carrying the results. The proxy is the only one that knows the trusted proxies, locations and
+// middlewares use GetClientIp and IsTrustedPeer.
+func ResolveClient(req *http.Request, trusted TrustedProxies) *http.Request {
+	c := client{ip: ClientIp(req, trusted), trustedPeer: trusted.Contains(parseIp(req.RemoteAddr))}
+	return req.WithContext(context.WithValue(req.Context(), clientKey{}, c))
+}
+
+// SetClientIp returns the shallow copy of the request carrying the resolved client IP, the IP is propagated to
+// the requests copied from this one, so it's available to routers, limiters and middlewares
+func SetClientIp(req *http.Request, ip net.IP) *http.Request {
+	c, _ := req.Context().Value(clientKey{}).(client)
+	c.ip = ip
+	return req.WithContext(context.WithValue(req.Context(), clientKey{}, c))
+}
+
+// GetClientIp returns the client IP resolved by the proxy
+func GetClientIp(req *http.Request) (net.IP, bool) {
+	c, _ := req.Context().Value(clientKey{}).(client)
+	return c.ip, c.ip != nil
+}
+
+// IsTrustedPeer returns true if the proxy has found the peer sending the request in its trusted proxies
+func IsTrustedPeer(req *http.Request) bool {
+	c, _ := req.Context().Value(clientKey{}).(client)
+	return c.trustedPeer
+}
+
+// FormatForwardedFor formats the IP as a node of RFC 7239 Forwarded header, IPv6 addresses are quoted and bracketed
+func FormatForwardedFor(ip net.IP) string {
+	if ip.To4() == nil {
+		quoted, _ := QuoteForwardedValue("[" + ip.String() + "]")
+		return quoted
+	}
+	return ip.String()
+}
+
+// QuoteForwardedValue formats the value as RFC 7230 quoted-string for RFC 7239 Forwarded header, only '"' and '\'
+// are escaped. Returns false if the value has the bytes that can't be sent in the header, e.g. control or non-ASCII bytes
+func QuoteForwardedValue(v string) (string, bool) {
+	b := &strings.Builder{}
+	b.WriteByte('"')
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+		case c != '\t' && (c < ' ' || c > '~'):
+			return "", false
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+	return b.String(), true
+}
+
+// forwardedFor returns the hops from the Forwarded header or from X-Forwarded-For if there's no Forwarded header
+func forwardedFor(h http.Header) []string {
+	if values, ok := h[headers.Forwarded]; ok {
+		hops := []string{}
+		for _, element := range splitQuoted(strings.Join(values, ","), ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "for") {
+					node = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				}
+			}
+			hops = append(hops, node)
+		}
+		return hops
+	}
+	hops := []string{}
+	for _, v := range h[headers.XForwardedFor] {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseIp parses the IP from the address that can include port, e.g. 10.0.0.1, 10.0.0.1:80, [::1]:80, [::1] or ::1
+func parseIp(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+}
+
+// splitQuoted splits the string by the separator ignoring separators inside quoted strings
+func splitQuoted(s string, sep rune) []string {
+	out := []string{}
+	quoted, start := false, 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == sep && !quoted:
+			out = append(out, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(out, strings.TrimSpace(s[start:]))
+}
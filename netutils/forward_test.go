@@ -0,0 +1,114 @@
+package netutils
+
+import (
+	"net"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *NetUtilsSuite) TestParseTrustedProxies(c *C) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8", "192.168.1.1", "2001:db8::/32")
+	c.Assert(err, IsNil)
+	c.Assert(trusted.Contains(net.ParseIP("10.1.2.3")), Equals, true)
+	c.Assert(trusted.Contains(net.ParseIP("192.168.1.1")), Equals, true)
+	c.Assert(trusted.Contains(net.ParseIP("192.168.1.2")), Equals, false)
+	c.Assert(trusted.Contains(net.ParseIP("2001:db8::1")), Equals, true)
+	c.Assert(trusted.Contains(nil), Equals, false)
+
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	c.Assert(err, NotNil)
+	_, err = ParseTrustedProxies("bad")
+	c.Assert(err, NotNil)
+}
+
+func (s *NetUtilsSuite) TestClientIp(c *C) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8", "2001:db8::/32")
+	c.Assert(err, IsNil)
+
+	cases := []struct {
+		RemoteAddr string
+		Headers    map[string]string
+		Expected   string
+	}{
+		// Untrusted peer, headers are ignored
+		{"1.2.3.4:80", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		// Trusted peer without headers
+		{"10.0.0.1:80", nil, "10.0.0.1"},
+		// Trusted hops are skipped
+		{"10.0.0.1:80", map[string]string{"X-Forwarded-For": "5.6.7.8, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		// All hops are trusted
+		{"10.0.0.1:80", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		// Garbage in the chain
+		{"10.0.0.1:80", map[string]string{"X-Forwarded-For": "garbage, 10.0.0.2"}, "10.0.0.2"},
+		// Forwarded header takes precedence
+		{"10.0.0.1:80", map[string]string{
+			"X-Forwarded-For": "5.6.7.8",
+			"Forwarded":       `for=192.0.2.60;proto=http, For="[2001:db8:cafe::17]:4711";by=10.0.0.2, for=10.0.0.2`,
+		}, "192.0.2.60"},
+		{"[2001:db8::1]:80", map[string]string{"Forwarded": `for="[2001:db9::17]:4711"`}, "2001:db9::17"},
+		{"10.0.0.1:80", map[string]string{"Forwarded": `for=unknown, for=10.0.0.2`}, "10.0.0.2"},
+	}
+	for _, tc := range cases {
+		req := &http.Request{RemoteAddr: tc.RemoteAddr, Header: make(http.Header)}
+		for k, v := range tc.Headers {
+			req.Header.Set(k, v)
+		}
+		c.Assert(ClientIp(req, trusted).String(), Equals, tc.Expected, Commentf("%v", tc))
+	}
+}
+
+func (s *NetUtilsSuite) TestClientIpContext(c *C) {
+	req := &http.Request{}
+	_, ok := GetClientIp(req)
+	c.Assert(ok, Equals, false)
+
+	req = SetClientIp(req, net.ParseIP("1.2.3.4"))
+	ip, ok := GetClientIp(req)
+	c.Assert(ok, Equals, true)
+	c.Assert(ip.String(), Equals, "1.2.3.4")
+}
+
+func (s *NetUtilsSuite) TestResolveClient(c *C) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8")
+	c.Assert(err, IsNil)
+
+	req := &http.Request{RemoteAddr: "10.0.0.1:5000", Header: http.Header{"X-Forwarded-For": []string{"1.2.3.4"}}}
+	c.Assert(IsTrustedPeer(req), Equals, false)
+
+	resolved := ResolveClient(req, trusted)
+	c.Assert(IsTrustedPeer(resolved), Equals, true)
+	ip, ok := GetClientIp(resolved)
+	c.Assert(ok, Equals, true)
+	c.Assert(ip.String(), Equals, "1.2.3.4")
+
+	req.RemoteAddr = "192.168.1.1:5000"
+	resolved = ResolveClient(req, trusted)
+	c.Assert(IsTrustedPeer(resolved), Equals, false)
+	ip, _ = GetClientIp(resolved)
+	c.Assert(ip.String(), Equals, "192.168.1.1")
+}
+
+func (s *NetUtilsSuite) TestFormatForwardedFor(c *C) {
+	c.Assert(FormatForwardedFor(net.ParseIP("1.2.3.4")), Equals, "1.2.3.4")
+	c.Assert(FormatForwardedFor(net.ParseIP("2001:db8::1")), Equals, `"[2001:db8::1]"`)
+}
+
+func (s *NetUtilsSuite) TestQuoteForwardedValue(c *C) {
+	for _, tc := range []struct {
+		value  string
+		quoted string
+	}{
+		{"example.com:8080", `"example.com:8080"`},
+		{`a"b\c`, `"a\"b\\c"`},
+		{"a b\tc", "\"a b\tc\""},
+	} {
+		quoted, ok := QuoteForwardedValue(tc.value)
+		c.Assert(ok, Equals, true)
+		c.Assert(quoted, Equals, tc.quoted)
+	}
+	for _, value := range []string{"a\x01b", "a\x7fb", "ex\u00e4mple.com"} {
+		_, ok := QuoteForwardedValue(value)
+		c.Assert(ok, Equals, false, Commentf("%q", value))
+	}
+}
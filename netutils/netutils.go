@@ -79,6 +79,30 @@ func RemoveHeaders(names []string, headers http.Header) {
 	}
 }
 
+// RemoveConnectionHeaders removes headers listed in the Connection header,
+// as they are hop-by-hop headers too (RFC 7230, section 6.1)
+func RemoveConnectionHeaders(headers http.Header) {
+	for _, v := range headers["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				headers.Del(name)
+			}
+		}
+	}
+}
+
+// HasHeaderValue returns true if any of the comma separated header values equals the given value (case insensitive)
+func HasHeaderValue(headers http.Header, name, value string) bool {
+	for _, v := range headers[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func MustParseUrl(inUrl string) *url.URL {
 	u, err := ParseUrl(inUrl)
 	if err != nil {
@@ -116,7 +140,7 @@ func ParseAuthHeader(header string) (*BasicAuth, error) {
 
 	values := strings.Fields(header)
 	if len(values) != 2 {
-		return nil, fmt.Errorf(fmt.Sprintf("Failed to parse header '%s'", header))
+		return nil, fmt.Errorf("Failed to parse header '%s'", header)
 	}
 
 	auth_type := strings.ToLower(values[0])
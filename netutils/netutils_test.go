@@ -2,9 +2,11 @@ package netutils
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
+	"github.com/mailgun/vulcan/errors"
 	. "gopkg.in/check.v1"
 )
 
@@ -156,3 +158,45 @@ func (s *NetUtilsSuite) TestRemoveHeaders(c *C) {
 	c.Assert(source.Get("a"), Equals, "")
 	c.Assert(source.Get("c"), Equals, "d")
 }
+
+func (s *NetUtilsSuite) TestRemoveConnectionHeaders(c *C) {
+	h := http.Header{}
+	h.Add("Connection", "close, X-Hop")
+	h.Add("Connection", "X-Other")
+	h.Add("X-Hop", "1")
+	h.Add("X-Other", "2")
+	h.Add("X-Keep", "3")
+
+	RemoveConnectionHeaders(h)
+	c.Assert(h.Get("X-Hop"), Equals, "")
+	c.Assert(h.Get("X-Other"), Equals, "")
+	c.Assert(h.Get("X-Keep"), Equals, "3")
+}
+
+func (s *NetUtilsSuite) TestHasHeaderValue(c *C) {
+	h := http.Header{}
+	h.Add("Te", "gzip, Trailers")
+
+	c.Assert(HasHeaderValue(h, "TE", "trailers"), Equals, true)
+	c.Assert(HasHeaderValue(h, "Te", "deflate"), Equals, false)
+	c.Assert(HasHeaderValue(h, "Connection", "close"), Equals, false)
+}
+
+func (s *NetUtilsSuite) TestReply(c *C) {
+	w := httptest.NewRecorder()
+	ReplyJson(w, map[string]string{"a": "b"})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(w.Body.String(), Equals, `{"a":"b"}`)
+
+	w = httptest.NewRecorder()
+	ReplyError(w, errors.FromStatus(http.StatusNotFound))
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(w.Body.String(), Equals, `{"error":"Not Found"}`)
+
+	// Values that can not be encoded are internal errors
+	w = httptest.NewRecorder()
+	ReplyJson(w, func() {})
+	c.Assert(w.Code, Equals, http.StatusInternalServerError)
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/mailgun/vulcan/errors"
 )
 
 func NewHttpResponse(request *http.Request, statusCode int, body []byte, contentType string) *http.Response {
@@ -35,3 +37,22 @@ func NewJsonResponse(request *http.Request, statusCode int, message interface{})
 	}
 	return NewHttpResponse(request, statusCode, bytes, "application/json")
 }
+
+// ReplyJson writes the value encoded as JSON, used by the admin handlers
+func ReplyJson(w http.ResponseWriter, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		ReplyError(w, errors.FromStatus(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// ReplyError writes the error formatted as JSON, used by the admin handlers
+func ReplyError(w http.ResponseWriter, err errors.ProxyError) {
+	statusCode, body, contentType := (&errors.JsonFormatter{}).Format(err)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -2,15 +2,21 @@
 package vulcan
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
 	"sync/atomic"
 
 	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
 	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/grpc"
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/middleware"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/requestid"
 	"github.com/mailgun/vulcan/route"
 )
 
@@ -26,11 +32,38 @@ type Proxy struct {
 type Options struct {
 	// Takes a status code and formats it into proxy response
 	ErrorFormatter errors.Formatter
+	// Proxies and load balancers in front of vulcan, used to resolve the client IP from
+	// the X-Forwarded-For or Forwarded headers, see netutils.ClientIp
+	TrustedProxies netutils.TrustedProxies
+	// Notified after every request has been completed, e.g. access loggers
+	CompletionObservers []middleware.CompletionObserver
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+	// Generates globally unique request ids, defaults to UUIDv4
+	RequestIdGenerator requestid.Generator
+	// Header carrying the request id to the endpoints and back to the client, defaults to X-Request-Id.
+	// Request ids sent by the TrustedProxies are preserved.
+	RequestIdHeader string
 }
 
 // Accepts requests, round trips it to the endpoint, and writes back the response.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	err := p.proxyRequest(w, r)
+	// Resolve the client once, so routers, limiters and locations see the same client
+	r = netutils.ResolveClient(r, p.options.TrustedProxies)
+
+	// Endpoints get the request id in the request header and the client in the response header
+	requestId := p.requestId(r)
+	r.Header.Set(p.options.RequestIdHeader, requestId)
+	w.Header().Set(p.options.RequestIdHeader, requestId)
+
+	var t *tracker
+	if len(p.options.CompletionObservers) != 0 {
+		t = newTracker(p.options.TimeProvider.UtcNow(), w, r)
+		w = t
+		defer p.observeCompletion(t)
+	}
+
+	err := p.proxyRequest(w, r, t)
 	if err == nil {
 		return
 	}
@@ -41,7 +74,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.URL = e.URL
 		r.Host = e.URL.Host
 		r.RequestURI = e.URL.String()
-		if err := p.proxyRequest(w, r); err != nil {
+		if err := p.proxyRequest(w, r, t); err != nil {
 			p.replyError(err, w, r)
 		}
 	default:
@@ -73,10 +106,11 @@ func (p *Proxy) GetRouter() route.Router {
 }
 
 // Round trips the request to the selected location and writes back the response
-func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request) error {
-
+func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request, t *tracker) error {
 	// Create a unique request with sequential ids that will be passed to all interfaces.
 	req := request.NewBaseRequest(r, atomic.AddInt64(&p.lastRequestId, 1), nil)
+	request.SetRequestId(req, r.Header.Get(p.options.RequestIdHeader))
+	t.setRequest(r, req)
 	location, err := p.router.Route(req)
 	if err != nil {
 		return err
@@ -87,22 +121,51 @@ func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request) error {
 		log.Errorf("%s failed to route", req)
 		return errors.FromStatus(http.StatusBadGateway)
 	}
+	t.setLocation(location)
 
 	response, err := location.RoundTrip(req)
 	if response != nil {
+		// Hop-by-hop headers are not allowed in HTTP/2 responses and make no sense for HTTP/1.1 clients
+		netutils.RemoveConnectionHeaders(response.Header)
+		netutils.RemoveHeaders(headers.HopHeaders, response.Header)
 		netutils.CopyHeaders(w.Header(), response.Header)
+		w.Header().Set(p.options.RequestIdHeader, request.GetRequestId(req))
+		// Trailers have to be announced before writing the headers, so HTTP/1.1 response is chunked
+		for k := range response.Trailer {
+			w.Header().Add(headers.Trailer, k)
+		}
 		w.WriteHeader(response.StatusCode)
 		io.Copy(w, response.Body)
 		response.Body.Close()
+		for k, vv := range response.Trailer {
+			w.Header()[k] = vv
+		}
 		return nil
 	} else {
 		return err
 	}
 }
 
+// requestId returns the valid request id sent by the trusted proxy or generates a new one
+func (p *Proxy) requestId(r *http.Request) string {
+	if id := r.Header.Get(p.options.RequestIdHeader); id != "" && requestid.IsValid(id) {
+		if netutils.IsTrustedPeer(r) {
+			return id
+		}
+	}
+	return p.options.RequestIdGenerator.Generate()
+}
+
 // replyError is a helper function that takes error and replies with HTTP compatible error to the client.
 func (p *Proxy) replyError(err error, w http.ResponseWriter, req *http.Request) {
-	proxyError := convertError(err)
+	proxyError := errors.WithRequestId(convertError(err), req.Header.Get(p.options.RequestIdHeader))
+	// gRPC clients can't read formatted bodies, so reply with the status in headers instead
+	if grpc.IsGrpc(req.Header) {
+		re := grpc.NewErrorResponse(req, grpc.FromHttpStatus(proxyError.GetStatusCode()), proxyError.Error())
+		netutils.CopyHeaders(w.Header(), re.Header)
+		w.WriteHeader(re.StatusCode)
+		return
+	}
 	statusCode, body, contentType := p.options.ErrorFormatter.Format(proxyError)
 	w.Header().Set("Content-Type", contentType)
 	if proxyError.Headers() != nil {
@@ -116,10 +179,22 @@ func validateOptions(o Options) (Options, error) {
 	if o.ErrorFormatter == nil {
 		o.ErrorFormatter = &errors.JsonFormatter{}
 	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	if o.RequestIdGenerator == nil {
+		o.RequestIdGenerator = &requestid.UuidV4Generator{}
+	}
+	if o.RequestIdHeader == "" {
+		o.RequestIdHeader = requestid.DefaultHeader
+	}
 	return o, nil
 }
 
 func convertError(err error) errors.ProxyError {
+	if err == context.Canceled {
+		return &errors.HttpError{StatusCode: errors.StatusClientClosedRequest, Body: "Client Closed Request"}
+	}
 	switch e := err.(type) {
 	case errors.ProxyError:
 		return e
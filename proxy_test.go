@@ -3,11 +3,17 @@ package vulcan
 import (
 	"github.com/mailgun/timetools"
 	. "github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/requestid"
 	. "github.com/mailgun/vulcan/route"
 	. "github.com/mailgun/vulcan/testutils"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"time"
 )
 
@@ -77,3 +83,199 @@ func (s *ProxySuite) TestReadTimeout(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(response.StatusCode, Equals, http.StatusRequestTimeout)
 }
+
+// gRPC clients get the error status in headers
+func (s *ProxySuite) TestGrpcFailure(c *C) {
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{"http://localhost:63999"}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, bodyBytes, err := MakeRequest(proxyServer.URL, Opts{Headers: http.Header{"Content-Type": []string{"application/grpc"}}})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(response.Header.Get("Content-Type"), Equals, "application/grpc")
+	c.Assert(response.Header.Get("Grpc-Status"), Equals, "14")
+	c.Assert(response.Header.Get("Grpc-Message"), Equals, "Bad%20Gateway")
+	c.Assert(len(bodyBytes), Equals, 0)
+}
+
+// Proxy resolves the client IP using the forwarding headers sent by trusted proxies
+func (s *ProxySuite) TestClientIp(c *C) {
+	var clientIp string
+	location := &recordingLocation{fn: func(r request.Request) {
+		ip, _ := netutils.GetClientIp(r.GetHttpRequest())
+		clientIp = ip.String()
+	}}
+
+	trusted, err := netutils.ParseTrustedProxies("127.0.0.0/8")
+	c.Assert(err, IsNil)
+	proxy, err := NewProxyWithOptions(&ConstRouter{location}, Options{TrustedProxies: trusted})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	_, _, err = MakeRequest(proxyServer.URL, Opts{Headers: http.Header{"X-Forwarded-For": []string{"1.2.3.4, 127.0.0.2"}}})
+	c.Assert(err, IsNil)
+	c.Assert(clientIp, Equals, "1.2.3.4")
+
+	// Peer is not trusted
+	proxy, err = NewProxy(&ConstRouter{location})
+	c.Assert(err, IsNil)
+	proxyServer2 := httptest.NewServer(proxy)
+	defer proxyServer2.Close()
+
+	_, _, err = MakeRequest(proxyServer2.URL, Opts{Headers: http.Header{"X-Forwarded-For": []string{"1.2.3.4"}}})
+	c.Assert(err, IsNil)
+	c.Assert(clientIp, Equals, "127.0.0.1")
+}
+
+type recordingLocation struct {
+	fn func(request.Request)
+}
+
+func (l *recordingLocation) GetId() string {
+	return "recording"
+}
+
+func (l *recordingLocation) RoundTrip(r request.Request) (*http.Response, error) {
+	l.fn(r)
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+// Completion observers are notified once per request after all attempts
+func (s *ProxySuite) TestCompletionObservers(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	var completions []middleware.Completion
+	observer := &completionObserver{fn: func(r request.Request, cm middleware.Completion) {
+		completions = append(completions, cm)
+	}}
+	proxy, err := NewProxyWithOptions(&ConstRouter{&ConstHttpLocation{server.URL}}, Options{
+		CompletionObservers: []middleware.CompletionObserver{observer},
+		TimeProvider:        s.tm,
+	})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	_, _, err = MakeRequest(proxyServer.URL+"/path", Opts{Method: "POST", Body: "hello"})
+	c.Assert(err, IsNil)
+
+	c.Assert(len(completions), Equals, 1)
+	cm := completions[0]
+	c.Assert(cm.StatusCode, Equals, http.StatusOK)
+	c.Assert(cm.LocationId, Equals, server.URL)
+	c.Assert(cm.BytesIn, Equals, int64(5))
+	c.Assert(cm.BytesOut, Equals, int64(len("Hi, I'm endpoint")))
+	c.Assert(cm.Start, Equals, s.tm.UtcNow())
+	c.Assert(cm.HttpRequest.RequestURI, Equals, "/path")
+
+	// Failed requests are observed as well
+	proxy, err = NewProxyWithOptions(&ConstRouter{&ConstHttpLocation{"http://localhost:63999"}}, Options{
+		CompletionObservers: []middleware.CompletionObserver{observer},
+	})
+	c.Assert(err, IsNil)
+	proxyServer2 := httptest.NewServer(proxy)
+	defer proxyServer2.Close()
+
+	_, _, err = MakeRequest(proxyServer2.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(len(completions), Equals, 2)
+	c.Assert(completions[1].StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(completions[1].BytesOut > 0, Equals, true)
+}
+
+// Tracker keeps the optional interfaces of the response writer, e.g. for streaming
+func (s *ProxySuite) TestTrackerWriterInterfaces(c *C) {
+	w := httptest.NewRecorder()
+	t := newTracker(s.tm.UtcNow(), w, &http.Request{})
+
+	var _ http.Flusher = t
+	var _ http.Hijacker = t
+	t.Flush()
+	c.Assert(w.Flushed, Equals, true)
+	c.Assert(t.completion.StatusCode, Equals, http.StatusOK)
+
+	// Recorder can't be hijacked
+	_, _, err := t.Hijack()
+	c.Assert(err, NotNil)
+
+	c.Assert(t.Unwrap(), Equals, http.ResponseWriter(w))
+	c.Assert(http.NewResponseController(t).Flush(), IsNil)
+}
+
+type completionObserver struct {
+	fn func(request.Request, middleware.Completion)
+}
+
+func (o *completionObserver) ObserveCompletion(r request.Request, cm middleware.Completion) {
+	o.fn(r, cm)
+}
+
+// Request id is generated, sent to the endpoint and echoed back to the client
+func (s *ProxySuite) TestRequestId(c *C) {
+	var endpointId string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		endpointId = r.Header.Get("X-Request-Id")
+		w.Header().Set("X-Request-Id", "endpoint-id")
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	var observedId string
+	location := &recordingLocation{fn: func(r request.Request) {
+		observedId = request.GetRequestId(r)
+	}}
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{server.URL}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	// Request id sent by the untrusted client is replaced
+	response, _, err := MakeRequest(proxyServer.URL, Opts{Headers: http.Header{"X-Request-Id": []string{"client-id"}}})
+	c.Assert(err, IsNil)
+	c.Assert(endpointId, Not(Equals), "client-id")
+	c.Assert(len(endpointId), Equals, 36)
+	c.Assert(response.Header["X-Request-Id"], DeepEquals, []string{endpointId})
+
+	// Trusted proxy's request id is preserved, custom generator and header are used
+	trusted, err := netutils.ParseTrustedProxies("127.0.0.1")
+	c.Assert(err, IsNil)
+	proxy, err = NewProxyWithOptions(&ConstRouter{location}, Options{
+		TrustedProxies:     trusted,
+		RequestIdGenerator: &requestid.UlidGenerator{},
+		RequestIdHeader:    "X-Trace",
+	})
+	c.Assert(err, IsNil)
+	proxyServer2 := httptest.NewServer(proxy)
+	defer proxyServer2.Close()
+
+	response, _, err = MakeRequest(proxyServer2.URL, Opts{Headers: http.Header{"X-Trace": []string{"lb-id"}}})
+	c.Assert(err, IsNil)
+	c.Assert(observedId, Equals, "lb-id")
+	c.Assert(response.Header.Get("X-Trace"), Equals, "lb-id")
+
+	response, _, err = MakeRequest(proxyServer2.URL, Opts{Headers: http.Header{"X-Trace": []string{"bad id"}}})
+	c.Assert(err, IsNil)
+	c.Assert(len(observedId), Equals, 26)
+	c.Assert(response.Header.Get("X-Trace"), Equals, observedId)
+}
+
+// Error responses include the request id in the body
+func (s *ProxySuite) TestRequestIdInErrors(c *C) {
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{"http://localhost:63999"}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, bodyBytes, err := MakeRequest(proxyServer.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+	id := response.Header.Get("X-Request-Id")
+	c.Assert(id, Not(Equals), "")
+	c.Assert(string(bodyBytes), Equals, `{"error":"Bad Gateway","request_id":"`+id+`"}`)
+}
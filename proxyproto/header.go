@@ -0,0 +1,245 @@
+// Package proxyproto implements PROXY protocol v1 and v2 used by L4 load balancers
+// to pass the original client address to the proxy, see http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Version of the PROXY protocol
+type Version int
+
+const (
+	// Human readable header, e.g. PROXY TCP4 192.168.0.1 192.168.0.11 56324 443
+	V1 Version = 1
+	// Binary header
+	V2 Version = 2
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+	v2Length    = 16
+)
+
+// v2Signature starts every v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoHeader is returned when the connection does not start with the PROXY protocol header
+var ErrNoHeader = fmt.Errorf("No PROXY protocol header")
+
+// Header carries the addresses of the original connection
+type Header struct {
+	Version Version
+	// Client address, nil if the connection was originated by the load balancer itself,
+	// e.g. for health checks, or the address family is not supported
+	Source *net.TCPAddr
+	// Address the client connected to
+	Destination *net.TCPAddr
+}
+
+// Format returns the header encoded according to its version
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case V1:
+		return h.formatV1(), nil
+	case V2:
+		return h.formatV2(), nil
+	}
+	return nil, fmt.Errorf("Unsupported PROXY protocol version: %d", h.Version)
+}
+
+// WriteTo writes the encoded header to the writer
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	data, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func (h *Header) String() string {
+	return fmt.Sprintf("Header(version=%d, source=%v, destination=%v)", h.Version, h.Source, h.Destination)
+}
+
+// isIPv4 returns true if both addresses are IPv4, false if both are IPv6 and ok is false if the families differ
+func (h *Header) isIPv4() (ipv4 bool, ok bool) {
+	if h.Source == nil || h.Destination == nil {
+		return false, false
+	}
+	src, dst := h.Source.IP.To4() != nil, h.Destination.IP.To4() != nil
+	return src, src == dst
+}
+
+func (h *Header) formatV1() []byte {
+	ipv4, ok := h.isIPv4()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP6"
+	if ipv4 {
+		proto = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		proto, h.Source.IP.String(), h.Destination.IP.String(), h.Source.Port, h.Destination.Port))
+}
+
+func (h *Header) formatV2() []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(v2Signature)
+
+	ipv4, ok := h.isIPv4()
+	if !ok {
+		// LOCAL command, the receiver uses the real connection addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	var src, dst net.IP
+	if ipv4 {
+		buf.Write([]byte{0x21, 0x11, 0x00, 12})
+		src, dst = h.Source.IP.To4(), h.Destination.IP.To4()
+	} else {
+		buf.Write([]byte{0x21, 0x21, 0x00, 36})
+		src, dst = h.Source.IP.To16(), h.Destination.IP.To16()
+	}
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(buf, binary.BigEndian, uint16(h.Source.Port))
+	binary.Write(buf, binary.BigEndian, uint16(h.Destination.Port))
+	return buf.Bytes()
+}
+
+// ReadHeader reads v1 or v2 header from the reader, returns ErrNoHeader if the data does not start with the header.
+// In this case no data is consumed from the reader.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		prefix, err := r.Peek(len(v1Prefix))
+		if err != nil || string(prefix) != v1Prefix {
+			return nil, ErrNoHeader
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		signature, err := r.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(signature, v2Signature) {
+			return nil, ErrNoHeader
+		}
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, fmt.Errorf("PROXY v1 header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY v1 header should end with CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: V1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Malformed PROXY v1 header: %q", line)
+	}
+	var err error
+	if h.Source, err = parseV1Addr(fields[1], fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Addr(fields[1], fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || (proto == "TCP4") != (parsed.To4() != nil) {
+		return nil, fmt.Errorf("Bad %s address in PROXY v1 header: '%s'", proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Bad port in PROXY v1 header: '%s'", port)
+	}
+	return &net.TCPAddr{IP: parsed, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, v2Length)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY v2 version: %d", fixed[12]>>4)
+	}
+	command, family := fixed[12]&0x0F, fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	h := &Header{Version: V2}
+	switch command {
+	case 0x00:
+		// LOCAL command, connection was established by the load balancer itself
+		return h, nil
+	case 0x01:
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY v2 command: %d", command)
+	}
+	// Address family and transport protocol, only TCP over IPv4 and IPv6 are supported,
+	// other families are accepted, but the addresses are ignored. Extra bytes (TLVs) are skipped.
+	switch family {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("PROXY v2 header is too short for IPv4 addresses")
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("PROXY v2 header is too short for IPv6 addresses")
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	}
+	return h, nil
+}
+
+type contextKey struct{}
+
+// NewContext returns the context carrying the header, it's used to pass the client addresses to the dialer
+func NewContext(ctx context.Context, h *Header) context.Context {
+	return context.WithValue(ctx, contextKey{}, h)
+}
+
+// FromContext returns the header stored in the context
+func FromContext(ctx context.Context) (*Header, bool) {
+	h, ok := ctx.Value(contextKey{}).(*Header)
+	return h, ok
+}
@@ -0,0 +1,124 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mailgun/log"
+)
+
+const DefaultReadHeaderTimeout = time.Duration(10) * time.Second
+
+type Options struct {
+	// Networks of the load balancers allowed to send the header, headers from other peers are not parsed.
+	// No peers are trusted if empty, so the clients can't spoof their addresses.
+	TrustedNets []*net.IPNet
+	// Trusts all peers regardless of TrustedNets, e.g. when the listener is reachable by the load balancers only
+	TrustAll bool
+	// Rejects the connections from the trusted peers that don't start with the header
+	Required bool
+	// Time to wait for the header after the connection has been accepted
+	ReadHeaderTimeout time.Duration
+}
+
+// Listener parses PROXY protocol headers of the accepted connections, the connections report
+// the client address from the header as their remote address, so http.Request.RemoteAddr is the client's address.
+type Listener struct {
+	net.Listener
+	options Options
+}
+
+// NewListener wraps the listener, to terminate TLS wrap the returned listener with tls.NewListener
+func NewListener(l net.Listener, o Options) *Listener {
+	if o.ReadHeaderTimeout <= 0 {
+		o.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	return &Listener{Listener: l, options: o}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		options: l.options,
+		once:    &sync.Once{},
+	}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	if l.options.TrustAll {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.options.TrustedNets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn reads the header lazily on the first Read or RemoteAddr call, so Accept
+// is not blocked by slow clients
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	options Options
+	once    *sync.Once
+	header  *Header
+	err     error
+}
+
+// GetHeader returns the parsed header, nil header and nil error mean that the connection had no header
+func (c *Conn) GetHeader() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, err := c.GetHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header or the peer address if there's no header
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, _ := c.GetHeader(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client has connected to or the local address if there's no header
+func (c *Conn) LocalAddr() net.Addr {
+	if h, _ := c.GetHeader(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.options.ReadHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.header, c.err = ReadHeader(c.reader)
+	if c.err == ErrNoHeader && !c.options.Required {
+		c.err = nil
+	}
+	if c.err != nil {
+		log.Errorf("Failed to read PROXY protocol header from %v: %s", c.Conn.RemoteAddr(), c.err)
+	}
+}
@@ -0,0 +1,236 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestProxyProto(t *testing.T) { TestingT(t) }
+
+type ProxyProtoSuite struct {
+}
+
+var _ = Suite(&ProxyProtoSuite{})
+
+func (s *ProxyProtoSuite) TestFormatV1(c *C) {
+	h := &Header{Version: V1, Source: tcpAddr("192.168.0.1:56324"), Destination: tcpAddr("192.168.0.11:443")}
+	data, err := h.Format()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+
+	h = &Header{Version: V1, Source: tcpAddr("[2001:db8::1]:56324"), Destination: tcpAddr("[2001:db8::2]:443")}
+	data, err = h.Format()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")
+
+	// Mixed families can not be represented
+	h = &Header{Version: V1, Source: tcpAddr("192.168.0.1:56324"), Destination: tcpAddr("[2001:db8::2]:443")}
+	data, err = h.Format()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "PROXY UNKNOWN\r\n")
+
+	_, err = (&Header{Version: 3}).Format()
+	c.Assert(err, NotNil)
+}
+
+func (s *ProxyProtoSuite) TestRoundTrip(c *C) {
+	headers := []*Header{
+		{Version: V1, Source: tcpAddr("192.168.0.1:56324"), Destination: tcpAddr("192.168.0.11:443")},
+		{Version: V1, Source: tcpAddr("[2001:db8::1]:56324"), Destination: tcpAddr("[2001:db8::2]:443")},
+		{Version: V1},
+		{Version: V2, Source: tcpAddr("192.168.0.1:56324"), Destination: tcpAddr("192.168.0.11:443")},
+		{Version: V2, Source: tcpAddr("[2001:db8::1]:56324"), Destination: tcpAddr("[2001:db8::2]:443")},
+		{Version: V2},
+	}
+	for _, h := range headers {
+		data, err := h.Format()
+		c.Assert(err, IsNil)
+
+		r := bufio.NewReader(bytes.NewReader(append(data, []byte("GET / HTTP/1.1\r\n")...)))
+		out, err := ReadHeader(r)
+		c.Assert(err, IsNil)
+		c.Assert(out.Version, Equals, h.Version)
+		c.Assert(addrString(out.Source), Equals, addrString(h.Source))
+		c.Assert(addrString(out.Destination), Equals, addrString(h.Destination))
+
+		// The rest of the data is left intact
+		rest, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		c.Assert(string(rest), Equals, "GET / HTTP/1.1\r\n")
+	}
+}
+
+func (s *ProxyProtoSuite) TestReadV2SkipsTlvs(c *C) {
+	data := append([]byte{}, v2Signature...)
+	data = append(data, 0x21, 0x11, 0x00, 15, 127, 0, 0, 1, 127, 0, 0, 2, 0x00, 0x50, 0x01, 0xBB, 0x04, 0x00, 0x00)
+	r := bufio.NewReader(bytes.NewReader(append(data, 'x')))
+	h, err := ReadHeader(r)
+	c.Assert(err, IsNil)
+	c.Assert(h.Source.String(), Equals, "127.0.0.1:80")
+	c.Assert(h.Destination.String(), Equals, "127.0.0.2:443")
+	b, err := r.ReadByte()
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, byte('x'))
+}
+
+func (s *ProxyProtoSuite) TestNoHeader(c *C) {
+	for _, data := range []string{"GET / HTTP/1.1\r\n", "POST / HTTP/1.1\r\n", "\r\n\r\nhello world"} {
+		r := bufio.NewReader(strings.NewReader(data))
+		_, err := ReadHeader(r)
+		c.Assert(err, Equals, ErrNoHeader)
+		rest, _ := ioutil.ReadAll(r)
+		c.Assert(string(rest), Equals, data)
+	}
+}
+
+func (s *ProxyProtoSuite) TestMalformedHeaders(c *C) {
+	cases := []string{
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 100000\r\n",
+		"PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		string(v2Signature) + "\x31\x11\x00\x0C",
+		string(v2Signature) + "\x21\x11\x00\x04\x01\x02\x03\x04",
+		string(v2Signature) + "\x21\x11\x00\x0C\x01",
+	}
+	for _, data := range cases {
+		_, err := ReadHeader(bufio.NewReader(strings.NewReader(data)))
+		c.Assert(err, NotNil, Commentf("%q", data))
+		c.Assert(err, Not(Equals), ErrNoHeader)
+	}
+}
+
+func (s *ProxyProtoSuite) TestListener(c *C) {
+	addr, closer := s.serve(c, Options{TrustAll: true})
+	defer closer()
+
+	// Client address is taken from the header
+	c.Assert(request(c, addr, "PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\n"), Equals, "10.0.0.1:5000")
+
+	h := &Header{Version: V2, Source: tcpAddr("[2001:db8::1]:5000"), Destination: tcpAddr("[2001:db8::2]:80")}
+	data, err := h.Format()
+	c.Assert(err, IsNil)
+	c.Assert(request(c, addr, string(data)), Equals, "[2001:db8::1]:5000")
+
+	// LOCAL command keeps the peer address
+	c.Assert(request(c, addr, "PROXY UNKNOWN\r\n"), Matches, "127.0.0.1:.*")
+
+	// Header is optional
+	c.Assert(request(c, addr, ""), Matches, "127.0.0.1:.*")
+}
+
+func (s *ProxyProtoSuite) TestListenerRequired(c *C) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	addr, closer := s.serve(c, Options{TrustedNets: []*net.IPNet{loopback}, Required: true})
+	defer closer()
+
+	c.Assert(request(c, addr, "PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\n"), Equals, "10.0.0.1:5000")
+	c.Assert(request(c, addr, ""), Equals, "")
+	c.Assert(request(c, addr, "PROXY TCP4 bad\r\n"), Equals, "")
+}
+
+func (s *ProxyProtoSuite) TestListenerUntrusted(c *C) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	addr, closer := s.serve(c, Options{TrustedNets: []*net.IPNet{trusted}})
+	defer closer()
+
+	// Header is not parsed, so the request is malformed
+	c.Assert(request(c, addr, "PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\n"), Equals, "")
+	c.Assert(request(c, addr, ""), Matches, "127.0.0.1:.*")
+}
+
+// Listener fails closed, no peers are trusted unless configured
+func (s *ProxyProtoSuite) TestListenerTrustsNobodyByDefault(c *C) {
+	addr, closer := s.serve(c, Options{})
+	defer closer()
+
+	c.Assert(request(c, addr, "PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\n"), Equals, "")
+	c.Assert(request(c, addr, ""), Matches, "127.0.0.1:.*")
+}
+
+func (s *ProxyProtoSuite) TestReadHeaderTimeout(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	pl := NewListener(l, Options{TrustAll: true, ReadHeaderTimeout: 10 * time.Millisecond})
+	defer pl.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4"))
+
+	accepted, err := pl.Accept()
+	c.Assert(err, IsNil)
+	defer accepted.Close()
+	_, err = accepted.(*Conn).GetHeader()
+	c.Assert(err, NotNil)
+}
+
+func (s *ProxyProtoSuite) TestContext(c *C) {
+	_, ok := FromContext(context.Background())
+	c.Assert(ok, Equals, false)
+
+	h := &Header{Version: V1}
+	out, ok := FromContext(NewContext(context.Background(), h))
+	c.Assert(ok, Equals, true)
+	c.Assert(out, Equals, h)
+}
+
+func (s *ProxyProtoSuite) serve(c *C, o Options) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.RemoteAddr))
+		}),
+	}
+	go srv.Serve(NewListener(l, o))
+	return l.Addr().String(), func() { srv.Close() }
+}
+
+// request sends the raw request prefixed with the header and returns the response body,
+// or empty string if the request failed
+func request(c *C, addr, header string) string {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(header + "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	c.Assert(err, IsNil)
+	re, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return ""
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return ""
+	}
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(body)
+}
+
+func tcpAddr(addr string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func addrString(a *net.TCPAddr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
@@ -27,6 +27,22 @@ type Request interface {
 	DeleteUserData(key string)                  // Clean up user data set from previously SetUserData call
 }
 
+// Key of the user data keeping the globally unique request id
+const requestIdKey = "request.requestId"
+
+// SetRequestId keeps the globally unique request id in the request user data
+func SetRequestId(r Request, id string) {
+	r.SetUserData(requestIdKey, id)
+}
+
+// GetRequestId returns the globally unique request id, sent to the endpoints and the client in X-Request-Id header,
+// or empty string if the request has no id
+func GetRequestId(r Request) string {
+	id, _ := r.GetUserData(requestIdKey)
+	s, _ := id.(string)
+	return s
+}
+
 type Attempt interface {
 	GetError() error
 	GetDuration() time.Duration
@@ -39,6 +55,16 @@ type BaseAttempt struct {
 	Duration time.Duration
 	Response *http.Response
 	Endpoint endpoint.Endpoint
+	// Set if a middleware has replied to the request instead of the endpoint, e.g. a rate limiter has rejected it
+	Intercepted bool
+}
+
+// IsIntercepted returns true if the attempt has never reached the endpoint, as a middleware has replied instead
+func IsIntercepted(a Attempt) bool {
+	i, ok := a.(interface {
+		IsIntercepted() bool
+	})
+	return ok && i.IsIntercepted()
 }
 
 func (ba *BaseAttempt) GetResponse() *http.Response {
@@ -57,6 +83,10 @@ func (ba *BaseAttempt) GetEndpoint() endpoint.Endpoint {
 	return ba.Endpoint
 }
 
+func (ba *BaseAttempt) IsIntercepted() bool {
+	return ba.Intercepted
+}
+
 type BaseRequest struct {
 	HttpRequest   *http.Request
 	Id            int64
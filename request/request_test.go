@@ -43,3 +43,11 @@ func (s *RequestSuite) TestUserDataNil(c *C) {
 	_, present := br.GetUserData("caller1")
 	c.Assert(present, Equals, false)
 }
+
+func (s *RequestSuite) TestRequestId(c *C) {
+	br := NewBaseRequest(&http.Request{}, 0, nil)
+	c.Assert(GetRequestId(br), Equals, "")
+
+	SetRequestId(br, "7c9e6679-7425-40de-944b-e07fc1f90ae7")
+	c.Assert(GetRequestId(br), Equals, "7c9e6679-7425-40de-944b-e07fc1f90ae7")
+}
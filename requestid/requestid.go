@@ -0,0 +1,90 @@
+// Package requestid generates globally unique request ids
+package requestid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mailgun/timetools"
+)
+
+const DefaultHeader = "X-Request-Id"
+
+// MaxLength is the maximum length of the request id accepted from the clients
+const MaxLength = 128
+
+// Generator returns a new globally unique request id
+type Generator interface {
+	Generate() string
+}
+
+// UuidV4Generator generates random UUIDs, e.g. 7c9e6679-7425-40de-944b-e07fc1f90ae7
+type UuidV4Generator struct {
+}
+
+func (g *UuidV4Generator) Generate() string {
+	var b [16]byte
+	mustRead(b[:])
+	// Version 4 and RFC 4122 variant
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// UlidGenerator generates ULIDs, e.g. 01ARZ3NDEKTSV4RRFFQ69G5FAV, that are sorted by the time of generation
+// with the millisecond precision, see https://github.com/ulid/spec
+type UlidGenerator struct {
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *UlidGenerator) Generate() string {
+	var tp timetools.TimeProvider = &timetools.RealTime{}
+	if g.TimeProvider != nil {
+		tp = g.TimeProvider
+	}
+	now := tp.UtcNow()
+	ms := uint64(now.Unix())*1000 + uint64(now.Nanosecond()/1000000)
+
+	// 48 bits of the timestamp followed by 80 bits of randomness
+	var b [16]byte
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], ms)
+	copy(b[0:6], ts[2:8])
+	mustRead(b[6:])
+
+	// 128 bits are encoded as 26 characters of 5 bits, the first character holds the top 3 bits only
+	hi, lo := binary.BigEndian.Uint64(b[0:8]), binary.BigEndian.Uint64(b[8:16])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// IsValid checks the request id received from the client, it should be short and consist of visible
+// ASCII characters other than quotes and backslashes, so it's safe to put it in logs and headers
+func IsValid(id string) bool {
+	if len(id) == 0 || len(id) > MaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func mustRead(b []byte) {
+	// crypto/rand never fails on supported platforms
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,56 @@
+package requestid
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "gopkg.in/check.v1"
+)
+
+func TestRequestId(t *testing.T) { TestingT(t) }
+
+type RequestIdSuite struct {
+}
+
+var _ = Suite(&RequestIdSuite{})
+
+func (s *RequestIdSuite) TestUuidV4(c *C) {
+	g := &UuidV4Generator{}
+	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := g.Generate()
+		c.Assert(re.MatchString(id), Equals, true, Commentf(id))
+		c.Assert(seen[id], Equals, false)
+		seen[id] = true
+	}
+}
+
+func (s *RequestIdSuite) TestUlid(c *C) {
+	tm := &timetools.FreezedTime{CurrentTime: time.Unix(1469918176, 385000000).UTC()}
+	g := &UlidGenerator{TimeProvider: tm}
+	id := g.Generate()
+	c.Assert(len(id), Equals, 26)
+	// Timestamp part from the spec example
+	c.Assert(id[:10], Equals, "01ARYZ6S41")
+	c.Assert(strings.Trim(id, crockford), Equals, "")
+
+	// Ids are sorted by time
+	tm.CurrentTime = tm.CurrentTime.Add(time.Millisecond)
+	c.Assert(g.Generate() > id, Equals, true)
+
+	c.Assert(len((&UlidGenerator{}).Generate()), Equals, 26)
+}
+
+func (s *RequestIdSuite) TestIsValid(c *C) {
+	c.Assert(IsValid("7c9e6679-7425-40de-944b-e07fc1f90ae7"), Equals, true)
+	c.Assert(IsValid("01ARZ3NDEKTSV4RRFFQ69G5FAV"), Equals, true)
+	c.Assert(IsValid(""), Equals, false)
+	c.Assert(IsValid(strings.Repeat("a", MaxLength+1)), Equals, false)
+	c.Assert(IsValid("with space"), Equals, false)
+	c.Assert(IsValid(`with"quote`), Equals, false)
+	c.Assert(IsValid("new\nline"), Equals, false)
+}
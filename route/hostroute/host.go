@@ -29,6 +29,10 @@ func (h *HostRouter) Route(req Request) (Location, error) {
 	defer h.mutex.Unlock()
 
 	hostname := strings.Split(strings.ToLower(req.GetHttpRequest().Host), ":")[0]
+	// HTTP/1.0 clients may omit the Host header, in this case use the server name from TLS handshake
+	if tls := req.GetHttpRequest().TLS; hostname == "" && tls != nil {
+		hostname = strings.ToLower(tls.ServerName)
+	}
 	matcher, exists := h.routers[hostname]
 	if !exists {
 		return nil, nil
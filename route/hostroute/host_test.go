@@ -1,6 +1,7 @@
 package hostroute
 
 import (
+	"crypto/tls"
 	. "github.com/mailgun/vulcan/location"
 	. "github.com/mailgun/vulcan/netutils"
 	. "github.com/mailgun/vulcan/request"
@@ -85,6 +86,25 @@ func (s *HostSuite) TestRemove(c *C) {
 	c.Assert(out, Equals, nil)
 }
 
+func (s *HostSuite) TestRouteByServerName(c *C) {
+	m := NewHostRouter()
+	r := &ConstRouter{Location: &Loc{Name: "a"}}
+	m.SetRouter("google.com", r)
+
+	req := request("", "http://google.com/")
+	req.GetHttpRequest().TLS = &tls.ConnectionState{ServerName: "Google.com"}
+	out, err := m.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, r.Location)
+
+	// Host header takes precedence
+	req = request("yahoo.com", "http://yahoo.com/")
+	req.GetHttpRequest().TLS = &tls.ConnectionState{ServerName: "google.com"}
+	out, err = m.Route(req)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, nil)
+}
+
 func request(hostname, url string) Request {
 	u := MustParseUrl(url)
 	hr := &http.Request{URL: u, Header: make(http.Header), Host: hostname}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/netutils"
+)
+
+// DefaultCertHost is the name used by the admin API to refer to the default certificate,
+// underscore is not allowed in host names, so it does not clash with real hosts
+const DefaultCertHost = "_default"
+
+// CertHandler is an admin API managing certificates in the store:
+//
+//	GET    /certs        - lists the hosts that have certificates
+//	PUT    /certs/<host> - adds or replaces the certificate, the body is {"cert": "<PEM>", "key": "<PEM>"}
+//	DELETE /certs/<host> - removes the certificate
+//
+// Use DefaultCertHost as the host to manage the default certificate.
+// The handler does no authentication, so it should be served on the internal interface only.
+type CertHandler struct {
+	certs *CertStore
+}
+
+type certRequest struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+func NewCertHandler(certs *CertStore) *CertHandler {
+	return &CertHandler{
+		certs: certs,
+	}
+}
+
+func (h *CertHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/certs" && r.Method == "GET":
+		netutils.ReplyJson(w, map[string]interface{}{"hosts": h.certs.GetHosts()})
+	case strings.HasPrefix(path, "/certs/") && (r.Method == "PUT" || r.Method == "POST"):
+		h.upsertCert(w, r, strings.TrimPrefix(path, "/certs/"))
+	case strings.HasPrefix(path, "/certs/") && r.Method == "DELETE":
+		h.removeCert(w, strings.TrimPrefix(path, "/certs/"))
+	default:
+		netutils.ReplyError(w, errors.FromStatus(http.StatusNotFound))
+	}
+}
+
+func (h *CertHandler) upsertCert(w http.ResponseWriter, r *http.Request, host string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		netutils.ReplyError(w, &errors.HttpError{StatusCode: http.StatusBadRequest, Body: err.Error()})
+		return
+	}
+	var cr certRequest
+	if err := json.Unmarshal(body, &cr); err != nil {
+		netutils.ReplyError(w, &errors.HttpError{StatusCode: http.StatusBadRequest, Body: fmt.Sprintf("Bad JSON: %s", err)})
+		return
+	}
+	if host == DefaultCertHost {
+		err = h.certs.SetDefaultCert([]byte(cr.Cert), []byte(cr.Key))
+	} else {
+		err = h.certs.UpsertCert(host, []byte(cr.Cert), []byte(cr.Key))
+	}
+	if err != nil {
+		netutils.ReplyError(w, &errors.HttpError{StatusCode: http.StatusBadRequest, Body: err.Error()})
+		return
+	}
+	log.Infof("Updated certificate for '%s'", host)
+	netutils.ReplyJson(w, map[string]interface{}{"host": host})
+}
+
+func (h *CertHandler) removeCert(w http.ResponseWriter, host string) {
+	if host == DefaultCertHost {
+		h.certs.RemoveDefaultCert()
+	} else if !h.certs.RemoveCert(host) {
+		netutils.ReplyError(w, &errors.HttpError{StatusCode: http.StatusNotFound, Body: fmt.Sprintf("Certificate for '%s' not found", host)})
+		return
+	}
+	log.Infof("Removed certificate for '%s'", host)
+	netutils.ReplyJson(w, map[string]interface{}{"host": host})
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ServerSuite) TestAdminApi(c *C) {
+	certs := NewCertStore()
+	admin := httptest.NewServer(NewCertHandler(certs))
+	defer admin.Close()
+
+	certPEM, keyPEM := MakeCert("a.example.com")
+	body, err := json.Marshal(map[string]string{"cert": string(certPEM), "key": string(keyPEM)})
+	c.Assert(err, IsNil)
+
+	response, _, err := MakeRequest(admin.URL+"/certs/a.example.com", Opts{Method: "PUT", Body: string(body)})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(certs.GetCert("a.example.com").Leaf.Subject.CommonName, Equals, "a.example.com")
+
+	response, _, err = MakeRequest(admin.URL+"/certs/"+DefaultCertHost, Opts{Method: "PUT", Body: string(body)})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(certs.GetCert("b.example.com"), NotNil)
+
+	response, out, err := GET(admin.URL+"/certs", Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(out), Equals, `{"hosts":["a.example.com"]}`)
+
+	response, _, err = MakeRequest(admin.URL+"/certs/a.example.com", Opts{Method: "DELETE"})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(certs.GetHosts(), DeepEquals, []string{})
+
+	response, _, err = MakeRequest(admin.URL+"/certs/a.example.com", Opts{Method: "DELETE"})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+
+	response, _, err = MakeRequest(admin.URL+"/certs/"+DefaultCertHost, Opts{Method: "DELETE"})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(certs.GetCert("b.example.com"), IsNil)
+}
+
+func (s *ServerSuite) TestAdminApiBadRequests(c *C) {
+	admin := httptest.NewServer(NewCertHandler(NewCertStore()))
+	defer admin.Close()
+
+	response, _, err := MakeRequest(admin.URL+"/certs/a.example.com", Opts{Method: "PUT", Body: "not json"})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+	response, _, err = MakeRequest(admin.URL+"/certs/a.example.com", Opts{Method: "PUT", Body: `{"cert": "bad", "key": "bad"}`})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+	response, _, err = GET(admin.URL+"/other", Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+}
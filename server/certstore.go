@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CertStore keeps the certificates keyed by the server name and picks the certificate for the incoming
+// TLS connection using SNI. Certificates can be added, rotated and removed while the server is running.
+type CertStore struct {
+	mutex       *sync.RWMutex
+	certs       map[string]*tls.Certificate
+	defaultCert *tls.Certificate
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{
+		mutex: &sync.RWMutex{},
+		certs: make(map[string]*tls.Certificate),
+	}
+}
+
+// UpsertCert adds or replaces the certificate for the host. Host can be a wildcard, e.g. *.example.com,
+// in this case the certificate is used for the server names that have exactly one label in place of *
+func (s *CertStore) UpsertCert(host string, certPEM, keyPEM []byte) error {
+	host = normalizeHost(host)
+	if host == "" {
+		return fmt.Errorf("Host can not be empty")
+	}
+	cert, err := parseCert(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.certs[host] = cert
+	return nil
+}
+
+// UpsertCertFiles reads PEM encoded certificate and key from disk and adds or replaces the certificate
+// for the host. Call it again with the same files to rotate the certificate after it was renewed on disk.
+func (s *CertStore) UpsertCertFiles(host, certFile, keyFile string) error {
+	certPEM, keyPEM, err := readFiles(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return s.UpsertCert(host, certPEM, keyPEM)
+}
+
+// RemoveCert removes the certificate for the host, returns false if the certificate was not found
+func (s *CertStore) RemoveCert(host string) bool {
+	host = normalizeHost(host)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.certs[host]; !ok {
+		return false
+	}
+	delete(s.certs, host)
+	return true
+}
+
+// SetDefaultCert sets the certificate used when client does not send SNI or there's no certificate for the server name
+func (s *CertStore) SetDefaultCert(certPEM, keyPEM []byte) error {
+	cert, err := parseCert(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.defaultCert = cert
+	return nil
+}
+
+// SetDefaultCertFiles reads the default certificate and key from disk
+func (s *CertStore) SetDefaultCertFiles(certFile, keyFile string) error {
+	certPEM, keyPEM, err := readFiles(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return s.SetDefaultCert(certPEM, keyPEM)
+}
+
+// RemoveDefaultCert removes the default certificate, so connections with unknown server names are rejected
+func (s *CertStore) RemoveDefaultCert() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.defaultCert = nil
+}
+
+// GetHosts returns sorted list of hosts that have certificates
+func (s *CertStore) GetHosts() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	hosts := make([]string, 0, len(s.certs))
+	for host := range s.certs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// GetCert returns the certificate for the server name, looking up the exact match first, then the wildcard match
+// and falling back to the default certificate. Returns nil if there's no certificate.
+func (s *CertStore) GetCert(serverName string) *tls.Certificate {
+	serverName = normalizeHost(serverName)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if serverName != "" {
+		if cert, ok := s.certs[serverName]; ok {
+			return cert
+		}
+		if idx := strings.IndexRune(serverName, '.'); idx != -1 {
+			if cert, ok := s.certs["*"+serverName[idx:]]; ok {
+				return cert
+			}
+		}
+	}
+	return s.defaultCert
+}
+
+// GetCertificate is a tls.Config callback that selects the certificate using SNI
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.GetCert(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("No certificate for server name '%s'", hello.ServerName)
+}
+
+func parseCert(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf = leaf
+	}
+	return &cert, nil
+}
+
+func readFiles(certFile, keyFile string) ([]byte, []byte, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -0,0 +1,163 @@
+// Server terminates TLS and serves the proxy, certificates are selected by SNI from the certificate store
+// that can be updated at runtime.
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// Minimum TLS version, defaults to tls.VersionTLS12
+	MinVersion uint16
+	// Allowed cipher suites, Go's defaults are used if empty
+	CipherSuites []uint16
+	// PEM encoded CA bundle used to verify client certificates
+	ClientCaFile string
+	// Client certificate policy, defaults to tls.VerifyClientCertIfGiven if ClientCaFile is set
+	// and to tls.NoClientCert otherwise
+	ClientAuth tls.ClientAuthType
+	// Disables HTTP/2 negotiation with the clients
+	DisableHttp2 bool
+	// Timeouts of the underlying http.Server, 0 means no timeout
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+// Server serves the handler, usually a vulcan.Proxy, over TLS. The connection details are
+// available to the handler in http.Request.TLS, e.g. the server name sent by the client and
+// the verified client certificates.
+type Server struct {
+	mutex   *sync.Mutex
+	handler http.Handler
+	certs   *CertStore
+	options Options
+	servers []*http.Server
+	closed  bool
+}
+
+func NewServer(handler http.Handler, certs *CertStore, o Options) (*Server, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("Handler can not be nil")
+	}
+	if certs == nil {
+		return nil, fmt.Errorf("Certificate store can not be nil")
+	}
+	o, err := setDefaults(o)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure the client CA bundle is valid on start and not on the first connection
+	if _, err := newTlsConfig(certs, o); err != nil {
+		return nil, err
+	}
+	return &Server{
+		mutex:   &sync.Mutex{},
+		handler: handler,
+		certs:   certs,
+		options: o,
+	}, nil
+}
+
+func (s *Server) GetCertStore() *CertStore {
+	return s.certs
+}
+
+// ListenAndServe listens on the TCP address and serves TLS connections, blocks until the server is closed
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts the connections on the listener and serves them over TLS, blocks until the server is closed.
+// Serve can be called several times with different listeners.
+func (s *Server) Serve(l net.Listener) error {
+	config, err := newTlsConfig(s.certs, s.options)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	srv := &http.Server{
+		Handler:      s.handler,
+		TLSConfig:    config,
+		ReadTimeout:  s.options.ReadTimeout,
+		WriteTimeout: s.options.WriteTimeout,
+		IdleTimeout:  s.options.IdleTimeout,
+	}
+	if s.options.DisableHttp2 {
+		// Non nil empty map disables HTTP/2
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return http.ErrServerClosed
+	}
+	s.servers = append(s.servers, srv)
+	s.mutex.Unlock()
+
+	// Certificates are provided by the store, so the files are not needed
+	return srv.ServeTLS(l, "", "")
+}
+
+// Close closes all listeners and connections
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	var err error
+	for _, srv := range s.servers {
+		if e := srv.Close(); e != nil {
+			err = e
+		}
+	}
+	s.servers = nil
+	return err
+}
+
+func setDefaults(o Options) (Options, error) {
+	if o.MinVersion == 0 {
+		o.MinVersion = tls.VersionTLS12
+	}
+	if o.ClientAuth == tls.NoClientCert && o.ClientCaFile != "" {
+		o.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if o.ClientCaFile == "" && (o.ClientAuth == tls.VerifyClientCertIfGiven || o.ClientAuth == tls.RequireAndVerifyClientCert) {
+		return o, fmt.Errorf("Client certificate verification requires ClientCaFile")
+	}
+	return o, nil
+}
+
+func newTlsConfig(certs *CertStore, o Options) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     o.MinVersion,
+		CipherSuites:   o.CipherSuites,
+		ClientAuth:     o.ClientAuth,
+	}
+	if o.ClientCaFile != "" {
+		bundle, err := ioutil.ReadFile(o.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No certificates found in CA bundle '%s'", o.ClientCaFile)
+		}
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
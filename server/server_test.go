@@ -0,0 +1,236 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func TestServer(t *testing.T) { TestingT(t) }
+
+type ServerSuite struct {
+	dir     string
+	servers []*Server
+}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *ServerSuite) TearDownTest(c *C) {
+	for _, srv := range s.servers {
+		srv.Close()
+	}
+	s.servers = nil
+}
+
+func (s *ServerSuite) TestSelectsCertBySni(c *C) {
+	certs := NewCertStore()
+	c.Assert(upsertCert(certs, "a.example.com"), IsNil)
+	c.Assert(upsertCert(certs, "*.b.example.com"), IsNil)
+
+	addr := s.serve(c, okHandler(), certs, Options{})
+
+	c.Assert(serverCommonName(c, addr, "a.example.com"), Equals, "a.example.com")
+	c.Assert(serverCommonName(c, addr, "A.Example.com"), Equals, "a.example.com")
+	c.Assert(serverCommonName(c, addr, "x.b.example.com"), Equals, "*.b.example.com")
+
+	// No default certificate, so the handshake fails
+	_, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "c.example.com", InsecureSkipVerify: true})
+	c.Assert(err, NotNil)
+
+	certPEM, keyPEM := MakeCert("default")
+	c.Assert(certs.SetDefaultCert(certPEM, keyPEM), IsNil)
+	c.Assert(serverCommonName(c, addr, "c.example.com"), Equals, "default")
+	c.Assert(serverCommonName(c, addr, "x.y.b.example.com"), Equals, "default")
+}
+
+func (s *ServerSuite) TestRotateCertFiles(c *C) {
+	certFile, keyFile := filepath.Join(s.dir, "cert.pem"), filepath.Join(s.dir, "key.pem")
+	certPEM, keyPEM := MakeCert("first")
+	writeFile(c, certFile, certPEM)
+	writeFile(c, keyFile, keyPEM)
+
+	certs := NewCertStore()
+	c.Assert(certs.UpsertCertFiles("a.example.com", certFile, keyFile), IsNil)
+	addr := s.serve(c, okHandler(), certs, Options{})
+	c.Assert(serverCommonName(c, addr, "a.example.com"), Equals, "first")
+
+	certPEM, keyPEM = MakeCert("second")
+	writeFile(c, certFile, certPEM)
+	writeFile(c, keyFile, keyPEM)
+	c.Assert(certs.UpsertCertFiles("a.example.com", certFile, keyFile), IsNil)
+	c.Assert(serverCommonName(c, addr, "a.example.com"), Equals, "second")
+
+	c.Assert(certs.RemoveCert("a.example.com"), Equals, true)
+	c.Assert(certs.RemoveCert("a.example.com"), Equals, false)
+	c.Assert(certs.GetHosts(), DeepEquals, []string{})
+}
+
+func (s *ServerSuite) TestBadCerts(c *C) {
+	certs := NewCertStore()
+	certPEM, keyPEM := MakeCert("a")
+	c.Assert(certs.UpsertCert("", certPEM, keyPEM), NotNil)
+	c.Assert(certs.UpsertCert("a", certPEM, []byte("bad key")), NotNil)
+	c.Assert(certs.UpsertCertFiles("a", "/not/exists", "/not/exists"), NotNil)
+
+	_, err := NewServer(okHandler(), certs, Options{ClientAuth: tls.RequireAndVerifyClientCert})
+	c.Assert(err, NotNil)
+
+	_, err = NewServer(okHandler(), certs, Options{ClientCaFile: "/not/exists"})
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestProxyOverTls(c *C) {
+	var forwardedProto, forwardedHost string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		forwardedProto = r.Header.Get("X-Forwarded-Proto")
+		forwardedHost = r.Header.Get("X-Forwarded-Host")
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	c.Assert(rr.AddEndpoint(endpoint.MustParseUrl(server.URL)), IsNil)
+	location, err := httploc.NewLocation("dummy", rr)
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&route.ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+
+	certs := NewCertStore()
+	c.Assert(upsertCert(certs, "localhost"), IsNil)
+	addr := s.serve(c, proxy, certs, Options{})
+
+	response, body, err := GET("https://"+addr, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hi")
+	c.Assert(forwardedProto, Equals, "https")
+	c.Assert(forwardedHost, Equals, addr)
+}
+
+func (s *ServerSuite) TestClientCerts(c *C) {
+	var peerName string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) != 0 {
+			peerName = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		w.Write([]byte("hi"))
+	})
+
+	clientCertPEM, clientKeyPEM := MakeCert("client")
+	caFile := filepath.Join(s.dir, "ca.pem")
+	writeFile(c, caFile, clientCertPEM)
+
+	certs := NewCertStore()
+	c.Assert(upsertCert(certs, "localhost"), IsNil)
+	addr := s.serve(c, handler, certs, Options{ClientCaFile: caFile, ClientAuth: tls.RequireAndVerifyClientCert})
+
+	// No client certificate
+	_, err := newClient(nil).Get("https://" + addr)
+	c.Assert(err, NotNil)
+
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	c.Assert(err, IsNil)
+	response, err := newClient(&clientCert).Get("https://" + addr)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(peerName, Equals, "client")
+}
+
+func (s *ServerSuite) TestHttp2(c *C) {
+	var proto string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	})
+	certs := NewCertStore()
+	c.Assert(upsertCert(certs, "localhost"), IsNil)
+
+	addr := s.serve(c, handler, certs, Options{})
+	client := newClient(nil)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	response, err := client.Get("https://" + addr)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(proto, Equals, "HTTP/2.0")
+
+	addr = s.serve(c, handler, certs, Options{DisableHttp2: true})
+	response, err = client.Get("https://" + addr)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(proto, Equals, "HTTP/1.1")
+}
+
+func (s *ServerSuite) TestClose(c *C) {
+	certs := NewCertStore()
+	c.Assert(upsertCert(certs, "localhost"), IsNil)
+	srv, err := NewServer(okHandler(), certs, Options{})
+	c.Assert(err, IsNil)
+	c.Assert(srv.GetCertStore(), Equals, certs)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(l)
+	}()
+	c.Assert(srv.Close(), IsNil)
+	c.Assert(<-done, Equals, http.ErrServerClosed)
+}
+
+func (s *ServerSuite) serve(c *C, handler http.Handler, certs *CertStore, o Options) string {
+	srv, err := NewServer(handler, certs, o)
+	c.Assert(err, IsNil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go srv.Serve(l)
+	s.servers = append(s.servers, srv)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return "localhost:" + port
+}
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+}
+
+func upsertCert(certs *CertStore, host string) error {
+	certPEM, keyPEM := MakeCert(host, host)
+	return certs.UpsertCert(host, certPEM, keyPEM)
+}
+
+func serverCommonName(c *C, addr, serverName string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func newClient(cert *tls.Certificate) *http.Client {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+func writeFile(c *C, path string, data []byte) {
+	c.Assert(ioutil.WriteFile(path, data, os.FileMode(0600)), IsNil)
+}
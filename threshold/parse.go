@@ -25,6 +25,7 @@ func ParseExpression(in string) (Predicate, error) {
 			"IsNetworkError": IsNetworkError,
 			"Attempts":       Attempts,
 			"ResponseCode":   ResponseCode,
+			"GrpcStatus":     GrpcStatus,
 		},
 	})
 	if err != nil {
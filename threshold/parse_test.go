@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/mailgun/vulcan/grpc"
 	. "github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
 )
@@ -127,6 +128,34 @@ func (s *ThresholdSuite) TestResponseCodeOrError(c *C) {
 	c.Assert(p(req), Equals, false)
 }
 
+func (s *ThresholdSuite) TestGrpcStatus(c *C) {
+	p, err := ParseExpression(`GrpcStatus() == 14 && Attempts() <= 1`)
+	c.Assert(err, IsNil)
+
+	// There are no attempts
+	c.Assert(p(&BaseRequest{}), Equals, false)
+
+	// gRPC endpoint is unavailable
+	req := &BaseRequest{
+		Attempts: []Attempt{
+			&BaseAttempt{
+				Response: grpc.NewErrorResponse(nil, grpc.Unavailable, ""),
+			},
+		},
+	}
+	c.Assert(p(req), Equals, true)
+
+	// Not a gRPC response
+	req = &BaseRequest{
+		Attempts: []Attempt{
+			&BaseAttempt{
+				Response: &http.Response{StatusCode: 503},
+			},
+		},
+	}
+	c.Assert(p(req), Equals, false)
+}
+
 func (s *ThresholdSuite) TestAttemptsLeLegacy(c *C) {
 	p, err := ParseExpression(`AttemptsLe(1)`)
 	c.Assert(err, IsNil)
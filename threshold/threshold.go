@@ -8,12 +8,14 @@ Examples:
 * RequestMethod() == "GET" && Attempts <= 2 && (IsNetworkError() || ResponseCode() == 408)
   This predicate triggers for GET requests with maximum 2 attempts
   on network errors or when upstream returns special http response code 408
+* GrpcStatus() == 14 triggers action when gRPC endpoint returns UNAVAILABLE status
 */
 package threshold
 
 import (
 	"fmt"
 
+	"github.com/mailgun/vulcan/grpc"
 	"github.com/mailgun/vulcan/request"
 )
 
@@ -58,6 +60,22 @@ func ResponseCode() RequestToInt {
 	}
 }
 
+// GrpcStatus returns mapper of the request to the gRPC status code of the last response,
+// returns -1 if there was no gRPC response.
+func GrpcStatus() RequestToInt {
+	return func(r request.Request) int {
+		attempts := len(r.GetAttempts())
+		if attempts == 0 {
+			return -1
+		}
+		code, ok := grpc.GetStatus(r.GetAttempts()[attempts-1].GetResponse())
+		if !ok {
+			return -1
+		}
+		return int(code)
+	}
+}
+
 // IsNetworkError returns a predicate that returns true if last attempt ended with network error.
 func IsNetworkError() Predicate {
 	return func(r request.Request) bool {
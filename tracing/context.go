@@ -0,0 +1,129 @@
+// Package tracing creates spans for the proxied requests and propagates W3C Trace Context
+// to the endpoints, see https://www.w3.org/TR/trace-context/
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+)
+
+const (
+	traceparentLength = 55
+	flagSampled       = 0x01
+)
+
+type TraceId [16]byte
+
+type SpanId [8]byte
+
+func (t TraceId) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceId) IsValid() bool {
+	return t != TraceId{}
+}
+
+func (s SpanId) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanId) IsValid() bool {
+	return s != SpanId{}
+}
+
+// SpanContext is the part of the span propagated to the endpoints in traceparent and tracestate headers
+type SpanContext struct {
+	TraceId TraceId
+	SpanId  SpanId
+	Flags   byte
+	// Vendor specific trace state, passed through as is
+	State string
+}
+
+func (c *SpanContext) IsSampled() bool {
+	return c.Flags&flagSampled != 0
+}
+
+// Traceparent formats the traceparent header value, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func (c *SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", c.TraceId, c.SpanId, c.Flags)
+}
+
+// ParseTraceparent parses the traceparent header value. Versions higher than 00 are parsed as 00
+// ignoring the extra fields, as required by the specification.
+func ParseTraceparent(value string) (*SpanContext, error) {
+	value = strings.TrimSpace(value)
+	if len(value) < traceparentLength || (len(value) > traceparentLength && value[traceparentLength] != '-') {
+		return nil, fmt.Errorf("Bad traceparent length: '%s'", value)
+	}
+	parts := strings.Split(value[:traceparentLength], "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, fmt.Errorf("Bad traceparent format: '%s'", value)
+	}
+	version, err := decodeHex(parts[0], 1)
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(value) != traceparentLength) {
+		return nil, fmt.Errorf("Bad traceparent version: '%s'", value)
+	}
+	c := &SpanContext{}
+	traceId, err := decodeHex(parts[1], 16)
+	if err != nil {
+		return nil, err
+	}
+	copy(c.TraceId[:], traceId)
+	spanId, err := decodeHex(parts[2], 8)
+	if err != nil {
+		return nil, err
+	}
+	copy(c.SpanId[:], spanId)
+	flags, err := decodeHex(parts[3], 1)
+	if err != nil {
+		return nil, err
+	}
+	c.Flags = flags[0]
+	if !c.TraceId.IsValid() || !c.SpanId.IsValid() {
+		return nil, fmt.Errorf("Traceparent has zero trace or span id: '%s'", value)
+	}
+	return c, nil
+}
+
+// decodeHex decodes lowercase hex string, uppercase characters are not allowed by the specification
+func decodeHex(s string, size int) ([]byte, error) {
+	if strings.ToLower(s) != s {
+		return nil, fmt.Errorf("Bad hex value: '%s'", s)
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != size {
+		return nil, fmt.Errorf("Bad hex value: '%s'", s)
+	}
+	return b, nil
+}
+
+func newTraceId() TraceId {
+	var t TraceId
+	for !t.IsValid() {
+		mustRead(t[:])
+	}
+	return t
+}
+
+func newSpanId() SpanId {
+	var s SpanId
+	for !s.IsValid() {
+		mustRead(s[:])
+	}
+	return s
+}
+
+func mustRead(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,300 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/vulcan/internal/queue"
+)
+
+const (
+	DefaultServiceName = "vulcan"
+	DefaultBatchSize   = 512
+	DefaultQueueSize   = 2048
+	DefaultFlushPeriod = 5 * time.Second
+	DefaultTimeout     = 10 * time.Second
+)
+
+type OtlpOptions struct {
+	// Value of the service.name resource attribute
+	ServiceName string
+	// Extra headers sent to the collector, e.g. for authentication
+	Headers http.Header
+	// Maximum number of spans sent in one request
+	BatchSize int
+	// Maximum number of spans waiting to be sent, spans are dropped if the queue is full
+	QueueSize int
+	// Spans are sent at least this often if the batch is not full
+	FlushPeriod time.Duration
+	// Timeout of the request to the collector
+	Timeout time.Duration
+	// Transport used to send the requests, http.DefaultTransport is used if it's nil
+	Transport http.RoundTripper
+}
+
+// OtlpExporter sends spans to the OpenTelemetry collector using OTLP over HTTP with JSON encoding.
+// Spans are queued and sent in batches in the background goroutine.
+type OtlpExporter struct {
+	url     string
+	options OtlpOptions
+	client  *http.Client
+	spans   *queue.Queue
+}
+
+// NewOtlpExporter creates the exporter sending spans to the collector url, e.g. http://localhost:4318/v1/traces
+func NewOtlpExporter(collectorUrl string) (*OtlpExporter, error) {
+	return NewOtlpExporterWithOptions(collectorUrl, OtlpOptions{})
+}
+
+func NewOtlpExporterWithOptions(collectorUrl string, o OtlpOptions) (*OtlpExporter, error) {
+	u, err := url.Parse(collectorUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported collector url scheme: '%s'", collectorUrl)
+	}
+	o = setOtlpDefaults(o)
+	e := &OtlpExporter{
+		url:     collectorUrl,
+		options: o,
+		client:  &http.Client{Transport: o.Transport, Timeout: o.Timeout},
+	}
+	e.spans = queue.New(o.QueueSize, e.loop)
+	return e, nil
+}
+
+// Export queues the spans, it never blocks, spans that do not fit in the queue are dropped and counted
+func (e *OtlpExporter) Export(spans []*Span) error {
+	for _, s := range spans {
+		e.spans.Push(s)
+	}
+	return nil
+}
+
+// GetDropped returns the number of spans dropped because the queue was full or the exporter was closed
+func (e *OtlpExporter) GetDropped() int64 {
+	return e.spans.GetDropped()
+}
+
+// Close sends the queued spans and stops the background goroutine
+func (e *OtlpExporter) Close() error {
+	e.spans.Close()
+	return nil
+}
+
+func (e *OtlpExporter) loop(spans <-chan interface{}) {
+	ticker := time.NewTicker(e.options.FlushPeriod)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	for {
+		select {
+		case s, ok := <-spans:
+			if !ok {
+				if len(batch) != 0 {
+					e.send(batch)
+				}
+				return
+			}
+			batch = append(batch, s.(*Span))
+			if len(batch) >= e.options.BatchSize {
+				e.send(batch)
+				batch = []*Span{}
+			}
+		case <-ticker.C:
+			if len(batch) != 0 {
+				e.send(batch)
+				batch = []*Span{}
+			}
+		}
+	}
+}
+
+func (e *OtlpExporter) send(spans []*Span) {
+	if err := e.post(spans); err != nil {
+		log.Errorf("Failed to send %d spans to %s: %s", len(spans), e.url, err)
+	}
+}
+
+func (e *OtlpExporter) post(spans []*Span) error {
+	data, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, vv := range e.options.Headers {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	re, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(re.Body, 1024))
+	if re.StatusCode < 200 || re.StatusCode >= 300 {
+		return fmt.Errorf("collector replied with %d: %s", re.StatusCode, body)
+	}
+	return nil
+}
+
+// OTLP JSON encoding, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpKindServer  = 2
+	otlpKindClient  = 3
+	otlpStatusError = 2
+)
+
+func (e *OtlpExporter) encode(spans []*Span) *otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceId:           s.TraceId.String(),
+			SpanId:            s.SpanId.String(),
+			Name:              s.Name,
+			Kind:              otlpKindServer,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+		}
+		if s.ParentSpanId.IsValid() {
+			o.ParentSpanId = s.ParentSpanId.String()
+		}
+		if s.Kind == SpanKindClient {
+			o.Kind = otlpKindClient
+		}
+		if s.Error != "" {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		out[i] = o
+	}
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: encodeAttributes(map[string]interface{}{"service.name": e.options.ServiceName}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/mailgun/vulcan/tracing"},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+func encodeAttributes(attrs map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	// Sorted keys keep the output stable
+	sort.Strings(keys)
+
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, k := range keys {
+		var v otlpValue
+		switch val := attrs[k].(type) {
+		case string:
+			v.StringValue = &val
+		case int:
+			i := strconv.Itoa(val)
+			v.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(val, 10)
+			v.IntValue = &i
+		case float64:
+			v.DoubleValue = &val
+		case bool:
+			v.BoolValue = &val
+		default:
+			s := fmt.Sprintf("%v", val)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: k, Value: v})
+	}
+	return out
+}
+
+func setOtlpDefaults(o OtlpOptions) OtlpOptions {
+	if o.ServiceName == "" {
+		o.ServiceName = DefaultServiceName
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultBatchSize
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = DefaultQueueSize
+	}
+	if o.FlushPeriod <= 0 {
+		o.FlushPeriod = DefaultFlushPeriod
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	return o
+}
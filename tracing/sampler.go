@@ -0,0 +1,39 @@
+package tracing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// DefaultSampleRatio is the share of the new traces sampled by default
+const DefaultSampleRatio = 0.01
+
+// Sampler decides if the new trace is sampled, i.e. exported. Traces continued from the incoming
+// trace context follow the caller's decision instead.
+type Sampler interface {
+	ShouldSample(traceId TraceId) bool
+}
+
+type ratioSampler struct {
+	bound uint64
+}
+
+// NewRatioSampler samples the given share of the traces, e.g. 0.1 samples every 10th trace. The decision
+// is made by the random part of the trace id, so it's the same for the trace id on all proxies.
+func NewRatioSampler(ratio float64) (Sampler, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("Sample ratio should be within [0, 1], got %v", ratio)
+	}
+	if ratio == 1 {
+		return &ratioSampler{bound: math.MaxUint64}, nil
+	}
+	return &ratioSampler{bound: uint64(ratio * math.MaxUint64)}, nil
+}
+
+func (s *ratioSampler) ShouldSample(traceId TraceId) bool {
+	if s.bound == math.MaxUint64 {
+		return true
+	}
+	return binary.BigEndian.Uint64(traceId[8:]) < s.bound
+}
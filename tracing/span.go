@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"time"
+)
+
+type SpanKind int
+
+const (
+	// Span for the request received by the proxy
+	SpanKindServer SpanKind = iota
+	// Span for the attempt to proxy the request to the endpoint
+	SpanKindClient
+)
+
+// Span is a finished operation passed to the exporter
+type Span struct {
+	TraceId TraceId
+	SpanId  SpanId
+	// Zero if the span is the root of the trace
+	ParentSpanId SpanId
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	// Attribute values are strings, ints, int64s, float64s or bools
+	Attributes map[string]interface{}
+	// Error message, the span has failed if it's not empty
+	Error string
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[key] = value
+}
+
+// Exporter sends finished spans to the tracing backend. It is called on the request path,
+// so implementations should not block, see OtlpExporter for the batching exporter.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// ExporterFn wraps the function to create an exporter compatible interface
+type ExporterFn func(spans []*Span) error
+
+func (fn ExporterFn) Export(spans []*Span) error {
+	return fn(spans)
+}
@@ -0,0 +1,176 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/log"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+const traceKey = "tracing.trace"
+
+type Options struct {
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+	// Decides if the new traces are sampled, ratio sampler with DefaultSampleRatio is used if it's nil
+	Sampler Sampler
+}
+
+// Tracer creates a server span for every request received by the proxy and a client span for every attempt
+// to proxy it to the endpoint. The trace context received in traceparent and tracestate headers is continued,
+// new traces are started for the requests without it and sampled by the Sampler. The endpoints receive
+// the context of the attempt span.
+//
+// Tracer should be added both as the location observer, to create the attempt spans, and as the proxy completion
+// observer, to finish the request and export its spans:
+//
+//	tracer, _ := tracing.NewTracer(exporter)
+//	location.GetObserverChain().Add("tracing", tracer)
+//	proxy, _ := vulcan.NewProxyWithOptions(router, vulcan.Options{CompletionObservers: []middleware.CompletionObserver{tracer}})
+type Tracer struct {
+	exporter Exporter
+	options  Options
+}
+
+// trace collects the spans of the request while it's being served
+type trace struct {
+	server   *Span
+	flags    byte
+	state    string
+	attempt  *Span
+	attempts []*Span
+}
+
+func NewTracer(exporter Exporter) (*Tracer, error) {
+	return NewTracerWithOptions(exporter, Options{})
+}
+
+func NewTracerWithOptions(exporter Exporter, o Options) (*Tracer, error) {
+	if exporter == nil {
+		return nil, fmt.Errorf("Exporter can not be nil")
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	if o.Sampler == nil {
+		sampler, err := NewRatioSampler(DefaultSampleRatio)
+		if err != nil {
+			return nil, err
+		}
+		o.Sampler = sampler
+	}
+	return &Tracer{exporter: exporter, options: o}, nil
+}
+
+// ObserveRequest starts the attempt span and injects its context into the request to the endpoint
+func (t *Tracer) ObserveRequest(r request.Request) {
+	tr := t.getTrace(r, r.GetHttpRequest())
+	span := &Span{
+		TraceId:      tr.server.TraceId,
+		SpanId:       newSpanId(),
+		ParentSpanId: tr.server.SpanId,
+		Name:         r.GetHttpRequest().Method,
+		Kind:         SpanKindClient,
+		Start:        t.options.TimeProvider.UtcNow(),
+	}
+	span.SetAttribute("vulcan.failover", len(r.GetAttempts()))
+	tr.attempt = span
+
+	ctx := &SpanContext{TraceId: span.TraceId, SpanId: span.SpanId, Flags: tr.flags, State: tr.state}
+	h := r.GetHttpRequest().Header
+	h.Set(TraceparentHeader, ctx.Traceparent())
+	if ctx.State != "" {
+		h.Set(TracestateHeader, ctx.State)
+	} else {
+		h.Del(TracestateHeader)
+	}
+}
+
+// ObserveResponse finishes the attempt span
+func (t *Tracer) ObserveResponse(r request.Request, a request.Attempt) {
+	tr := t.getTrace(r, r.GetHttpRequest())
+	span := tr.attempt
+	if span == nil {
+		return
+	}
+	tr.attempt = nil
+	span.End = t.options.TimeProvider.UtcNow()
+	if a.GetEndpoint() != nil {
+		span.SetAttribute("vulcan.endpoint", a.GetEndpoint().GetId())
+	}
+	if a.GetResponse() != nil {
+		span.SetAttribute("http.response.status_code", a.GetResponse().StatusCode)
+		if a.GetResponse().StatusCode >= http.StatusInternalServerError {
+			span.Error = http.StatusText(a.GetResponse().StatusCode)
+		}
+	}
+	if a.GetError() != nil {
+		span.Error = a.GetError().Error()
+	}
+	tr.attempts = append(tr.attempts, span)
+}
+
+// ObserveCompletion finishes the request span and exports the spans of the request if the trace is sampled
+func (t *Tracer) ObserveCompletion(r request.Request, c middleware.Completion) {
+	tr := t.getTrace(r, c.HttpRequest)
+	if r != nil {
+		r.DeleteUserData(traceKey)
+	}
+
+	span := tr.server
+	span.Start = c.Start
+	span.End = c.Start.Add(c.Duration)
+	span.SetAttribute("http.request.method", c.HttpRequest.Method)
+	span.SetAttribute("url.path", c.HttpRequest.URL.Path)
+	span.SetAttribute("http.response.status_code", c.StatusCode)
+	if ip, ok := netutils.GetClientIp(c.HttpRequest); ok {
+		span.SetAttribute("client.address", ip.String())
+	}
+	if c.LocationId != "" {
+		span.SetAttribute("vulcan.location", c.LocationId)
+	}
+	if r != nil && request.GetRequestId(r) != "" {
+		span.SetAttribute("vulcan.request_id", request.GetRequestId(r))
+	}
+	if c.StatusCode >= http.StatusInternalServerError {
+		span.Error = http.StatusText(c.StatusCode)
+	}
+
+	if tr.flags&flagSampled == 0 {
+		return
+	}
+	if err := t.exporter.Export(append([]*Span{span}, tr.attempts...)); err != nil {
+		log.Errorf("Failed to export spans: %s", err)
+	}
+}
+
+// getTrace returns the trace of the request, creating it from the incoming trace context on the first call
+func (t *Tracer) getTrace(r request.Request, httpReq *http.Request) *trace {
+	if r != nil {
+		if v, ok := r.GetUserData(traceKey); ok {
+			return v.(*trace)
+		}
+	}
+	tr := &trace{server: &Span{SpanId: newSpanId(), Name: httpReq.Method, Kind: SpanKindServer}}
+	parent, err := ParseTraceparent(httpReq.Header.Get(TraceparentHeader))
+	if err == nil {
+		tr.server.TraceId = parent.TraceId
+		tr.server.ParentSpanId = parent.SpanId
+		tr.flags = parent.Flags & flagSampled
+		tr.state = strings.Join(httpReq.Header[TracestateHeader], ",")
+	} else {
+		tr.server.TraceId = newTraceId()
+		if t.options.Sampler.ShouldSample(tr.server.TraceId) {
+			tr.flags = flagSampled
+		}
+	}
+	if r != nil {
+		r.SetUserData(traceKey, tr)
+	}
+	return tr
+}
@@ -0,0 +1,391 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func TestTracing(t *testing.T) { TestingT(t) }
+
+type TracingSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&TracingSuite{
+	tm: &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	},
+})
+
+func (s *TracingSuite) TestParseTraceparent(c *C) {
+	ctx, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	c.Assert(err, IsNil)
+	c.Assert(ctx.TraceId.String(), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(ctx.SpanId.String(), Equals, "00f067aa0ba902b7")
+	c.Assert(ctx.IsSampled(), Equals, true)
+	c.Assert(ctx.Traceparent(), Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	// Future versions may add fields
+	ctx, err = ParseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	c.Assert(err, IsNil)
+	c.Assert(ctx.IsSampled(), Equals, false)
+
+	bad := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+	}
+	for _, v := range bad {
+		_, err := ParseTraceparent(v)
+		c.Assert(err, NotNil, Commentf("%s", v))
+	}
+}
+
+func (s *TracingSuite) TestNewTrace(c *C) {
+	var traceparent string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(TraceparentHeader)
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	exporter := &recordingExporter{}
+	proxy, done := s.newProxy(c, exporter, server.URL)
+	defer proxy.Close()
+
+	response, _, err := GET(proxy.URL, Opts{})
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	<-done
+
+	spans := exporter.getSpans()
+	c.Assert(len(spans), Equals, 2)
+	requestSpan, attemptSpan := spans[0], spans[1]
+
+	c.Assert(requestSpan.Kind, Equals, SpanKindServer)
+	c.Assert(requestSpan.TraceId.IsValid(), Equals, true)
+	c.Assert(requestSpan.ParentSpanId.IsValid(), Equals, false)
+	c.Assert(requestSpan.Name, Equals, "GET")
+	c.Assert(requestSpan.Attributes["http.response.status_code"], Equals, http.StatusOK)
+	c.Assert(requestSpan.Attributes["vulcan.location"], Equals, "loc1")
+	c.Assert(requestSpan.Attributes["vulcan.request_id"], NotNil)
+	c.Assert(requestSpan.Error, Equals, "")
+
+	c.Assert(attemptSpan.Kind, Equals, SpanKindClient)
+	c.Assert(attemptSpan.TraceId, Equals, requestSpan.TraceId)
+	c.Assert(attemptSpan.ParentSpanId, Equals, requestSpan.SpanId)
+	c.Assert(attemptSpan.Attributes["vulcan.endpoint"], Equals, server.URL)
+	c.Assert(attemptSpan.Attributes["vulcan.failover"], Equals, 0)
+	c.Assert(attemptSpan.Attributes["http.response.status_code"], Equals, http.StatusOK)
+
+	// Endpoint is the child of the attempt span
+	c.Assert(traceparent, Equals, fmt.Sprintf("00-%s-%s-01", attemptSpan.TraceId, attemptSpan.SpanId))
+}
+
+func (s *TracingSuite) TestContinueTrace(c *C) {
+	var traceparent, tracestate string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(TraceparentHeader)
+		tracestate = r.Header.Get(TracestateHeader)
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	exporter := &recordingExporter{}
+	proxy, done := s.newProxy(c, exporter, server.URL)
+	defer proxy.Close()
+
+	headers := http.Header{}
+	headers.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	headers.Set(TracestateHeader, "congo=t61rcWkgMzE")
+	_, _, err := GET(proxy.URL, Opts{Headers: headers})
+	c.Assert(err, IsNil)
+	<-done
+
+	spans := exporter.getSpans()
+	c.Assert(len(spans), Equals, 2)
+	c.Assert(spans[0].TraceId.String(), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(spans[0].ParentSpanId.String(), Equals, "00f067aa0ba902b7")
+	c.Assert(traceparent, Equals, fmt.Sprintf("00-4bf92f3577b34da6a3ce929d0e0e4736-%s-01", spans[1].SpanId))
+	c.Assert(tracestate, Equals, "congo=t61rcWkgMzE")
+}
+
+func (s *TracingSuite) TestNotSampled(c *C) {
+	var traceparent string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(TraceparentHeader)
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	exporter := &recordingExporter{}
+	proxy, done := s.newProxy(c, exporter, server.URL)
+	defer proxy.Close()
+
+	headers := http.Header{}
+	headers.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, _, err := GET(proxy.URL, Opts{Headers: headers})
+	c.Assert(err, IsNil)
+	<-done
+
+	// The context is propagated, but nothing is exported
+	c.Assert(len(exporter.getSpans()), Equals, 0)
+	ctx, err := ParseTraceparent(traceparent)
+	c.Assert(err, IsNil)
+	c.Assert(ctx.TraceId.String(), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(ctx.IsSampled(), Equals, false)
+}
+
+func (s *TracingSuite) TestRatioSampler(c *C) {
+	for _, ratio := range []float64{-0.1, 1.1} {
+		_, err := NewRatioSampler(ratio)
+		c.Assert(err, NotNil)
+	}
+
+	never, err := NewRatioSampler(0)
+	c.Assert(err, IsNil)
+	always, err := NewRatioSampler(1)
+	c.Assert(err, IsNil)
+	half, err := NewRatioSampler(0.5)
+	c.Assert(err, IsNil)
+
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		id := newTraceId()
+		c.Assert(never.ShouldSample(id), Equals, false)
+		c.Assert(always.ShouldSample(id), Equals, true)
+		// Decision is the same for the same trace
+		c.Assert(half.ShouldSample(id), Equals, half.ShouldSample(id))
+		if half.ShouldSample(id) {
+			sampled++
+		}
+	}
+	c.Assert(sampled > 400 && sampled < 600, Equals, true, Commentf("%d", sampled))
+}
+
+// New traces are not exported unless sampled, while the context is still propagated
+func (s *TracingSuite) TestNewTraceNotSampled(c *C) {
+	sampler, err := NewRatioSampler(0)
+	c.Assert(err, IsNil)
+	tracer, err := NewTracerWithOptions(&recordingExporter{}, Options{TimeProvider: s.tm, Sampler: sampler})
+	c.Assert(err, IsNil)
+
+	r := request.NewBaseRequest(&http.Request{Method: "GET", Header: http.Header{}}, 1, nil)
+	tracer.ObserveRequest(r)
+	ctx, err := ParseTraceparent(r.GetHttpRequest().Header.Get(TraceparentHeader))
+	c.Assert(err, IsNil)
+	c.Assert(ctx.IsSampled(), Equals, false)
+
+	tracer, err = NewTracer(&recordingExporter{})
+	c.Assert(err, IsNil)
+	c.Assert(tracer.options.Sampler, NotNil)
+}
+
+func (s *TracingSuite) TestFailover(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	exporter := &recordingExporter{}
+	proxy, done := s.newProxy(c, exporter, "http://localhost:63999", server.URL)
+	defer proxy.Close()
+
+	// Round robin starts with either endpoint, so make two requests to hit the failed one first
+	for i := 0; i < 2; i++ {
+		response, _, err := GET(proxy.URL, Opts{})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		<-done
+	}
+
+	// Every trace has the request span and the attempts numbered in order
+	failed := 0
+	attempts := map[TraceId]int{}
+	for _, span := range exporter.getSpans() {
+		if span.Kind == SpanKindServer {
+			c.Assert(span.Error, Equals, "")
+			continue
+		}
+		c.Assert(span.Attributes["vulcan.failover"], Equals, attempts[span.TraceId])
+		attempts[span.TraceId] += 1
+		if span.Attributes["vulcan.endpoint"] == "http://localhost:63999" {
+			c.Assert(span.Error, Not(Equals), "")
+			failed += 1
+		} else {
+			c.Assert(span.Error, Equals, "")
+		}
+	}
+	c.Assert(len(attempts), Equals, 2)
+	c.Assert(failed > 0, Equals, true)
+}
+
+func (s *TracingSuite) TestOtlpExporter(c *C) {
+	requests := make(chan map[string]interface{}, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, Equals, "POST")
+		c.Assert(r.URL.Path, Equals, "/v1/traces")
+		c.Assert(r.Header.Get("Content-Type"), Equals, "application/json")
+		c.Assert(r.Header.Get("Authorization"), Equals, "Bearer secret")
+		body, _ := ioutil.ReadAll(r.Body)
+		var decoded map[string]interface{}
+		c.Assert(json.Unmarshal(body, &decoded), IsNil)
+		requests <- decoded
+	}))
+	defer collector.Close()
+
+	_, err := NewOtlpExporter("localhost:4318")
+	c.Assert(err, NotNil)
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret")
+	e, err := NewOtlpExporterWithOptions(collector.URL+"/v1/traces", OtlpOptions{ServiceName: "edge", Headers: headers, BatchSize: 2})
+	c.Assert(err, IsNil)
+
+	ctx, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	c.Assert(err, IsNil)
+	start := s.tm.UtcNow()
+	server := &Span{
+		TraceId:    ctx.TraceId,
+		SpanId:     ctx.SpanId,
+		Name:       "GET",
+		Kind:       SpanKindServer,
+		Start:      start,
+		End:        start.Add(time.Second),
+		Attributes: map[string]interface{}{"http.response.status_code": 502, "vulcan.location": "loc1"},
+		Error:      "Bad Gateway",
+	}
+	attempt := &Span{
+		TraceId:      ctx.TraceId,
+		SpanId:       SpanId{1, 2, 3, 4, 5, 6, 7, 8},
+		ParentSpanId: ctx.SpanId,
+		Name:         "GET",
+		Kind:         SpanKindClient,
+		Start:        start,
+		End:          start.Add(time.Millisecond),
+	}
+	c.Assert(e.Export([]*Span{server, attempt}), IsNil)
+
+	var decoded map[string]interface{}
+	select {
+	case decoded = <-requests:
+	case <-time.After(time.Second):
+		c.Fatalf("Timeout waiting for the spans")
+	}
+	c.Assert(e.Close(), IsNil)
+
+	resourceSpans := decoded["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	c.Assert(resourceSpans["resource"], DeepEquals, map[string]interface{}{
+		"attributes": []interface{}{
+			map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "edge"}},
+		},
+	})
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	c.Assert(len(spans), Equals, 2)
+	c.Assert(spans[0], DeepEquals, map[string]interface{}{
+		"traceId":           "4bf92f3577b34da6a3ce929d0e0e4736",
+		"spanId":            "00f067aa0ba902b7",
+		"name":              "GET",
+		"kind":              float64(2),
+		"startTimeUnixNano": "1330837567000000000",
+		"endTimeUnixNano":   "1330837568000000000",
+		"attributes": []interface{}{
+			map[string]interface{}{"key": "http.response.status_code", "value": map[string]interface{}{"intValue": "502"}},
+			map[string]interface{}{"key": "vulcan.location", "value": map[string]interface{}{"stringValue": "loc1"}},
+		},
+		"status": map[string]interface{}{"code": float64(2), "message": "Bad Gateway"},
+	})
+	c.Assert(spans[1].(map[string]interface{})["parentSpanId"], Equals, "00f067aa0ba902b7")
+	c.Assert(spans[1].(map[string]interface{})["kind"], Equals, float64(3))
+
+	// Spans are dropped after close
+	e.Export([]*Span{server})
+	c.Assert(e.GetDropped(), Equals, int64(1))
+}
+
+func (s *TracingSuite) TestOtlpExporterFlushesOnClose(c *C) {
+	received := make(chan int, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var decoded otlpRequest
+		c.Assert(json.NewDecoder(r.Body).Decode(&decoded), IsNil)
+		received <- len(decoded.ResourceSpans[0].ScopeSpans[0].Spans)
+	}))
+	defer collector.Close()
+
+	e, err := NewOtlpExporterWithOptions(collector.URL, OtlpOptions{FlushPeriod: time.Hour})
+	c.Assert(err, IsNil)
+	c.Assert(e.Export([]*Span{{TraceId: newTraceId(), SpanId: newSpanId()}}), IsNil)
+	c.Assert(e.Close(), IsNil)
+	c.Assert(<-received, Equals, 1)
+}
+
+func (s *TracingSuite) newProxy(c *C, exporter Exporter, urls ...string) (*httptest.Server, completed) {
+	sampler, err := NewRatioSampler(1)
+	c.Assert(err, IsNil)
+	tracer, err := NewTracerWithOptions(exporter, Options{TimeProvider: s.tm, Sampler: sampler})
+	c.Assert(err, IsNil)
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	for _, u := range urls {
+		c.Assert(rr.AddEndpoint(endpoint.MustParseUrl(u)), IsNil)
+	}
+	location, err := httploc.NewLocation("loc1", rr)
+	c.Assert(err, IsNil)
+	c.Assert(location.GetObserverChain().Add("tracing", tracer), IsNil)
+
+	done := make(completed, 10)
+	proxy, err := vulcan.NewProxyWithOptions(&route.ConstRouter{Location: location}, vulcan.Options{
+		CompletionObservers: []middleware.CompletionObserver{tracer, done},
+	})
+	c.Assert(err, IsNil)
+	return httptest.NewServer(proxy), done
+}
+
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) getSpans() []*Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.spans
+}
+
+// completed is notified after the tracer has exported the spans of the request
+type completed chan bool
+
+func (ch completed) ObserveCompletion(r request.Request, c middleware.Completion) {
+	ch <- true
+}
@@ -0,0 +1,114 @@
+package vulcan
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/request"
+)
+
+// tracker collects the request completion details for the completion observers. Nil tracker is valid
+// and ignores all calls, so the proxy does not pay for the tracking when there are no observers.
+type tracker struct {
+	http.ResponseWriter
+	body       *countingReader
+	completion middleware.Completion
+	req        request.Request
+}
+
+func newTracker(start time.Time, w http.ResponseWriter, r *http.Request) *tracker {
+	t := &tracker{ResponseWriter: w}
+	t.completion.Start = start
+	t.completion.HttpRequest = r
+	if r.Body != nil {
+		t.body = &countingReader{ReadCloser: r.Body}
+		r.Body = t.body
+	}
+	return t
+}
+
+func (t *tracker) setRequest(r *http.Request, req request.Request) {
+	if t == nil {
+		return
+	}
+	t.completion.HttpRequest = r
+	t.req = req
+}
+
+func (t *tracker) setLocation(l location.Location) {
+	if t == nil {
+		return
+	}
+	t.completion.LocationId = l.GetId()
+}
+
+func (t *tracker) WriteHeader(statusCode int) {
+	if t.completion.StatusCode == 0 {
+		t.completion.StatusCode = statusCode
+	}
+	t.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (t *tracker) Write(data []byte) (int, error) {
+	if t.completion.StatusCode == 0 {
+		t.completion.StatusCode = http.StatusOK
+	}
+	n, err := t.ResponseWriter.Write(data)
+	t.completion.BytesOut += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered data to the client, so the streaming responses are not held by the tracker
+func (t *tracker) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		if t.completion.StatusCode == 0 {
+			t.completion.StatusCode = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (t *tracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := t.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the original response writer for http.ResponseController
+func (t *tracker) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+func (p *Proxy) observeCompletion(t *tracker) {
+	c := t.completion
+	c.Duration = p.options.TimeProvider.UtcNow().Sub(c.Start)
+	if c.StatusCode == 0 {
+		c.StatusCode = http.StatusOK
+	}
+	if t.body != nil {
+		c.BytesIn = t.body.count
+	}
+	for _, o := range p.options.CompletionObservers {
+		o.ObserveCompletion(t.req, c)
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}